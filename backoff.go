@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// BackoffStrategy is how the delay between retries grows
+type BackoffStrategy string
+
+const (
+	// BackoffStrategyFixed waits the base delay before every retry
+	BackoffStrategyFixed BackoffStrategy = "fixed"
+
+	// BackoffStrategyExponential doubles the delay after every retry, starting at the base delay, up to the max delay
+	BackoffStrategyExponential BackoffStrategy = "exponential"
+
+	// BackoffStrategyExponentialFullJitter waits a random delay between zero and the exponential strategy's delay, so many clients retrying at once spread out
+	BackoffStrategyExponentialFullJitter BackoffStrategy = "exponential-full-jitter"
+)
+
+// BackoffStrategies are all the supported backoff strategies
+var BackoffStrategies = []BackoffStrategy{
+	BackoffStrategyFixed,
+	BackoffStrategyExponential,
+	BackoffStrategyExponentialFullJitter,
+}
+
+// Backoff computes the delays between retries
+type Backoff struct {
+	// Strategy is how the delay grows
+	Strategy BackoffStrategy
+
+	// Base is the delay before the first retry
+	Base time.Duration
+
+	// Max is the longest delay, zero means no limit
+	Max time.Duration
+
+	// Rand is the source of randomness for jitter, if nil a shared source is used
+	Rand *rand.Rand
+}
+
+// WithBase returns a copy of the backoff with a different base delay
+func (backoff Backoff) WithBase(base time.Duration) Backoff {
+	backoff.Base = base
+	return backoff
+}
+
+// Delay returns how long to wait before the retry, retries are numbered starting at 1
+func (backoff Backoff) Delay(retry int) time.Duration {
+	if backoff.Strategy == BackoffStrategyFixed {
+		return backoff.capped(backoff.Base)
+	}
+
+	delay := backoff.Base
+	for i := 1; i < retry; i++ {
+		if backoff.Max > 0 && delay >= backoff.Max {
+			break
+		}
+		delay *= 2
+	}
+	delay = backoff.capped(delay)
+
+	if backoff.Strategy == BackoffStrategyExponentialFullJitter && delay > 0 {
+		if backoff.Rand != nil {
+			return time.Duration(backoff.Rand.Int64N(int64(delay) + 1))
+		}
+		return time.Duration(rand.Int64N(int64(delay) + 1))
+	}
+
+	return delay
+}
+
+// capped limits delay to the max delay
+func (backoff Backoff) capped(delay time.Duration) time.Duration {
+	if backoff.Max > 0 && delay > backoff.Max {
+		return backoff.Max
+	}
+
+	return delay
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		want    []time.Duration
+	}{
+		{
+			name:    "fixed",
+			backoff: Backoff{Strategy: BackoffStrategyFixed, Base: time.Second},
+			want:    []time.Duration{time.Second, time.Second, time.Second, time.Second},
+		},
+		{
+			name:    "fixed capped",
+			backoff: Backoff{Strategy: BackoffStrategyFixed, Base: time.Minute, Max: 30 * time.Second},
+			want:    []time.Duration{30 * time.Second, 30 * time.Second},
+		},
+		{
+			name:    "exponential",
+			backoff: Backoff{Strategy: BackoffStrategyExponential, Base: time.Second},
+			want:    []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second},
+		},
+		{
+			name:    "exponential capped",
+			backoff: Backoff{Strategy: BackoffStrategyExponential, Base: time.Second, Max: 5 * time.Second},
+			want:    []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:    "no base delay",
+			backoff: Backoff{Strategy: BackoffStrategyExponentialFullJitter},
+			want:    []time.Duration{0, 0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i, want := range test.want {
+				if delay := test.backoff.Delay(i + 1); delay != want {
+					t.Errorf("retry %d delay is %s, expected %s", i+1, delay, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffDelayFullJitter(t *testing.T) {
+	// newBackoff creates a full jitter backoff with a fixed seed so its delays are reproducible
+	newBackoff := func() Backoff {
+		return Backoff{
+			Strategy: BackoffStrategyExponentialFullJitter,
+			Base:     time.Second,
+			Max:      10 * time.Second,
+			Rand:     rand.New(rand.NewPCG(1, 2)),
+		}
+	}
+
+	jittered, repeated := newBackoff(), newBackoff()
+	exponential := Backoff{Strategy: BackoffStrategyExponential, Base: time.Second, Max: 10 * time.Second}
+
+	var distinct bool
+	for retry := 1; retry <= 20; retry++ {
+		delay := jittered.Delay(retry)
+
+		if limit := exponential.Delay(retry); delay < 0 || delay > limit {
+			t.Errorf("retry %d delay is %s, expected between 0 and %s", retry, delay, limit)
+		}
+		if again := repeated.Delay(retry); again != delay {
+			t.Errorf("retry %d delay is %s with the same seed, expected %s", retry, again, delay)
+		}
+		if delay != exponential.Delay(retry) {
+			distinct = true
+		}
+	}
+
+	if !distinct {
+		t.Errorf("every delay equalled the exponential delay, expected jitter")
+	}
+}
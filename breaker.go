@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets calls through, it is the normal state
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen short-circuits calls until the cooldown elapses
+	CircuitOpen
+
+	// CircuitHalfOpen lets one call through to test if the failures have stopped
+	CircuitHalfOpen
+)
+
+// String returns the state's name
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops calls to a persistently failing qBittorrent, so it is not hammered with requests which may get the tool banned.
+// After threshold consecutive failures it opens and calls are short-circuited for the cooldown, then it half-opens and lets one call through.
+// If that call succeeds it closes, if it fails it opens again for another cooldown.
+type CircuitBreaker struct {
+	// threshold is the number of consecutive failures which open the breaker
+	threshold int
+
+	// cooldown is how long the breaker stays open before half-opening
+	cooldown time.Duration
+
+	// now returns the current time, replaced by tests
+	now func() time.Time
+
+	// lock guards the fields below
+	lock sync.Mutex
+
+	// state is the breaker's current state, an open breaker is only moved to half-open by Allow
+	state CircuitState
+
+	// failures is the number of consecutive failures
+	failures int
+
+	// openedAt is when the breaker last opened
+	openedAt time.Time
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker which opens after threshold consecutive failures and stays open for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow determines if a call may be made. If the breaker is open and the cooldown elapsed it half-opens and allows the call.
+// Returns if the call is allowed, and if it is not how long until the breaker half-opens.
+func (breaker *CircuitBreaker) Allow() (bool, time.Duration) {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	if breaker.state != CircuitOpen {
+		return true, 0
+	}
+
+	remaining := breaker.cooldown - breaker.now().Sub(breaker.openedAt)
+	if remaining > 0 {
+		return false, remaining
+	}
+
+	breaker.state = CircuitHalfOpen
+	return true, 0
+}
+
+// RecordSuccess records a call succeeded, which closes the breaker
+func (breaker *CircuitBreaker) RecordSuccess() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.state = CircuitClosed
+	breaker.failures = 0
+}
+
+// RecordFailure records a call failed. The breaker opens if it was half-open, or if the threshold of consecutive failures is reached.
+func (breaker *CircuitBreaker) RecordFailure() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.failures++
+	if breaker.state == CircuitHalfOpen || breaker.failures >= breaker.threshold {
+		breaker.state = CircuitOpen
+		breaker.openedAt = breaker.now()
+	}
+}
+
+// State returns the breaker's current state
+func (breaker *CircuitBreaker) State() CircuitState {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	return breaker.state
+}
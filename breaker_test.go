@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// outcomes of calls in order, true for a success, with the cooldown elapsing before each call after the breaker opens
+		outcomes []bool
+
+		wantState CircuitState
+	}{
+		{name: "closed below threshold", outcomes: []bool{false, false}, wantState: CircuitClosed},
+		{name: "opens at threshold", outcomes: []bool{false, false, false}, wantState: CircuitOpen},
+		{name: "success resets failures", outcomes: []bool{false, false, true, false, false}, wantState: CircuitClosed},
+		{name: "half-open failure reopens", outcomes: []bool{false, false, false, false}, wantState: CircuitOpen},
+		{name: "half-open success closes", outcomes: []bool{false, false, false, true}, wantState: CircuitClosed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Now()
+			breaker := NewCircuitBreaker(3, time.Minute)
+			breaker.now = func() time.Time { return now }
+
+			for i, success := range test.outcomes {
+				if breaker.State() == CircuitOpen {
+					if allowed, _ := breaker.Allow(); allowed {
+						t.Fatalf("call %d allowed before the cooldown elapsed", i)
+					}
+
+					now = now.Add(time.Minute)
+				}
+
+				if allowed, _ := breaker.Allow(); !allowed {
+					t.Fatalf("call %d not allowed", i)
+				}
+
+				if success {
+					breaker.RecordSuccess()
+				} else {
+					breaker.RecordFailure()
+				}
+			}
+
+			if state := breaker.State(); state != test.wantState {
+				t.Errorf("state is %s, expected %s", state, test.wantState)
+			}
+		})
+	}
+}
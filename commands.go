@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// Command is a subcommand which runs once instead of the sync loop
+type Command struct {
+	// Usage describes the command's arguments
+	Usage string
+
+	// Description explains what the command does
+	Description string
+
+	// Run performs the command with the arguments which followed the command name
+	Run func(ctx context.Context, cmdEnv CommandEnv, args []string) error
+}
+
+// CommandEnv is what commands are provided to do their work
+type CommandEnv struct {
+	// Logger is used to output information
+	Logger golog.Logger
+
+	// Config is the loaded configuration
+	Config *Config
+
+	// QBittorrentClient is used to make qBittorrent API requests
+	QBittorrentClient *QBittorrentClient
+
+	// JSON indicates results are printed as a CommandResult in JSON instead of as text
+	JSON bool
+}
+
+// CommandResult is the envelope in which every command prints its result when JSON output is enabled
+type CommandResult struct {
+	// OK indicates the command succeeded
+	OK bool `json:"ok"`
+
+	// Error is why the command failed, empty if it succeeded
+	Error string `json:"error,omitempty"`
+
+	// Port is the qBittorrent listen port the command read or set
+	Port uint16 `json:"port,omitempty"`
+
+	// Version is the qBittorrent version
+	Version string `json:"version,omitempty"`
+
+	// File is the file the command read or wrote
+	File string `json:"file,omitempty"`
+
+	// Preferences are qBittorrent's preferences
+	Preferences json.RawMessage `json:"preferences,omitempty"`
+
+	// Time is when the result was observed, for commands which print multiple results
+	Time *time.Time `json:"time,omitempty"`
+
+	// CurrentPort is qBittorrent's listen port, for commands which compare it with the port file
+	CurrentPort uint16 `json:"current_port,omitempty"`
+
+	// Match indicates qBittorrent already has the desired preferences, for commands which compare them
+	Match *bool `json:"match,omitempty"`
+
+	// Changes describe each preference which differs from its desired value
+	Changes []string `json:"changes,omitempty"`
+
+	// History are the most recent changes of qBittorrent's listen port, oldest first
+	History []PortChange `json:"history,omitempty"`
+}
+
+// output prints result as JSON if JSON output is enabled, otherwise prints text, if not empty
+func (cmdEnv CommandEnv) output(result CommandResult, text string) error {
+	if cmdEnv.JSON {
+		result.OK = true
+		return writeCommandResult(result)
+	}
+
+	if len(text) == 0 {
+		return nil
+	}
+
+	if _, err := fmt.Fprintln(os.Stdout, text); err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	return nil
+}
+
+// writeCommandResult prints result to stdout as one line of JSON
+func writeCommandResult(result CommandResult) error {
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		return fmt.Errorf("failed to write result as JSON: %s", err)
+	}
+
+	return nil
+}
+
+// RunCommand runs cmd, if JSON output is enabled and the command fails the error is also printed as a CommandResult
+func RunCommand(ctx context.Context, cmd Command, cmdEnv CommandEnv, args []string) error {
+	err := cmd.Run(ctx, cmdEnv, args)
+	if err != nil && cmdEnv.JSON {
+		if writeErr := writeCommandResult(CommandResult{Error: err.Error()}); writeErr != nil {
+			cmdEnv.Logger.Errorf("failed to report error: %s", writeErr)
+		}
+	}
+
+	return err
+}
+
+// Commands are all the subcommands, keyed by name
+var Commands = map[string]Command{
+	"snapshot": {
+		Usage:       "snapshot <file>",
+		Description: "Save qBittorrent's current values of the preferences this tool manages to a file",
+		Run:         runSnapshot,
+	},
+	"dump-prefs": {
+		Usage:       "dump-prefs",
+		Description: "Print all of qBittorrent's preferences as JSON, the output may contain secrets",
+		Run:         runDumpPrefs,
+	},
+	"get-port": {
+		Usage:       "get-port",
+		Description: "Print qBittorrent's current listen port",
+		Run:         runGetPort,
+	},
+	"set-port": {
+		Usage:       "set-port <port>",
+		Description: "Set qBittorrent's listen port once, without reading the port files",
+		Run:         runSetPort,
+	},
+	"test-login": {
+		Usage:       "test-login",
+		Description: "Log in to qBittorrent and print its version, to check the address and credentials",
+		Run:         runTestLogin,
+	},
+	"selftest": {
+		Usage:       "selftest [port]",
+		Description: "Sync a port from a temporary port file to qBittorrent, check qBittorrent uses it, then restore qBittorrent's port",
+		Run:         runSelfTest,
+	},
+	"diff": {
+		Usage:       "diff",
+		Description: "Print if qBittorrent's port matches the port file and what syncing would change, without changing anything",
+		Run:         runDiff,
+	},
+	"watch": {
+		Usage:       "watch [port file...]",
+		Description: "Print the port in the port files every time they change, without contacting qBittorrent",
+		Run:         runWatch,
+	},
+	"history": {
+		Usage:       "history",
+		Description: "Print the most recent changes of qBittorrent's port made by the running tool, read from its HTTP server",
+		Run:         runHistory,
+	},
+	"restore": {
+		Usage:       "restore <file>",
+		Description: "Set qBittorrent's preferences to the values saved in a file by snapshot",
+		Run:         runRestore,
+	},
+}
+
+// CommandNames returns the names of all commands in alphabetical order
+func CommandNames() []string {
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// runSnapshot saves the managed qBittorrent preferences to a file
+func runSnapshot(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one argument, the snapshot file")
+	}
+	snapshotFile := args[0]
+
+	prefs, err := cmdEnv.QBittorrentClient.GetServerPreferences(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get qBittorrent preferences: %s", err)
+	}
+
+	prefsJSON, err := json.MarshalIndent(prefs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode preferences as JSON: %s", err)
+	}
+
+	if err := os.WriteFile(snapshotFile, prefsJSON, 0600); err != nil {
+		return fmt.Errorf("failed to write snapshot file '%s': %s", snapshotFile, err)
+	}
+
+	cmdEnv.Logger.Infof("saved qBittorrent preferences to '%s': %s", snapshotFile, prefsJSON)
+
+	return cmdEnv.output(CommandResult{File: snapshotFile}, "")
+}
+
+// runRestore sets qBittorrent's preferences to those saved in a snapshot file
+func runRestore(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one argument, the snapshot file")
+	}
+	snapshotFile := args[0]
+
+	prefsJSON, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot file '%s': %s", snapshotFile, err)
+	}
+
+	var prefs QBittorrentServerPreferences
+	if err := json.Unmarshal(prefsJSON, &prefs); err != nil {
+		return fmt.Errorf("failed to decode snapshot file '%s' as JSON: %s", snapshotFile, err)
+	}
+
+	if err := cmdEnv.QBittorrentClient.SetServerPreferences(ctx, prefs); err != nil {
+		return fmt.Errorf("failed to set qBittorrent preferences: %s", err)
+	}
+
+	cmdEnv.Logger.Infof("restored qBittorrent preferences from '%s'", snapshotFile)
+
+	return cmdEnv.output(CommandResult{File: snapshotFile}, "")
+}
+
+// runDumpPrefs prints all of qBittorrent's preferences, not only those this tool manages
+func runDumpPrefs(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expected no arguments")
+	}
+
+	prefsJSON, err := cmdEnv.QBittorrentClient.GetRawServerPreferences(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get qBittorrent preferences: %s", err)
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, prefsJSON, "", "  "); err != nil {
+		return fmt.Errorf("failed to format preferences '%s' as JSON: %s", prefsJSON, err)
+	}
+
+	cmdEnv.Logger.Warn("qBittorrent's preferences may contain secrets, such as proxy and WebUI credentials, take care when sharing them")
+
+	return cmdEnv.output(CommandResult{Preferences: prefsJSON}, indented.String())
+}
+
+// runGetPort prints qBittorrent's listen port
+func runGetPort(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expected no arguments")
+	}
+
+	prefs, err := cmdEnv.QBittorrentClient.GetServerPreferences(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get qBittorrent preferences: %s", err)
+	}
+
+	return cmdEnv.output(CommandResult{Port: prefs.ListenPort}, fmt.Sprint(prefs.ListenPort))
+}
+
+// runSetPort sets qBittorrent's listen port to the port given as an argument
+func runSetPort(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one argument, the port")
+	}
+
+	port, err := parsePortNumber(args[0])
+	if err != nil {
+		return err
+	}
+	if port == 0 {
+		return fmt.Errorf("port must be greater than 0")
+	}
+
+	if err := cmdEnv.QBittorrentClient.SetServerPreferences(ctx, QBittorrentServerPreferences{ListenPort: port}); err != nil {
+		return fmt.Errorf("failed to set qBittorrent preferences: %s", err)
+	}
+
+	cmdEnv.Logger.Infof("set qBittorrent's port to %d", port)
+
+	return cmdEnv.output(CommandResult{Port: port}, "")
+}
+
+// runTestLogin logs in to qBittorrent and prints its version
+func runTestLogin(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expected no arguments")
+	}
+
+	if err := cmdEnv.QBittorrentClient.Login(ctx); err != nil {
+		return fmt.Errorf("failed to log in to qBittorrent: %s", err)
+	}
+
+	version, err := cmdEnv.QBittorrentClient.GetVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get qBittorrent version: %s", err)
+	}
+
+	cmdEnv.Logger.Infof("logged in to qBittorrent %s", version)
+
+	return cmdEnv.output(CommandResult{Version: version}, "")
+}
+
+// runSelfTest syncs a known port to qBittorrent from a temporary port file, the same way the sync loop does, and checks qBittorrent uses it.
+// The configured port files are not touched, and qBittorrent's previous port is restored afterwards.
+func runSelfTest(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected at most one argument, the port to test with")
+	}
+
+	prefs, err := cmdEnv.QBittorrentClient.GetServerPreferences(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get qBittorrent preferences: %s", err)
+	}
+	previousPort := prefs.ListenPort
+
+	port := selfTestPort(previousPort)
+	if len(args) == 1 {
+		port, err = parsePortNumber(args[0])
+		if err != nil {
+			return err
+		}
+		if port == 0 {
+			return fmt.Errorf("port must be greater than 0")
+		}
+	}
+
+	portDir, err := os.MkdirTemp("", "qbittorrent-port-updater-selftest-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory for the port file: %s", err)
+	}
+	defer os.RemoveAll(portDir)
+
+	portFile := filepath.Join(portDir, "port")
+	if err := os.WriteFile(portFile, []byte(fmt.Sprint(port)), 0600); err != nil {
+		return fmt.Errorf("failed to write temporary port file '%s': %s", portFile, err)
+	}
+
+	syncer := NewPortSyncer(NewPortSyncerOptions{
+		Logger:                 cmdEnv.Logger,
+		QBittorrentClient:      cmdEnv.QBittorrentClient,
+		PortFiles:              []string{portFile},
+		PortFileFormat:         PortFileFormatPlain,
+		DisableRandomPort:      cmdEnv.Config.DisableRandomPort,
+		SetPreferencesAttempts: cmdEnv.Config.SetPreferencesAttempts,
+		Metrics:                NewMetrics(cmdEnv.Config.InstanceName),
+	})
+
+	_, syncErr := syncer.Sync(ctx)
+	if syncErr == nil {
+		prefs, syncErr = cmdEnv.QBittorrentClient.GetServerPreferences(ctx)
+		if syncErr == nil && prefs.ListenPort != port {
+			syncErr = fmt.Errorf("qBittorrent's port is %s after syncing, expected %d", formatListenPort(prefs.ListenPort), port)
+		}
+	}
+
+	// Leave qBittorrent as it was, the sync loop will set the real port anyway
+	if previousPort != 0 && previousPort != port {
+		if err := cmdEnv.QBittorrentClient.SetServerPreferences(ctx, QBittorrentServerPreferences{ListenPort: previousPort}); err != nil {
+			return errors.Join(syncErr, fmt.Errorf("failed to restore qBittorrent's port to %d: %s", previousPort, err))
+		}
+	}
+
+	if syncErr != nil {
+		return fmt.Errorf("self-test failed: %w", syncErr)
+	}
+
+	cmdEnv.Logger.Infof("self-test passed, synced port %d from a port file to qBittorrent", port)
+
+	return cmdEnv.output(CommandResult{Port: port}, "")
+}
+
+// selfTestPort returns a port which differs from qBittorrent's current port, so the self-test has to change it
+func selfTestPort(currentPort uint16) uint16 {
+	switch currentPort {
+	case 0:
+		return 6881
+	case 65535:
+		return currentPort - 1
+	default:
+		return currentPort + 1
+	}
+}
+
+// runDiff compares the port in the port files, or from the port command, with qBittorrent's preferences and prints what syncing would change
+func runDiff(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("expected no arguments")
+	}
+
+	cfg := cmdEnv.Config
+
+	selector, err := ParsePortSelector(cfg.PortSelector)
+	if err != nil {
+		return fmt.Errorf("failed to parse port selector: %s", err)
+	}
+
+	var expectedPortRange *PortRange
+	if len(cfg.ExpectedPortRange) > 0 {
+		portRange, err := ParsePortRange(cfg.ExpectedPortRange)
+		if err != nil {
+			return fmt.Errorf("failed to parse expected port range: %s", err)
+		}
+		expectedPortRange = &portRange
+	}
+
+	syncer := NewPortSyncer(NewPortSyncerOptions{
+		Logger:                   cmdEnv.Logger,
+		QBittorrentClient:        cmdEnv.QBittorrentClient,
+		PortFiles:                cfg.PortFiles,
+		PortCommand:              cfg.PortCommand,
+		PortFileReadTimeout:      time.Duration(cfg.PortFileReadTimeoutSeconds) * time.Second,
+		PortCommandTimeout:       time.Duration(cfg.PortCommandTimeoutSeconds) * time.Second,
+		PortFileFormat:           cfg.PortFileFormat,
+		PortSelector:             selector,
+		ExpectedPortRange:        expectedPortRange,
+		TreatZeroAsUnavailable:   cfg.TreatZeroAsUnavailable,
+		DisableRandomPort:        cfg.DisableRandomPort,
+		PinRandomPortRange:       cfg.PinRandomPortRange,
+		SetAnnouncePort:          cfg.SetAnnouncePort,
+		UPnP:                     cfg.UPnP,
+		MaxConnections:           cfg.MaxConnections,
+		MaxConnectionsPerTorrent: cfg.MaxConnectionsPerTorrent,
+		NetworkInterface:         cfg.NetworkInterface,
+		InterfaceAddress:         cfg.ListenInterfaceAddress(),
+		Metrics:                  NewMetrics(cfg.InstanceName),
+	})
+
+	var port uint16
+	var portFile string
+	source := "port command"
+	if len(cfg.PortCommand) > 0 {
+		port, err = syncer.GetPortCommandValue(ctx)
+		if err != nil {
+			return err
+		}
+	} else {
+		port, portFile, err = syncer.GetDesiredPort()
+		if err != nil {
+			return err
+		}
+		if len(portFile) == 0 {
+			return fmt.Errorf("none of the port files %v contain a port yet", cfg.PortFiles)
+		}
+		source = fmt.Sprintf("port file '%s'", portFile)
+	}
+
+	diff, err := syncer.DiffTorrentPort(ctx, port)
+	if err != nil {
+		return err
+	}
+
+	match := diff.Matches()
+	result := CommandResult{
+		Port:        port,
+		File:        portFile,
+		CurrentPort: diff.CurrentPort,
+		Match:       &match,
+		Changes:     diff.Changes,
+	}
+
+	text := fmt.Sprintf("%s has port %d, qBittorrent's port is %s\n", source, port, formatListenPort(diff.CurrentPort))
+	if match {
+		text += "qBittorrent matches, syncing would not change anything\n"
+	} else {
+		text += fmt.Sprintf("qBittorrent differs, syncing would change: %s\n", strings.Join(diff.Changes, ", "))
+	}
+	for _, line := range diff.Lines {
+		text += fmt.Sprintf("  %s\n", line)
+	}
+
+	return cmdEnv.output(result, strings.TrimSuffix(text, "\n"))
+}
+
+// runWatch prints the port in each port file, then again every time it changes, until stopped. qBittorrent is never contacted.
+// The port files are the arguments, if there are none the configured port files are watched.
+func runWatch(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	portFiles := args
+	if len(portFiles) == 0 {
+		portFiles = slices.DeleteFunc(slices.Clone(cmdEnv.Config.PortFiles), func(portFile string) bool {
+			return portFile == StdinPortFile
+		})
+	}
+	if len(portFiles) == 0 {
+		return fmt.Errorf("no port files to watch, configure PORT_FILE or provide them as arguments")
+	}
+
+	selector, err := ParsePortSelector(cmdEnv.Config.PortSelector)
+	if err != nil {
+		return fmt.Errorf("failed to parse port selector: %s", err)
+	}
+
+	// lastObserved is the last value printed for each port file, so the multiple events of one write are only printed once
+	lastObserved := map[string]string{}
+
+	// observe prints the port in portFile, or why it does not contain one, if it changed since it was last printed
+	observe := func(portFile string) error {
+		result := CommandResult{File: portFile}
+		observed := ""
+
+		content, err := readPortFileWithFIFOTimeout(portFile)
+		if err == nil {
+			result.Port, err = ParsePort(cmdEnv.Config.PortFileFormat, selector, content)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			observed = fmt.Sprintf("no port: %s", err)
+		} else {
+			result.OK = true
+			observed = fmt.Sprint(result.Port)
+		}
+
+		if last, ok := lastObserved[portFile]; ok && last == observed {
+			return nil
+		}
+		lastObserved[portFile] = observed
+
+		now := time.Now()
+		if cmdEnv.JSON {
+			result.Time = &now
+			return writeCommandResult(result)
+		}
+
+		if _, err := fmt.Fprintf(os.Stdout, "%s %s: %s\n", now.Format(time.RFC3339), portFile, observed); err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+
+		return nil
+	}
+
+	for _, portFile := range portFiles {
+		if err := observe(portFile); err != nil {
+			return err
+		}
+	}
+
+	cmdEnv.Logger.Infof("watching %v for changes, stop with Ctrl+C", portFiles)
+
+	var outputErr error
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	defer cancelWatch()
+
+	err = WatchFiles(watchCtx, portFiles, func(portFile string) {
+		if err := observe(portFile); err != nil {
+			outputErr = err
+			cancelWatch()
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return outputErr
+}
+
+// historyRequestTimeout is how long the history command waits for the running tool's HTTP server to respond
+const historyRequestTimeout = 10 * time.Second
+
+// runHistory prints the port history of the tool running with the same configuration, which is kept in its memory so is read from its /status endpoint
+func runHistory(ctx context.Context, cmdEnv CommandEnv, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("expected no arguments")
+	}
+
+	if len(cmdEnv.Config.HTTPServerAddress) == 0 {
+		return fmt.Errorf("HTTP_SERVER_ADDRESS must be set, the history is read from the running tool's HTTP server")
+	}
+
+	statusURL, err := HTTPServerURL(cmdEnv.Config.HTTPServerAddress, "/status")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, historyRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, statusURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get status from the running tool, ensure it is running with the same HTTP_SERVER_ADDRESS: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("running tool responded to %s with status %d", statusURL, resp.StatusCode)
+	}
+
+	var status StatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("failed to decode status from the running tool: %s", err)
+	}
+
+	if len(status.PortHistory) == 0 {
+		return cmdEnv.output(CommandResult{}, "no port changes recorded")
+	}
+
+	lines := make([]string, 0, len(status.PortHistory))
+	for _, change := range status.PortHistory {
+		lines = append(lines, fmt.Sprintf("%s  %s -> %d", change.Time.Format(time.RFC3339), formatListenPort(change.OldPort), change.NewPort))
+	}
+
+	return cmdEnv.output(CommandResult{History: status.PortHistory}, strings.Join(lines, "\n"))
+}
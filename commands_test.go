@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+// newTestCommandEnv creates a CommandEnv for the fake qBittorrent
+func newTestCommandEnv(t *testing.T, fake *testutil.FakeQBittorrent) CommandEnv {
+	t.Helper()
+
+	cfg := newTestConfig(t)
+
+	return CommandEnv{
+		Logger:            golog.NewLogger("test"),
+		Config:            &cfg,
+		QBittorrentClient: newTestClient(t, fake),
+	}
+}
+
+func TestSnapshotRestoreCommands(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	cmdEnv := newTestCommandEnv(t, fake)
+
+	fake.SetPreference("listen_port", 50000)
+	fake.SetPreference("upnp", false)
+
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := Commands["snapshot"].Run(context.Background(), cmdEnv, []string{snapshotFile}); err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+
+	// Preferences change after the snapshot
+	fake.SetPreference("listen_port", 6881)
+	fake.SetPreference("upnp", true)
+
+	if err := Commands["restore"].Run(context.Background(), cmdEnv, []string{snapshotFile}); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("qBittorrent port is %d, expected the snapshot's 50000", port)
+	}
+	if upnp := fake.Preference("upnp"); upnp != false {
+		t.Errorf("qBittorrent upnp is %v, expected the snapshot's false", upnp)
+	}
+}
+
+func TestSnapshotRestoreCommandsErrors(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	cmdEnv := newTestCommandEnv(t, fake)
+
+	for _, name := range []string{"snapshot", "restore"} {
+		if err := Commands[name].Run(context.Background(), cmdEnv, nil); err == nil {
+			t.Errorf("%s without a file did not fail", name)
+		}
+	}
+
+	missingFile := filepath.Join(t.TempDir(), "missing.json")
+	if err := Commands["restore"].Run(context.Background(), cmdEnv, []string{missingFile}); err == nil {
+		t.Errorf("restore from a missing file did not fail")
+	}
+}
+
+// captureStdout returns what run writes to stdout
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	output := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- b
+	}()
+
+	run()
+	w.Close()
+
+	return string(<-output)
+}
+
+func TestDumpPrefsCommand(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	cmdEnv := newTestCommandEnv(t, fake)
+
+	// A preference the tool does not manage
+	fake.SetPreference("web_ui_username", "admin")
+
+	var runErr error
+	output := captureStdout(t, func() {
+		runErr = Commands["dump-prefs"].Run(context.Background(), cmdEnv, nil)
+	})
+	if runErr != nil {
+		t.Fatalf("failed to dump preferences: %s", runErr)
+	}
+
+	var dumped map[string]interface{}
+	if err := json.Unmarshal([]byte(output), &dumped); err != nil {
+		t.Fatalf("failed to decode output '%s' as JSON: %s", output, err)
+	}
+	if dumped["web_ui_username"] != "admin" || dumped["listen_port"] != float64(6881) {
+		t.Errorf("dumped preferences are %v, expected all of qBittorrent's preferences", dumped)
+	}
+
+	if err := Commands["dump-prefs"].Run(context.Background(), cmdEnv, []string{"extra"}); err == nil {
+		t.Errorf("dump-prefs with an argument did not fail")
+	}
+}
+
+func TestSelfTestCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		setup func(fake *testutil.FakeQBittorrent)
+
+		// wantSets is the number of requests to set preferences, the sync and restoring the previous port
+		wantSets int
+		wantErr  bool
+	}{
+		{name: "next port", wantSets: 2},
+		{name: "given port", args: []string{"50000"}, wantSets: 2},
+		{name: "given current port", args: []string{"6881"}, wantSets: 0},
+		{name: "port not applied", setup: func(fake *testutil.FakeQBittorrent) { fake.SetIgnorePreferenceChanges(true) }, wantSets: 2, wantErr: true},
+		{name: "invalid port", args: []string{"abc"}, wantErr: true},
+		{name: "too many arguments", args: []string{"50000", "50001"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			cmdEnv := newTestCommandEnv(t, fake)
+			if test.setup != nil {
+				test.setup(fake)
+			}
+
+			err := Commands["selftest"].Run(context.Background(), cmdEnv, test.args)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error is %v, expected an error: %t", err, test.wantErr)
+			}
+
+			if sets := fake.Requests("/api/v2/app/setPreferences"); sets != test.wantSets {
+				t.Errorf("made %d requests to set preferences, expected %d", sets, test.wantSets)
+			}
+			if port := fake.ListenPort(); port != 6881 {
+				t.Errorf("qBittorrent's port is %d after the self-test, expected the previous 6881", port)
+			}
+		})
+	}
+}
+
+func TestWatchCommand(t *testing.T) {
+	cfg := newTestConfig(t)
+	portFile := filepath.Join(t.TempDir(), "port")
+	cfg.PortFiles = []string{portFile}
+	writePortFile(t, portFile, 6881)
+
+	// qBittorrent is never contacted, so no client is provided
+	cmdEnv := CommandEnv{
+		Logger: golog.NewLogger("test"),
+		Config: &cfg,
+		JSON:   true,
+	}
+
+	output := captureStdout(t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- Commands["watch"].Run(ctx, cmdEnv, nil)
+		}()
+
+		// Each write is given time to be observed
+		time.Sleep(200 * time.Millisecond)
+		for _, port := range []uint16{50000, 50001, 50002} {
+			writePortFile(t, portFile, port)
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("failed to watch: %s", err)
+		}
+	})
+
+	// The file may be observed while it is being written, before it contains the port
+	ports := []uint16{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var result CommandResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("failed to decode '%s' as JSON: %s", line, err)
+		}
+		if result.File != portFile || result.Time == nil {
+			t.Errorf("result %+v does not include the port file and time", result)
+		}
+		if result.OK {
+			ports = append(ports, result.Port)
+		}
+	}
+
+	if fmt.Sprint(ports) != fmt.Sprint([]uint16{6881, 50000, 50001, 50002}) {
+		t.Errorf("printed ports %v, expected each written port once: %s", ports, output)
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		port        uint16
+		wantMatch   bool
+		wantChanges []string
+		wantText    string
+	}{
+		{
+			name:      "matching",
+			port:      6881,
+			wantMatch: true,
+			wantText:  "qBittorrent matches, syncing would not change anything",
+		},
+		{
+			name:        "differing",
+			port:        50000,
+			wantChanges: []string{"listen_port 6881 -> 50000"},
+			wantText:    "qBittorrent differs, syncing would change: listen_port 6881 -> 50000",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			cmdEnv := newTestCommandEnv(t, fake)
+
+			portFile := filepath.Join(t.TempDir(), "port")
+			cmdEnv.Config.PortFiles = []string{portFile}
+			writePortFile(t, portFile, test.port)
+
+			var runErr error
+			output := captureStdout(t, func() {
+				runErr = Commands["diff"].Run(context.Background(), cmdEnv, nil)
+			})
+			if runErr != nil {
+				t.Fatalf("failed to diff: %s", runErr)
+			}
+			wantHeader := fmt.Sprintf("port file '%s' has port %d, qBittorrent's port is 6881", portFile, test.port)
+			if !strings.Contains(output, wantHeader) || !strings.Contains(output, test.wantText) {
+				t.Errorf("output is '%s', expected it to include '%s' and '%s'", output, wantHeader, test.wantText)
+			}
+
+			cmdEnv.JSON = true
+			output = captureStdout(t, func() {
+				runErr = Commands["diff"].Run(context.Background(), cmdEnv, nil)
+			})
+			if runErr != nil {
+				t.Fatalf("failed to diff: %s", runErr)
+			}
+
+			var result CommandResult
+			if err := json.Unmarshal([]byte(output), &result); err != nil {
+				t.Fatalf("failed to decode output '%s' as JSON: %s", output, err)
+			}
+			if !result.OK || result.Port != test.port || result.File != portFile || result.CurrentPort != 6881 {
+				t.Errorf("result is %+v, expected the port file's and qBittorrent's ports", result)
+			}
+			if result.Match == nil || *result.Match != test.wantMatch {
+				t.Errorf("result match is %v, expected %t", result.Match, test.wantMatch)
+			}
+			if fmt.Sprint(result.Changes) != fmt.Sprint(test.wantChanges) {
+				t.Errorf("result changes are %v, expected %v", result.Changes, test.wantChanges)
+			}
+
+			// Nothing is ever applied
+			if sets := fake.Requests("/api/v2/app/setPreferences"); sets != 0 {
+				t.Errorf("qBittorrent's preferences were set %d times, expected never", sets)
+			}
+		})
+	}
+}
+
+func TestHistoryCommand(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	// The history is read from the running tool's HTTP server
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{PortHistorySize: 5})
+	srv := NewHTTPServer(NewHTTPServerOptions{
+		Logger:  golog.NewLogger("test"),
+		Address: "127.0.0.1:0",
+		Metrics: syncer.metrics,
+		Syncer:  syncer,
+	})
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Run(ctx)
+
+	cmdEnv := newTestCommandEnv(t, fake)
+	cmdEnv.Config.HTTPServerAddress = srv.listener.Addr().String()
+
+	for _, port := range []uint16{50000, 50001} {
+		writePortFile(t, portFile, port)
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync: %s", err)
+		}
+	}
+
+	var runErr error
+	output := captureStdout(t, func() {
+		runErr = Commands["history"].Run(context.Background(), cmdEnv, nil)
+	})
+	if runErr != nil {
+		t.Fatalf("failed to get history: %s", runErr)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "6881 -> 50000") || !strings.HasSuffix(lines[1], "50000 -> 50001") {
+		t.Errorf("output is '%s', expected both changes, oldest first", output)
+	}
+
+	cmdEnv.JSON = true
+	output = captureStdout(t, func() {
+		runErr = Commands["history"].Run(context.Background(), cmdEnv, nil)
+	})
+	if runErr != nil {
+		t.Fatalf("failed to get history: %s", runErr)
+	}
+	var result CommandResult
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("failed to decode output '%s' as JSON: %s", output, err)
+	}
+	if !result.OK || len(result.History) != 2 || result.History[1].NewPort != 50001 {
+		t.Errorf("result is %+v, expected both changes", result)
+	}
+
+	cmdEnv.Config.HTTPServerAddress = ""
+	if err := Commands["history"].Run(context.Background(), cmdEnv, nil); err == nil || !strings.Contains(err.Error(), "HTTP_SERVER_ADDRESS must be set") {
+		t.Errorf("error without an HTTP server address is %v", err)
+	}
+}
+
+func TestCommandsJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		setup   func(fake *testutil.FakeQBittorrent)
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "get-port",
+			want: map[string]interface{}{"ok": true, "port": float64(6881)},
+		},
+		{
+			name:    "get-port",
+			setup:   func(fake *testutil.FakeQBittorrent) { fake.FailNext(http.StatusBadRequest) },
+			wantErr: true,
+		},
+		{
+			name: "set-port",
+			args: []string{"50000"},
+			want: map[string]interface{}{"ok": true, "port": float64(50000)},
+		},
+		{
+			name:    "set-port",
+			args:    []string{"0"},
+			wantErr: true,
+		},
+		{
+			name: "test-login",
+			want: map[string]interface{}{"ok": true, "version": "v4.6.0"},
+		},
+		{
+			name:    "test-login",
+			setup:   func(fake *testutil.FakeQBittorrent) { fake.SetBanned(true) },
+			wantErr: true,
+		},
+		{
+			name: "dump-prefs",
+		},
+		{
+			name:    "dump-prefs",
+			args:    []string{"extra"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			cmdEnv := newTestCommandEnv(t, fake)
+			cmdEnv.JSON = true
+
+			if test.setup != nil {
+				test.setup(fake)
+			}
+
+			var runErr error
+			output := captureStdout(t, func() {
+				runErr = RunCommand(context.Background(), Commands[test.name], cmdEnv, test.args)
+			})
+			if (runErr != nil) != test.wantErr {
+				t.Fatalf("error is %v, expected an error: %t", runErr, test.wantErr)
+			}
+
+			var result map[string]interface{}
+			if err := json.Unmarshal([]byte(output), &result); err != nil {
+				t.Fatalf("failed to decode output '%s' as JSON: %s", output, err)
+			}
+
+			if test.wantErr {
+				if result["ok"] != false || result["error"] != runErr.Error() {
+					t.Errorf("result is %v, expected ok false and the error", result)
+				}
+				return
+			}
+
+			if test.want == nil {
+				// dump-prefs nests all of qBittorrent's preferences
+				prefs, ok := result["preferences"].(map[string]interface{})
+				if result["ok"] != true || !ok || prefs["listen_port"] != float64(6881) {
+					t.Errorf("result is %v, expected ok true and the preferences", result)
+				}
+				return
+			}
+
+			if len(result) != len(test.want) {
+				t.Errorf("result is %v, expected %v", result, test.want)
+			}
+			for key, value := range test.want {
+				if result[key] != value {
+					t.Errorf("result %s is %v, expected %v", key, result[key], value)
+				}
+			}
+		})
+	}
+}
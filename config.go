@@ -0,0 +1,1326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/caarlos0/env/v9"
+)
+
+// Config is the tool's configuration, loaded from env vars
+type Config struct {
+	// EnvFile is a file of env vars which are loaded in addition to, and override, the process' env vars. It is read again when the configuration is reloaded
+	EnvFile string `env:"ENV_FILE"`
+
+	// InstanceName identifies which qBittorrent this instance of the tool manages in logs and metrics, defaults to the host of QBittorrentAPINetloc
+	InstanceName string `env:"INSTANCE_NAME"`
+
+	// Verbose will make debug logs show
+	Verbose bool `env:"VERBOSE" envDefault:"false"`
+
+	// LogConfigFormat is how the configuration is logged at startup and by --check-config
+	LogConfigFormat LogConfigFormat `env:"LOG_CONFIG_FORMAT" envDefault:"text"`
+
+	// PortFiles are paths to files which contain only the VPNs forwarded port, in order of priority. The first file which exists and contains a valid port is used
+	PortFiles []string `env:"PORT_FILE" envSeparator:","`
+
+	// PortFileReadTimeoutSeconds is the maximum number of seconds reading a port file may take before the sync fails, so a stuck filesystem does not stall syncing, 0 means no limit
+	PortFileReadTimeoutSeconds int `env:"PORT_FILE_READ_TIMEOUT_SECONDS" envDefault:"10"`
+
+	// PortCommand is a shell command whose output contains the port, run each sync instead of reading port files. If empty PortFiles are used
+	PortCommand string `env:"PORT_COMMAND"`
+
+	// PortCommandTimeoutSeconds is the maximum number of seconds the port command may run for each sync before it is killed and the sync fails, 0 means no limit
+	PortCommandTimeoutSeconds int `env:"PORT_COMMAND_TIMEOUT_SECONDS" envDefault:"10"`
+
+	// PortFileFormat is how the contents of port files are parsed
+	PortFileFormat PortFileFormat `env:"PORT_FILE_FORMAT" envDefault:"plain"`
+
+	// OutputPortFile is the path of a file the port qBittorrent is using is written to after each successful sync, if empty the port is not written
+	OutputPortFile string `env:"OUTPUT_PORT_FILE"`
+
+	// ReadyFile is the path of a file which is written after the first successful sync and removed when the tool stops gracefully, if empty no file is written
+	ReadyFile string `env:"READY_FILE"`
+
+	// TreatZeroAsUnavailable controls whether a port file containing port 0 is treated as not containing a port yet, the same as a port file which does not exist. If false it is an error
+	TreatZeroAsUnavailable bool `env:"TREAT_ZERO_AS_UNAVAILABLE" envDefault:"true"`
+
+	// ExpectedPortRange is the range, in the format "<min>-<max>", ports read from port files must be in, ports outside of it are rejected. If empty any port is accepted
+	ExpectedPortRange string `env:"EXPECTED_PORT_RANGE"`
+
+	// PortSelector picks the port if a port file contains multiple, must be empty, "index:<n>", "protocol:<protocol>", or "jsonpath:<expression>". Only used by the json port file format
+	PortSelector string `env:"PORT_SELECTOR"`
+
+	// OnPortLost is what is done when the port files no longer contain a port after previously containing one, must be "ignore", "keep", or "default:<port>"
+	OnPortLost string `env:"ON_PORT_LOST" envDefault:"ignore"`
+
+	// NoChangeLogEvery is how many identical no change syncs occur between "No change" info log messages, 1 logs every sync and 0 logs only the first until the port changes
+	NoChangeLogEvery int `env:"NO_CHANGE_LOG_EVERY" envDefault:"1"`
+
+	// RefreshIntervalSeconds is the number of seconds between refreshes of the port file and setting of the qBittorrent torrent port
+	RefreshIntervalSeconds int `env:"REFRESH_INTERVAL_SECONDS,required" envDefault:"60"`
+
+	// QBittorrentAPINetloc is the network location of the qBittorrent API server
+	QBittorrentAPINetloc string `env:"QBITTORRENT_API_NETLOC,required"`
+
+	// ExtraQBittorrentAPINetlocs are the network locations of additional qBittorrent API servers, which are given the same port using the same credentials and settings
+	ExtraQBittorrentAPINetlocs []string `env:"EXTRA_QBITTORRENT_API_NETLOCS" envSeparator:","`
+
+	// MultiInstanceFailurePolicy determines if an additional qBittorrent which can't be reached when starting stops the tool, or is retried in the background
+	MultiInstanceFailurePolicy MultiInstanceFailurePolicy `env:"MULTI_INSTANCE_FAILURE_POLICY" envDefault:"best-effort"`
+
+	// QBittorrentUsername is the username to use when authenticating with the QBittorrent API
+	QBittorrentUsername string `env:"QBITTORRENT_USERNAME" envDefault:"admin"`
+
+	// QBittorrrentPassword is the password to use when authenticating with the QBittorrent API, may be empty if qBittorrent's WebUI authentication is disabled
+	QBittorrentPassword string `env:"QBITTORRENT_PASSWORD" secret:"true"`
+
+	// QBittorrentSessionID is the value of a qBittorrent session cookie obtained outside of the tool, used instead of logging in until qBittorrent rejects it
+	QBittorrentSessionID string `env:"QBITTORRENT_SID" secret:"true"`
+
+	// ClientCertFile is the path of a PEM encoded TLS client certificate presented to qBittorrent, for when it is behind a proxy which requires mutual TLS
+	ClientCertFile string `env:"CLIENT_CERT_FILE"`
+
+	// ClientKeyFile is the path of the PEM encoded private key of ClientCertFile
+	ClientKeyFile string `env:"CLIENT_KEY_FILE"`
+
+	// RequireHTTPS controls whether QBittorrentAPINetloc must use https and redirects to http are refused, so credentials are never sent in plaintext
+	RequireHTTPS bool `env:"REQUIRE_HTTPS" envDefault:"false"`
+
+	// MaskHostInLogs controls whether the host of QBittorrentAPINetloc is replaced in logged URLs, so logs shared in bug reports don't reveal internal addresses. Credentials are always removed from logged URLs
+	MaskHostInLogs bool `env:"MASK_HOST_IN_LOGS" envDefault:"false"`
+
+	// MaxResponseBodyBytes is the largest response body read from qBittorrent, larger responses fail instead of using unbounded memory
+	MaxResponseBodyBytes int64 `env:"MAX_RESPONSE_BODY_BYTES" envDefault:"16777216"`
+
+	// RequestHeaders are added to every request to qBittorrent, in the format "Name: value", separated by commas. Used to supply a service token to an authentication proxy in front of qBittorrent
+	RequestHeaders string `env:"REQUEST_HEADERS" secret:"true"`
+
+	// HostHeader replaces the Host header of requests to qBittorrent, for when qBittorrent's host header validation rejects the host in QBittorrentAPINetloc. If empty the host of QBittorrentAPINetloc is sent
+	HostHeader string `env:"HOST_HEADER"`
+
+	// SetPreferencesMethod is the HTTP method of requests which set qBittorrent's preferences, only changed for qBittorrent forks whose API differs
+	SetPreferencesMethod string `env:"SET_PREFERENCES_METHOD" envDefault:"POST"`
+
+	// APIPathPrefix is the path of qBittorrent's API relative to QBittorrentAPINetloc, for reverse proxies which rewrite paths
+	APIPathPrefix string `env:"API_PATH_PREFIX" envDefault:"/api/v2"`
+
+	// SetPreferencesPath is the API path requests which set qBittorrent's preferences are made to, only changed for qBittorrent forks whose API differs
+	SetPreferencesPath string `env:"SET_PREFERENCES_PATH" envDefault:"/api/v2/app/setPreferences"`
+
+	// SetPreferencesEncoding is how preferences are encoded in requests which set them, only changed for qBittorrent forks whose API differs
+	SetPreferencesEncoding SetPreferencesEncoding `env:"SET_PREFERENCES_ENCODING" envDefault:"json-in-form"`
+
+	// NetworkPreferencesPath is the path, relative to APIPathPrefix, of a typed endpoint which sets network preferences, used instead of the generic set preferences request while qBittorrent has it. If empty it is not used
+	NetworkPreferencesPath string `env:"NETWORK_PREFERENCES_PATH"`
+
+	// FormEncoding is how the bodies of login, set preferences, and reannounce requests are encoded, multipart for proxies which mangle URL encoded bodies
+	FormEncoding FormEncoding `env:"FORM_ENCODING" envDefault:"urlencoded"`
+
+	// PostLoginDelayMilliseconds is the number of milliseconds waited after logging in before making requests with the new session
+	PostLoginDelayMilliseconds int `env:"POST_LOGIN_DELAY_MILLISECONDS" envDefault:"0"`
+
+	// SkipLogin controls whether logging in to the qBittorrent API is skipped, for when qBittorrent bypasses authentication for this tool's address
+	SkipLogin bool `env:"SKIP_LOGIN" envDefault:"false"`
+
+	// UseKeyring controls whether the qBittorrent API password is read from the system keyring, if the keyring has no password QBittorrentPassword or AuthFile is used
+	UseKeyring bool `env:"USE_KEYRING" envDefault:"false"`
+
+	// KeyringService is the service name the password is stored under in the keyring
+	KeyringService string `env:"KEYRING_SERVICE" envDefault:"qbittorrent-port-updater"`
+
+	// KeyringAccount is the account name the password is stored under in the keyring, defaults to QBittorrentUsername
+	KeyringAccount string `env:"KEYRING_ACCOUNT"`
+
+	// AuthFile is the path of a file containing the qBittorrent API username and password, if set it takes precedence over QBittorrentUsername and QBittorrentPassword
+	AuthFile string `env:"AUTH_FILE"`
+
+	// DNSFallbackGracePeriodSeconds is how many seconds after qBittorrent's host was last resolved the address it resolved to is used if resolving it fails, 0 disables the fallback
+	DNSFallbackGracePeriodSeconds int `env:"DNS_FALLBACK_GRACE_PERIOD_SECONDS" envDefault:"0"`
+
+	// DialTimeoutSeconds is the maximum number of seconds establishing a connection to qBittorrent may take, so a stopped qBittorrent container fails fast. 0 means only the operating system's limit applies
+	DialTimeoutSeconds int `env:"DIAL_TIMEOUT_SECONDS" envDefault:"10"`
+
+	// DialKeepAliveSeconds is the number of seconds between TCP keep-alive probes of connections to qBittorrent, 0 disables keep-alive probes
+	DialKeepAliveSeconds int `env:"DIAL_KEEPALIVE_SECONDS" envDefault:"30"`
+
+	// SessionRefreshMarginSeconds is how many seconds before the qBittorrent session cookie expires the session is refreshed, this tolerates clock skew
+	SessionRefreshMarginSeconds int `env:"SESSION_REFRESH_MARGIN_SECONDS" envDefault:"60"`
+
+	// SlowRequestThresholdMilliseconds is how many milliseconds a qBittorrent API request may take before a warning is logged, 0 disables the warning
+	SlowRequestThresholdMilliseconds int `env:"SLOW_REQUEST_THRESHOLD_MS" envDefault:"0"`
+
+	// ReadinessTimeoutSeconds is the maximum number of seconds to wait for qBittorrent to be reachable before the first sync, 0 disables waiting
+	ReadinessTimeoutSeconds int `env:"READINESS_TIMEOUT_SECONDS" envDefault:"0"`
+
+	// ProceedIfNotReady controls whether syncing starts anyway if qBittorrent is not ready within ReadinessTimeoutSeconds, if false the program exits
+	ProceedIfNotReady bool `env:"PROCEED_IF_NOT_READY" envDefault:"false"`
+
+	// CheckPreferencesOnStartup controls whether the program logs in and reads qBittorrent's preferences before syncing, exiting if they can't be read, so missing permissions are reported apart from rejected credentials
+	CheckPreferencesOnStartup bool `env:"CHECK_PREFERENCES_ON_STARTUP" envDefault:"false"`
+
+	// PortFileStaleThresholdSeconds is the number of seconds after the port file was last written that a warning is logged, 0 disables the warning
+	PortFileStaleThresholdSeconds int `env:"PORT_FILE_STALE_THRESHOLD_SECONDS" envDefault:"0"`
+
+	// AllowPortFileNotExist controls whether or not the port PortFile can not exist, if false and the PortFile does not exist then the program will error
+	AllowPortFileNotExist bool `env:"ALLOW_PORT_FILE_NOT_EXIST,required" envDefault:"true"`
+
+	// PortFileMissingGracePeriodSeconds is the number of seconds the port files may not contain a port before it is an error, when AllowPortFileNotExist is false, so a port file which briefly disappears while it is replaced is not an error
+	PortFileMissingGracePeriodSeconds int `env:"PORT_FILE_MISSING_GRACE_PERIOD_SECONDS" envDefault:"0"`
+
+	// DisableRandomPort controls whether qBittorrent's "use different port on each startup" (random_port) preference is turned off, if it is on qBittorrent will change the port when it restarts
+	DisableRandomPort bool `env:"DISABLE_RANDOM_PORT" envDefault:"false"`
+
+	// SkipIfRandomPort controls whether the port is left unchanged while qBittorrent's random_port preference is on and DisableRandomPort is false
+	SkipIfRandomPort bool `env:"SKIP_IF_RANDOM_PORT" envDefault:"false"`
+
+	// SkipIfListenPortUnset controls whether the port is left unchanged while qBittorrent reports listen_port 0, which it does before it finished starting
+	SkipIfListenPortUnset bool `env:"SKIP_IF_LISTEN_PORT_UNSET" envDefault:"false"`
+
+	// MinimalMode is how the port is set without ever reading qBittorrent's preferences, one of MinimalModes, if empty the preferences are read and only those which differ are changed
+	MinimalMode string `env:"MINIMAL_MODE"`
+
+	// CompareAndSwap controls whether qBittorrent's port is read again right before changing it, and left unchanged if something else changed it since the sync read it
+	CompareAndSwap bool `env:"COMPARE_AND_SWAP" envDefault:"false"`
+
+	// ReannounceOnChange controls whether torrents are reannounced to their trackers after a sync changes qBittorrent's preferences, so peers learn about the new port sooner
+	ReannounceOnChange bool `env:"REANNOUNCE_ON_CHANGE" envDefault:"false"`
+
+	// ResumeOnChange is which torrents are resumed after a sync changes qBittorrent's listen port, one of ResumeOnChangeModes, if empty none are
+	ResumeOnChange string `env:"RESUME_ON_CHANGE"`
+
+	// OnChangeCommand is a shell command run after a sync changes qBittorrent's listen port, with the QB_OLD_PORT and QB_NEW_PORT env vars. If empty no command is run
+	OnChangeCommand string `env:"ON_CHANGE_COMMAND"`
+
+	// OnChangeCommandExtendedEnv controls whether the on change command is also run with env vars describing the instance, qBittorrent, and why the port changed
+	OnChangeCommandExtendedEnv bool `env:"ON_CHANGE_COMMAND_EXTENDED_ENV" envDefault:"false"`
+
+	// OnChangeCommandAsync controls whether the on change command is run in the background, one run at a time, so a slow command does not delay syncs
+	OnChangeCommandAsync bool `env:"ON_CHANGE_COMMAND_ASYNC" envDefault:"false"`
+
+	// OnChangeCommandQueueSize is the most runs of the on change command which wait while ON_CHANGE_COMMAND_ASYNC is true, the oldest is dropped once it is full
+	OnChangeCommandQueueSize int `env:"ON_CHANGE_COMMAND_QUEUE_SIZE" envDefault:"10"`
+
+	// APICallBudget is the number of qBittorrent API requests a sync makes before optional requests are skipped, zero means no limit
+	APICallBudget int `env:"API_CALL_BUDGET" envDefault:"0"`
+
+	// PinRandomPortRange controls whether, while qBittorrent's random_port preference is on, its random port range is narrowed to only the forwarded port instead of random_port being turned off
+	PinRandomPortRange bool `env:"PIN_RANDOM_PORT_RANGE" envDefault:"false"`
+
+	// SetAnnouncePort controls whether qBittorrent's announce_port preference, the port announced to trackers, is set to the forwarded port along with the listen port
+	SetAnnouncePort bool `env:"SET_ANNOUNCE_PORT" envDefault:"false"`
+
+	// UPnP is the UPnP / NAT-PMP port forwarding state to enforce in qBittorrent, if not set then UPnP is not managed
+	UPnP *bool `env:"UPNP"`
+
+	// MaxConnections is the global maximum number of connections to enforce in qBittorrent, -1 for unlimited, if not set then it is not managed
+	MaxConnections *int `env:"MAX_CONNECTIONS"`
+
+	// MaxConnectionsPerTorrent is the maximum number of connections per torrent to enforce in qBittorrent, -1 for unlimited, if not set then it is not managed
+	MaxConnectionsPerTorrent *int `env:"MAX_CONNECTIONS_PER_TORRENT"`
+
+	// NetworkInterface is the network interface qBittorrent binds to to enforce, such as the VPN's interface, if not set then it is not managed
+	NetworkInterface *string `env:"NETWORK_INTERFACE"`
+
+	// InterfaceAddress is the address of the network interface qBittorrent binds to to enforce, if not set then it is not managed
+	InterfaceAddress *string `env:"INTERFACE_ADDRESS"`
+
+	// ListenAddressFamily is the address family qBittorrent listens on to enforce, one of ListenAddressFamilies, if empty then it is not managed. It is enforced through the interface address, so it can't be combined with InterfaceAddress
+	ListenAddressFamily string `env:"LISTEN_ADDRESS_FAMILY"`
+
+	// ApplyWindow is the daily window, in the format "HH:MM-HH:MM", outside of which changes to qBittorrent are deferred. If empty changes are always applied
+	ApplyWindow string `env:"APPLY_WINDOW"`
+
+	// ApplyWindowTimezone is the IANA timezone ApplyWindow is in
+	ApplyWindowTimezone string `env:"APPLY_WINDOW_TIMEZONE" envDefault:"Local"`
+
+	// ApplyOnlyWhenActive controls whether changes to qBittorrent are deferred while it has no active torrents
+	ApplyOnlyWhenActive bool `env:"APPLY_ONLY_WHEN_ACTIVE" envDefault:"false"`
+
+	// ForceSet controls whether the port is set every sync even if qBittorrent already reports it, useful if qBittorrent did not actually bind the port
+	ForceSet bool `env:"FORCE_SET" envDefault:"false"`
+
+	// SetPreferencesAttempts is the number of times setting qBittorrent's preferences is tried in one sync before the sync fails
+	SetPreferencesAttempts int `env:"SET_PREFERENCES_ATTEMPTS" envDefault:"3"`
+
+	// SetPreferencesBackoffSeconds is the number of seconds before the first retry of setting qBittorrent's preferences, how it grows for each following retry depends on BackoffStrategy
+	SetPreferencesBackoffSeconds int `env:"SET_PREFERENCES_BACKOFF_SECONDS" envDefault:"1"`
+
+	// UnavailableRetries is the number of times a request is retried if qBittorrent responds with 503, which it does while its WebUI is starting
+	UnavailableRetries int `env:"UNAVAILABLE_RETRIES" envDefault:"5"`
+
+	// UnavailableBackoffSeconds is the number of seconds before the first retry of a request qBittorrent responded to with 503, how it grows for each following retry depends on BackoffStrategy
+	UnavailableBackoffSeconds int `env:"UNAVAILABLE_BACKOFF_SECONDS" envDefault:"1"`
+
+	// BackoffStrategy is how the delay between retries grows, for setting preferences and waiting for qBittorrent to be ready
+	BackoffStrategy BackoffStrategy `env:"BACKOFF_STRATEGY" envDefault:"exponential-full-jitter"`
+
+	// BackoffMaxSeconds is the longest number of seconds waited between retries, zero means no limit
+	BackoffMaxSeconds int `env:"BACKOFF_MAX_SECONDS" envDefault:"30"`
+
+	// VerifyChanges controls whether qBittorrent's preferences are read back after being changed to ensure the change took effect. Opt-in so upgrades keep making one request per change
+	VerifyChanges bool `env:"VERIFY_CHANGES" envDefault:"false"`
+
+	// VerifyAttempts is the number of times qBittorrent's preferences are read back after a change before verifying it fails, for qBittorrent builds which apply changes asynchronously. More than 1 implies VerifyChanges
+	VerifyAttempts int `env:"VERIFY_ATTEMPTS" envDefault:"1"`
+
+	// VerifyDelayMilliseconds is the number of milliseconds waited between reading qBittorrent's preferences back
+	VerifyDelayMilliseconds int `env:"VERIFY_DELAY_MILLISECONDS" envDefault:"500"`
+
+	// VerifyReachableWithinSeconds is how long qBittorrent is given to report it is reachable after a change for verification to pass, 0 does not check reachability
+	VerifyReachableWithinSeconds int `env:"VERIFY_REACHABLE_WITHIN_SECONDS" envDefault:"0"`
+
+	// RollbackOnVerifyFailure controls whether qBittorrent's preferences are changed back to their previous values if verifying a change fails. Implies VerifyChanges
+	RollbackOnVerifyFailure bool `env:"ROLLBACK_ON_VERIFY_FAILURE" envDefault:"false"`
+
+	// LockFile is a file held while changing qBittorrent's preferences, so only one of several tools managing the same qBittorrent changes it at a time, if empty no lock is used
+	LockFile string `env:"LOCK_FILE"`
+
+	// LockTimeoutSeconds is the maximum number of seconds a sync waits for another tool to release the lock file before failing, 0 means no limit
+	LockTimeoutSeconds int `env:"LOCK_TIMEOUT_SECONDS" envDefault:"30"`
+
+	// LockStaleSeconds is the age in seconds after which a lock file is assumed to be left behind by a tool which crashed and is removed, 0 means lock files never go stale
+	LockStaleSeconds int `env:"LOCK_STALE_SECONDS" envDefault:"300"`
+
+	// CircuitBreakerThreshold is the number of consecutive syncs which fail to reach qBittorrent after which syncs are skipped for the cooldown, 0 disables the circuit breaker
+	CircuitBreakerThreshold int `env:"CIRCUIT_BREAKER_THRESHOLD" envDefault:"0"`
+
+	// CircuitBreakerCooldownSeconds is the number of seconds syncs are skipped for once the circuit breaker opens
+	CircuitBreakerCooldownSeconds int `env:"CIRCUIT_BREAKER_COOLDOWN_SECONDS" envDefault:"300"`
+
+	// PreserveScheduler controls whether qBittorrent's alternative speed limit scheduler preferences are read and sent unchanged whenever preferences are set, so the scheduler's state is not reset
+	PreserveScheduler bool `env:"PRESERVE_SCHEDULER" envDefault:"false"`
+
+	// SkipInitialSync controls whether the first sync waits for the refresh interval to elapse instead of running at startup
+	SkipInitialSync bool `env:"SKIP_INITIAL_SYNC" envDefault:"false"`
+
+	// WaitForPortFileSeconds is the maximum number of seconds to wait for a port file to be created before the first sync, 0 disables waiting
+	WaitForPortFileSeconds int `env:"WAIT_FOR_PORT_FILE_SECONDS" envDefault:"0"`
+
+	// WatchPortFiles controls whether the port files are watched and a sync runs as soon as one changes, in addition to syncing every RefreshIntervalSeconds
+	WatchPortFiles bool `env:"WATCH_PORT_FILES" envDefault:"false"`
+
+	// SyncTimeoutSeconds is the maximum number of seconds a single sync may take before it is aborted and counted as a failure, 0 means no limit
+	SyncTimeoutSeconds int `env:"SYNC_TIMEOUT_SECONDS" envDefault:"0"`
+
+	// CheckReachability controls whether qBittorrent's connection status is checked after each sync to report if the port is reachable
+	CheckReachability bool `env:"CHECK_REACHABILITY" envDefault:"false"`
+
+	// HTTPServerAddress is the host:port on which the HTTP server which serves metrics listens, if empty the server is not started
+	HTTPServerAddress string `env:"HTTP_SERVER_ADDRESS"`
+
+	// HTTPServerToken is the bearer token required by HTTP endpoints which change state, if empty those endpoints are disabled
+	HTTPServerToken string `env:"HTTP_SERVER_TOKEN" secret:"true"`
+
+	// PortHistorySize is the number of the most recent changes of qBittorrent's listen port which are reported by the /status endpoint and the history command, zero disables the history
+	PortHistorySize int `env:"PORT_HISTORY_SIZE" envDefault:"20"`
+
+	// PushgatewayURL is the URL of a Prometheus Pushgateway metrics are pushed to after each sync, if empty metrics are not pushed
+	PushgatewayURL string `env:"PUSHGATEWAY_URL" secret:"true"`
+
+	// PushgatewayJob is the job label metrics pushed to the Pushgateway are grouped by
+	PushgatewayJob string `env:"PUSHGATEWAY_JOB" envDefault:"qbittorrent_port_updater"`
+
+	// PushgatewayInstance is the instance label metrics pushed to the Pushgateway are grouped by, defaults to InstanceName
+	PushgatewayInstance string `env:"PUSHGATEWAY_INSTANCE"`
+
+	// NotifyWebhookURLs are URLs a JSON description of each sync which changed qBittorrent or failed is posted to
+	NotifyWebhookURLs []string `env:"NOTIFY_WEBHOOK_URLS" envSeparator:"," secret:"true"`
+
+	// NotifyDiscordWebhookURLs are Discord webhook URLs a message about each sync which changed qBittorrent or failed is posted to
+	NotifyDiscordWebhookURLs []string `env:"NOTIFY_DISCORD_WEBHOOK_URLS" envSeparator:"," secret:"true"`
+
+	// NotifyThrottleSeconds is the number of seconds after a notification during which identical notifications are suppressed and summarized, zero disables throttling
+	NotifyThrottleSeconds int `env:"NOTIFY_THROTTLE_SECONDS" envDefault:"0"`
+
+	// ReportOnExit controls whether a summary of the syncs which ran is logged when the sync loop stops gracefully
+	ReportOnExit bool `env:"REPORT_ON_EXIT" envDefault:"false"`
+
+	// MaxRuntimeSeconds is the number of seconds after which the sync loop stops and the tool exits successfully, so it can be restarted by a process supervisor, zero means no limit
+	MaxRuntimeSeconds int `env:"MAX_RUNTIME_SECONDS" envDefault:"0"`
+
+	// WatchdogThresholdSeconds is the number of seconds which may pass without a sync finishing before the sync loop is considered stalled and an error is logged, zero disables the watchdog
+	WatchdogThresholdSeconds int `env:"WATCHDOG_THRESHOLD_SECONDS" envDefault:"0"`
+
+	// WatchdogExit controls whether the tool exits with a non-zero status when the watchdog detects the sync loop stalled, so an orchestrator restarts it
+	WatchdogExit bool `env:"WATCHDOG_EXIT" envDefault:"false"`
+
+	// HTTPServerRequired controls whether failing to start the HTTP server stops the program, if false syncing continues without the HTTP server
+	HTTPServerRequired bool `env:"HTTP_SERVER_REQUIRED" envDefault:"false"`
+
+	// ShutdownGracePeriodSeconds is the number of seconds an in-flight sync is given to finish after a graceful stop signal is received
+	ShutdownGracePeriodSeconds int `env:"SHUTDOWN_GRACE_PERIOD_SECONDS" envDefault:"10"`
+
+	// LogoutOnExit controls whether the qBittorrent session is ended when the sync loop stops gracefully
+	LogoutOnExit bool `env:"LOGOUT_ON_EXIT" envDefault:"false"`
+
+	// LogoutTimeoutSeconds is the maximum number of seconds logging out on exit may take, so an unreachable qBittorrent does not delay exiting, 0 means only ShutdownCleanupTimeoutSeconds limits it
+	LogoutTimeoutSeconds int `env:"LOGOUT_TIMEOUT_SECONDS" envDefault:"3"`
+
+	// LogoutSkipIfLastSyncFailed controls whether logging out on exit is skipped if the last sync failed, since qBittorrent is likely unreachable
+	LogoutSkipIfLastSyncFailed bool `env:"LOGOUT_SKIP_IF_LAST_SYNC_FAILED" envDefault:"false"`
+
+	// ShutdownCleanupTimeoutSeconds is the maximum number of seconds cleanup, like logging out, may take after the sync loop stops gracefully, 0 means no limit
+	ShutdownCleanupTimeoutSeconds int `env:"SHUTDOWN_CLEANUP_TIMEOUT_SECONDS" envDefault:"10"`
+
+	// ExitCodes maps failure classes to the exit code the tool exits with when it fails because of them, in the format "<class>=<code>,...". Failures without an exit code exit with 1
+	ExitCodes string `env:"EXIT_CODES"`
+}
+
+// LogConfigFormat is how the configuration is logged
+type LogConfigFormat string
+
+const (
+	// LogConfigFormatText logs the configuration as aligned, human readable lines
+	LogConfigFormatText LogConfigFormat = "text"
+
+	// LogConfigFormatJSON logs every configuration field as one line of JSON, keyed by env var name
+	LogConfigFormatJSON LogConfigFormat = "json"
+)
+
+// LogConfigFormats are all the supported log config formats
+var LogConfigFormats = []LogConfigFormat{
+	LogConfigFormatText,
+	LogConfigFormatJSON,
+}
+
+// DefaultConfigPrefix is the prefix of all configuration env vars, unless overridden by the ConfigPrefixEnvVar env var
+const DefaultConfigPrefix = "QBITTORRENT_PORT_UPDATER_"
+
+// ConfigPrefixEnvVar is the env var which can override DefaultConfigPrefix, it is always read without a prefix
+const ConfigPrefixEnvVar = "QBITTORRENT_PORT_UPDATER_CONFIG_PREFIX"
+
+// ConfigPrefix returns the prefix of configuration env vars
+func ConfigPrefix() string {
+	if prefix, ok := os.LookupEnv(ConfigPrefixEnvVar); ok {
+		return prefix
+	}
+
+	return DefaultConfigPrefix
+}
+
+// LoadConfig from environment vars, and the env file if ENV_FILE is set
+func LoadConfig() (*Config, error) {
+	environment := map[string]string{}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		environment[key] = value
+	}
+
+	if envFile := environment[ConfigPrefix()+"ENV_FILE"]; len(envFile) > 0 {
+		content, err := os.ReadFile(envFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ENV_FILE '%s': %s", envFile, err)
+		}
+
+		fileEnvironment, err := ParseEnvFile(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ENV_FILE '%s': %s", envFile, err)
+		}
+
+		for key, value := range fileEnvironment {
+			environment[key] = value
+		}
+	}
+
+	var cfg Config
+	if err := env.ParseWithOptions(&cfg, env.Options{
+		Prefix:      ConfigPrefix(),
+		Environment: environment,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to load configuration from env vars: %s", err)
+	}
+
+	for i, portFile := range cfg.PortFiles {
+		expanded, err := ExpandPath(portFile, environment)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand PORT_FILE path '%s': %s", portFile, err)
+		}
+		cfg.PortFiles[i] = expanded
+	}
+
+	if len(cfg.AuthFile) > 0 {
+		content, err := os.ReadFile(cfg.AuthFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read AUTH_FILE '%s': %s", cfg.AuthFile, err)
+		}
+
+		username, password, err := ParseAuthFile(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse AUTH_FILE '%s': %s", cfg.AuthFile, err)
+		}
+
+		cfg.QBittorrentUsername = username
+		cfg.QBittorrentPassword = password
+	}
+
+	if cfg.UseKeyring {
+		if len(cfg.KeyringAccount) == 0 {
+			cfg.KeyringAccount = cfg.QBittorrentUsername
+		}
+
+		password, err := SystemKeyring.Get(cfg.KeyringService, cfg.KeyringAccount)
+		if err == nil {
+			cfg.QBittorrentPassword = password
+		} else if !errors.Is(err, ErrKeyringSecretNotFound) || len(cfg.QBittorrentPassword) == 0 {
+			return nil, fmt.Errorf("failed to get password for service '%s' and account '%s' from keyring: %s", cfg.KeyringService, cfg.KeyringAccount, err)
+		}
+	}
+
+	if len(cfg.InstanceName) == 0 {
+		if baseURL, err := ParseNetworkLocation(cfg.QBittorrentAPINetloc); err == nil {
+			cfg.InstanceName = baseURL.Hostname()
+		}
+	}
+
+	if len(cfg.PushgatewayInstance) == 0 {
+		cfg.PushgatewayInstance = cfg.InstanceName
+	}
+
+	return &cfg, nil
+}
+
+// ParseEnvFile parses the contents of an env file, which has a KEY=VALUE env var on each line.
+// Blank lines and lines starting with # are ignored, lines may start with "export" and values may be surrounded by quotes, so the file can also be sourced by a shell.
+func ParseEnvFile(content []byte) (map[string]string, error) {
+	environment := map[string]string{}
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("line %d is not in the format KEY=VALUE", i+1)
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		environment[key] = value
+	}
+
+	return environment, nil
+}
+
+// ReloadableConfigFields are the env vars, without the prefix, whose changes are applied when the configuration is reloaded. Changes to any others require a restart
+var ReloadableConfigFields = []string{
+	"ENV_FILE",
+	"PORT_FILE",
+	"REFRESH_INTERVAL_SECONDS",
+	"VERBOSE",
+	"NOTIFY_WEBHOOK_URLS",
+	"NOTIFY_DISCORD_WEBHOOK_URLS",
+	"QBITTORRENT_API_NETLOC",
+	"QBITTORRENT_USERNAME",
+	"QBITTORRENT_PASSWORD",
+	"AUTH_FILE",
+}
+
+// ChangedConfigFields compares two configurations and returns the env vars, without the prefix, whose values differ
+func ChangedConfigFields(old *Config, new *Config) []string {
+	var changed []string
+
+	oldValue := reflect.ValueOf(*old)
+	newValue := reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		tag, ok := oldValue.Type().Field(i).Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
+// ExpandPath replaces a leading "~/" with the user's home directory, and $VAR or ${VAR} with the values of env vars in environment.
+// References to env vars which are not set, and a "${" without a closing "}", are left exactly as written, so a "$" which is part of a file name is preserved.
+func ExpandPath(path string, environment map[string]string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to determine home directory: %s", err)
+		}
+		path = home + strings.TrimPrefix(path, "~")
+	}
+
+	var expanded strings.Builder
+	for {
+		start := strings.IndexByte(path, '$')
+		if start < 0 {
+			expanded.WriteString(path)
+			return expanded.String(), nil
+		}
+		expanded.WriteString(path[:start])
+		path = path[start:]
+
+		// reference is the whole "$VAR" or "${VAR}", name only VAR
+		var reference, name string
+		if strings.HasPrefix(path, "${") {
+			end := strings.IndexByte(path, '}')
+			if end < 0 {
+				expanded.WriteString(path)
+				return expanded.String(), nil
+			}
+			reference, name = path[:end+1], path[2:end]
+		} else {
+			end := 1
+			for end < len(path) && isEnvVarNameByte(path[end]) {
+				end++
+			}
+			reference, name = path[:end], path[1:end]
+		}
+
+		if value, ok := environment[name]; ok && len(name) > 0 {
+			expanded.WriteString(value)
+		} else {
+			expanded.WriteString(reference)
+		}
+		path = path[len(reference):]
+	}
+}
+
+// isEnvVarNameByte determines if c can be part of an env var name
+func isEnvVarNameByte(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// ParseApplyWindow parses ApplyWindow in ApplyWindowTimezone, returns nil if ApplyWindow is empty
+func (cfg Config) ParseApplyWindow() (*TimeWindow, error) {
+	if len(cfg.ApplyWindow) == 0 {
+		return nil, nil
+	}
+
+	location, err := time.LoadLocation(cfg.ApplyWindowTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("APPLY_WINDOW_TIMEZONE '%s' is not a valid timezone: %s", cfg.ApplyWindowTimezone, err)
+	}
+
+	window, err := ParseTimeWindow(cfg.ApplyWindow, location)
+	if err != nil {
+		return nil, fmt.Errorf("APPLY_WINDOW is invalid, is '%s': %s", cfg.ApplyWindow, err)
+	}
+
+	return &window, nil
+}
+
+// Notifiers creates a notifier for each configured notification channel, combined so they are all notified at once
+func (cfg Config) Notifiers() (*MultiNotifier, error) {
+	var notifiers []Notifier
+
+	for i, webhookURL := range cfg.NotifyWebhookURLs {
+		notifier, err := NewWebhookNotifier(webhookURL)
+		if err != nil {
+			return nil, fmt.Errorf("NOTIFY_WEBHOOK_URLS entry %d is invalid: %s", i+1, err)
+		}
+		notifiers = append(notifiers, notifier)
+	}
+
+	for i, webhookURL := range cfg.NotifyDiscordWebhookURLs {
+		notifier, err := NewDiscordNotifier(webhookURL)
+		if err != nil {
+			return nil, fmt.Errorf("NOTIFY_DISCORD_WEBHOOK_URLS entry %d is invalid: %s", i+1, err)
+		}
+		notifiers = append(notifiers, notifier)
+	}
+
+	return NewMultiNotifier(notifiers...), nil
+}
+
+// minimalModeConflicts returns the names of the settings which are set but can't be used with MINIMAL_MODE
+func (cfg Config) minimalModeConflicts() []string {
+	settings := []struct {
+		name string
+		set  bool
+	}{
+		{name: "CHECK_PREFERENCES_ON_STARTUP", set: cfg.CheckPreferencesOnStartup},
+		{name: "DISABLE_RANDOM_PORT", set: cfg.DisableRandomPort},
+		{name: "SKIP_IF_RANDOM_PORT", set: cfg.SkipIfRandomPort},
+		{name: "SKIP_IF_LISTEN_PORT_UNSET", set: cfg.SkipIfListenPortUnset},
+		{name: "COMPARE_AND_SWAP", set: cfg.CompareAndSwap},
+		{name: "PIN_RANDOM_PORT_RANGE", set: cfg.PinRandomPortRange},
+		{name: "SET_ANNOUNCE_PORT", set: cfg.SetAnnouncePort},
+		{name: "UPNP", set: cfg.UPnP != nil},
+		{name: "MAX_CONNECTIONS", set: cfg.MaxConnections != nil},
+		{name: "MAX_CONNECTIONS_PER_TORRENT", set: cfg.MaxConnectionsPerTorrent != nil},
+		{name: "NETWORK_INTERFACE", set: cfg.NetworkInterface != nil},
+		{name: "INTERFACE_ADDRESS", set: cfg.InterfaceAddress != nil},
+		{name: "LISTEN_ADDRESS_FAMILY", set: len(cfg.ListenAddressFamily) > 0},
+		{name: "APPLY_WINDOW", set: len(cfg.ApplyWindow) > 0},
+		{name: "APPLY_ONLY_WHEN_ACTIVE", set: cfg.ApplyOnlyWhenActive},
+		{name: "VERIFY_CHANGES", set: cfg.VerifyChanges},
+		{name: "PRESERVE_SCHEDULER", set: cfg.PreserveScheduler},
+	}
+
+	var conflicts []string
+	for _, setting := range settings {
+		if setting.set {
+			conflicts = append(conflicts, setting.name)
+		}
+	}
+
+	return conflicts
+}
+
+// SetPreferencesRequest returns how requests which set qBittorrent's preferences are made
+func (cfg Config) SetPreferencesRequest() SetPreferencesRequest {
+	return SetPreferencesRequest{
+		Method:   cfg.SetPreferencesMethod,
+		Path:     cfg.SetPreferencesPath,
+		Encoding: cfg.SetPreferencesEncoding,
+	}
+}
+
+// ListenAddressFamilies maps each supported LISTEN_ADDRESS_FAMILY value to the interface address which makes qBittorrent listen on all addresses of that family
+var ListenAddressFamilies = map[string]string{
+	"all":  "",
+	"ipv4": "0.0.0.0",
+	"ipv6": "::",
+}
+
+// ListenInterfaceAddress returns the interface address to enforce, from InterfaceAddress or ListenAddressFamily, nil if it is not managed
+func (cfg Config) ListenInterfaceAddress() *string {
+	if address, ok := ListenAddressFamilies[cfg.ListenAddressFamily]; ok {
+		return &address
+	}
+
+	return cfg.InterfaceAddress
+}
+
+// ParseAuthFile parses the contents of an auth file into a username and password.
+// The contents must either be a single "username:password" line, or the username on the first line and the password on the second.
+func ParseAuthFile(content []byte) (string, string, error) {
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	var username, password string
+	switch len(lines) {
+	case 1:
+		var found bool
+		username, password, found = strings.Cut(lines[0], ":")
+		if !found {
+			return "", "", fmt.Errorf("expected a single line in the format 'username:password'")
+		}
+	case 2:
+		username, password = lines[0], lines[1]
+	default:
+		return "", "", fmt.Errorf("expected 'username:password' or the username and password on 2 lines, found %d lines", len(lines))
+	}
+
+	if len(username) == 0 {
+		return "", "", fmt.Errorf("username is empty")
+	}
+
+	return username, password, nil
+}
+
+// StdinPortFile is the PORT_FILE value which indicates the port should be read from stdin
+const StdinPortFile = "-"
+
+// ReadPortFromStdin indicates the port should be read once from stdin instead of from port files
+func (cfg Config) ReadPortFromStdin() bool {
+	return slices.Contains(cfg.PortFiles, StdinPortFile)
+}
+
+// Validate checks the configuration for structural problems without contacting qBittorrent.
+// All problems are reported at once, joined into one error.
+func (cfg Config) Validate() error {
+	var problems []error
+
+	if len(cfg.PortFiles) == 0 && len(cfg.PortCommand) == 0 {
+		problems = append(problems, fmt.Errorf("PORT_FILE must contain at least one path, or PORT_COMMAND must be set"))
+	}
+	if len(cfg.PortFiles) > 0 && len(cfg.PortCommand) > 0 {
+		problems = append(problems, fmt.Errorf("PORT_FILE and PORT_COMMAND can't both be set"))
+	}
+	if cfg.SkipLogin && len(cfg.QBittorrentSessionID) > 0 {
+		problems = append(problems, fmt.Errorf("QBITTORRENT_SID can't be used with SKIP_LOGIN, qBittorrent does not require a session if logging in is skipped"))
+	}
+	if cfg.WatchPortFiles && len(cfg.PortCommand) > 0 {
+		problems = append(problems, fmt.Errorf("WATCH_PORT_FILES can't be used with PORT_COMMAND, there are no port files to watch"))
+	}
+	if cfg.PortFileReadTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("PORT_FILE_READ_TIMEOUT_SECONDS must not be negative, is %d", cfg.PortFileReadTimeoutSeconds))
+	}
+	if len(cfg.MinimalMode) > 0 && !slices.Contains(MinimalModes, cfg.MinimalMode) {
+		problems = append(problems, fmt.Errorf("MINIMAL_MODE must be one of %v, is '%s'", MinimalModes, cfg.MinimalMode))
+	} else if conflicts := cfg.minimalModeConflicts(); len(cfg.MinimalMode) > 0 && len(conflicts) > 0 {
+		problems = append(problems, fmt.Errorf("MINIMAL_MODE can't be used with %s, which need qBittorrent's preferences to be read or manage other preferences", strings.Join(conflicts, ", ")))
+	}
+	if len(cfg.ResumeOnChange) > 0 && !slices.Contains(ResumeOnChangeModes, cfg.ResumeOnChange) {
+		problems = append(problems, fmt.Errorf("RESUME_ON_CHANGE must be one of %v, is '%s'", ResumeOnChangeModes, cfg.ResumeOnChange))
+	}
+
+	if cfg.OnChangeCommandExtendedEnv && len(cfg.OnChangeCommand) == 0 {
+		problems = append(problems, fmt.Errorf("ON_CHANGE_COMMAND_EXTENDED_ENV is true but ON_CHANGE_COMMAND is not set"))
+	}
+	if cfg.OnChangeCommandAsync && len(cfg.OnChangeCommand) == 0 {
+		problems = append(problems, fmt.Errorf("ON_CHANGE_COMMAND_ASYNC is true but ON_CHANGE_COMMAND is not set"))
+	}
+	if cfg.OnChangeCommandQueueSize < 1 {
+		problems = append(problems, fmt.Errorf("ON_CHANGE_COMMAND_QUEUE_SIZE must be at least 1, is %d", cfg.OnChangeCommandQueueSize))
+	}
+
+	if cfg.PortCommandTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("PORT_COMMAND_TIMEOUT_SECONDS must not be negative, is %d", cfg.PortCommandTimeoutSeconds))
+	}
+	if cfg.ReadPortFromStdin() && len(cfg.PortFiles) > 1 {
+		problems = append(problems, fmt.Errorf("PORT_FILE '%s' (stdin) cannot be combined with other port files", StdinPortFile))
+	}
+	portFileExists := cfg.ReadPortFromStdin()
+	for _, portFile := range cfg.PortFiles {
+		if portFile == StdinPortFile {
+			continue
+		}
+
+		if len(strings.TrimSpace(portFile)) == 0 {
+			problems = append(problems, fmt.Errorf("PORT_FILE contains an empty path"))
+			continue
+		}
+
+		if _, err := os.Stat(portFile); err == nil {
+			portFileExists = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, fmt.Errorf("PORT_FILE '%s' cannot be accessed: %s", portFile, err))
+		}
+	}
+	if !cfg.AllowPortFileNotExist && !portFileExists && len(cfg.PortFiles) > 0 {
+		problems = append(problems, fmt.Errorf("none of the PORT_FILE paths exist and ALLOW_PORT_FILE_NOT_EXIST is false"))
+	}
+
+	if !slices.Contains(LogConfigFormats, cfg.LogConfigFormat) {
+		problems = append(problems, fmt.Errorf("LOG_CONFIG_FORMAT must be one of %v, is '%s'", LogConfigFormats, cfg.LogConfigFormat))
+	}
+
+	if !slices.Contains(PortFileFormats, cfg.PortFileFormat) {
+		problems = append(problems, fmt.Errorf("PORT_FILE_FORMAT must be one of %v, is '%s'", PortFileFormats, cfg.PortFileFormat))
+	}
+
+	if len(cfg.OutputPortFile) > 0 && slices.Contains(cfg.PortFiles, cfg.OutputPortFile) {
+		problems = append(problems, fmt.Errorf("OUTPUT_PORT_FILE '%s' must not be one of the PORT_FILE paths", cfg.OutputPortFile))
+	}
+	if len(cfg.ReadyFile) > 0 && (slices.Contains(cfg.PortFiles, cfg.ReadyFile) || cfg.ReadyFile == cfg.OutputPortFile) {
+		problems = append(problems, fmt.Errorf("READY_FILE '%s' must not be one of the PORT_FILE paths or OUTPUT_PORT_FILE", cfg.ReadyFile))
+	}
+
+	if len(cfg.ExpectedPortRange) > 0 {
+		if _, err := ParsePortRange(cfg.ExpectedPortRange); err != nil {
+			problems = append(problems, fmt.Errorf("EXPECTED_PORT_RANGE is invalid, is '%s': %s", cfg.ExpectedPortRange, err))
+		}
+	}
+
+	if _, err := ParsePortSelector(cfg.PortSelector); err != nil {
+		problems = append(problems, fmt.Errorf("PORT_SELECTOR is invalid, is '%s': %s", cfg.PortSelector, err))
+	}
+	if len(cfg.PortSelector) > 0 && cfg.PortFileFormat != PortFileFormatJSON {
+		problems = append(problems, fmt.Errorf("PORT_SELECTOR can only be used with PORT_FILE_FORMAT '%s'", PortFileFormatJSON))
+	}
+
+	if _, err := ParsePortLostPolicy(cfg.OnPortLost); err != nil {
+		problems = append(problems, fmt.Errorf("ON_PORT_LOST is invalid, is '%s': %s", cfg.OnPortLost, err))
+	}
+
+	if cfg.NoChangeLogEvery < 0 {
+		problems = append(problems, fmt.Errorf("NO_CHANGE_LOG_EVERY must be 0 or greater, is %d", cfg.NoChangeLogEvery))
+	}
+
+	if cfg.RefreshIntervalSeconds <= 0 {
+		problems = append(problems, fmt.Errorf("REFRESH_INTERVAL_SECONDS must be greater than 0, is %d", cfg.RefreshIntervalSeconds))
+	}
+	if cfg.WaitForPortFileSeconds < 0 {
+		problems = append(problems, fmt.Errorf("WAIT_FOR_PORT_FILE_SECONDS must not be negative, is %d", cfg.WaitForPortFileSeconds))
+	}
+	if cfg.SyncTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("SYNC_TIMEOUT_SECONDS must not be negative, is %d", cfg.SyncTimeoutSeconds))
+	}
+	if cfg.MaxRuntimeSeconds < 0 {
+		problems = append(problems, fmt.Errorf("MAX_RUNTIME_SECONDS must not be negative, is %d", cfg.MaxRuntimeSeconds))
+	}
+	if cfg.PortHistorySize < 0 {
+		problems = append(problems, fmt.Errorf("PORT_HISTORY_SIZE must not be negative, is %d", cfg.PortHistorySize))
+	}
+
+	// Syncs finish at most every refresh interval, so a lower threshold would always fire
+	if cfg.WatchdogThresholdSeconds < 0 {
+		problems = append(problems, fmt.Errorf("WATCHDOG_THRESHOLD_SECONDS must not be negative, is %d", cfg.WatchdogThresholdSeconds))
+	} else if cfg.WatchdogThresholdSeconds > 0 && cfg.WatchdogThresholdSeconds <= cfg.RefreshIntervalSeconds {
+		problems = append(problems, fmt.Errorf("WATCHDOG_THRESHOLD_SECONDS must be greater than REFRESH_INTERVAL_SECONDS (%d), is %d", cfg.RefreshIntervalSeconds, cfg.WatchdogThresholdSeconds))
+	}
+	if cfg.WatchdogExit && cfg.WatchdogThresholdSeconds == 0 {
+		problems = append(problems, fmt.Errorf("WATCHDOG_EXIT is true but WATCHDOG_THRESHOLD_SECONDS is 0, which disables the watchdog"))
+	}
+
+	if cfg.ShutdownGracePeriodSeconds < 0 {
+		problems = append(problems, fmt.Errorf("SHUTDOWN_GRACE_PERIOD_SECONDS must not be negative, is %d", cfg.ShutdownGracePeriodSeconds))
+	}
+	if cfg.LogoutTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("LOGOUT_TIMEOUT_SECONDS must not be negative, is %d", cfg.LogoutTimeoutSeconds))
+	}
+
+	if cfg.ShutdownCleanupTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("SHUTDOWN_CLEANUP_TIMEOUT_SECONDS must not be negative, is %d", cfg.ShutdownCleanupTimeoutSeconds))
+	}
+	if _, err := ParseExitCodes(cfg.ExitCodes); err != nil {
+		problems = append(problems, fmt.Errorf("EXIT_CODES is invalid, is '%s': %s", cfg.ExitCodes, err))
+	}
+
+	if cfg.VerifyAttempts < 1 {
+		problems = append(problems, fmt.Errorf("VERIFY_ATTEMPTS must be at least 1, is %d", cfg.VerifyAttempts))
+	}
+	if cfg.VerifyDelayMilliseconds < 0 {
+		problems = append(problems, fmt.Errorf("VERIFY_DELAY_MILLISECONDS must not be negative, is %d", cfg.VerifyDelayMilliseconds))
+	}
+	if cfg.VerifyReachableWithinSeconds < 0 {
+		problems = append(problems, fmt.Errorf("VERIFY_REACHABLE_WITHIN_SECONDS must not be negative, is %d", cfg.VerifyReachableWithinSeconds))
+	}
+
+	if cfg.LockTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("LOCK_TIMEOUT_SECONDS must not be negative, is %d", cfg.LockTimeoutSeconds))
+	}
+	if cfg.LockStaleSeconds < 0 {
+		problems = append(problems, fmt.Errorf("LOCK_STALE_SECONDS must not be negative, is %d", cfg.LockStaleSeconds))
+	}
+
+	if cfg.CircuitBreakerThreshold < 0 {
+		problems = append(problems, fmt.Errorf("CIRCUIT_BREAKER_THRESHOLD must not be negative, is %d", cfg.CircuitBreakerThreshold))
+	}
+	if cfg.CircuitBreakerThreshold > 0 && cfg.CircuitBreakerCooldownSeconds <= 0 {
+		problems = append(problems, fmt.Errorf("CIRCUIT_BREAKER_COOLDOWN_SECONDS must be greater than 0, is %d", cfg.CircuitBreakerCooldownSeconds))
+	}
+
+	if cfg.DNSFallbackGracePeriodSeconds < 0 {
+		problems = append(problems, fmt.Errorf("DNS_FALLBACK_GRACE_PERIOD_SECONDS must not be negative, is %d", cfg.DNSFallbackGracePeriodSeconds))
+	}
+
+	if cfg.DialTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("DIAL_TIMEOUT_SECONDS must not be negative, is %d", cfg.DialTimeoutSeconds))
+	}
+	if cfg.DialKeepAliveSeconds < 0 {
+		problems = append(problems, fmt.Errorf("DIAL_KEEPALIVE_SECONDS must not be negative, is %d", cfg.DialKeepAliveSeconds))
+	}
+
+	if cfg.SlowRequestThresholdMilliseconds < 0 {
+		problems = append(problems, fmt.Errorf("SLOW_REQUEST_THRESHOLD_MS must not be negative, is %d", cfg.SlowRequestThresholdMilliseconds))
+	}
+
+	if cfg.SessionRefreshMarginSeconds < 0 {
+		problems = append(problems, fmt.Errorf("SESSION_REFRESH_MARGIN_SECONDS must not be negative, is %d", cfg.SessionRefreshMarginSeconds))
+	}
+
+	if cfg.PortFileMissingGracePeriodSeconds < 0 {
+		problems = append(problems, fmt.Errorf("PORT_FILE_MISSING_GRACE_PERIOD_SECONDS must not be negative, is %d", cfg.PortFileMissingGracePeriodSeconds))
+	}
+
+	if cfg.APICallBudget < 0 {
+		problems = append(problems, fmt.Errorf("API_CALL_BUDGET must not be negative, is %d", cfg.APICallBudget))
+	}
+
+	if cfg.ReadinessTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("READINESS_TIMEOUT_SECONDS must not be negative, is %d", cfg.ReadinessTimeoutSeconds))
+	}
+
+	// The URL is not included in problems since it may contain credentials
+	if len(cfg.PushgatewayURL) > 0 {
+		if pushgatewayURL, err := url.Parse(cfg.PushgatewayURL); err != nil || (pushgatewayURL.Scheme != "http" && pushgatewayURL.Scheme != "https") || len(pushgatewayURL.Host) == 0 {
+			problems = append(problems, fmt.Errorf("PUSHGATEWAY_URL must be an http or https URL"))
+		}
+		if len(cfg.PushgatewayJob) == 0 {
+			problems = append(problems, fmt.Errorf("PUSHGATEWAY_JOB must be set if PUSHGATEWAY_URL is set"))
+		}
+	}
+
+	if cfg.PortFileStaleThresholdSeconds < 0 {
+		problems = append(problems, fmt.Errorf("PORT_FILE_STALE_THRESHOLD_SECONDS must not be negative, is %d", cfg.PortFileStaleThresholdSeconds))
+	}
+
+	if cfg.SetPreferencesAttempts < 1 {
+		problems = append(problems, fmt.Errorf("SET_PREFERENCES_ATTEMPTS must be at least 1, is %d", cfg.SetPreferencesAttempts))
+	}
+	if cfg.SetPreferencesBackoffSeconds < 0 {
+		problems = append(problems, fmt.Errorf("SET_PREFERENCES_BACKOFF_SECONDS must not be negative, is %d", cfg.SetPreferencesBackoffSeconds))
+	}
+
+	if cfg.UnavailableRetries < 0 {
+		problems = append(problems, fmt.Errorf("UNAVAILABLE_RETRIES must not be negative, is %d", cfg.UnavailableRetries))
+	}
+	if cfg.UnavailableBackoffSeconds < 0 {
+		problems = append(problems, fmt.Errorf("UNAVAILABLE_BACKOFF_SECONDS must not be negative, is %d", cfg.UnavailableBackoffSeconds))
+	}
+
+	if !slices.Contains(BackoffStrategies, cfg.BackoffStrategy) {
+		problems = append(problems, fmt.Errorf("BACKOFF_STRATEGY must be one of %v, is '%s'", BackoffStrategies, cfg.BackoffStrategy))
+	}
+
+	if cfg.BackoffMaxSeconds < 0 {
+		problems = append(problems, fmt.Errorf("BACKOFF_MAX_SECONDS must not be negative, is %d", cfg.BackoffMaxSeconds))
+	}
+
+	if cfg.MaxConnections != nil && *cfg.MaxConnections != -1 && *cfg.MaxConnections <= 0 {
+		problems = append(problems, fmt.Errorf("MAX_CONNECTIONS must be -1 or greater than 0, is %d", *cfg.MaxConnections))
+	}
+	if cfg.MaxConnectionsPerTorrent != nil && *cfg.MaxConnectionsPerTorrent != -1 && *cfg.MaxConnectionsPerTorrent <= 0 {
+		problems = append(problems, fmt.Errorf("MAX_CONNECTIONS_PER_TORRENT must be -1 or greater than 0, is %d", *cfg.MaxConnectionsPerTorrent))
+	}
+
+	if baseURL, err := ParseNetworkLocation(cfg.QBittorrentAPINetloc); err != nil {
+		problems = append(problems, fmt.Errorf("QBITTORRENT_API_NETLOC is not valid: %s", err))
+	} else if cfg.RequireHTTPS && baseURL.Scheme != "https" {
+		problems = append(problems, fmt.Errorf("QBITTORRENT_API_NETLOC must use https because REQUIRE_HTTPS is true, it uses %s", baseURL.Scheme))
+	}
+
+	for _, netloc := range cfg.ExtraQBittorrentAPINetlocs {
+		if baseURL, err := ParseNetworkLocation(netloc); err != nil {
+			problems = append(problems, fmt.Errorf("EXTRA_QBITTORRENT_API_NETLOCS contains '%s' which is not valid: %s", cfg.logNetloc(netloc), err))
+		} else if cfg.RequireHTTPS && baseURL.Scheme != "https" {
+			problems = append(problems, fmt.Errorf("EXTRA_QBITTORRENT_API_NETLOCS must use https because REQUIRE_HTTPS is true, '%s' uses %s", cfg.logNetloc(netloc), baseURL.Scheme))
+		}
+	}
+	if !slices.Contains(MultiInstanceFailurePolicies, cfg.MultiInstanceFailurePolicy) {
+		problems = append(problems, fmt.Errorf("MULTI_INSTANCE_FAILURE_POLICY must be one of %v, is '%s'", MultiInstanceFailurePolicies, cfg.MultiInstanceFailurePolicy))
+	}
+
+	if _, err := cfg.ParseApplyWindow(); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.PinRandomPortRange && cfg.DisableRandomPort {
+		problems = append(problems, fmt.Errorf("PIN_RANDOM_PORT_RANGE and DISABLE_RANDOM_PORT can't both be true"))
+	}
+
+	// qBittorrent treats an empty interface as any interface, which is the opposite of binding to the VPN
+	if cfg.NetworkInterface != nil && len(strings.TrimSpace(*cfg.NetworkInterface)) == 0 {
+		problems = append(problems, fmt.Errorf("NETWORK_INTERFACE must not be empty when set, unset it to leave qBittorrent's network interface untouched"))
+	}
+
+	if len(cfg.ListenAddressFamily) > 0 {
+		if _, ok := ListenAddressFamilies[cfg.ListenAddressFamily]; !ok {
+			problems = append(problems, fmt.Errorf("LISTEN_ADDRESS_FAMILY must be one of 'all', 'ipv4', or 'ipv6', is '%s'", cfg.ListenAddressFamily))
+		}
+		if cfg.InterfaceAddress != nil {
+			problems = append(problems, fmt.Errorf("LISTEN_ADDRESS_FAMILY and INTERFACE_ADDRESS can't both be set"))
+		}
+	}
+
+	if _, err := cfg.Notifiers(); err != nil {
+		problems = append(problems, err)
+	}
+	if cfg.NotifyThrottleSeconds < 0 {
+		problems = append(problems, fmt.Errorf("NOTIFY_THROTTLE_SECONDS must not be negative, is %d", cfg.NotifyThrottleSeconds))
+	}
+
+	if cfg.MaxResponseBodyBytes <= 0 {
+		problems = append(problems, fmt.Errorf("MAX_RESPONSE_BODY_BYTES must be greater than 0, is %d", cfg.MaxResponseBodyBytes))
+	}
+
+	if err := cfg.SetPreferencesRequest().Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("SET_PREFERENCES_METHOD, SET_PREFERENCES_PATH, or SET_PREFERENCES_ENCODING is invalid: %s", err))
+	}
+	if len(cfg.NetworkPreferencesPath) > 0 && !strings.HasPrefix(cfg.NetworkPreferencesPath, "/") {
+		problems = append(problems, fmt.Errorf("NETWORK_PREFERENCES_PATH must start with '/', is '%s'", cfg.NetworkPreferencesPath))
+	}
+	if _, err := ParseAPIPathPrefix(cfg.APIPathPrefix); err != nil {
+		problems = append(problems, fmt.Errorf("API_PATH_PREFIX is invalid: %s", err))
+	}
+	if !slices.Contains(FormEncodings, cfg.FormEncoding) {
+		problems = append(problems, fmt.Errorf("FORM_ENCODING must be one of %v, is '%s'", FormEncodings, cfg.FormEncoding))
+	}
+	if cfg.PostLoginDelayMilliseconds < 0 {
+		problems = append(problems, fmt.Errorf("POST_LOGIN_DELAY_MILLISECONDS must not be negative, is %d", cfg.PostLoginDelayMilliseconds))
+	}
+
+	if requestHeaders, err := ParseRequestHeaders(cfg.RequestHeaders); err != nil {
+		problems = append(problems, fmt.Errorf("REQUEST_HEADERS is invalid: %s", err))
+	} else if len(requestHeaders.Values("Host")) > 0 {
+		problems = append(problems, fmt.Errorf("REQUEST_HEADERS can't set the Host header, use HOST_HEADER instead"))
+	}
+	if strings.ContainsAny(cfg.HostHeader, " \t/") {
+		problems = append(problems, fmt.Errorf("HOST_HEADER must be a host, optionally with a port, is '%s'", cfg.HostHeader))
+	}
+
+	if (len(cfg.ClientCertFile) > 0) != (len(cfg.ClientKeyFile) > 0) {
+		problems = append(problems, fmt.Errorf("CLIENT_CERT_FILE and CLIENT_KEY_FILE must be set together"))
+	} else if len(cfg.ClientCertFile) > 0 {
+		if _, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile); err != nil {
+			problems = append(problems, fmt.Errorf("CLIENT_CERT_FILE '%s' and CLIENT_KEY_FILE '%s' could not be loaded: %s", cfg.ClientCertFile, cfg.ClientKeyFile, err))
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// LogEffective outputs the configuration in the log config format, secrets are redacted
+func (cfg Config) LogEffective(logger golog.Logger) {
+	if cfg.LogConfigFormat != LogConfigFormatJSON {
+		cfg.Log(logger)
+		return
+	}
+
+	cfgJSON, err := cfg.EffectiveJSON()
+	if err != nil {
+		logger.Warnf("failed to encode configuration as JSON, logging it as text: %s", err)
+		cfg.Log(logger)
+		return
+	}
+
+	logger.Infof("effective configuration: %s", cfgJSON)
+}
+
+// EffectiveJSON encodes every configuration field as a JSON object keyed by env var name, without the prefix, in the order the fields are declared.
+// Fields tagged secret:"true", and fields whose value is read from a file with the env "file" option, are redacted.
+// QBittorrentAPINetloc and ExtraQBittorrentAPINetlocs are encoded as they are logged, without credentials and with the host masked if MaskHostInLogs is set.
+func (cfg Config) EffectiveJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+
+	value := reflect.ValueOf(cfg)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		tag, ok := field.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		var fieldValue interface{} = value.Field(i).Interface()
+		if field.Tag.Get("secret") == "true" || slices.Contains(strings.Split(options, ","), "file") {
+			fieldValue = redactValue(value.Field(i))
+		}
+		if field.Name == "QBittorrentAPINetloc" {
+			fieldValue = cfg.logNetloc(cfg.QBittorrentAPINetloc)
+		}
+		if field.Name == "ExtraQBittorrentAPINetlocs" {
+			fieldValue = cfg.logExtraNetlocs()
+		}
+
+		fieldJSON, err := json.Marshal(fieldValue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %s", name, err)
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, "%q:%s", name, fieldJSON)
+	}
+
+	buf.WriteString("}")
+
+	return buf.Bytes(), nil
+}
+
+// logNetloc returns the network location netloc as it can be logged, without credentials and with the host masked if MaskHostInLogs is set
+func (cfg Config) logNetloc(netloc string) string {
+	// An invalid network location is not logged at all, it may contain credentials which could not be found to be removed
+	baseURL, err := ParseNetworkLocation(netloc)
+	if err != nil {
+		return "<invalid>"
+	}
+
+	return LogURL(*baseURL, cfg.MaskHostInLogs)
+}
+
+// logExtraNetlocs returns ExtraQBittorrentAPINetlocs as they can be logged, see logNetloc
+func (cfg Config) logExtraNetlocs() []string {
+	netlocs := []string{}
+	for _, netloc := range cfg.ExtraQBittorrentAPINetlocs {
+		netlocs = append(netlocs, cfg.logNetloc(netloc))
+	}
+
+	return netlocs
+}
+
+// Log outputs the configuration, secrets are redacted
+func (cfg Config) Log(logger golog.Logger) {
+	logger.Infof("  Verbose                  : %t", cfg.Verbose)
+	logger.Infof("  Env File                 : %s", cfg.EnvFile)
+	logger.Infof("  Port Files               : %s", strings.Join(cfg.PortFiles, ", "))
+	logger.Infof("  Port File Read Timeout   : %ds", cfg.PortFileReadTimeoutSeconds)
+	if len(cfg.PortCommand) > 0 {
+		logger.Infof("  Port Command             : %s", cfg.PortCommand)
+		logger.Infof("  Port Command Timeout     : %ds", cfg.PortCommandTimeoutSeconds)
+	}
+	logger.Infof("  Port File Format         : %s", cfg.PortFileFormat)
+	logger.Infof("  Output Port File         : %s", cfg.OutputPortFile)
+	logger.Infof("  Ready File               : %s", cfg.ReadyFile)
+	logger.Infof("  Treat Zero As Unavailable: %t", cfg.TreatZeroAsUnavailable)
+	logger.Infof("  Expected Port Range      : %s", cfg.ExpectedPortRange)
+	logger.Infof("  Port Selector            : %s", cfg.PortSelector)
+	logger.Infof("  On Port Lost             : %s", cfg.OnPortLost)
+	logger.Infof("  Port File Stale Threshold: %ds", cfg.PortFileStaleThresholdSeconds)
+	logger.Infof("  Allow Port File Not Exist: %t", cfg.AllowPortFileNotExist)
+	logger.Infof("  Missing Port Grace Period: %ds", cfg.PortFileMissingGracePeriodSeconds)
+	logger.Infof("  Instance Name            : %s", cfg.InstanceName)
+	logger.Infof("  Refresh Interval         : %ds", cfg.RefreshIntervalSeconds)
+	logger.Infof("  No Change Log Every      : %d", cfg.NoChangeLogEvery)
+	logger.Infof("  Disable Random Port      : %t", cfg.DisableRandomPort)
+	logger.Infof("  Skip If Random Port      : %t", cfg.SkipIfRandomPort)
+	logger.Infof("  Skip If Port Unset       : %t", cfg.SkipIfListenPortUnset)
+	logger.Infof("  Compare And Swap         : %t", cfg.CompareAndSwap)
+	logger.Infof("  Minimal Mode             : %s", cfg.MinimalMode)
+	logger.Infof("  Reannounce On Change     : %t", cfg.ReannounceOnChange)
+	logger.Infof("  Resume On Change         : %s", cfg.ResumeOnChange)
+	if len(cfg.OnChangeCommand) > 0 {
+		logger.Infof("  On Change Command        : %s", cfg.OnChangeCommand)
+		logger.Infof("  On Change Extended Env   : %t", cfg.OnChangeCommandExtendedEnv)
+		logger.Infof("  On Change Async          : %t", cfg.OnChangeCommandAsync)
+		logger.Infof("  On Change Queue Size     : %d", cfg.OnChangeCommandQueueSize)
+	}
+	logger.Infof("  API Call Budget          : %d", cfg.APICallBudget)
+	logger.Infof("  Pin Random Port Range    : %t", cfg.PinRandomPortRange)
+	logger.Infof("  Set Announce Port        : %t", cfg.SetAnnouncePort)
+	logger.Infof("  UPnP                     : %s", formatOptional(cfg.UPnP))
+	logger.Infof("  Max Connections          : %s", formatOptional(cfg.MaxConnections))
+	logger.Infof("  Max Connections / Torrent: %s", formatOptional(cfg.MaxConnectionsPerTorrent))
+	logger.Infof("  Network Interface        : %s", formatOptional(cfg.NetworkInterface))
+	logger.Infof("  Interface Address        : %s", formatOptional(cfg.InterfaceAddress))
+	logger.Infof("  Listen Address Family    : %s", cfg.ListenAddressFamily)
+	logger.Infof("  Apply Window             : %s", cfg.ApplyWindow)
+	logger.Infof("  Apply Window Timezone    : %s", cfg.ApplyWindowTimezone)
+	logger.Infof("  Apply Only When Active   : %t", cfg.ApplyOnlyWhenActive)
+	logger.Infof("  Force Set                : %t", cfg.ForceSet)
+	logger.Infof("  Set Preferences Attempts : %d", cfg.SetPreferencesAttempts)
+	logger.Infof("  Set Preferences Backoff  : %ds", cfg.SetPreferencesBackoffSeconds)
+	logger.Infof("  Unavailable Retries      : %d", cfg.UnavailableRetries)
+	logger.Infof("  Unavailable Backoff      : %ds", cfg.UnavailableBackoffSeconds)
+	logger.Infof("  Backoff Strategy         : %s", cfg.BackoffStrategy)
+	logger.Infof("  Backoff Max              : %ds", cfg.BackoffMaxSeconds)
+	logger.Infof("  Verify Changes           : %t", cfg.VerifyChanges)
+	logger.Infof("  Verify Attempts          : %d", cfg.VerifyAttempts)
+	logger.Infof("  Verify Delay             : %dms", cfg.VerifyDelayMilliseconds)
+	logger.Infof("  Verify Reachable Within  : %ds", cfg.VerifyReachableWithinSeconds)
+	logger.Infof("  Rollback On Verify Fail  : %t", cfg.RollbackOnVerifyFailure)
+	logger.Infof("  Lock File                : %s", cfg.LockFile)
+	if len(cfg.LockFile) > 0 {
+		logger.Infof("  Lock Timeout             : %ds", cfg.LockTimeoutSeconds)
+		logger.Infof("  Lock Stale               : %ds", cfg.LockStaleSeconds)
+	}
+	logger.Infof("  Circuit Breaker Threshold: %d", cfg.CircuitBreakerThreshold)
+	if cfg.CircuitBreakerThreshold > 0 {
+		logger.Infof("  Circuit Breaker Cooldown : %ds", cfg.CircuitBreakerCooldownSeconds)
+	}
+	logger.Infof("  Preserve Scheduler       : %t", cfg.PreserveScheduler)
+	logger.Infof("  Skip Initial Sync        : %t", cfg.SkipInitialSync)
+	logger.Infof("  Wait For Port File       : %ds", cfg.WaitForPortFileSeconds)
+	logger.Infof("  Watch Port Files         : %t", cfg.WatchPortFiles)
+	logger.Infof("  Sync Timeout             : %ds", cfg.SyncTimeoutSeconds)
+	logger.Infof("  Shutdown Grace Period    : %ds", cfg.ShutdownGracePeriodSeconds)
+	logger.Infof("  Max Runtime              : %ds", cfg.MaxRuntimeSeconds)
+	logger.Infof("  Watchdog Threshold       : %ds", cfg.WatchdogThresholdSeconds)
+	logger.Infof("  Watchdog Exit            : %t", cfg.WatchdogExit)
+	if notifiers, err := cfg.Notifiers(); err == nil {
+		logger.Infof("  Notifiers                : %s", notifiers.Name())
+	}
+	logger.Infof("  Notify Throttle          : %ds", cfg.NotifyThrottleSeconds)
+	logger.Infof("  Report On Exit           : %t", cfg.ReportOnExit)
+	logger.Infof("  Logout On Exit           : %t", cfg.LogoutOnExit)
+	if cfg.LogoutOnExit {
+		logger.Infof("  Logout Timeout           : %ds", cfg.LogoutTimeoutSeconds)
+		logger.Infof("  Logout Skip If Failed    : %t", cfg.LogoutSkipIfLastSyncFailed)
+	}
+	logger.Infof("  Shutdown Cleanup Timeout : %ds", cfg.ShutdownCleanupTimeoutSeconds)
+	logger.Infof("  Exit Codes               : %s", cfg.ExitCodes)
+	logger.Infof("  Check Reachability       : %t", cfg.CheckReachability)
+	logger.Infof("  HTTP Server Address      : %s", cfg.HTTPServerAddress)
+	logger.Infof("  HTTP Server Token        : %s", redact(cfg.HTTPServerToken))
+	logger.Infof("  Port History Size        : %d", cfg.PortHistorySize)
+	logger.Infof("  Pushgateway URL          : %s", redact(cfg.PushgatewayURL))
+	logger.Infof("  Pushgateway Job          : %s", cfg.PushgatewayJob)
+	logger.Infof("  Pushgateway Instance     : %s", cfg.PushgatewayInstance)
+	logger.Infof("  HTTP Server Required     : %t", cfg.HTTPServerRequired)
+	logger.Infof("  qBittorrent API          : %s", cfg.logNetloc(cfg.QBittorrentAPINetloc))
+	logger.Infof("  Extra qBittorrent APIs   : %s", strings.Join(cfg.logExtraNetlocs(), ", "))
+	logger.Infof("  Multi-Instance Policy    : %s", cfg.MultiInstanceFailurePolicy)
+	logger.Infof("  qBittorrent Username     : %s", cfg.QBittorrentUsername)
+
+	logger.Infof("  qBittorrent Password     : %s", redact(cfg.QBittorrentPassword))
+	logger.Infof("  Auth File                : %s", cfg.AuthFile)
+	logger.Infof("  Use Keyring              : %t", cfg.UseKeyring)
+	if cfg.UseKeyring {
+		logger.Infof("  Keyring Service          : %s", cfg.KeyringService)
+		logger.Infof("  Keyring Account          : %s", cfg.KeyringAccount)
+	}
+	logger.Infof("  Skip Login               : %t", cfg.SkipLogin)
+	logger.Infof("  qBittorrent Session ID   : %s", redact(cfg.QBittorrentSessionID))
+	logger.Infof("  Client Cert File         : %s", cfg.ClientCertFile)
+	logger.Infof("  Client Key File          : %s", cfg.ClientKeyFile)
+	logger.Infof("  Require HTTPS            : %t", cfg.RequireHTTPS)
+	logger.Infof("  Mask Host In Logs        : %t", cfg.MaskHostInLogs)
+	logger.Infof("  Max Response Body Bytes  : %d", cfg.MaxResponseBodyBytes)
+	logger.Infof("  API Path Prefix          : %s", cfg.APIPathPrefix)
+	logger.Infof("  Set Preferences Request  : %s %s (%s)", cfg.SetPreferencesMethod, cfg.SetPreferencesPath, cfg.SetPreferencesEncoding)
+	logger.Infof("  Network Preferences Path : %s", cfg.NetworkPreferencesPath)
+	logger.Infof("  Form Encoding            : %s", cfg.FormEncoding)
+	logger.Infof("  Post Login Delay         : %dms", cfg.PostLoginDelayMilliseconds)
+	if requestHeaders, err := ParseRequestHeaders(cfg.RequestHeaders); err == nil {
+		names := []string{}
+		for name := range requestHeaders {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		logger.Infof("  Request Headers          : %s", strings.Join(names, ", "))
+	}
+	logger.Infof("  Host Header              : %s", cfg.HostHeader)
+	logger.Infof("  DNS Fallback Grace Period: %ds", cfg.DNSFallbackGracePeriodSeconds)
+	logger.Infof("  Dial Timeout             : %ds", cfg.DialTimeoutSeconds)
+	logger.Infof("  Dial Keep-Alive          : %ds", cfg.DialKeepAliveSeconds)
+	logger.Infof("  Session Refresh Margin   : %ds", cfg.SessionRefreshMarginSeconds)
+	logger.Infof("  Slow Request Threshold   : %dms", cfg.SlowRequestThresholdMilliseconds)
+	logger.Infof("  Readiness Timeout        : %ds", cfg.ReadinessTimeoutSeconds)
+	logger.Infof("  Proceed If Not Ready     : %t", cfg.ProceedIfNotReady)
+	logger.Infof("  Check Prefs On Startup   : %t", cfg.CheckPreferencesOnStartup)
+}
+
+// DialKeepAlive is the keep-alive interval of connections to qBittorrent, as expected by NewQBittorrentClientOptions.DialKeepAlive
+func (cfg Config) DialKeepAlive() time.Duration {
+	if cfg.DialKeepAliveSeconds == 0 {
+		return -1
+	}
+
+	return time.Duration(cfg.DialKeepAliveSeconds) * time.Second
+}
+
+// MaxRuntime is how long the sync loop runs before the tool exits, as expected by RunSyncLoopOptions.MaxRuntime
+func (cfg Config) MaxRuntime() time.Duration {
+	return time.Duration(cfg.MaxRuntimeSeconds) * time.Second
+}
+
+// redactValue hides a secret configuration field's value for output, indicating only if it is empty
+func redactValue(value reflect.Value) string {
+	if value.IsZero() || (value.Kind() == reflect.Slice && value.Len() == 0) {
+		return redact("")
+	}
+
+	return redact(fmt.Sprint(value.Interface()))
+}
+
+// redact hides a secret value for output, indicating only if it is empty
+func redact(secret string) string {
+	if len(secret) == 0 {
+		return "<EMPTY>"
+	}
+
+	return "<READACTED>"
+}
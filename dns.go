@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// DialContextFunc dials a network address, like net.Dialer.DialContext
+type DialContextFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// resolvedAddress is an IP a host resolved to
+type resolvedAddress struct {
+	// ip the host resolved to
+	ip string
+
+	// resolvedAt is when the host last resolved to ip
+	resolvedAt time.Time
+}
+
+// DNSFallbackDialer dials addresses and remembers the IP each host was last reached at.
+// If a host fails to resolve, for example because of container DNS churn, the remembered IP is dialed instead for up to gracePeriod after it was last resolved.
+type DNSFallbackDialer struct {
+	// logger is used to output information
+	logger golog.Logger
+
+	// dial makes connections, it resolves hosts itself
+	dial DialContextFunc
+
+	// gracePeriod is how long after a host was last resolved its IP may be used when resolving it fails
+	gracePeriod time.Duration
+
+	// lock guards resolved
+	lock sync.Mutex
+
+	// resolved is the address each host was last reached at, keyed by host
+	resolved map[string]resolvedAddress
+}
+
+// NewDNSFallbackDialer creates a DNSFallbackDialer which makes connections with dial
+func NewDNSFallbackDialer(logger golog.Logger, dial DialContextFunc, gracePeriod time.Duration) *DNSFallbackDialer {
+	return &DNSFallbackDialer{
+		logger:      logger,
+		dial:        dial,
+		gracePeriod: gracePeriod,
+		resolved:    map[string]resolvedAddress{},
+	}
+}
+
+// DialContext dials address. If its host fails to resolve and was reached within the grace period the IP it was reached at is dialed instead.
+func (dialer *DNSFallbackDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.dial(ctx, network, address)
+	}
+
+	conn, err := dialer.dial(ctx, network, address)
+	if err == nil {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			dialer.lock.Lock()
+			dialer.resolved[host] = resolvedAddress{ip: tcpAddr.IP.String(), resolvedAt: time.Now()}
+			dialer.lock.Unlock()
+		}
+
+		return conn, nil
+	}
+
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return nil, err
+	}
+
+	dialer.lock.Lock()
+	cached, ok := dialer.resolved[host]
+	dialer.lock.Unlock()
+
+	age := time.Since(cached.resolvedAt)
+	if !ok || age > dialer.gracePeriod {
+		return nil, err
+	}
+
+	dialer.logger.Warnf("failed to resolve '%s', using the cached address %s it resolved to %s ago: %s", host, cached.ip, age.Round(time.Second), dnsErr)
+
+	return dialer.dial(ctx, network, net.JoinHostPort(cached.ip, port))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// fakeResolvingDial returns a dial function which resolves host to 127.0.0.1, or fails to resolve it while *dnsDown is true
+func fakeResolvingDial(host string, dnsDown *bool) DialContextFunc {
+	var netDialer net.Dialer
+
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		addressHost, port, _ := net.SplitHostPort(address)
+		if addressHost == host {
+			if *dnsDown {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}}
+			}
+			address = net.JoinHostPort("127.0.0.1", port)
+		}
+
+		return netDialer.DialContext(ctx, network, address)
+	}
+}
+
+func TestDNSFallbackDialer(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod time.Duration
+
+		// wait is how long after resolving DNS fails
+		wait    time.Duration
+		wantErr bool
+	}{
+		{name: "within grace period", gracePeriod: time.Minute},
+		{name: "grace period elapsed", gracePeriod: 10 * time.Millisecond, wait: 50 * time.Millisecond, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			address := net.JoinHostPort("qbittorrent.test", port)
+
+			var warnLog bytes.Buffer
+			dnsDown := false
+			dialer := NewDNSFallbackDialer(golog.NewWriterLogger("test", io.Discard, io.Discard, &warnLog, io.Discard, io.Discard), fakeResolvingDial("qbittorrent.test", &dnsDown), test.gracePeriod)
+
+			conn, err := dialer.DialContext(context.Background(), "tcp", address)
+			if err != nil {
+				t.Fatalf("failed to dial while DNS works: %s", err)
+			}
+			conn.Close()
+
+			dnsDown = true
+			time.Sleep(test.wait)
+
+			conn, err = dialer.DialContext(context.Background(), "tcp", address)
+			if test.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dialed the cached address after the grace period elapsed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to dial while DNS is down: %s", err)
+			}
+			defer conn.Close()
+
+			if remote := conn.RemoteAddr().String(); remote != server.Listener.Addr().String() {
+				t.Errorf("dialed %s, expected the cached address %s", remote, server.Listener.Addr())
+			}
+			if !strings.Contains(warnLog.String(), "using the cached address 127.0.0.1") {
+				t.Errorf("did not warn that the cached address is in use: %s", warnLog.String())
+			}
+		})
+	}
+}
+
+func TestDNSFallbackDialerNeverResolved(t *testing.T) {
+	dnsDown := true
+	dialer := NewDNSFallbackDialer(golog.NewLogger("test"), fakeResolvingDial("qbittorrent.test", &dnsDown), time.Minute)
+
+	if conn, err := dialer.DialContext(context.Background(), "tcp", "qbittorrent.test:8080"); err == nil {
+		conn.Close()
+		t.Errorf("dialed a host which never resolved")
+	}
+}
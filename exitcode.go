@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// FailureClass groups the errors the tool can exit with, so supervisors can react to each differently
+type FailureClass string
+
+const (
+	// FailureClassAuth is qBittorrent, or an authentication proxy in front of it, not accepting the tool's credentials
+	FailureClassAuth FailureClass = "auth"
+
+	// FailureClassNetwork is qBittorrent not being reachable over the network
+	FailureClassNetwork FailureClass = "network"
+
+	// FailureClassConfig is the configuration being invalid
+	FailureClassConfig FailureClass = "config"
+
+	// FailureClassPortParse is a port source containing something which is not a valid port
+	FailureClassPortParse FailureClass = "port-parse"
+
+	// FailureClassPortFilePermission is a port file existing but the tool not being permitted to read it
+	FailureClassPortFilePermission FailureClass = "port-file-permission"
+
+	// FailureClassOther is any other failure
+	FailureClassOther FailureClass = "other"
+)
+
+// FailureClasses are the failure classes exit codes can be configured for
+var FailureClasses = []FailureClass{FailureClassAuth, FailureClassNetwork, FailureClassConfig, FailureClassPortParse, FailureClassPortFilePermission, FailureClassOther}
+
+// DefaultExitCode is the exit code of failures without a configured exit code
+const DefaultExitCode = 1
+
+// ErrInvalidConfig indicates the configuration is invalid
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// ClassifyFailure determines the failure class of err
+func ClassifyFailure(err error) FailureClass {
+	var loginErr QBittorrentLoginNotAuthorizedError
+	var parseErr PortFileParseError
+	var permissionErr PortFilePermissionError
+	var urlErr *url.Error
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, ErrInvalidConfig):
+		return FailureClassConfig
+	case errors.As(err, &loginErr), errors.Is(err, ErrForbiddenAfterLogin), errors.Is(err, ErrSessionIDRejected), errors.Is(err, ErrNoSessionCookie), errors.Is(err, ErrAuthProxyRedirect), errors.Is(err, ErrAuthProxyChallenge):
+		return FailureClassAuth
+	case errors.As(err, &parseErr):
+		return FailureClassPortParse
+	case errors.As(err, &permissionErr):
+		return FailureClassPortFilePermission
+	case errors.As(err, &urlErr), errors.As(err, &netErr):
+		return FailureClassNetwork
+	default:
+		return FailureClassOther
+	}
+}
+
+// ExitCodes maps failure classes to the exit code the tool exits with when it fails because of them
+type ExitCodes map[FailureClass]int
+
+// ParseExitCodes parses exit codes in the format "<class>=<code>,...", classes must be FailureClasses and codes 1 to 255
+func ParseExitCodes(value string) (ExitCodes, error) {
+	exitCodes := ExitCodes{}
+
+	for _, mapping := range strings.Split(value, ",") {
+		mapping = strings.TrimSpace(mapping)
+		if len(mapping) == 0 {
+			continue
+		}
+
+		class, codeValue, found := strings.Cut(mapping, "=")
+		if !found {
+			return nil, fmt.Errorf("'%s' must be in the format '<class>=<code>'", mapping)
+		}
+
+		failureClass := FailureClass(strings.TrimSpace(class))
+		if !isFailureClass(failureClass) {
+			return nil, fmt.Errorf("'%s' is not one of %v", failureClass, FailureClasses)
+		}
+
+		code, err := strconv.Atoi(strings.TrimSpace(codeValue))
+		if err != nil || code < 1 || code > 255 {
+			return nil, fmt.Errorf("exit code for %s must be a number from 1 to 255, is '%s'", failureClass, strings.TrimSpace(codeValue))
+		}
+
+		exitCodes[failureClass] = code
+	}
+
+	return exitCodes, nil
+}
+
+// For returns the exit code for err, DefaultExitCode if none is configured for its failure class
+func (exitCodes ExitCodes) For(err error) int {
+	if code, ok := exitCodes[ClassifyFailure(err)]; ok {
+		return code
+	}
+
+	return DefaultExitCode
+}
+
+// Fatal logs err and exits with its exit code
+func (exitCodes ExitCodes) Fatal(logger golog.Logger, err error) {
+	logger.Error(err.Error())
+	os.Exit(exitCodes.For(err))
+}
+
+// isFailureClass determines if class is one of FailureClasses
+func isFailureClass(class FailureClass) bool {
+	for _, failureClass := range FailureClasses {
+		if class == failureClass {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestParseExitCodes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    ExitCodes
+		wantErr bool
+	}{
+		{value: "", want: ExitCodes{}},
+		{value: "auth=10, network=11", want: ExitCodes{FailureClassAuth: 10, FailureClassNetwork: 11}},
+		{value: "port-parse=13,", want: ExitCodes{FailureClassPortParse: 13}},
+		{value: "auth", wantErr: true},
+		{value: "unknown=10", wantErr: true},
+		{value: "auth=0", wantErr: true},
+		{value: "auth=256", wantErr: true},
+		{value: "auth=ten", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			exitCodes, err := ParseExitCodes(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", exitCodes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if fmt.Sprint(exitCodes) != fmt.Sprint(test.want) {
+				t.Errorf("exit codes are %v, expected %v", exitCodes, test.want)
+			}
+		})
+	}
+}
+
+func TestExitCodesFor(t *testing.T) {
+	exitCodes, err := ParseExitCodes("auth=10,network=11,config=12,port-parse=13,port-file-permission=14")
+	if err != nil {
+		t.Fatalf("failed to parse exit codes: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "auth", err: fmt.Errorf("failed to sync port: failed to login: %w", QBittorrentLoginNotAuthorizedError{"not authorized (200): 'Fails.'"}), want: 10},
+		{name: "forbidden after login", err: fmt.Errorf("failed to sync port: %w", ErrForbiddenAfterLogin), want: 10},
+		{name: "auth proxy", err: fmt.Errorf("failed to sync port: %w", ErrAuthProxyChallenge), want: 10},
+		{name: "network", err: fmt.Errorf("failed to sync port: %w", &url.Error{Op: "Get", URL: "http://localhost:8080", Err: errors.New("connection refused")}), want: 11},
+		{name: "config", err: fmt.Errorf("%w:\nREFRESH_INTERVAL_SECONDS must be greater than 0", ErrInvalidConfig), want: 12},
+		{name: "port parse", err: fmt.Errorf("failed to sync port: %w", errors.Join(NewPortFileParseError("port", []byte("abc"), errors.New("invalid syntax")))), want: 13},
+		{name: "port file permission", err: fmt.Errorf("failed to sync port: %w", PortFilePermissionError{Path: "port", Err: os.ErrPermission}), want: 14},
+		{name: "other", err: errors.New("something else"), want: DefaultExitCode},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := exitCodes.For(test.err); code != test.want {
+				t.Errorf("exit code is %d, expected %d", code, test.want)
+			}
+		})
+	}
+
+	// Without configured exit codes every failure exits with the default
+	if code := (ExitCodes{}).For(ErrInvalidConfig); code != DefaultExitCode {
+		t.Errorf("exit code without configured exit codes is %d, expected %d", code, DefaultExitCode)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// PortChange is a change of qBittorrent's listen port made by a sync
+type PortChange struct {
+	// Time is when the port was changed
+	Time time.Time `json:"time"`
+
+	// OldPort is qBittorrent's port before the change, zero if qBittorrent had not finished starting
+	OldPort uint16 `json:"old_port"`
+
+	// NewPort is qBittorrent's port after the change
+	NewPort uint16 `json:"new_port"`
+}
+
+// PortHistory is a ring buffer of the most recent port changes, older changes are dropped once it is full.
+// It is safe to use concurrently.
+type PortHistory struct {
+	// lock guards the fields below
+	lock sync.Mutex
+
+	// changes holds the changes, once full next is the index of the oldest
+	changes []PortChange
+
+	// next is the index the next change is stored at
+	next int
+
+	// full indicates every slot in changes holds a change
+	full bool
+}
+
+// NewPortHistory creates a PortHistory which retains the most recent size changes, if size is not positive no changes are retained
+func NewPortHistory(size int) *PortHistory {
+	return &PortHistory{
+		changes: make([]PortChange, max(size, 0)),
+	}
+}
+
+// Add records change, dropping the oldest change if the history is full
+func (history *PortHistory) Add(change PortChange) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	if len(history.changes) == 0 {
+		return
+	}
+
+	history.changes[history.next] = change
+	history.next = (history.next + 1) % len(history.changes)
+	if history.next == 0 {
+		history.full = true
+	}
+}
+
+// Changes returns the retained changes, oldest first
+func (history *PortHistory) Changes() []PortChange {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	if !history.full {
+		return append([]PortChange{}, history.changes[:history.next]...)
+	}
+
+	return append(append([]PortChange{}, history.changes[history.next:]...), history.changes[:history.next]...)
+}
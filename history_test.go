@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPortHistory(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		adds      int
+		wantPorts []uint16
+	}{
+		{name: "empty", size: 3, wantPorts: []uint16{}},
+		{name: "not full", size: 3, adds: 2, wantPorts: []uint16{50001, 50002}},
+		{name: "full", size: 3, adds: 3, wantPorts: []uint16{50001, 50002, 50003}},
+		{name: "wrapped", size: 3, adds: 7, wantPorts: []uint16{50005, 50006, 50007}},
+		{name: "disabled", size: 0, adds: 2, wantPorts: []uint16{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			history := NewPortHistory(test.size)
+			start := time.Now()
+			for i := 1; i <= test.adds; i++ {
+				history.Add(PortChange{
+					Time:    start.Add(time.Duration(i) * time.Second),
+					OldPort: uint16(50000 + i - 1),
+					NewPort: uint16(50000 + i),
+				})
+			}
+
+			// The most recent changes are retained, oldest first
+			ports := []uint16{}
+			for _, change := range history.Changes() {
+				ports = append(ports, change.NewPort)
+			}
+			if fmt.Sprint(ports) != fmt.Sprint(test.wantPorts) {
+				t.Errorf("history has new ports %v, expected %v", ports, test.wantPorts)
+			}
+		})
+	}
+}
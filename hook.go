@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// hookCommandTimeout is how long the on change command may run before it is killed
+const hookCommandTimeout = 30 * time.Second
+
+const (
+	// HookTriggerPortChange indicates the port files, or port command, provided a port qBittorrent was not using
+	HookTriggerPortChange = "port_change"
+
+	// HookTriggerDrift indicates qBittorrent's port was changed outside of this tool and was set back
+	HookTriggerDrift = "drift"
+)
+
+// HookEnvVars are the variables the on change command is always run with
+var HookEnvVars = []string{"QB_OLD_PORT", "QB_NEW_PORT"}
+
+// HookExtendedEnvVars are the variables the on change command is also run with if the extended environment is enabled
+var HookExtendedEnvVars = []string{"QB_INSTANCE_NAME", "QB_URL", "QB_TIME", "QB_TRIGGER", "QB_PORT_SOURCE"}
+
+// HookEvent describes the port change the on change command is run for
+type HookEvent struct {
+	// InstanceName identifies which qBittorrent was changed
+	InstanceName string
+
+	// QBittorrentURL is the network location of qBittorrent's API
+	QBittorrentURL string
+
+	// Time at which qBittorrent's port was changed
+	Time time.Time
+
+	// OldPort is qBittorrent's port before the change, zero if qBittorrent had not finished starting
+	OldPort uint16
+
+	// NewPort is qBittorrent's port after the change
+	NewPort uint16
+
+	// Trigger is why the port was changed, HookTriggerPortChange or HookTriggerDrift
+	Trigger string
+
+	// PortSource is the port file, or "port command", the port was read from
+	PortSource string
+}
+
+// Environ returns the variables describing the event, the extended variables are only included if extended is true
+func (event HookEvent) Environ(extended bool) []string {
+	env := []string{
+		fmt.Sprintf("QB_OLD_PORT=%d", event.OldPort),
+		fmt.Sprintf("QB_NEW_PORT=%d", event.NewPort),
+	}
+
+	if extended {
+		env = append(env,
+			"QB_INSTANCE_NAME="+event.InstanceName,
+			"QB_URL="+event.QBittorrentURL,
+			"QB_TIME="+event.Time.UTC().Format(time.RFC3339),
+			"QB_TRIGGER="+event.Trigger,
+			"QB_PORT_SOURCE="+event.PortSource,
+		)
+	}
+
+	return env
+}
+
+// RunHookCommand runs command with the shell, with the tool's environment and the variables describing event.
+// The command is killed if it does not finish within hookCommandTimeout.
+func RunHookCommand(ctx context.Context, command string, event HookEvent, extendedEnv bool) error {
+	ctx, cancel := context.WithTimeout(ctx, hookCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), event.Environ(extendedEnv)...)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("did not finish within %s", hookCommandTimeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("exited with status %d: %s", exitErr.ExitCode(), strings.TrimSpace(stderr.String()))
+	} else if err != nil {
+		return fmt.Errorf("failed to run: %s", err)
+	}
+
+	return nil
+}
+
+// HookWorker runs the on change command in the background, one run at a time, so a slow command does not delay syncs.
+// Events wait in a bounded queue, if it is full the oldest event is dropped.
+type HookWorker struct {
+	// logger is used to output the results of runs
+	logger golog.Logger
+
+	// command is the shell command which is run
+	command string
+
+	// extendedEnv indicates the command is also run with HookExtendedEnvVars
+	extendedEnv bool
+
+	// queueSize is the most events which wait to be run
+	queueSize int
+
+	// lock guards queue and running
+	lock sync.Mutex
+
+	// queue are the events which wait to be run, oldest first
+	queue []HookEvent
+
+	// running indicates the worker goroutine is running the queued events
+	running bool
+
+	// idle is closed when the worker goroutine stops because the queue is empty, nil if it is not running
+	idle chan struct{}
+}
+
+// NewHookWorkerOptions are options to create a new HookWorker
+type NewHookWorkerOptions struct {
+	// Logger is used to output the results of runs
+	Logger golog.Logger
+
+	// Command is the shell command which is run
+	Command string
+
+	// ExtendedEnv indicates the command is also run with HookExtendedEnvVars
+	ExtendedEnv bool
+
+	// QueueSize is the most events which wait to be run, at least 1 are
+	QueueSize int
+}
+
+// NewHookWorker creates a new HookWorker
+func NewHookWorker(opts NewHookWorkerOptions) *HookWorker {
+	return &HookWorker{
+		logger:      opts.Logger,
+		command:     opts.Command,
+		extendedEnv: opts.ExtendedEnv,
+		queueSize:   max(opts.QueueSize, 1),
+	}
+}
+
+// Enqueue queues the command to be run for event and returns without waiting for it to run.
+// If the queue is full the oldest queued event is dropped, the run in progress is not affected.
+func (worker *HookWorker) Enqueue(event HookEvent) {
+	worker.lock.Lock()
+	defer worker.lock.Unlock()
+
+	if len(worker.queue) >= worker.queueSize {
+		dropped := worker.queue[0]
+		worker.queue = worker.queue[1:]
+		worker.logger.Warnf("on change command queue is full, dropped the run for listen_port %s -> %d", formatListenPort(dropped.OldPort), dropped.NewPort)
+	}
+	worker.queue = append(worker.queue, event)
+
+	if !worker.running {
+		worker.running = true
+		worker.idle = make(chan struct{})
+		go worker.run(worker.idle)
+	}
+}
+
+// Wait blocks until every queued event has been run, or ctx is canceled
+func (worker *HookWorker) Wait(ctx context.Context) {
+	worker.lock.Lock()
+	idle := worker.idle
+	worker.lock.Unlock()
+
+	if idle == nil {
+		return
+	}
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+}
+
+// run runs the queued events in order until the queue is empty, then closes idle
+func (worker *HookWorker) run(idle chan struct{}) {
+	defer close(idle)
+
+	for {
+		worker.lock.Lock()
+		if len(worker.queue) == 0 {
+			worker.running = false
+			worker.lock.Unlock()
+			return
+		}
+		event := worker.queue[0]
+		worker.queue = worker.queue[1:]
+		worker.lock.Unlock()
+
+		// Syncs don't wait for the command, so it is not stopped with them, only hookCommandTimeout bounds it
+		if err := RunHookCommand(context.Background(), worker.command, event, worker.extendedEnv); err != nil {
+			worker.logger.Warnf("on change command failed: %s", err)
+			continue
+		}
+
+		worker.logger.Debugf("ran on change command for listen_port %s -> %d", formatListenPort(event.OldPort), event.NewPort)
+	}
+}
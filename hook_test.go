@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+// readHookEnv reads the variables a hook command wrote to envFile with env
+func readHookEnv(t *testing.T, envFile string) map[string]string {
+	t.Helper()
+
+	content, err := os.ReadFile(envFile)
+	if err != nil {
+		t.Fatalf("failed to read the hook command's environment: %s", err)
+	}
+
+	env := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		name, value, _ := strings.Cut(line, "=")
+		env[name] = value
+	}
+
+	return env
+}
+
+func TestRunHookCommand(t *testing.T) {
+	event := HookEvent{
+		InstanceName:   "test-instance",
+		QBittorrentURL: "http://qbittorrent:8080",
+		Time:           time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		OldPort:        6881,
+		NewPort:        50000,
+		Trigger:        HookTriggerDrift,
+		PortSource:     "/tmp/port",
+	}
+
+	tests := []struct {
+		name        string
+		extendedEnv bool
+		want        map[string]string
+	}{
+		{
+			name: "default",
+			want: map[string]string{"QB_OLD_PORT": "6881", "QB_NEW_PORT": "50000"},
+		},
+		{
+			name:        "extended",
+			extendedEnv: true,
+			want: map[string]string{
+				"QB_OLD_PORT":      "6881",
+				"QB_NEW_PORT":      "50000",
+				"QB_INSTANCE_NAME": "test-instance",
+				"QB_URL":           "http://qbittorrent:8080",
+				"QB_TIME":          "2024-01-02T03:04:05Z",
+				"QB_TRIGGER":       "drift",
+				"QB_PORT_SOURCE":   "/tmp/port",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envFile := filepath.Join(t.TempDir(), "env")
+			if err := RunHookCommand(context.Background(), "env > "+envFile, event, test.extendedEnv); err != nil {
+				t.Fatalf("failed to run hook command: %s", err)
+			}
+			env := readHookEnv(t, envFile)
+
+			// Every documented variable is either set or not, so hook authors can rely on them
+			for _, name := range append(HookEnvVars, HookExtendedEnvVars...) {
+				value, ok := env[name]
+				want, wantOK := test.want[name]
+				if ok != wantOK || value != want {
+					t.Errorf("%s is '%s' (set: %t), expected '%s' (set: %t)", name, value, ok, want, wantOK)
+				}
+			}
+
+			// The tool's environment is passed through
+			if _, ok := env["PATH"]; !ok {
+				t.Errorf("PATH is not set, expected the tool's environment to be included")
+			}
+		})
+	}
+
+	if err := RunHookCommand(context.Background(), "echo broken >&2; exit 3", event, false); err == nil || !strings.Contains(err.Error(), "exited with status 3: broken") {
+		t.Errorf("error is %v, expected the exit status and stderr", err)
+	}
+}
+
+func TestPortSyncerOnChangeCommand(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	envFile := filepath.Join(t.TempDir(), "env")
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		OnChangeCommand:            "env > " + envFile,
+		OnChangeCommandExtendedEnv: true,
+		InstanceName:               "test-instance",
+	})
+
+	steps := []struct {
+		name string
+
+		// setup changes the port file or qBittorrent before syncing
+		setup func()
+
+		// want are the variables the command is run with, nil if it must not be run
+		want map[string]string
+	}{
+		{
+			name:  "port file changed",
+			setup: func() { writePortFile(t, portFile, 50000) },
+			want:  map[string]string{"QB_OLD_PORT": "6881", "QB_NEW_PORT": "50000", "QB_TRIGGER": "port_change", "QB_PORT_SOURCE": portFile, "QB_INSTANCE_NAME": "test-instance"},
+		},
+		{
+			name:  "unchanged",
+			setup: func() {},
+		},
+		{
+			name:  "drift",
+			setup: func() { fake.SetPreference("listen_port", 6000) },
+			want:  map[string]string{"QB_OLD_PORT": "6000", "QB_NEW_PORT": "50000", "QB_TRIGGER": "drift"},
+		},
+	}
+
+	for _, step := range steps {
+		os.Remove(envFile)
+		step.setup()
+
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("%s: failed to sync: %s", step.name, err)
+		}
+
+		if step.want == nil {
+			if _, err := os.Stat(envFile); err == nil {
+				t.Errorf("%s: on change command was run, expected it not to be", step.name)
+			}
+			continue
+		}
+
+		env := readHookEnv(t, envFile)
+		for name, want := range step.want {
+			if env[name] != want {
+				t.Errorf("%s: %s is '%s', expected '%s'", step.name, name, env[name], want)
+			}
+		}
+		if !strings.HasPrefix(env["QB_URL"], "http://") {
+			t.Errorf("%s: QB_URL is '%s', expected qBittorrent's network location", step.name, env["QB_URL"])
+		}
+	}
+}
+
+// readHookRuns reads the new ports a hook command appended to runsFile, one per run
+func readHookRuns(t *testing.T, runsFile string) []string {
+	t.Helper()
+
+	content, err := os.ReadFile(runsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		t.Fatalf("failed to read the hook command's runs: %s", err)
+	}
+
+	return strings.Fields(string(content))
+}
+
+func TestHookWorker(t *testing.T) {
+	runsFile := filepath.Join(t.TempDir(), "runs")
+	worker := NewHookWorker(NewHookWorkerOptions{
+		Logger:    golog.NewLogger("test"),
+		Command:   "echo $QB_NEW_PORT >> " + runsFile + "; sleep 0.3",
+		QueueSize: 2,
+	})
+
+	// Once the first run started the queue fills up, the next event drops the oldest queued one
+	worker.Enqueue(HookEvent{NewPort: 50001})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(readHookRuns(t, runsFile)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the first run did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, port := range []uint16{50002, 50003, 50004} {
+		worker.Enqueue(HookEvent{NewPort: port})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	worker.Wait(ctx)
+
+	if runs := readHookRuns(t, runsFile); strings.Join(runs, ",") != "50001,50003,50004" {
+		t.Errorf("command ran for %v, expected 50001, 50003, and 50004 in order", runs)
+	}
+}
+
+func TestPortSyncerOnChangeCommandAsync(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	runsFile := filepath.Join(t.TempDir(), "runs")
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		OnChangeCommand:          "sleep 0.5; echo $QB_NEW_PORT >> " + runsFile,
+		OnChangeCommandAsync:     true,
+		OnChangeCommandQueueSize: 10,
+	})
+
+	// Syncs don't wait for the slow command
+	start := time.Now()
+	for _, port := range []uint16{50000, 50001} {
+		writePortFile(t, portFile, port)
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync port %d: %s", port, err)
+		}
+		if listenPort := fake.ListenPort(); listenPort != port {
+			t.Errorf("qBittorrent's port is %d, expected %d", listenPort, port)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("syncs took %s, expected them not to wait for the on change command", elapsed)
+	}
+	if runs := readHookRuns(t, runsFile); len(runs) != 0 {
+		t.Errorf("command finished for %v before the syncs, expected it to still be running", runs)
+	}
+
+	// The runs finish in the background, one after another
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	syncer.WaitForOnChangeCommands(ctx)
+
+	if runs := readHookRuns(t, runsFile); strings.Join(runs, ",") != "50000,50001" {
+		t.Errorf("command ran for %v, expected 50000 then 50001", runs)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// MultiInstanceFailurePolicy determines what happens when an additional qBittorrent instance can't be reached when the tool starts
+type MultiInstanceFailurePolicy string
+
+const (
+	// MultiInstanceFailureAllOrNothing stops the tool if any instance can't be reached when it starts, or if any instance's sync loop fails
+	MultiInstanceFailureAllOrNothing MultiInstanceFailurePolicy = "all-or-nothing"
+
+	// MultiInstanceFailureBestEffort starts the instances which can be reached, and keeps retrying the others in the background
+	MultiInstanceFailureBestEffort MultiInstanceFailurePolicy = "best-effort"
+)
+
+// MultiInstanceFailurePolicies are all the supported multi-instance failure policies
+var MultiInstanceFailurePolicies = []MultiInstanceFailurePolicy{
+	MultiInstanceFailureAllOrNothing,
+	MultiInstanceFailureBestEffort,
+}
+
+// Instance is an additional qBittorrent instance, whose port is synced alongside the port of the main instance
+type Instance struct {
+	// Name identifies the instance in logs and metrics
+	Name string
+
+	// Syncer syncs the instance's port using the instance's own qBittorrent client and metrics
+	Syncer *PortSyncer
+}
+
+// instanceState is the state of an instance in an InstanceGroup
+type instanceState struct {
+	Instance
+
+	// logger is used to output information about the instance
+	logger golog.Logger
+
+	// up indicates the instance was reached, so its sync loop can be started
+	up bool
+}
+
+// InstanceGroup runs the sync loops of additional qBittorrent instances, according to a multi-instance failure policy
+type InstanceGroup struct {
+	// instances are the additional instances
+	instances []*instanceState
+
+	// policy determines what happens when an instance can't be reached or its sync loop fails
+	policy MultiInstanceFailurePolicy
+
+	// retryBackoff computes the delays between attempts to reach an instance in the background
+	retryBackoff Backoff
+
+	// interval is the duration between syncs of each instance
+	interval time.Duration
+}
+
+// NewInstanceGroupOptions are options to create a new InstanceGroup
+type NewInstanceGroupOptions struct {
+	// Logger is used to output information, each instance logs with a child logger named after it
+	Logger golog.Logger
+
+	// Instances are the additional instances
+	Instances []Instance
+
+	// Policy determines what happens when an instance can't be reached or its sync loop fails
+	Policy MultiInstanceFailurePolicy
+
+	// RetryBackoff computes the delays between attempts to reach an instance in the background
+	RetryBackoff Backoff
+
+	// Interval is the duration between syncs of each instance
+	Interval time.Duration
+}
+
+// NewInstanceGroup creates a new InstanceGroup
+func NewInstanceGroup(opts NewInstanceGroupOptions) *InstanceGroup {
+	group := &InstanceGroup{
+		policy:       opts.Policy,
+		retryBackoff: opts.RetryBackoff,
+		interval:     opts.Interval,
+	}
+
+	for _, instance := range opts.Instances {
+		group.instances = append(group.instances, &instanceState{
+			Instance: instance,
+			logger:   opts.Logger.GetChild(instance.Name),
+		})
+	}
+
+	return group
+}
+
+// Check tries to reach every instance by reading its preferences, logging in if required, so failures are found before any sync loop starts.
+// Under the all-or-nothing policy the first instance which can't be reached is returned as an error. Under the best-effort policy failures are logged,
+// and Run keeps retrying those instances in the background.
+func (group *InstanceGroup) Check(ctx context.Context) error {
+	for _, instance := range group.instances {
+		err := instance.check(ctx)
+		if err != nil && group.policy == MultiInstanceFailureAllOrNothing {
+			return fmt.Errorf("failed to reach qBittorrent instance %s: %w", instance.Name, err)
+		} else if err != nil {
+			instance.logger.Warnf("failed to reach qBittorrent, starting the other instances and retrying it in the background: %s", err)
+			continue
+		}
+
+		instance.logger.Info("reached qBittorrent")
+		instance.up = true
+	}
+
+	return nil
+}
+
+// Run runs the sync loop of every instance until ctx is canceled, and of instances which Check could not reach once they are reached.
+// A sync which is running when ctx is canceled is allowed to finish like in Loop, only harshCtx being canceled aborts it immediately.
+// Under the all-or-nothing policy an instance's sync loop failing stops every instance, and its error is returned. Under the best-effort policy the failure is
+// logged, and the instance is restarted once it is reached again.
+// Returns once every instance stopped
+func (group *InstanceGroup) Run(ctx context.Context, harshCtx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stopped := make(chan error, len(group.instances))
+	for _, instance := range group.instances {
+		go func(instance *instanceState) {
+			stopped <- group.runInstance(ctx, harshCtx, instance)
+		}(instance)
+	}
+
+	var firstErr error
+	for range group.instances {
+		if err := <-stopped; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	return firstErr
+}
+
+// runInstance runs instance's sync loop until ctx is canceled, first retrying to reach it if it is not up
+func (group *InstanceGroup) runInstance(ctx context.Context, harshCtx context.Context, instance *instanceState) error {
+	for {
+		if !instance.up {
+			if err := group.retryCheck(ctx, instance); err != nil {
+				return nil
+			}
+		}
+
+		instance.Syncer.metrics.InstanceUp.Set(1)
+		err := instance.Syncer.Loop(ctx, harshCtx, group.interval)
+		instance.Syncer.metrics.InstanceUp.Set(0)
+
+		if err == nil || ctx.Err() != nil {
+			return nil
+		}
+		if group.policy == MultiInstanceFailureAllOrNothing {
+			return fmt.Errorf("failed to run sync loop of qBittorrent instance %s: %w", instance.Name, err)
+		}
+
+		instance.logger.Errorf("sync loop failed, restarting it once qBittorrent is reached again: %s", err)
+		instance.up = false
+	}
+}
+
+// retryCheck tries to reach instance until it succeeds, waiting between attempts according to the retry backoff.
+// Returns an error if ctx was canceled first
+func (group *InstanceGroup) retryCheck(ctx context.Context, instance *instanceState) error {
+	for retry := 1; ; retry++ {
+		delay := group.retryBackoff.Delay(retry)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		if err := instance.check(ctx); err != nil {
+			instance.logger.Warnf("failed to reach qBittorrent, retrying in the background: %s", err)
+			continue
+		}
+
+		instance.logger.Info("reached qBittorrent, starting its sync loop")
+		instance.up = true
+
+		return nil
+	}
+}
+
+// check tries to reach the instance by reading its preferences, recording a failure in its metrics
+func (instance *instanceState) check(ctx context.Context) error {
+	if err := instance.Syncer.QBittorrentClient().CheckPreferencesReadable(ctx); err != nil {
+		instance.Syncer.metrics.InstanceCheckFailures.Inc()
+		return err
+	}
+
+	return nil
+}
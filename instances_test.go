@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+// newTestInstance creates an additional instance named name which syncs port 50000 to fake, with its own metrics
+func newTestInstance(t *testing.T, name string, fake *testutil.FakeQBittorrent) Instance {
+	t.Helper()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{Metrics: NewMetrics(name)})
+	writePortFile(t, portFile, 50000)
+
+	return Instance{Name: name, Syncer: syncer}
+}
+
+// waitForPort waits for fake to use port, failing the test if it does not within a second
+func waitForPort(t *testing.T, fake *testutil.FakeQBittorrent, port uint16) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for fake.ListenPort() != port {
+		if time.Now().After(deadline) {
+			t.Fatalf("qBittorrent port is %d, expected it to become %d", fake.ListenPort(), port)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInstanceGroupBestEffort(t *testing.T) {
+	healthy := testutil.NewFakeQBittorrent("admin", "password")
+	defer healthy.Close()
+
+	// Recovers while the group is running
+	banned := testutil.NewFakeQBittorrent("admin", "password")
+	defer banned.Close()
+	banned.SetBanned(true)
+
+	down := testutil.NewFakeQBittorrent("admin", "password")
+	down.Close()
+
+	instances := []Instance{
+		newTestInstance(t, "healthy", healthy),
+		newTestInstance(t, "banned", banned),
+		newTestInstance(t, "down", down),
+	}
+	group := NewInstanceGroup(NewInstanceGroupOptions{
+		Logger:       golog.NewLogger("test"),
+		Instances:    instances,
+		Policy:       MultiInstanceFailureBestEffort,
+		RetryBackoff: Backoff{Strategy: BackoffStrategyFixed, Base: 10 * time.Millisecond},
+		Interval:     time.Hour,
+	})
+
+	if err := group.Check(context.Background()); err != nil {
+		t.Fatalf("check failed, expected best-effort to start the healthy instances: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- group.Run(ctx, context.Background())
+	}()
+
+	waitForPort(t, healthy, 50000)
+	if port := banned.ListenPort(); port != 6881 {
+		t.Errorf("banned qBittorrent port is %d, expected it to be unchanged", port)
+	}
+
+	banned.SetBanned(false)
+	waitForPort(t, banned, 50000)
+
+	wantUp := map[string]float64{"healthy": 1, "banned": 1, "down": 0}
+	for _, instance := range instances {
+		if up := gaugeValue(t, instance.Syncer.metrics.InstanceUp); up != wantUp[instance.Name] {
+			t.Errorf("%s instance_up is %v, expected %v", instance.Name, up, wantUp[instance.Name])
+		}
+	}
+	if failures := counterValue(t, instances[2].Syncer.metrics.InstanceCheckFailures); failures < 2 {
+		t.Errorf("down instance_check_failures_total is %v, expected the down instance to be retried in the background", failures)
+	}
+
+	cancel()
+	if err := <-runErr; err != nil {
+		t.Errorf("failed to run instances: %s", err)
+	}
+}
+
+func TestInstanceGroupAllOrNothing(t *testing.T) {
+	healthy := testutil.NewFakeQBittorrent("admin", "password")
+	defer healthy.Close()
+
+	down := testutil.NewFakeQBittorrent("admin", "password")
+	down.Close()
+
+	group := NewInstanceGroup(NewInstanceGroupOptions{
+		Logger:       golog.NewLogger("test"),
+		Instances:    []Instance{newTestInstance(t, "healthy", healthy), newTestInstance(t, "down", down)},
+		Policy:       MultiInstanceFailureAllOrNothing,
+		RetryBackoff: Backoff{Strategy: BackoffStrategyFixed, Base: 10 * time.Millisecond},
+		Interval:     time.Hour,
+	})
+
+	err := group.Check(context.Background())
+	if err == nil {
+		t.Fatalf("check succeeded, expected the down instance to fail it")
+	}
+	if !strings.Contains(err.Error(), "instance down") {
+		t.Errorf("error is '%s', expected it to name the down instance", err)
+	}
+	if ClassifyFailure(err) != FailureClassNetwork {
+		t.Errorf("error is classified as %s, expected %s", ClassifyFailure(err), FailureClassNetwork)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ErrKeyringSecretNotFound indicates the keyring does not contain a secret for the service and account
+var ErrKeyringSecretNotFound = errors.New("secret not found in keyring")
+
+// Keyring retrieves secrets from a credential store
+type Keyring interface {
+	// Get returns the secret stored for the service and account, or ErrKeyringSecretNotFound
+	Get(service string, account string) (string, error)
+}
+
+// SystemKeyring is the operating system's credential store, the macOS Keychain or the Secret Service (ex., GNOME Keyring or KWallet) on Linux.
+// Secrets are looked up the same way github.com/zalando/go-keyring stores them, without linking against the platform libraries.
+var SystemKeyring Keyring = commandKeyring{}
+
+// commandKeyring retrieves secrets by running the platform's keyring command line tool
+type commandKeyring struct{}
+
+// Get runs the platform's keyring tool to look up the secret
+func (commandKeyring) Get(service string, account string) (string, error) {
+	cmd, err := keyringLookupCommand(service, account)
+	if err != nil {
+		return "", err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) && keyringNotFoundExitCode(exitErr.ExitCode()) {
+		return "", ErrKeyringSecretNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("failed to run '%s': %s: %s", cmd.Path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	secret := strings.TrimRight(string(out), "\r\n")
+	if len(secret) == 0 {
+		return "", ErrKeyringSecretNotFound
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// keyringLookupCommand looks up the secret in the login Keychain with the security tool
+func keyringLookupCommand(service string, account string) (*exec.Cmd, error) {
+	return exec.Command("/usr/bin/security", "find-generic-password", "-s", service, "-a", account, "-w"), nil
+}
+
+// keyringNotFoundExitCode indicates if security exited with the code it uses when no item matches
+func keyringNotFoundExitCode(code int) bool {
+	return code == 44
+}
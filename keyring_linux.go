@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// keyringLookupCommand looks up the secret in the Secret Service with secret-tool, from libsecret
+func keyringLookupCommand(service string, account string) (*exec.Cmd, error) {
+	path, err := exec.LookPath("secret-tool")
+	if err != nil {
+		return nil, fmt.Errorf("secret-tool, usually in the libsecret-tools or libsecret package, is required to use the keyring: %s", err)
+	}
+
+	return exec.Command(path, "lookup", "service", service, "username", account), nil
+}
+
+// keyringNotFoundExitCode indicates if secret-tool exited with the code it uses when no secret matches
+func keyringNotFoundExitCode(code int) bool {
+	return code == 1
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// keyringLookupCommand returns an error, the keyring is not supported on this platform
+func keyringLookupCommand(service string, account string) (*exec.Cmd, error) {
+	return nil, fmt.Errorf("the keyring is not supported on %s", runtime.GOOS)
+}
+
+// keyringNotFoundExitCode is never called, as there is no command
+func keyringNotFoundExitCode(code int) bool {
+	return false
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// ErrLockTimeout indicates a lock file was held by someone else for longer than the lock timeout
+var ErrLockTimeout = errors.New("timed out waiting for lock file")
+
+// lockPollInterval is how often a held lock file is checked to see if it was released
+const lockPollInterval = 100 * time.Millisecond
+
+// FileLock is a lock shared between processes, held by whoever created the lock file.
+// It ensures only one of several tools managing the same qBittorrent changes its preferences at a time.
+type FileLock struct {
+	// path of the lock file
+	path string
+
+	// timeout is how long Acquire waits for the lock, zero means no limit
+	timeout time.Duration
+
+	// staleAfter is the age after which a lock file is assumed to have been left behind by a holder which crashed, and is removed
+	staleAfter time.Duration
+
+	// foundStale is called after a lock file was found to be stale, before it is taken over, nil if nothing is called. Set by tests to race the takeover
+	foundStale func()
+}
+
+// NewFileLock creates a FileLock which uses the file at path
+func NewFileLock(path string, timeout time.Duration, staleAfter time.Duration) *FileLock {
+	return &FileLock{
+		path:       path,
+		timeout:    timeout,
+		staleAfter: staleAfter,
+	}
+}
+
+// Path is the lock file's path
+func (lock *FileLock) Path() string {
+	return lock.path
+}
+
+// Acquire blocks until the lock is held, ctx is canceled, or the timeout elapses.
+// A lock file older than the stale age is removed and the lock taken over.
+// Returns a function which releases the lock, or an error wrapping ErrLockTimeout if the lock was not acquired in time.
+func (lock *FileLock) Acquire(ctx context.Context) (func() error, error) {
+	if lock.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lock.timeout)
+		defer cancel()
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := lock.tryCreate(token)
+		if err == nil {
+			return func() error {
+				return lock.release(token)
+			}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		if removed, err := lock.removeIfStale(token); err != nil {
+			return nil, err
+		} else if removed {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("%w: '%s' is still held after %s", ErrLockTimeout, lock.path, lock.timeout)
+			}
+
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryCreate creates the lock file containing token, fails with an error wrapping fs.ErrExist if it is already held
+func (lock *FileLock) tryCreate(token []byte) error {
+	file, err := os.OpenFile(lock.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return err
+		}
+
+		return fmt.Errorf("failed to create lock file '%s': %s", lock.path, err)
+	}
+
+	_, writeErr := file.Write(token)
+	if err := errors.Join(writeErr, file.Close()); err != nil {
+		os.Remove(lock.path)
+		return fmt.Errorf("failed to write lock file '%s': %s", lock.path, err)
+	}
+
+	return nil
+}
+
+// removeIfStale removes the lock file if it is older than the stale age, returns true if it was removed or no longer exists.
+// token is the lock token of the caller, used to name the file the stale lock file is moved to.
+// The lock file is moved aside before it is removed, so a lock file another tool created after this one was found stale is put back instead of being removed.
+func (lock *FileLock) removeIfStale(token []byte) (bool, error) {
+	info, err := os.Stat(lock.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check lock file '%s': %s", lock.path, err)
+	}
+
+	if lock.staleAfter <= 0 || time.Since(info.ModTime()) < lock.staleAfter {
+		return false, nil
+	}
+
+	staleContent, err := os.ReadFile(lock.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read stale lock file '%s': %s", lock.path, err)
+	}
+
+	if lock.foundStale != nil {
+		lock.foundStale()
+	}
+
+	// Renaming is atomic, so whichever lock file is moved aside is known exactly, even if others are taking over the stale lock at the same time
+	movedPath := fmt.Sprintf("%s.stale-%s", lock.path, hex.EncodeToString(token))
+	if err := os.Rename(lock.path, movedPath); errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to move stale lock file '%s': %s", lock.path, err)
+	}
+
+	movedContent, err := os.ReadFile(movedPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read stale lock file '%s': %s", movedPath, err)
+	}
+
+	if !bytes.Equal(movedContent, staleContent) {
+		// Another tool took over the stale lock first, the moved lock file is theirs. Linking never replaces a lock file created since
+		if err := os.Link(movedPath, lock.path); err != nil && !errors.Is(err, fs.ErrExist) {
+			return false, fmt.Errorf("failed to restore lock file '%s': %s", lock.path, err)
+		}
+	}
+
+	if err := os.Remove(movedPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("failed to remove stale lock file '%s': %s", movedPath, err)
+	}
+
+	return bytes.Equal(movedContent, staleContent), nil
+}
+
+// release removes the lock file, if it still contains token. If it does not the lock was taken over as stale and is left to its new holder.
+func (lock *FileLock) release(token []byte) error {
+	content, err := os.ReadFile(lock.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read lock file '%s': %s", lock.path, err)
+	}
+
+	if !bytes.Equal(content, token) {
+		return nil
+	}
+
+	if err := os.Remove(lock.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove lock file '%s': %s", lock.path, err)
+	}
+
+	return nil
+}
+
+// newLockToken creates the content of a lock file, which identifies its holder
+func newLockToken() ([]byte, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("failed to generate lock token: %s", err)
+	}
+
+	return []byte(fmt.Sprintf("%d %s\n", os.Getpid(), hex.EncodeToString(random))), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	lock := NewFileLock(path, 300*time.Millisecond, time.Hour)
+
+	release, err := lock.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("failed to acquire lock: %s", err)
+	}
+
+	if _, err := lock.Acquire(context.Background()); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("acquiring a held lock failed with %v, expected ErrLockTimeout", err)
+	}
+
+	if err := release(); err != nil {
+		t.Fatalf("failed to release lock: %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file exists after release")
+	}
+
+	if _, err := lock.Acquire(context.Background()); err != nil {
+		t.Errorf("failed to acquire released lock: %s", err)
+	}
+}
+
+func TestFileLockStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	if err := os.WriteFile(path, []byte("crashed holder\n"), 0o644); err != nil {
+		t.Fatalf("failed to write lock file: %s", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("failed to age lock file: %s", err)
+	}
+
+	release, err := NewFileLock(path, time.Second, time.Minute).Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("failed to take over stale lock: %s", err)
+	}
+
+	// The lock is taken over by someone else after it went stale, releasing must leave their lock file
+	if err := os.WriteFile(path, []byte("new holder\n"), 0o644); err != nil {
+		t.Fatalf("failed to write lock file: %s", err)
+	}
+	if err := release(); err != nil {
+		t.Fatalf("failed to release lock: %s", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("release removed another holder's lock file: %s", err)
+	}
+}
+
+func TestFileLockStaleTakenOverByOther(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	if err := os.WriteFile(path, []byte("crashed holder\n"), 0o644); err != nil {
+		t.Fatalf("failed to write lock file: %s", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("failed to age lock file: %s", err)
+	}
+
+	// Another tool takes over the stale lock between it being found stale and being removed
+	lock := NewFileLock(path, 300*time.Millisecond, time.Minute)
+	lock.foundStale = func() {
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("failed to remove lock file: %s", err)
+		}
+		if err := os.WriteFile(path, []byte("new holder\n"), 0o644); err != nil {
+			t.Fatalf("failed to write lock file: %s", err)
+		}
+	}
+
+	if _, err := lock.Acquire(context.Background()); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("acquiring a lock taken over by someone else failed with %v, expected ErrLockTimeout", err)
+	}
+
+	if content, err := os.ReadFile(path); err != nil || string(content) != "new holder\n" {
+		t.Errorf("lock file contains '%s' (%v), expected the other holder's lock file to be left", content, err)
+	}
+	leftover, err := filepath.Glob(path + ".stale-*")
+	if err != nil {
+		t.Fatalf("failed to list moved lock files: %s", err)
+	}
+	if len(leftover) > 0 {
+		t.Errorf("moved lock files %v were left behind", leftover)
+	}
+}
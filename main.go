@@ -2,490 +2,498 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"net/http"
-	"net/http/cookiejar"
-	"net/url"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Noah-Huppert/gointerrupt"
 	"github.com/Noah-Huppert/golog"
-	"github.com/caarlos0/env/v9"
 )
 
-// Config is the tool's configuration, loaded from env vars
-type Config struct {
-	// Verbose will make debug logs show
-	Verbose bool `env:"VERBOSE" envDefault:"false"`
-
-	// PortFile is the path to the file which contains only the VPNs forwarded port
-	PortFile string `env:"PORT_FILE,required"`
-
-	// RefreshIntervalSeconds is the number of seconds between refreshes of the port file and setting of the qBittorrent torrent port
-	RefreshIntervalSeconds int `env:"REFRESH_INTERVAL_SECONDS,required" envDefault:"60"`
-
-	// QBittorrentAPINetloc is the network location of the qBittorrent API server
-	QBittorrentAPINetloc string `env:"QBITTORRENT_API_NETLOC,required"`
-
-	// QBittorrentUsername is the username to use when authenticating with the QBittorrent API
-	QBittorrentUsername string `env:"QBITTORRENT_USERNAME,required" envDefault:"admin"`
-
-	// QBittorrrentPassword is the password to use when authenticating with the QBittorrent API
-	QBittorrentPassword string `env:"QBITTORRENT_PASSWORD,required"`
-
-	// AllowPortFileNotExist controls whether or not the port PortFile can not exist, if false and the PortFile does not exist then the program will error
-	AllowPortFileNotExist bool `env:"ALLOW_PORT_FILE_NOT_EXIST,required" envDefault:"true"`
-}
-
-// LoadConfig from environment vars
-func LoadConfig() (*Config, error) {
-	var cfg Config
-	if err := env.ParseWithOptions(&cfg, env.Options{
-		Prefix: "QBITTORRENT_PORT_UPDATER_",
-	}); err != nil {
-		return nil, fmt.Errorf("failed to load configuration from env vars: %s", err)
+func main() {
+	startTime := time.Now()
+
+	checkConfig := flag.Bool("check-config", false, "Load and validate the configuration, print it, then exit without contacting qBittorrent")
+	force := flag.Bool("force", false, "Set the port even if qBittorrent already reports it, overrides FORCE_SET")
+	jsonOutput := flag.Bool("json", false, "Print the command's result, or error, as JSON like {\"ok\":true,\"port\":6881}")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nWithout a command the sync loop is run.\n\nCommands:\n", os.Args[0])
+		for _, name := range CommandNames() {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %s\n    \t%s\n", Commands[name].Usage, Commands[name].Description)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var command *Command
+	if flag.NArg() > 0 {
+		cmd, ok := Commands[flag.Arg(0)]
+		if !ok {
+			fmt.Fprintf(flag.CommandLine.Output(), "unknown command '%s'\n", flag.Arg(0))
+			flag.Usage()
+			os.Exit(2)
+		}
+		command = &cmd
 	}
 
-	return &cfg, nil
-}
-
-// QBittorrentClient is an API client for qBittorrent
-type QBittorrentClient struct {
-	// logger is used to output information
-	logger golog.Logger
-
-	// baseURL is the location of the qBittorrent API location
-	baseURL url.URL
-
-	// httpClient used to make API requests, stores auth cookies
-	httpClient *http.Client
-
-	// username to login with
-	username string
-
-	// password to login with
-	password string
-}
-
-// NewQBittorrentClientOptions are options for creating a new QBittorrentClient
-type NewQBittorrentClientOptions struct {
-	// Logger is used to output information
-	Logger golog.Logger
+	ctxPair := gointerrupt.NewCtxPair(context.Background())
 
-	// NetworkLocation is the location of the qBittorrent server
-	NetworkLocation string
+	log := golog.NewLogger("main")
+	if *jsonOutput {
+		// Logs are normally written to stdout, which must only contain the JSON result
+		log = golog.NewWriterLogger("main", os.Stderr, os.Stderr, os.Stderr, os.Stderr, os.Stderr)
+	}
 
-	// Username to login with
-	Username string
+	// Load configuration
+	loadConfig := func() (*Config, error) {
+		cfg, err := LoadConfig()
+		if err != nil {
+			return nil, err
+		}
 
-	// Password to login with
-	Password string
-}
+		if *force {
+			cfg.ForceSet = true
+		}
 
-// NewQBittorrentClient creates a new QBittorrentClient
-func NewQBittorrentClient(opts NewQBittorrentClientOptions) (*QBittorrentClient, error) {
-	// Parse base URL
-	baseURL, err := url.Parse(opts.NetworkLocation)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse network location into valid URL: %s", err)
+		return cfg, nil
 	}
 
-	// Create HTTP client
-	cookieJar, err := cookiejar.New(nil)
+	cfg, err := loadConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cookie jar for http client: %s", err)
+		log.Fatalf("failed to load configuration: %s", err)
 	}
 
-	httpClient := &http.Client{
-		Jar: cookieJar,
+	if cfg.Verbose {
+		log.SetLevel(golog.DebugLevel)
+	} else {
+		log.SetLevel(golog.InfoLevel)
 	}
 
-	return &QBittorrentClient{
-		logger:     opts.Logger,
-		baseURL:    *baseURL,
-		httpClient: httpClient,
-		username:   opts.Username,
-		password:   opts.Password,
-	}, nil
-}
-
-// QBittorrentLoginNotAuthorizedError occurs when a qBittorrent API login request fails because credentials were not accepted by the server
-type QBittorrentLoginNotAuthorizedError struct {
-	err string
-}
-
-// Error returns an error message
-func (e QBittorrentLoginNotAuthorizedError) Error() string {
-	return e.err
-}
-
-// QBittorrentUnauthorizedError indicates the API client is not logged in
-type QBittorrentUnauthorizedError struct{}
+	if len(cfg.InstanceName) > 0 {
+		log.SetName(fmt.Sprintf("%s/main", cfg.InstanceName))
+	}
 
-// Error returns a string representation
-func (e QBittorrentUnauthorizedError) Error() string {
-	return "not authorized"
-}
+	log.Infof("loaded configuration")
+	cfg.LogEffective(log)
 
-// doReq sends the provided request, if autoLogin is true also tries to automatically login if the server indicates we are not logged in.
-// Returns (response, response body, error)
-func (client *QBittorrentClient) doReq(ctx context.Context, req *http.Request, autoLogin bool) (*http.Response, []byte, error) {
-	// Debug log request
-	client.logger.Debugf("HTTP request:")
-	client.logger.Debugf("  %s %s", req.Method, req.URL)
-	client.logger.Debugf("  Headers:")
-	for key, value := range req.Header {
-		client.logger.Debugf("    '%s': '%s'", key, value)
+	if err := cfg.Validate(); err != nil {
+		// EXIT_CODES may be the invalid setting, if so the default exit code is used
+		exitCodes, _ := ParseExitCodes(cfg.ExitCodes)
+		exitCodes.Fatal(log, fmt.Errorf("%w:\n%s", ErrInvalidConfig, err))
 	}
 
-	reqCookies := req.Cookies()
-	client.logger.Debugf("Cookies:")
-	for key, value := range reqCookies {
-		client.logger.Debugf("    '%s': '%s'", key, value)
+	exitCodes, err := ParseExitCodes(cfg.ExitCodes)
+	if err != nil {
+		log.Fatalf("failed to parse EXIT_CODES: %s", err)
 	}
 
-	client.logger.Debugf("  Body: '%s'", req.Body)
-
-	// Make request
-	resp, err := client.httpClient.Do(req.WithContext(ctx))
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to make request: %s", err)
+	if *checkConfig {
+		log.Info("configuration is valid")
+		return
 	}
 
-	// Handle response
-	respBody, err := io.ReadAll(resp.Body)
+	metrics := NewMetrics(cfg.InstanceName)
+
+	tracerProvider, shutdownTracing, err := NewTracerProvider(ctxPair.Graceful(), cfg.InstanceName)
 	if err != nil {
-		return resp, nil, fmt.Errorf("failed to read response body: %s", err)
+		log.Fatalf("failed to setup tracing: %s", err)
 	}
-
-	// ... Debug log response
-	client.logger.Debugf("HTTP response: %d - %s", resp.StatusCode, resp.Status)
-	client.logger.Debugf("  Headers:")
-	for key, value := range resp.Header {
-		client.logger.Debugf("    '%s': '%s'", key, value)
+	if endpoint := TracingEndpoint(); len(endpoint) > 0 {
+		log.Infof("exporting traces to '%s'", endpoint)
 	}
-	client.logger.Debugf("  Body: '%s'", respBody)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
 
-	if resp.StatusCode == http.StatusForbidden {
-		// Try to automatically login and then repeat request
-		if autoLogin {
-			client.logger.Info("automatically logging in")
-			if err := client.Login(ctx); err != nil {
-				return resp, nil, fmt.Errorf("failed to login: %s", err)
-			}
-
-			return client.doReq(ctx, req, false)
+		if err := shutdownTracing(ctx); err != nil {
+			log.Warnf("failed to export remaining traces: %s", err)
 		}
+	}()
 
-		return resp, respBody, QBittorrentUnauthorizedError{}
-	} else if resp.StatusCode != http.StatusOK {
-		return resp, respBody, fmt.Errorf("non-OK status code %d - %s: '%s'", resp.StatusCode, resp.Status, respBody)
+	retryBackoff := Backoff{
+		Strategy: cfg.BackoffStrategy,
+		Max:      time.Duration(cfg.BackoffMaxSeconds) * time.Second,
 	}
 
-	return resp, respBody, nil
-}
-
-// Login authenticates with the API, must be called for each client in order for later API calls to work
-// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#login
-// Returns QBittorrentLoginNotAuthorizedError if the credentials were not accepted
-func (client *QBittorrentClient) Login(ctx context.Context) error {
-	// Setup request
-	reqURL := client.baseURL
-	reqURL.Path += "/api/v2/auth/login"
-
-	reqBodyValues := url.Values{}
-	reqBodyValues.Set("username", client.username)
-	reqBodyValues.Set("password", client.password)
+	// Create qBittorrent client
+	qbittorrentLogger := log.GetChild("qbittorrent")
+	newInstanceQBittorrentClient := func(cfg *Config, netloc string, logger golog.Logger, metrics *Metrics) (*QBittorrentClient, error) {
+		requestHeaders, err := ParseRequestHeaders(cfg.RequestHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse REQUEST_HEADERS: %s", err)
+		}
 
-	req, err := http.NewRequest("POST", reqURL.String(), strings.NewReader(reqBodyValues.Encode()))
+		return NewQBittorrentClient(NewQBittorrentClientOptions{
+			Logger:                 logger,
+			NetworkLocation:        netloc,
+			Username:               cfg.QBittorrentUsername,
+			Password:               cfg.QBittorrentPassword,
+			SessionID:              cfg.QBittorrentSessionID,
+			ClientCertFile:         cfg.ClientCertFile,
+			ClientKeyFile:          cfg.ClientKeyFile,
+			RequireHTTPS:           cfg.RequireHTTPS,
+			MaskHostInLogs:         cfg.MaskHostInLogs,
+			APIPathPrefix:          cfg.APIPathPrefix,
+			SkipLogin:              cfg.SkipLogin,
+			Headers:                requestHeaders,
+			HostHeader:             cfg.HostHeader,
+			MaxResponseBodyBytes:   cfg.MaxResponseBodyBytes,
+			SessionRefreshMargin:   time.Duration(cfg.SessionRefreshMarginSeconds) * time.Second,
+			SlowRequestThreshold:   time.Duration(cfg.SlowRequestThresholdMilliseconds) * time.Millisecond,
+			DNSFallbackGracePeriod: time.Duration(cfg.DNSFallbackGracePeriodSeconds) * time.Second,
+			DialTimeout:            time.Duration(cfg.DialTimeoutSeconds) * time.Second,
+			DialKeepAlive:          cfg.DialKeepAlive(),
+			Metrics:                metrics,
+			ReadinessBackoff:       retryBackoff.WithBase(time.Second),
+			UnavailableRetries:     cfg.UnavailableRetries,
+			UnavailableBackoff:     retryBackoff.WithBase(time.Duration(cfg.UnavailableBackoffSeconds) * time.Second),
+			SetPreferencesRequest:  cfg.SetPreferencesRequest(),
+			NetworkPreferencesPath: cfg.NetworkPreferencesPath,
+			PreserveScheduler:      cfg.PreserveScheduler,
+			FormEncoding:           cfg.FormEncoding,
+			PostLoginDelay:         time.Duration(cfg.PostLoginDelayMilliseconds) * time.Millisecond,
+			TracerProvider:         tracerProvider,
+		})
+	}
+	newQBittorrentClient := func(cfg *Config) (*QBittorrentClient, error) {
+		return newInstanceQBittorrentClient(cfg, cfg.QBittorrentAPINetloc, qbittorrentLogger, metrics)
+	}
+
+	qBittorrentClient, err := newQBittorrentClient(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to craft HTTP request: %s", err)
+		log.Fatalf("failed to create qBittorrent API client: %s", err)
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	// Do request
-	resp, respBody, err := client.doReq(ctx, req, false)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode == 403 {
-		return QBittorrentLoginNotAuthorizedError{fmt.Sprintf("not authorized: '%s'", respBody)}
-	}
+	if command != nil {
+		err := RunCommand(ctxPair.Graceful(), *command, CommandEnv{
+			Logger:            log.GetChild(flag.Arg(0)),
+			Config:            cfg,
+			QBittorrentClient: qBittorrentClient,
+			JSON:              *jsonOutput,
+		}, flag.Args()[1:])
+		if err != nil {
+			if *jsonOutput {
+				// The error was already printed as JSON
+				os.Exit(exitCodes.For(err))
+			}
 
-	cookies := resp.Cookies()
+			exitCodes.Fatal(log, fmt.Errorf("failed to run %s command: %w", flag.Arg(0), err))
+		}
 
-	if len(cookies) == 0 {
-		return fmt.Errorf("received no authentication cookie in response from the server, body: %s", respBody)
+		return
 	}
 
-	client.httpClient.Jar.SetCookies(&client.baseURL, cookies)
-
-	// Authentication cookie should now be in jar
-	return nil
-}
-
-// QBittorrentServerPreferences are settings which control the behavior of qBittorrent
-type QBittorrentServerPreferences struct {
-	// ListenPort is the port on which qBittorrent will listen for incoming torrent connections
-	ListenPort uint16 `json:"listen_port,omitempty"`
-}
-
-// SetServerPreferences updates qBittorrent server preferences
-// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#set-application-preferences
-func (client *QBittorrentClient) SetServerPreferences(ctx context.Context, prefs QBittorrentServerPreferences) error {
-	// Setup request
-	reqURL := client.baseURL
-	reqURL.Path += "/api/v2/app/setPreferences"
-
-	prefsJSON, err := json.Marshal(prefs)
-	if err != nil {
-		return fmt.Errorf("failed to encode server preferences as JSON: %s", err)
+	var expectedPortRange *PortRange
+	if len(cfg.ExpectedPortRange) > 0 {
+		portRange, err := ParsePortRange(cfg.ExpectedPortRange)
+		if err != nil {
+			log.Fatalf("failed to parse EXPECTED_PORT_RANGE: %s", err)
+		}
+		expectedPortRange = &portRange
 	}
-	reqBodyValues := url.Values{}
-	reqBodyValues.Set("json", string(prefsJSON))
 
-	req, err := http.NewRequest("POST", reqURL.String(), strings.NewReader(reqBodyValues.Encode()))
+	applyWindow, err := cfg.ParseApplyWindow()
 	if err != nil {
-		return fmt.Errorf("failed to craft HTTP request: %s", err)
+		log.Fatalf("failed to parse apply window: %s", err)
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	// Do request
-	_, _, err = client.doReq(ctx, req, true)
+	portSelector, err := ParsePortSelector(cfg.PortSelector)
 	if err != nil {
-		return err
+		log.Fatalf("failed to parse PORT_SELECTOR: %s", err)
 	}
 
-	return nil
-}
-
-// GetServerPreferences retrieves the current qBittorrent server preferences
-// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#get-application-preferences
-func (client *QBittorrentClient) GetServerPreferences(ctx context.Context) (*QBittorrentServerPreferences, error) {
-	// Setup request
-	reqURL := client.baseURL
-	reqURL.Path += "/api/v2/app/preferences"
-
-	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	onPortLost, err := ParsePortLostPolicy(cfg.OnPortLost)
 	if err != nil {
-		return nil, fmt.Errorf("failed to craft HTTP request: %s", err)
+		log.Fatalf("failed to parse ON_PORT_LOST: %s", err)
 	}
 
-	// Do request
-	_, respBody, err := client.doReq(ctx, req, true)
+	notifier, err := cfg.Notifiers()
 	if err != nil {
-		return nil, err
+		log.Fatalf("failed to create notifiers: %s", err)
 	}
 
-	var prefs QBittorrentServerPreferences
-	if err := json.Unmarshal(respBody, &prefs); err != nil {
-		return nil, fmt.Errorf("failed to decode response into JSON: %s", err)
+	var metricsPusher *MetricsPusher
+	if len(cfg.PushgatewayURL) > 0 {
+		metricsPusher = NewMetricsPusher(NewMetricsPusherOptions{
+			URL:      cfg.PushgatewayURL,
+			Job:      cfg.PushgatewayJob,
+			Instance: cfg.PushgatewayInstance,
+			Metrics:  metrics,
+		})
 	}
 
-	return &prefs, nil
-}
-
-// PortSyncer reads the port file and sets qBittorrent's torrent port if it differs
-type PortSyncer struct {
-	// logger is used to output information
-	logger golog.Logger
-
-	// qBittorrentClient is the API client used to make qBittorrent API requests
-	qBittorrentClient *QBittorrentClient
-
-	// allowPortFileNotExist indicates if the PortFile can not exist without an error being thrown
-	allowPortFileNotExist bool
-
-	// portFile is the file which contains the VPNs forwarded port
-	portFile string
-}
-
-// NewPortSyncerOptions are options to create a new port syncer
-type NewPortSyncerOptions struct {
-	// Logger is used to output information
-	Logger golog.Logger
-
-	// QBittorrentClient is the API client used to make qBittorrent API requests
-	QBittorrentClient *QBittorrentClient
-
-	// AllowPortFileNotExist indicates if the PortFile can not exist without an error being thrown
-	AllowPortFileNotExist bool
-
-	// PortFile is the file which contains the VPNs forwarded port
-	PortFile string
-}
+	// Notifiers can be added by reloading the configuration, so results are always sent
+	swappableNotifier := NewSwappableNotifier(notifier)
+	syncResults := make(chan SyncResult, 16)
+	notifyLogger := log.GetChild("notify")
+	throttledNotifier := NewThrottledNotifier(notifyLogger, swappableNotifier, time.Duration(cfg.NotifyThrottleSeconds)*time.Second)
+	notificationsDone := make(chan struct{})
+	go func() {
+		defer close(notificationsDone)
+		NotifyResults(ctxPair.Harsh(), notifyLogger, throttledNotifier, cfg.InstanceName, syncResults)
+	}()
 
-// NewPortSyncer creates a new PortSyncer
-func NewPortSyncer(opts NewPortSyncerOptions) *PortSyncer {
-	return &PortSyncer{
-		logger:                opts.Logger,
-		qBittorrentClient:     opts.QBittorrentClient,
-		allowPortFileNotExist: opts.AllowPortFileNotExist,
-		portFile:              opts.PortFile,
+	var lock *FileLock
+	if len(cfg.LockFile) > 0 {
+		lock = NewFileLock(cfg.LockFile, time.Duration(cfg.LockTimeoutSeconds)*time.Second, time.Duration(cfg.LockStaleSeconds)*time.Second)
 	}
-}
 
-// GetPortFileValue reads the port file and gets the integer value of the port
-func (syncer *PortSyncer) GetPortFileValue() (uint16, error) {
-	fileBytes, err := os.ReadFile(syncer.portFile)
-	if err != nil {
-		return 0, fmt.Errorf("failed to read port file '%s': %s", syncer.portFile, err)
-	}
+	newCircuitBreaker := func() *CircuitBreaker {
+		if cfg.CircuitBreakerThreshold == 0 {
+			return nil
+		}
 
-	fileInt, err := strconv.ParseUint(string(fileBytes), 10, 16)
-	if err != nil {
-		return 0, fmt.Errorf("failed to convert port file contents '%s' into int16: %s", fileBytes, err)
+		return NewCircuitBreaker(cfg.CircuitBreakerThreshold, time.Duration(cfg.CircuitBreakerCooldownSeconds)*time.Second)
 	}
 
-	return uint16(fileInt), nil
-}
-
-// ReconcileTorrentPort ensures that qBittorrent's torrent port is the one provided
-// Returns a boolean indicating if the port had to be changed
-func (syncer *PortSyncer) ReconcileTorrentPort(ctx context.Context, port uint16) (bool, error) {
-	prefs, err := syncer.qBittorrentClient.GetServerPreferences(ctx)
-	if err != nil {
-		return false, fmt.Errorf("failed to get current qBittorrent server preferences : %s", err)
-	}
+	// Create syncer and start
+	syncerLogger := log.GetChild("port-syncer")
 
-	if prefs.ListenPort == port {
-		return false, nil
-	}
+	syncerOpts := NewPortSyncerOptions{
+		Logger:                     syncerLogger,
+		QBittorrentClient:          qBittorrentClient,
+		TracerProvider:             tracerProvider,
+		AllowPortFileNotExist:      cfg.AllowPortFileNotExist,
+		MissingPortGracePeriod:     time.Duration(cfg.PortFileMissingGracePeriodSeconds) * time.Second,
+		PortFiles:                  cfg.PortFiles,
+		PortCommand:                cfg.PortCommand,
+		PortFileReadTimeout:        time.Duration(cfg.PortFileReadTimeoutSeconds) * time.Second,
+		PortCommandTimeout:         time.Duration(cfg.PortCommandTimeoutSeconds) * time.Second,
+		PortFileFormat:             cfg.PortFileFormat,
+		OutputPortFile:             cfg.OutputPortFile,
+		ReadyFile:                  cfg.ReadyFile,
+		ExpectedPortRange:          expectedPortRange,
+		TreatZeroAsUnavailable:     cfg.TreatZeroAsUnavailable,
+		PortSelector:               portSelector,
+		OnPortLost:                 onPortLost,
+		PortFileStaleThreshold:     time.Duration(cfg.PortFileStaleThresholdSeconds) * time.Second,
+		ShutdownGracePeriod:        time.Duration(cfg.ShutdownGracePeriodSeconds) * time.Second,
+		DisableRandomPort:          cfg.DisableRandomPort,
+		SkipIfRandomPort:           cfg.SkipIfRandomPort,
+		SkipIfListenPortUnset:      cfg.SkipIfListenPortUnset,
+		CompareAndSwap:             cfg.CompareAndSwap,
+		MinimalMode:                cfg.MinimalMode,
+		ReannounceOnChange:         cfg.ReannounceOnChange,
+		ResumeOnChange:             cfg.ResumeOnChange,
+		PortHistorySize:            cfg.PortHistorySize,
+		OnChangeCommand:            cfg.OnChangeCommand,
+		OnChangeCommandExtendedEnv: cfg.OnChangeCommandExtendedEnv,
+		OnChangeCommandAsync:       cfg.OnChangeCommandAsync,
+		OnChangeCommandQueueSize:   cfg.OnChangeCommandQueueSize,
+		InstanceName:               cfg.InstanceName,
+		APICallBudget:              cfg.APICallBudget,
+		PinRandomPortRange:         cfg.PinRandomPortRange,
+		SetAnnouncePort:            cfg.SetAnnouncePort,
+		UPnP:                       cfg.UPnP,
+		MaxConnections:             cfg.MaxConnections,
+		MaxConnectionsPerTorrent:   cfg.MaxConnectionsPerTorrent,
+		NetworkInterface:           cfg.NetworkInterface,
+		InterfaceAddress:           cfg.ListenInterfaceAddress(),
+		ApplyWindow:                applyWindow,
+		ApplyOnlyWhenActive:        cfg.ApplyOnlyWhenActive,
+		SyncTimeout:                time.Duration(cfg.SyncTimeoutSeconds) * time.Second,
+		ForceSet:                   cfg.ForceSet,
+		SetPreferencesAttempts:     cfg.SetPreferencesAttempts,
+		SetPreferencesBackoff:      retryBackoff.WithBase(time.Duration(cfg.SetPreferencesBackoffSeconds) * time.Second),
+		VerifyChanges:              cfg.VerifyChanges,
+		VerifyAttempts:             cfg.VerifyAttempts,
+		VerifyDelay:                time.Duration(cfg.VerifyDelayMilliseconds) * time.Millisecond,
+		VerifyReachableWithin:      time.Duration(cfg.VerifyReachableWithinSeconds) * time.Second,
+		RollbackOnVerifyFailure:    cfg.RollbackOnVerifyFailure,
+		Lock:                       lock,
+		CircuitBreaker:             newCircuitBreaker(),
+		SkipInitialSync:            cfg.SkipInitialSync,
+		WaitForPortFile:            time.Duration(cfg.WaitForPortFileSeconds) * time.Second,
+		WatchPortFiles:             cfg.WatchPortFiles,
+		CheckReachability:          cfg.CheckReachability,
+		NoChangeLogEvery:           cfg.NoChangeLogEvery,
+		Metrics:                    metrics,
+		MetricsPusher:              metricsPusher,
+		SyncResults:                syncResults,
+	}
+	syncer := NewPortSyncer(syncerOpts)
+
+	// Start HTTP server
+	if len(cfg.HTTPServerAddress) > 0 {
+		httpServer := NewHTTPServer(NewHTTPServerOptions{
+			Logger:    log.GetChild("http"),
+			Address:   cfg.HTTPServerAddress,
+			Metrics:   metrics,
+			Syncer:    syncer,
+			StartTime: startTime,
+			Token:     cfg.HTTPServerToken,
+		})
+
+		if err := httpServer.Listen(); err != nil {
+			if cfg.HTTPServerRequired {
+				log.Fatalf("failed to start HTTP server: %s", err)
+			}
 
-	err = syncer.qBittorrentClient.SetServerPreferences(ctx, QBittorrentServerPreferences{
-		ListenPort: port,
-	})
-	if err != nil {
-		return false, fmt.Errorf("failed to set qBittorrent torrent port: %s", err)
+			log.Warnf("failed to start HTTP server, continuing to sync without it: %s", err)
+		} else {
+			go func() {
+				if err := httpServer.Run(ctxPair.Graceful()); err != nil {
+					log.Fatalf("failed to run HTTP server: %s", err)
+				}
+			}()
+		}
 	}
 
-	return true, nil
-}
+	if cfg.ReadinessTimeoutSeconds > 0 {
+		log.Infof("waiting up to %ds for qBittorrent to be ready", cfg.ReadinessTimeoutSeconds)
 
-// Sync reads the port file and ensures qBittorrent is using that port for torrents
-// Will automatically login to the qBittorrent API if not authorized and re-call Sync() itself. The selfCall argument tracks if Sync() is re-calling itself so it doesn't recruse infinitely.
-// Returns a boolean indicating if the qBittorrent port had to be changed
-func (syncer *PortSyncer) Sync(ctx context.Context) (bool, error) {
-	if _, err := os.Stat(syncer.portFile); errors.Is(err, os.ErrNotExist) {
-		if syncer.allowPortFileNotExist {
-			syncer.logger.Infof("port file '%s' does not exist yet, skipping sync...", syncer.portFile)
-			return false, nil
+		version, err := qBittorrentClient.WaitUntilReady(ctxPair.Graceful(), time.Duration(cfg.ReadinessTimeoutSeconds)*time.Second)
+		if err != nil && ctxPair.Graceful().Err() != nil {
+			log.Info("stopped while waiting for qBittorrent to be ready")
+			return
+		} else if err != nil && cfg.ProceedIfNotReady {
+			log.Warnf("proceeding even though qBittorrent is not ready: %s", err)
+		} else if err != nil {
+			exitCodes.Fatal(log, fmt.Errorf("failed to wait for qBittorrent to be ready: %w", err))
+		} else {
+			log.Infof("qBittorrent %s is ready", version)
 		}
-
-		return false, fmt.Errorf("port file '%s' does not", syncer.portFile)
 	}
 
-	port, err := syncer.GetPortFileValue()
-	if err != nil {
-		return false, fmt.Errorf("failed to get desired port from port file: %s", err)
-	}
+	if cfg.CheckPreferencesOnStartup {
+		if err := qBittorrentClient.CheckPreferencesReadable(ctxPair.Graceful()); err != nil && ctxPair.Graceful().Err() != nil {
+			log.Info("stopped while checking qBittorrent's preferences can be read")
+			return
+		} else if err != nil {
+			exitCodes.Fatal(log, fmt.Errorf("failed to check qBittorrent's preferences can be read: %w", err))
+		}
 
-	changed, err := syncer.ReconcileTorrentPort(ctx, port)
-	if err != nil {
-		return false, fmt.Errorf("failed to reconcile qBittorrent port differences: %s", err)
+		log.Info("qBittorrent's preferences can be read")
 	}
 
-	if changed {
-		syncer.logger.Infof("Changed qBittorrent torrent port to %d", port)
+	if version, webAPIVersion, err := qBittorrentClient.DetectVersions(ctxPair.Graceful()); err != nil && ctxPair.Graceful().Err() != nil {
+		log.Info("stopped while detecting qBittorrent's version")
+		return
+	} else if err != nil {
+		log.Warnf("failed to detect qBittorrent's version, it will not be reported in metrics or the status: %s", err)
 	} else {
-		syncer.logger.Infof("No change to qBittorrent torrent port (is: %d)", port)
+		log.Infof("qBittorrent version %s, WebAPI version %s", version, webAPIVersion)
 	}
 
-	return changed, nil
-}
-
-// Loop calls the sync process on an interval until ctx is canceled
-func (syncer *PortSyncer) Loop(ctx context.Context, interval time.Duration) error {
-	ticker := time.NewTicker(interval)
-
-	if _, err := syncer.Sync(ctx); err != nil {
-		return fmt.Errorf("failed to sync port: %s", err)
-	}
+	if cfg.ReadPortFromStdin() {
+		log.Info("reading port from stdin, syncing once")
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			if _, err := syncer.Sync(ctx); err != nil {
-				return fmt.Errorf("failed to sync port: %s", err)
-			}
+		if _, err := syncer.SyncFromReader(ctxPair.Harsh(), os.Stdin, "stdin"); err != nil {
+			exitCodes.Fatal(log, fmt.Errorf("failed to sync port from stdin: %w", err))
 		}
-	}
-}
-
-func main() {
-	ctxPair := gointerrupt.NewCtxPair(context.Background())
-
-	log := golog.NewLogger("main")
 
-	// Load configuration
-	cfg, err := LoadConfig()
-	if err != nil {
-		log.Fatalf("failed to load configuration: %s", err)
+		log.Info("done")
+		return
 	}
 
-	if cfg.Verbose {
-		log.SetLevel(golog.DebugLevel)
-	} else {
-		log.SetLevel(golog.InfoLevel)
-	}
+	// Additional instances sync the same port with their own client, metrics, and circuit breaker. Files, notifications, and the lock belong to the main instance
+	var instances []Instance
+	for _, netloc := range cfg.ExtraQBittorrentAPINetlocs {
+		baseURL, err := ParseNetworkLocation(netloc)
+		if err != nil {
+			log.Fatalf("failed to parse EXTRA_QBITTORRENT_API_NETLOCS: %s", err)
+		}
+		name := baseURL.Host
+		instanceLog := log.GetChild(name)
+		instanceMetrics := metrics.ForInstance(name)
 
-	log.Infof("loaded configuration")
-	log.Infof("  Verbose                  : %t", cfg.Verbose)
-	log.Infof("  Port File                : %s", cfg.PortFile)
-	log.Infof("  Allow Port File Not Exist: %t", cfg.AllowPortFileNotExist)
-	log.Infof("  Refresh Interval         : %ds", cfg.RefreshIntervalSeconds)
-	log.Infof("  qBittorrent API          : %s", cfg.QBittorrentAPINetloc)
-	log.Infof("  qBittorrent Username     : %s", cfg.QBittorrentUsername)
+		client, err := newInstanceQBittorrentClient(cfg, netloc, instanceLog.GetChild("qbittorrent"), instanceMetrics)
+		if err != nil {
+			log.Fatalf("failed to create qBittorrent API client for instance %s: %s", name, err)
+		}
 
-	redactedQBittorrentPW := "<READACTED>"
-	if len(cfg.QBittorrentPassword) == 0 {
-		redactedQBittorrentPW = "<EMPTY>"
+		instanceOpts := syncerOpts
+		instanceOpts.Logger = instanceLog.GetChild("port-syncer")
+		instanceOpts.QBittorrentClient = client
+		instanceOpts.Metrics = instanceMetrics
+		instanceOpts.InstanceName = name
+		instanceOpts.CircuitBreaker = newCircuitBreaker()
+		instanceOpts.OutputPortFile = ""
+		instanceOpts.ReadyFile = ""
+		instanceOpts.Lock = nil
+		instanceOpts.SyncResults = nil
+
+		instances = append(instances, Instance{Name: name, Syncer: NewPortSyncer(instanceOpts)})
+	}
+
+	var instanceGroup *InstanceGroup
+	if len(instances) > 0 {
+		instanceGroup = NewInstanceGroup(NewInstanceGroupOptions{
+			Logger:       log,
+			Instances:    instances,
+			Policy:       cfg.MultiInstanceFailurePolicy,
+			RetryBackoff: retryBackoff.WithBase(time.Duration(cfg.RefreshIntervalSeconds) * time.Second),
+			Interval:     time.Duration(cfg.RefreshIntervalSeconds) * time.Second,
+		})
+
+		if err := instanceGroup.Check(ctxPair.Graceful()); err != nil && ctxPair.Graceful().Err() != nil {
+			log.Info("stopped while reaching the additional qBittorrent instances")
+			return
+		} else if err != nil {
+			exitCodes.Fatal(log, err)
+		}
 	}
-	log.Infof("  qBittorrent Password     : %s", redactedQBittorrentPW)
 
-	// Create qBittorrent client
-	qbittorrentLogger := log.GetChild("qbittorrent")
-	qBittorrentClient, err := NewQBittorrentClient(NewQBittorrentClientOptions{
-		Logger:          qbittorrentLogger,
-		NetworkLocation: cfg.QBittorrentAPINetloc,
-		Username:        cfg.QBittorrentUsername,
-		Password:        cfg.QBittorrentPassword,
+	reloader := NewReloader(NewReloaderOptions{
+		Logger:               log.GetChild("reload"),
+		LoadConfig:           loadConfig,
+		NewQBittorrentClient: newQBittorrentClient,
+		Loggers:              []golog.Logger{log, qbittorrentLogger, syncerLogger},
+		Syncer:               syncer,
+		Notifier:             swappableNotifier,
+		Config:               cfg,
 	})
-	if err != nil {
-		log.Fatalf("failed to create qBittorrent API client: %s", err)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go reloader.Run(ctxPair.Graceful(), reloadSignals)
+
+	// A ready file left by a run which did not stop gracefully would signal the tool is ready before it synced
+	if len(cfg.ReadyFile) > 0 {
+		if err := RemoveReadyFile(cfg.ReadyFile); err != nil {
+			log.Fatalf("failed to remove ready file of a previous run: %s", err)
+		}
 	}
 
-	// Create syncer and start
-	syncerLogger := log.GetChild("port-syncer")
-	syncer := NewPortSyncer(NewPortSyncerOptions{
-		Logger:                syncerLogger,
-		QBittorrentClient:     qBittorrentClient,
-		AllowPortFileNotExist: cfg.AllowPortFileNotExist,
-		PortFile:              cfg.PortFile,
-	})
-
 	log.Info("starting sync loop")
 
-	go func() {
-		select {
-		case <-ctxPair.Graceful().Done():
-			log.Info("received graceful stop signal, exitting...")
-		case <-ctxPair.Harsh().Done():
-			log.Info("received harsh stop signal, exitting...")
-		}
-	}()
+	cleanup := NewShutdownCleanup(NewShutdownCleanupOptions{
+		Logger:                     log,
+		Syncer:                     syncer,
+		StartTime:                  startTime,
+		ReportStatus:               cfg.ReportOnExit,
+		Logout:                     cfg.LogoutOnExit,
+		LogoutTimeout:              time.Duration(cfg.LogoutTimeoutSeconds) * time.Second,
+		SkipLogoutIfLastSyncFailed: cfg.LogoutSkipIfLastSyncFailed,
+		ReadyFile:                  cfg.ReadyFile,
+		NotificationsDone:          notificationsDone,
+		Timeout:                    time.Duration(cfg.ShutdownCleanupTimeoutSeconds) * time.Second,
+	})
 
-	err = syncer.Loop(ctxPair.Graceful(), time.Duration(cfg.RefreshIntervalSeconds)*time.Second)
-	if err != nil {
-		log.Fatalf("failed to run sync loop: %s", err)
+	var watchdog *Watchdog
+	if cfg.WatchdogThresholdSeconds > 0 {
+		watchdog = NewWatchdog(NewWatchdogOptions{
+			Logger:      log.GetChild("watchdog"),
+			Syncer:      syncer,
+			Threshold:   time.Duration(cfg.WatchdogThresholdSeconds) * time.Second,
+			ExitOnStall: cfg.WatchdogExit,
+		})
+	}
+
+	metrics.InstanceUp.Set(1)
+	if err := RunSyncLoop(ctxPair.Graceful(), ctxPair.Harsh(), RunSyncLoopOptions{
+		Logger:     log,
+		Syncer:     syncer,
+		Instances:  instanceGroup,
+		Cleanup:    cleanup,
+		Watchdog:   watchdog,
+		Interval:   time.Duration(cfg.RefreshIntervalSeconds) * time.Second,
+		MaxRuntime: cfg.MaxRuntime(),
+	}); err != nil {
+		exitCodes.Fatal(log, err)
 	}
 
 	log.Info("done")
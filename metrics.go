@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsNamespace prefixes the names of all metrics
+const metricsNamespace = "qbittorrent_port_updater"
+
+// Metrics are Prometheus metrics which describe the tool's behavior
+type Metrics struct {
+	// Registry is the Prometheus registry all metrics are registered with
+	Registry *prometheus.Registry
+
+	// SyncFailures counts syncs which failed
+	SyncFailures prometheus.Counter
+
+	// PortFileAge is the number of seconds since the port file was last written
+	PortFileAge prometheus.Gauge
+
+	// Retries counts qBittorrent API requests which were retried, labeled by the reason of the retry
+	Retries *prometheus.CounterVec
+
+	// APIRequestDuration is how long qBittorrent took to respond to API requests, labeled by the API endpoint
+	APIRequestDuration *prometheus.HistogramVec
+
+	// Changes counts syncs which changed qBittorrent's preferences
+	Changes prometheus.Counter
+
+	// DriftCorrections counts syncs which changed qBittorrent's port back to the port a previous sync set, after it was changed outside of the tool
+	DriftCorrections prometheus.Counter
+
+	// LastChangeTime is the Unix time at which a sync last changed qBittorrent's preferences
+	LastChangeTime prometheus.Gauge
+
+	// PortMismatchDuration is the number of seconds qBittorrent has not been using the port read from the port files, 0 when it is
+	PortMismatchDuration prometheus.Gauge
+
+	// StartupPortDiffered is 1 if qBittorrent's port differed from the port file when the tool started and had to be corrected, 0 otherwise
+	StartupPortDiffered prometheus.Gauge
+
+	// Reachable is 1 if qBittorrent reports it is connectable from the internet, 0 otherwise
+	Reachable prometheus.Gauge
+
+	// CircuitBreakerState is the circuit breaker's state: 0 closed, 1 open, 2 half-open
+	CircuitBreakerState prometheus.Gauge
+
+	// InstanceUp is 1 while the instance's sync loop is running, 0 while it is stopped, for example while an additional instance is being retried in the background
+	InstanceUp prometheus.Gauge
+
+	// InstanceCheckFailures counts failed attempts to reach an additional instance before starting its sync loop
+	InstanceCheckFailures prometheus.Counter
+
+	// QBittorrentInfo is 1, labeled with qBittorrent's version and WebAPI version, so versions can be tracked across deployments
+	QBittorrentInfo *prometheus.GaugeVec
+
+	// versionLock guards qBittorrentVersion and webAPIVersion
+	versionLock sync.Mutex
+
+	// qBittorrentVersion is the last detected qBittorrent version, empty if it was not detected
+	qBittorrentVersion string
+
+	// webAPIVersion is the last detected qBittorrent WebAPI version, empty if it was not detected
+	webAPIVersion string
+}
+
+// NewMetrics creates and registers the tool's metrics, labeled with instanceName so metrics from multiple instances can be told apart
+func NewMetrics(instanceName string) *Metrics {
+	return newMetrics(prometheus.NewRegistry(), instanceName)
+}
+
+// ForInstance creates metrics for another qBittorrent instance, labeled with instanceName and registered with the same registry, so they are served and pushed together
+func (metrics *Metrics) ForInstance(instanceName string) *Metrics {
+	return newMetrics(metrics.Registry, instanceName)
+}
+
+// newMetrics creates the tool's metrics and registers them with registry, labeled with instanceName
+func newMetrics(registry *prometheus.Registry, instanceName string) *Metrics {
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"instance_name": instanceName}, registry)
+
+	metrics := &Metrics{
+		Registry: registry,
+		SyncFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sync_failures_total",
+			Help:      "Number of syncs which failed, including syncs which exceeded the sync timeout",
+		}),
+		PortFileAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "port_file_age_seconds",
+			Help:      "Number of seconds since the port file the port was read from was last written, as of the last sync",
+		}),
+		Retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "retries_total",
+			Help:      "Number of qBittorrent API requests which were retried, by reason: " + strings.Join(RetryReasons, ", "),
+		}, []string{"reason"}),
+		APIRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_request_duration_seconds",
+			Help:      "Number of seconds qBittorrent took to respond to API requests, by endpoint. Requests which failed without a response are included",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		Changes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "changes_total",
+			Help:      "Number of syncs which changed qBittorrent's preferences",
+		}),
+		DriftCorrections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "drift_corrections_total",
+			Help:      "Number of syncs which changed qBittorrent's port back to the port a previous sync set, because it was changed outside of the tool, for example by qBittorrent restarting with a random port. Included in changes_total",
+		}),
+		LastChangeTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_change_timestamp_seconds",
+			Help:      "Unix time at which a sync last changed qBittorrent's preferences, 0 if no sync has changed them",
+		}),
+		PortMismatchDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "port_mismatch_duration_seconds",
+			Help:      "Number of seconds since qBittorrent's port stopped matching the port read from the port files, because changing it failed or was deferred, as of the last sync. 0 when qBittorrent is using the port",
+		}),
+		StartupPortDiffered: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "startup_port_differed",
+			Help:      "1 if qBittorrent's port differed from the port file when the tool started and had to be corrected, 0 otherwise. Set once, by the first sync which reaches qBittorrent",
+		}),
+		Reachable: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "reachable",
+			Help:      "1 if qBittorrent's connection status reports it is reachable from the internet on its listen port, 0 otherwise",
+		}),
+		CircuitBreakerState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breaker around qBittorrent calls: 0 closed, 1 open and skipping syncs, 2 half-open and testing if qBittorrent recovered",
+		}),
+		InstanceUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "instance_up",
+			Help:      "1 while the instance's sync loop is running, 0 while it is stopped, for example while an additional instance from EXTRA_QBITTORRENT_API_NETLOCS can't be reached and is being retried in the background",
+		}),
+		InstanceCheckFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "instance_check_failures_total",
+			Help:      "Number of failed attempts to reach an additional instance from EXTRA_QBITTORRENT_API_NETLOCS before starting its sync loop",
+		}),
+		QBittorrentInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "qbittorrent_info",
+			Help:      "Always 1, labeled with the version and WebAPI version of qBittorrent, labels are empty until they are detected",
+		}, []string{"version", "webapi_version"}),
+	}
+
+	registerer.MustRegister(
+		metrics.SyncFailures,
+		metrics.PortFileAge,
+		metrics.Retries,
+		metrics.APIRequestDuration,
+		metrics.Changes,
+		metrics.DriftCorrections,
+		metrics.LastChangeTime,
+		metrics.PortMismatchDuration,
+		metrics.StartupPortDiffered,
+		metrics.Reachable,
+		metrics.CircuitBreakerState,
+		metrics.InstanceUp,
+		metrics.InstanceCheckFailures,
+		metrics.QBittorrentInfo,
+	)
+
+	// Initialize all reasons so they are reported before the first retry
+	for _, reason := range RetryReasons {
+		metrics.Retries.WithLabelValues(reason)
+	}
+
+	return metrics
+}
+
+// RecordQBittorrentVersion records qBittorrent's version in the info metric
+func (metrics *Metrics) RecordQBittorrentVersion(version string) {
+	metrics.versionLock.Lock()
+	defer metrics.versionLock.Unlock()
+
+	metrics.qBittorrentVersion = version
+	metrics.setQBittorrentInfo()
+}
+
+// RecordQBittorrentWebAPIVersion records qBittorrent's WebAPI version in the info metric
+func (metrics *Metrics) RecordQBittorrentWebAPIVersion(webAPIVersion string) {
+	metrics.versionLock.Lock()
+	defer metrics.versionLock.Unlock()
+
+	metrics.webAPIVersion = webAPIVersion
+	metrics.setQBittorrentInfo()
+}
+
+// setQBittorrentInfo replaces the info metric with one labeled with the current versions, the caller must hold versionLock
+func (metrics *Metrics) setQBittorrentInfo() {
+	metrics.QBittorrentInfo.Reset()
+	metrics.QBittorrentInfo.WithLabelValues(metrics.qBittorrentVersion, metrics.webAPIVersion).Set(1)
+}
+
+// QBittorrentVersions returns the last detected qBittorrent version and WebAPI version, each empty if it was not detected
+func (metrics *Metrics) QBittorrentVersions() (string, string) {
+	metrics.versionLock.Lock()
+	defer metrics.versionLock.Unlock()
+
+	return metrics.qBittorrentVersion, metrics.webAPIVersion
+}
+
+// metricsPushTimeout is how long pushing metrics to a Pushgateway may take
+const metricsPushTimeout = 10 * time.Second
+
+// MetricsPusher pushes metrics to a Prometheus Pushgateway, for environments where Prometheus can't scrape the HTTP server
+type MetricsPusher struct {
+	// pusher pushes the metrics registry to the Pushgateway
+	pusher *push.Pusher
+}
+
+// NewMetricsPusherOptions are options for creating a MetricsPusher
+type NewMetricsPusherOptions struct {
+	// URL of the Pushgateway, may include basic authentication credentials
+	URL string
+
+	// Job is the job label metrics are grouped by in the Pushgateway
+	Job string
+
+	// Instance is the instance label metrics are grouped by in the Pushgateway, if empty metrics are only grouped by job
+	Instance string
+
+	// Metrics are pushed
+	Metrics *Metrics
+}
+
+// NewMetricsPusher creates a MetricsPusher
+func NewMetricsPusher(opts NewMetricsPusherOptions) *MetricsPusher {
+	pusher := push.New(opts.URL, opts.Job).
+		Gatherer(opts.Metrics.Registry).
+		Client(&http.Client{Timeout: metricsPushTimeout})
+	if len(opts.Instance) > 0 {
+		pusher = pusher.Grouping("instance", opts.Instance)
+	}
+
+	return &MetricsPusher{
+		pusher: pusher,
+	}
+}
+
+// Push pushes all metrics to the Pushgateway, replacing those pushed before
+func (pusher *MetricsPusher) Push(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, metricsPushTimeout)
+	defer cancel()
+
+	return pusher.pusher.PushContext(ctx)
+}
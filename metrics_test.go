@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+func TestNewMetricsInstanceName(t *testing.T) {
+	metrics := NewMetrics("seedbox")
+	metrics.SyncFailures.Inc()
+
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	if len(families) == 0 {
+		t.Fatalf("no metrics were gathered")
+	}
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var instanceName string
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "instance_name" {
+					instanceName = label.GetValue()
+				}
+			}
+
+			if instanceName != "seedbox" {
+				t.Errorf("%s has instance_name '%s', expected 'seedbox'", family.GetName(), instanceName)
+			}
+		}
+	}
+}
+
+func TestPortSyncerPushMetrics(t *testing.T) {
+	var lock sync.Mutex
+	var pushedPaths []string
+	var pushedBody string
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		lock.Lock()
+		defer lock.Unlock()
+		pushedPaths = append(pushedPaths, r.Method+" "+r.URL.Path)
+		pushedBody = string(body)
+	}))
+	defer pushgateway.Close()
+
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	metrics := NewMetrics("test")
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		Metrics: metrics,
+		MetricsPusher: NewMetricsPusher(NewMetricsPusherOptions{
+			URL:      pushgateway.URL,
+			Job:      "port_updater",
+			Instance: "seedbox",
+			Metrics:  metrics,
+		}),
+	})
+	writePortFile(t, portFile, 50000)
+
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(pushedPaths) != 1 || pushedPaths[0] != "PUT /metrics/job/port_updater/instance/seedbox" {
+		t.Fatalf("pushed to %v, expected one push to the port_updater job's seedbox instance", pushedPaths)
+	}
+	if !strings.Contains(pushedBody, "qbittorrent_port_updater_changes_total") {
+		t.Errorf("pushed metrics don't include qbittorrent_port_updater_changes_total")
+	}
+}
+
+func TestPortSyncerPushMetricsFailure(t *testing.T) {
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer pushgateway.Close()
+
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	var warnLog bytes.Buffer
+	metrics := NewMetrics("test")
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		Logger:  golog.NewWriterLogger("test", io.Discard, io.Discard, &warnLog, io.Discard, io.Discard),
+		Metrics: metrics,
+		MetricsPusher: NewMetricsPusher(NewMetricsPusherOptions{
+			URL:     pushgateway.URL,
+			Job:     "port_updater",
+			Metrics: metrics,
+		}),
+	})
+	writePortFile(t, portFile, 50000)
+
+	// Failing to push does not fail the sync
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("qBittorrent's port is %d, expected 50000", port)
+	}
+	if !strings.Contains(warnLog.String(), "failed to push metrics to the Pushgateway") {
+		t.Errorf("warning log is '%s', expected it to report the failed push", warnLog.String())
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// Notifier sends a notification about a sync to one channel, such as a webhook
+type Notifier interface {
+	// Name identifies the channel in logs and errors, it must not contain secrets
+	Name() string
+
+	// Notify sends a notification about event
+	Notify(ctx context.Context, event NotificationEvent) error
+}
+
+// NotificationEvent is what notifiers are told about
+type NotificationEvent struct {
+	// InstanceName identifies which qBittorrent the event is about
+	InstanceName string `json:"instance_name"`
+
+	// Time at which the sync finished
+	Time time.Time `json:"time"`
+
+	// Port is the port read from the port file, zero if no port was read
+	Port uint16 `json:"port"`
+
+	// PortFile is the port file the port was read from, empty if no port was read
+	PortFile string `json:"port_file"`
+
+	// Changed indicates qBittorrent's preferences were changed
+	Changed bool `json:"changed"`
+
+	// Error is the error which caused the sync to fail, empty if it succeeded
+	Error string `json:"error,omitempty"`
+
+	// FailureClass is the class of the error which caused the sync to fail, one of FailureClasses, empty if it succeeded
+	FailureClass FailureClass `json:"failure_class,omitempty"`
+
+	// Repeated is the number of identical notifications which were suppressed by throttling, if not zero this event summarizes them and is the last of them
+	Repeated int `json:"repeated,omitempty"`
+}
+
+// NewNotificationEvent creates the event which describes result
+func NewNotificationEvent(instanceName string, result SyncResult) NotificationEvent {
+	event := NotificationEvent{
+		InstanceName: instanceName,
+		Time:         result.Time,
+		Port:         result.Port,
+		PortFile:     result.PortFile,
+		Changed:      result.Changed,
+	}
+	if result.Err != nil {
+		event.Error = result.Err.Error()
+		event.FailureClass = ClassifyFailure(result.Err)
+	}
+
+	return event
+}
+
+// Message describes the event in a human readable sentence
+func (event NotificationEvent) Message() string {
+	var message string
+	if len(event.Error) > 0 {
+		message = fmt.Sprintf("[%s] failed to sync qBittorrent's port: %s", event.InstanceName, event.Error)
+	} else {
+		message = fmt.Sprintf("[%s] changed qBittorrent's port to %d (from: %s)", event.InstanceName, event.Port, event.PortFile)
+	}
+
+	if event.Repeated > 0 {
+		message += fmt.Sprintf(" (repeated %d times)", event.Repeated)
+	}
+
+	return message
+}
+
+// shouldNotify determines if result is worth a notification, only syncs which changed qBittorrent or failed are
+func shouldNotify(result SyncResult) bool {
+	return result.Changed || result.Err != nil
+}
+
+// MultiNotifier sends every notification to several notifiers at once.
+// Each notifier fails independently, one failing or being slow does not stop the others from being notified.
+type MultiNotifier struct {
+	// notifiers are all sent every notification
+	notifiers []Notifier
+}
+
+// NewMultiNotifier creates a MultiNotifier which sends to all of notifiers
+func NewMultiNotifier(notifiers ...Notifier) *MultiNotifier {
+	return &MultiNotifier{
+		notifiers: notifiers,
+	}
+}
+
+// Name lists the names of all notifiers
+func (multi *MultiNotifier) Name() string {
+	names := make([]string, len(multi.notifiers))
+	for i, notifier := range multi.notifiers {
+		names[i] = notifier.Name()
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// Len is the number of notifiers
+func (multi *MultiNotifier) Len() int {
+	return len(multi.notifiers)
+}
+
+// Notify sends event to all notifiers concurrently and waits for them to finish.
+// Returns the errors of all notifiers which failed joined into one error, each wrapped with the notifier's name.
+func (multi *MultiNotifier) Notify(ctx context.Context, event NotificationEvent) error {
+	errs := make([]error, len(multi.notifiers))
+
+	var wg sync.WaitGroup
+	for i, notifier := range multi.notifiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := notifier.Notify(ctx, event); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", notifier.Name(), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// SwappableNotifier sends notifications to a notifier which can be replaced while notifications are being sent, so notification settings can be reloaded
+type SwappableNotifier struct {
+	// lock guards notifier
+	lock sync.RWMutex
+
+	// notifier is sent every notification
+	notifier Notifier
+}
+
+// NewSwappableNotifier creates a SwappableNotifier which sends to notifier
+func NewSwappableNotifier(notifier Notifier) *SwappableNotifier {
+	return &SwappableNotifier{
+		notifier: notifier,
+	}
+}
+
+// Set replaces the notifier notifications are sent to
+func (swappable *SwappableNotifier) Set(notifier Notifier) {
+	swappable.lock.Lock()
+	defer swappable.lock.Unlock()
+
+	swappable.notifier = notifier
+}
+
+// get returns the notifier notifications are currently sent to
+func (swappable *SwappableNotifier) get() Notifier {
+	swappable.lock.RLock()
+	defer swappable.lock.RUnlock()
+
+	return swappable.notifier
+}
+
+// Name is the name of the current notifier
+func (swappable *SwappableNotifier) Name() string {
+	return swappable.get().Name()
+}
+
+// Notify sends event to the current notifier
+func (swappable *SwappableNotifier) Notify(ctx context.Context, event NotificationEvent) error {
+	return swappable.get().Notify(ctx, event)
+}
+
+// ThrottledNotifier suppresses notifications identical to one sent within the window, so a flapping port or a repeating error does not spam every channel.
+// When the window of a notification closes a summary is sent if identical notifications were suppressed, its Repeated field counts them.
+type ThrottledNotifier struct {
+	// logger is used to output information
+	logger golog.Logger
+
+	// notifier is sent the notifications which are not suppressed
+	notifier Notifier
+
+	// window is how long identical notifications are suppressed after one is sent
+	window time.Duration
+
+	// lock guards windows
+	lock sync.Mutex
+
+	// windows are the open windows keyed by the message of the notification which opened them
+	windows map[string]*throttleWindow
+}
+
+// throttleWindow is the period after a notification was sent during which identical notifications are suppressed
+type throttleWindow struct {
+	// last is the last notification which was suppressed
+	last NotificationEvent
+
+	// repeated is the number of notifications which were suppressed
+	repeated int
+}
+
+// NewThrottledNotifier creates a ThrottledNotifier which sends to notifier, zero window disables throttling
+func NewThrottledNotifier(logger golog.Logger, notifier Notifier, window time.Duration) *ThrottledNotifier {
+	return &ThrottledNotifier{
+		logger:   logger,
+		notifier: notifier,
+		window:   window,
+		windows:  map[string]*throttleWindow{},
+	}
+}
+
+// Name is the name of the throttled notifier
+func (throttled *ThrottledNotifier) Name() string {
+	return throttled.notifier.Name()
+}
+
+// Notify sends event unless an identical event was sent within the window, in which case it is counted for the window's summary
+func (throttled *ThrottledNotifier) Notify(ctx context.Context, event NotificationEvent) error {
+	if throttled.window <= 0 {
+		return throttled.notifier.Notify(ctx, event)
+	}
+
+	// Events only differ by time when they are identical
+	key := event.Message()
+
+	throttled.lock.Lock()
+	if window, ok := throttled.windows[key]; ok {
+		window.last = event
+		window.repeated++
+		throttled.lock.Unlock()
+
+		throttled.logger.Debugf("suppressed notification sent within the last %s: %s", throttled.window, key)
+		return nil
+	}
+	throttled.windows[key] = &throttleWindow{}
+	throttled.lock.Unlock()
+
+	time.AfterFunc(throttled.window, func() {
+		throttled.closeWindow(key)
+	})
+
+	return throttled.notifier.Notify(ctx, event)
+}
+
+// closeWindow ends the window of the notification with the message key, and sends a summary if notifications were suppressed during it
+func (throttled *ThrottledNotifier) closeWindow(key string) {
+	throttled.lock.Lock()
+	window := throttled.windows[key]
+	delete(throttled.windows, key)
+	throttled.lock.Unlock()
+
+	if window == nil || window.repeated == 0 {
+		return
+	}
+
+	summary := window.last
+	summary.Repeated = window.repeated
+
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+
+	if err := throttled.notifier.Notify(ctx, summary); err != nil {
+		throttled.logger.Warnf("failed to send summary of repeated notifications: %s", err)
+	}
+}
+
+// NotifyResults sends a notification to notifier for every result received from results which is worth one, until ctx is canceled or results is closed.
+// Failed notifications are logged, they never stop later notifications.
+func NotifyResults(ctx context.Context, logger golog.Logger, notifier Notifier, instanceName string, results <-chan SyncResult) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case result, ok := <-results:
+			if !ok {
+				return
+			}
+
+			if !shouldNotify(result) {
+				continue
+			}
+
+			if err := notifier.Notify(ctx, NewNotificationEvent(instanceName, result)); err != nil {
+				logger.Warnf("failed to send notifications: %s", err)
+			}
+		}
+	}
+}
+
+// notificationTimeout is the longest a single notification request may take
+const notificationTimeout = 10 * time.Second
+
+// WebhookNotifier posts events as JSON to a URL
+type WebhookNotifier struct {
+	// name identifies the webhook without revealing the URL, which may contain a secret
+	name string
+
+	// url events are posted to
+	url string
+
+	// httpClient makes the requests
+	httpClient *http.Client
+
+	// encode creates the request body for an event
+	encode func(event NotificationEvent) interface{}
+}
+
+// NewWebhookNotifier creates a notifier which posts events, as NotificationEvent JSON, to webhookURL
+func NewWebhookNotifier(webhookURL string) (*WebhookNotifier, error) {
+	return newWebhookNotifier("webhook", webhookURL, func(event NotificationEvent) interface{} {
+		return event
+	})
+}
+
+// NewDiscordNotifier creates a notifier which posts events as messages to a Discord webhook URL
+func NewDiscordNotifier(webhookURL string) (*WebhookNotifier, error) {
+	return newWebhookNotifier("discord", webhookURL, func(event NotificationEvent) interface{} {
+		return map[string]string{
+			"content": event.Message(),
+		}
+	})
+}
+
+// newWebhookNotifier creates a WebhookNotifier of kind, which uses encode to create request bodies
+func newWebhookNotifier(kind string, webhookURL string, encode func(event NotificationEvent) interface{}) (*WebhookNotifier, error) {
+	parsed, err := ParseWebhookURL(webhookURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookNotifier{
+		name:       fmt.Sprintf("%s %s", kind, parsed.Host),
+		url:        webhookURL,
+		httpClient: &http.Client{Timeout: notificationTimeout},
+		encode:     encode,
+	}, nil
+}
+
+// ParseWebhookURL ensures webhookURL is an absolute http or https URL
+func ParseWebhookURL(webhookURL string) (*url.URL, error) {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		// The URL may contain a secret, so it is left out of the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+
+		return nil, fmt.Errorf("failed to parse webhook URL: %s", err)
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("webhook URL scheme '%s' is not supported, must be http or https", parsed.Scheme)
+	}
+	if len(parsed.Hostname()) == 0 {
+		return nil, fmt.Errorf("webhook URL does not contain a host")
+	}
+
+	return parsed, nil
+}
+
+// Name identifies the webhook by its kind and host
+func (webhook *WebhookNotifier) Name() string {
+	return webhook.name
+}
+
+// Notify posts event to the webhook
+func (webhook *WebhookNotifier) Notify(ctx context.Context, event NotificationEvent) error {
+	body, err := json.Marshal(webhook.encode(event))
+	if err != nil {
+		return fmt.Errorf("failed to encode notification as JSON: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhook.httpClient.Do(req)
+	if err != nil {
+		// The URL may contain a secret, so it is left out of the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+
+		return fmt.Errorf("failed to post notification: %s", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+// fakeNotifier records the events it is notified of and fails with err, if not nil
+type fakeNotifier struct {
+	name string
+	err  error
+
+	lock   sync.Mutex
+	events []NotificationEvent
+}
+
+func (fake *fakeNotifier) Name() string {
+	return fake.name
+}
+
+func (fake *fakeNotifier) Notify(ctx context.Context, event NotificationEvent) error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.events = append(fake.events, event)
+
+	return fake.err
+}
+
+// Events returns the events the notifier was notified of
+func (fake *fakeNotifier) Events() []NotificationEvent {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	return append([]NotificationEvent{}, fake.events...)
+}
+
+func TestMultiNotifierChangeEvent(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncResults := make(chan SyncResult, 4)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{SyncResults: syncResults})
+	writePortFile(t, portFile, 50000)
+
+	failing := &fakeNotifier{name: "failing", err: errors.New("webhook is down")}
+	working := &fakeNotifier{name: "working"}
+	notifier := NewMultiNotifier(failing, working)
+
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	close(syncResults)
+
+	NotifyResults(context.Background(), golog.NewLogger("test"), notifier, "test", syncResults)
+
+	for _, notified := range []*fakeNotifier{failing, working} {
+		events := notified.Events()
+		if len(events) != 1 {
+			t.Fatalf("%s notifier received %d events, expected 1", notified.name, len(events))
+		}
+		if !events[0].Changed || events[0].Port != 50000 {
+			t.Errorf("%s notifier received %+v, expected a change to port 50000", notified.name, events[0])
+		}
+	}
+
+	err := notifier.Notify(context.Background(), NotificationEvent{})
+	if err == nil || !strings.Contains(err.Error(), "failing: webhook is down") {
+		t.Errorf("error is %v, expected it to name the failing notifier", err)
+	}
+	if len(working.Events()) != 2 {
+		t.Errorf("working notifier was not notified alongside the failing notifier")
+	}
+}
+
+func TestNotifyResultsSkipsUnchanged(t *testing.T) {
+	results := make(chan SyncResult, 3)
+	results <- SyncResult{Port: 50000}
+	results <- SyncResult{Skipped: true}
+	results <- SyncResult{Err: errors.New("qBittorrent is down")}
+	close(results)
+
+	notified := &fakeNotifier{name: "fake"}
+	NotifyResults(context.Background(), golog.NewLogger("test"), NewMultiNotifier(notified), "test", results)
+
+	events := notified.Events()
+	if len(events) != 1 || events[0].Error != "qBittorrent is down" {
+		t.Errorf("notified of %+v, expected only the failed sync", events)
+	}
+}
+
+func TestThrottledNotifier(t *testing.T) {
+	notified := &fakeNotifier{name: "fake"}
+	throttled := NewThrottledNotifier(golog.NewLogger("test"), notified, 100*time.Millisecond)
+
+	failed := NotificationEvent{InstanceName: "test", Error: "qBittorrent is down"}
+	for i := 0; i < 5; i++ {
+		if err := throttled.Notify(context.Background(), failed); err != nil {
+			t.Fatalf("failed to notify: %s", err)
+		}
+	}
+
+	// A different event is not throttled by the other's window
+	changed := NotificationEvent{InstanceName: "test", Port: 50000, Changed: true}
+	if err := throttled.Notify(context.Background(), changed); err != nil {
+		t.Fatalf("failed to notify: %s", err)
+	}
+
+	if events := notified.Events(); len(events) != 2 || events[0].Error != failed.Error || events[1].Port != changed.Port {
+		t.Fatalf("notified of %+v before the window closed, expected the error once and the change", events)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(notified.Events()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events := notified.Events()
+	if len(events) != 3 {
+		t.Fatalf("notified of %+v after the window closed, expected a summary of the repeated error", events)
+	}
+	if summary := events[2]; summary.Repeated != 4 || !strings.HasSuffix(summary.Message(), "qBittorrent is down (repeated 4 times)") {
+		t.Errorf("summary is %+v with message '%s', expected it to count the 4 suppressed errors", summary, summary.Message())
+	}
+
+	// Nothing was suppressed in the change's window, so it has no summary
+	time.Sleep(200 * time.Millisecond)
+	if events := notified.Events(); len(events) != 3 {
+		t.Errorf("notified of %+v, expected no summary of the change", events)
+	}
+
+	// The window closed, so the error is sent again
+	if err := throttled.Notify(context.Background(), failed); err != nil {
+		t.Fatalf("failed to notify: %s", err)
+	}
+	if events := notified.Events(); len(events) != 4 || events[3].Repeated != 0 {
+		t.Errorf("notified of %+v, expected the error to be sent after its window closed", events)
+	}
+}
+
+func TestWebhookNotifiers(t *testing.T) {
+	tests := []struct {
+		name        string
+		newNotifier func(webhookURL string) (*WebhookNotifier, error)
+		wantKey     string
+	}{
+		{name: "webhook", newNotifier: NewWebhookNotifier, wantKey: "port"},
+		{name: "discord", newNotifier: NewDiscordNotifier, wantKey: "content"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("failed to decode request body: %s", err)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			notifier, err := test.newNotifier(server.URL + "/hook/secret")
+			if err != nil {
+				t.Fatalf("failed to create notifier: %s", err)
+			}
+			if strings.Contains(notifier.Name(), "secret") {
+				t.Errorf("name '%s' contains the URL's path", notifier.Name())
+			}
+
+			event := NotificationEvent{InstanceName: "test", Time: time.Now(), Port: 50000, PortFile: "port", Changed: true}
+			if err := notifier.Notify(context.Background(), event); err != nil {
+				t.Fatalf("failed to notify: %s", err)
+			}
+
+			if _, ok := body[test.wantKey]; !ok {
+				t.Errorf("request body %v does not contain '%s'", body, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestParseWebhookURLInvalid(t *testing.T) {
+	for _, webhookURL := range []string{"", "ftp://example.com/hook", "https:///hook"} {
+		if _, err := ParseWebhookURL(webhookURL); err == nil {
+			t.Errorf("'%s' was accepted, expected an error", webhookURL)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// RunPortCommand runs command with the shell and returns its stdout, which is parsed like the contents of a port file.
+// The command is killed if it does not finish within timeout, zero means no limit.
+// Exiting with a non-zero status or printing nothing is wrapped with ErrPortNotAvailable, the same as a port file which does not exist.
+func RunPortCommand(ctx context.Context, command string, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("did not finish within %s", timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("exited with status %d: %w: %s", exitErr.ExitCode(), ErrPortNotAvailable, strings.TrimSpace(stderr.String()))
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to run: %s", err)
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, fmt.Errorf("printed nothing: %w", ErrPortNotAvailable)
+	}
+
+	return stdout.Bytes(), nil
+}
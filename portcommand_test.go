@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunPortCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+
+		wantOutput string
+
+		// wantNotAvailable indicates the error must wrap ErrPortNotAvailable
+		wantNotAvailable bool
+
+		// wantErr is a substring of the error, empty if no error is expected
+		wantErr string
+	}{
+		{name: "prints port", command: "echo 50000", wantOutput: "50000\n"},
+		{name: "non-zero exit", command: "echo 'no mapping' >&2; exit 3", wantNotAvailable: true, wantErr: "exited with status 3"},
+		{name: "prints nothing", command: "echo", wantNotAvailable: true, wantErr: "printed nothing"},
+		{name: "timeout", command: "sleep 5", wantErr: "did not finish within"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := RunPortCommand(context.Background(), test.command, 200*time.Millisecond)
+			if len(test.wantErr) == 0 && err != nil {
+				t.Fatalf("failed to run port command: %s", err)
+			}
+			if len(test.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("error is %v, expected it to contain '%s'", err, test.wantErr)
+			}
+			if errors.Is(err, ErrPortNotAvailable) != test.wantNotAvailable {
+				t.Errorf("error %v wrapping ErrPortNotAvailable is %t, expected %t", err, !test.wantNotAvailable, test.wantNotAvailable)
+			}
+			if string(output) != test.wantOutput {
+				t.Errorf("output is '%s', expected '%s'", output, test.wantOutput)
+			}
+		})
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/oliveagle/jsonpath"
+)
+
+// PortFileFormat describes how the contents of a port file are parsed
+type PortFileFormat string
+
+const (
+	// PortFileFormatPlain is a file which contains only the port number
+	PortFileFormatPlain PortFileFormat = "plain"
+
+	// PortFileFormatNATPMPC is the text output of the natpmpc tool, the mapped public port is used
+	PortFileFormatNATPMPC PortFileFormat = "natpmpc"
+
+	// PortFileFormatJSON is JSON containing one or more port mappings, the port selector picks which is used
+	PortFileFormatJSON PortFileFormat = "json"
+
+	// PortFileFormatRange is a file which contains a port number or a range of ports, like "49152-49152" or "49152:49152", which must contain only one port
+	PortFileFormatRange PortFileFormat = "range"
+
+	// PortFileFormatFirstToken is a file whose first word is the port number, the rest of the file is ignored, like a status file with a timestamp after the port
+	PortFileFormatFirstToken PortFileFormat = "first-token"
+)
+
+// PortFileFormats are all the supported port file formats
+var PortFileFormats = []PortFileFormat{
+	PortFileFormatPlain,
+	PortFileFormatNATPMPC,
+	PortFileFormatJSON,
+	PortFileFormatRange,
+	PortFileFormatFirstToken,
+}
+
+// ErrPortNotAvailable indicates a port source exists but does not contain a port yet
+var ErrPortNotAvailable = errors.New("port not available yet")
+
+// maxPortFileErrorContent is the most bytes of a port file's content included in a PortFileParseError
+const maxPortFileErrorContent = 64
+
+// PortFileParseError indicates the contents of a port file could not be parsed into a port
+type PortFileParseError struct {
+	// Source is the port file, or other source, the contents were read from
+	Source string
+
+	// Content is the start of the contents, at most maxPortFileErrorContent bytes
+	Content []byte
+
+	// Truncated indicates Content is only the start of the contents
+	Truncated bool
+
+	// Err is why the contents could not be parsed
+	Err error
+}
+
+// NewPortFileParseError creates a PortFileParseError, only keeping the start of content
+func NewPortFileParseError(source string, content []byte, err error) PortFileParseError {
+	parseErr := PortFileParseError{
+		Source:  source,
+		Content: content,
+		Err:     err,
+	}
+
+	if len(content) > maxPortFileErrorContent {
+		parseErr.Content = content[:maxPortFileErrorContent]
+		parseErr.Truncated = true
+	}
+
+	return parseErr
+}
+
+// Error returns an error message, the content is quoted so unexpected characters are escaped
+func (e PortFileParseError) Error() string {
+	truncated := ""
+	if e.Truncated {
+		truncated = " (truncated)"
+	}
+
+	return fmt.Sprintf("failed to parse '%s' contents %q%s: %s", e.Source, e.Content, truncated, e.Err)
+}
+
+// Unwrap returns why the contents could not be parsed
+func (e PortFileParseError) Unwrap() error {
+	return e.Err
+}
+
+// PortFilePermissionError indicates a port file exists but the tool is not permitted to read it, usually because it is owned by another user
+type PortFilePermissionError struct {
+	// Path is the port file
+	Path string
+
+	// Err is the error reading the port file failed with
+	Err error
+}
+
+// Error returns an error message which explains how to fix the permissions
+func (e PortFilePermissionError) Error() string {
+	return fmt.Sprintf("cannot read port file '%s': permission denied, check the port file is readable by the user the tool runs as (uid %d), in a container set its user or the file's owner: %s", e.Path, os.Getuid(), e.Err)
+}
+
+// Unwrap returns the error reading the port file failed with
+func (e PortFilePermissionError) Unwrap() error {
+	return e.Err
+}
+
+// ErrPortFileReadTimeout indicates reading a port file did not finish in time, usually because its filesystem, like a stale network mount, is not responding
+var ErrPortFileReadTimeout = errors.New("timed out reading port file")
+
+// readWithTimeout calls read and returns its result, or an error wrapping ErrPortFileReadTimeout if it does not return within timeout, zero means no limit.
+// A read stuck on a filesystem can't be canceled, so one which times out is left to finish in the background.
+func readWithTimeout(timeout time.Duration, read func() ([]byte, error)) ([]byte, error) {
+	if timeout <= 0 {
+		return read()
+	}
+
+	type readResult struct {
+		content []byte
+		err     error
+	}
+
+	// Buffered so the read can finish after the timeout without anything receiving its result
+	results := make(chan readResult, 1)
+	go func() {
+		content, err := read()
+		results <- readResult{content: content, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-results:
+		return result.content, result.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: did not finish within %s", ErrPortFileReadTimeout, timeout)
+	}
+}
+
+// portFIFOReadTimeout is the longest a port file which is a named pipe is waited on for a port to be written
+const portFIFOReadTimeout = time.Second
+
+// readPortFileWithFIFOTimeout reads a port file, a named pipe is waited on for at most portFIFOReadTimeout
+func readPortFileWithFIFOTimeout(path string) ([]byte, error) {
+	return ReadPortFile(path, portFIFOReadTimeout)
+}
+
+// ReadPortFile reads the contents of a port file.
+// Some VPN scripts write the port to a named pipe (FIFO) instead of a regular file, reading one normally blocks until a writer appears.
+// Named pipes are instead read for at most fifoTimeout, if no writer has written a port by then an error wrapping ErrPortNotAvailable is returned.
+func ReadPortFile(path string, fifoTimeout time.Duration) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		return os.ReadFile(path)
+	}
+
+	// Opening a named pipe without O_NONBLOCK blocks until a writer opens it
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := file.SetReadDeadline(time.Now().Add(fifoTimeout)); err != nil {
+		return nil, fmt.Errorf("failed to set a read timeout on named pipe: %s", err)
+	}
+
+	content, err := io.ReadAll(file)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("is a named pipe which was not written to within %s: %w", fifoTimeout, ErrPortNotAvailable)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Reading a named pipe which has no writer ends immediately without any content
+	if len(content) == 0 {
+		return nil, fmt.Errorf("is a named pipe which has no writer yet: %w", ErrPortNotAvailable)
+	}
+
+	return content, nil
+}
+
+// natpmpcMappedPortRegexp matches the line natpmpc outputs when a port mapping is created, ex:
+// Mapped public port 49152 protocol TCP to local port 0 liftime 60
+var natpmpcMappedPortRegexp = regexp.MustCompile(`Mapped public port (\d+) protocol`)
+
+// ParsePort extracts the port from the contents of a port file in the provided format.
+// The selector picks the port if the contents contain multiple, it is only used by formats which can contain multiple ports.
+// Returns ErrPortNotAvailable if the contents are valid for the format but do not contain a port yet.
+// A port of 0 is returned as is, whether it means no port is forwarded yet is up to the caller.
+func ParsePort(format PortFileFormat, selector PortSelector, content []byte) (uint16, error) {
+	switch format {
+	case PortFileFormatPlain:
+		// The \r of files written with Windows line endings is whitespace too, so "49152\r\n" is a valid port
+		value := strings.TrimSpace(string(content))
+		if len(value) == 0 {
+			return 0, fmt.Errorf("port file is empty: %w", ErrPortNotAvailable)
+		}
+
+		return parsePortNumber(value)
+	case PortFileFormatNATPMPC:
+		match := natpmpcMappedPortRegexp.FindSubmatch(content)
+		if match == nil {
+			return 0, fmt.Errorf("natpmpc output does not contain a mapped public port: %w", ErrPortNotAvailable)
+		}
+
+		return parsePortNumber(string(match[1]))
+	case PortFileFormatJSON:
+		if len(selector.JSONPath) > 0 {
+			return selector.lookupJSONPath(content)
+		}
+
+		mappings, err := parseJSONPortMappings(content)
+		if err != nil {
+			return 0, err
+		}
+		if len(mappings) == 0 {
+			return 0, fmt.Errorf("JSON does not contain any ports: %w", ErrPortNotAvailable)
+		}
+
+		return selector.Select(mappings)
+	case PortFileFormatRange:
+		value := strings.TrimSpace(string(content))
+		if len(value) == 0 {
+			return 0, fmt.Errorf("port file is empty: %w", ErrPortNotAvailable)
+		}
+
+		return parsePortRange(value)
+	case PortFileFormatFirstToken:
+		tokens := strings.Fields(string(content))
+		if len(tokens) == 0 {
+			return 0, fmt.Errorf("port file is empty: %w", ErrPortNotAvailable)
+		}
+
+		return parsePortNumber(tokens[0])
+	default:
+		return 0, fmt.Errorf("unknown port file format '%s'", format)
+	}
+}
+
+// parsePortNumber converts a string into a port number
+func parsePortNumber(value string) (uint16, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		// The value may be the entire contents of a port file, so only its start is included
+		if len(value) > maxPortFileErrorContent {
+			value = value[:maxPortFileErrorContent] + "..."
+		}
+
+		return 0, fmt.Errorf("failed to convert '%s' into a port number: %s", value, errors.Unwrap(err))
+	}
+
+	return uint16(port), nil
+}
+
+// portRangeSeparators separate the first and last port of a range in a PortFileFormatRange port file
+const portRangeSeparators = "-:"
+
+// parsePortRange converts a port number, or a range of ports which contains only one port, into a port number.
+// qBittorrent listens on one port, so a range of multiple ports is an error.
+func parsePortRange(value string) (uint16, error) {
+	separator := strings.IndexAny(value, portRangeSeparators)
+	if separator == -1 {
+		return parsePortNumber(value)
+	}
+
+	first, err := parsePortNumber(strings.TrimSpace(value[:separator]))
+	if err != nil {
+		return 0, fmt.Errorf("first port of range: %w", err)
+	}
+	last, err := parsePortNumber(strings.TrimSpace(value[separator+1:]))
+	if err != nil {
+		return 0, fmt.Errorf("last port of range: %w", err)
+	}
+
+	if first != last {
+		return 0, fmt.Errorf("range %d-%d contains multiple ports, qBittorrent listens on only one port", first, last)
+	}
+
+	return first, nil
+}
+
+// PortLostAction is what is done when the port files no longer contain a port, after previously containing one
+type PortLostAction string
+
+const (
+	// PortLostActionIgnore leaves qBittorrent untouched, syncs behave as if the port files never contained a port
+	PortLostActionIgnore PortLostAction = "ignore"
+
+	// PortLostActionKeep keeps setting the last port read from the port files
+	PortLostActionKeep PortLostAction = "keep"
+
+	// PortLostActionDefault sets a fallback port
+	PortLostActionDefault PortLostAction = "default"
+)
+
+// PortLostPolicy describes what is done when the port files no longer contain a port, after previously containing one
+type PortLostPolicy struct {
+	// Action to take
+	Action PortLostAction
+
+	// DefaultPort is the port set by PortLostActionDefault
+	DefaultPort uint16
+}
+
+// ParsePortLostPolicy parses a policy in the format "ignore", "keep", or "default:<port>"
+func ParsePortLostPolicy(value string) (PortLostPolicy, error) {
+	action, arg, hasArg := strings.Cut(value, ":")
+
+	switch PortLostAction(action) {
+	case PortLostActionIgnore, PortLostActionKeep:
+		if hasArg {
+			return PortLostPolicy{}, fmt.Errorf("'%s' does not accept a value", action)
+		}
+
+		return PortLostPolicy{Action: PortLostAction(action)}, nil
+	case PortLostActionDefault:
+		port, err := parsePortNumber(arg)
+		if err != nil {
+			return PortLostPolicy{}, fmt.Errorf("'%s' must be followed by a valid port, like '%s:6881': %s", action, action, err)
+		}
+		if port == 0 {
+			return PortLostPolicy{}, fmt.Errorf("'%s' port must not be 0", action)
+		}
+
+		return PortLostPolicy{Action: PortLostActionDefault, DefaultPort: port}, nil
+	default:
+		return PortLostPolicy{}, fmt.Errorf("must be one of '%s', '%s', or '%s:<port>'", PortLostActionIgnore, PortLostActionKeep, PortLostActionDefault)
+	}
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	// Min is the lowest port in the range
+	Min uint16
+
+	// Max is the highest port in the range
+	Max uint16
+}
+
+// ParsePortRange parses a range in the format "<min>-<max>"
+func ParsePortRange(value string) (PortRange, error) {
+	minValue, maxValue, found := strings.Cut(value, "-")
+	if !found {
+		return PortRange{}, fmt.Errorf("must be in the format '<min>-<max>'")
+	}
+
+	minPort, err := parsePortNumber(strings.TrimSpace(minValue))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid minimum: %s", err)
+	}
+
+	maxPort, err := parsePortNumber(strings.TrimSpace(maxValue))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid maximum: %s", err)
+	}
+
+	if minPort > maxPort {
+		return PortRange{}, fmt.Errorf("minimum %d is greater than maximum %d", minPort, maxPort)
+	}
+
+	return PortRange{Min: minPort, Max: maxPort}, nil
+}
+
+// Contains indicates if port is within the range
+func (portRange PortRange) Contains(port uint16) bool {
+	return port >= portRange.Min && port <= portRange.Max
+}
+
+// String formats the range in the format ParsePortRange accepts
+func (portRange PortRange) String() string {
+	return fmt.Sprintf("%d-%d", portRange.Min, portRange.Max)
+}
+
+// PortMapping is one port forwarded by a VPN
+type PortMapping struct {
+	// Port is the forwarded port
+	Port uint16
+
+	// Protocol is the protocol the port is forwarded for, like "tcp" or "udp", empty if not specified
+	Protocol string
+}
+
+// String formats the mapping like "6881/tcp"
+func (mapping PortMapping) String() string {
+	if len(mapping.Protocol) == 0 {
+		return fmt.Sprint(mapping.Port)
+	}
+
+	return fmt.Sprintf("%d/%s", mapping.Port, mapping.Protocol)
+}
+
+// parseJSONPortMappings extracts port mappings from JSON. The JSON can be:
+//   - A port number: 6881
+//   - An object with a port, and optionally a protocol: {"port": 6881, "protocol": "tcp"}
+//   - An object with a list of ports: {"ports": [...]}
+//   - A list where each item is a port number or an object with a port
+func parseJSONPortMappings(content []byte) ([]PortMapping, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %s", err)
+	}
+
+	return jsonPortMappings(value)
+}
+
+// jsonPortMappings extracts port mappings from a decoded JSON value
+func jsonPortMappings(value interface{}) ([]PortMapping, error) {
+	switch typed := value.(type) {
+	case json.Number:
+		port, err := parsePortNumber(typed.String())
+		if err != nil {
+			return nil, err
+		}
+
+		return []PortMapping{{Port: port}}, nil
+	case []interface{}:
+		var mappings []PortMapping
+		for i, item := range typed {
+			itemMappings, err := jsonPortMappings(item)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %s", i, err)
+			}
+			mappings = append(mappings, itemMappings...)
+		}
+
+		return mappings, nil
+	case map[string]interface{}:
+		if ports, ok := typed["ports"]; ok {
+			return jsonPortMappings(ports)
+		}
+
+		portValue, ok := typed["port"].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("object does not contain a numeric 'port' or a 'ports' list")
+		}
+
+		port, err := parsePortNumber(portValue.String())
+		if err != nil {
+			return nil, err
+		}
+
+		protocol, _ := typed["protocol"].(string)
+
+		return []PortMapping{{Port: port, Protocol: strings.ToLower(protocol)}}, nil
+	default:
+		return nil, fmt.Errorf("expected a port number, an object, or a list, found %v", value)
+	}
+}
+
+// PortSelector picks one port when a port file contains multiple
+type PortSelector struct {
+	// Index of the port to pick, used if Protocol is empty
+	Index int
+
+	// Protocol of the port to pick, the first port with the protocol is picked
+	Protocol string
+
+	// JSONPath is an expression which extracts the port from JSON of any shape, if set Index and Protocol are not used
+	JSONPath string
+}
+
+// ParsePortSelector parses a selector in the format "index:<n>", "protocol:<protocol>", or "jsonpath:<expression>", an empty selector picks the first port
+func ParsePortSelector(value string) (PortSelector, error) {
+	if len(value) == 0 {
+		return PortSelector{}, nil
+	}
+
+	kind, arg, _ := strings.Cut(value, ":")
+	switch kind {
+	case "index":
+		index, err := strconv.Atoi(arg)
+		if err != nil || index < 0 {
+			return PortSelector{}, fmt.Errorf("'index' must be followed by a number 0 or greater, like 'index:1'")
+		}
+
+		return PortSelector{Index: index}, nil
+	case "protocol":
+		if len(arg) == 0 {
+			return PortSelector{}, fmt.Errorf("'protocol' must be followed by a protocol, like 'protocol:tcp'")
+		}
+
+		return PortSelector{Protocol: strings.ToLower(arg)}, nil
+	case "jsonpath":
+		// The expression may contain colons, like a slice
+		_, expression, _ := strings.Cut(value, ":")
+		if len(expression) == 0 {
+			return PortSelector{}, fmt.Errorf("'jsonpath' must be followed by an expression, like 'jsonpath:$.vpn.port'")
+		}
+		if _, err := jsonpath.Compile(expression); err != nil {
+			return PortSelector{}, fmt.Errorf("invalid JSONPath '%s': %s", expression, err)
+		}
+
+		return PortSelector{JSONPath: expression}, nil
+	default:
+		return PortSelector{}, fmt.Errorf("must be 'index:<n>', 'protocol:<protocol>', or 'jsonpath:<expression>'")
+	}
+}
+
+// lookupJSONPath extracts the port from content using the JSONPath expression.
+// The expression must match one number, or one string containing a number. A null value is treated as no port being available yet.
+func (selector PortSelector) lookupJSONPath(content []byte) (uint16, error) {
+	var document interface{}
+	if err := json.Unmarshal(content, &document); err != nil {
+		return 0, fmt.Errorf("failed to decode JSON: %s", err)
+	}
+
+	compiled, err := jsonpath.Compile(selector.JSONPath)
+	if err != nil {
+		return 0, fmt.Errorf("invalid JSONPath '%s': %s", selector.JSONPath, err)
+	}
+
+	value, err := compiled.Lookup(document)
+	if err != nil {
+		return 0, fmt.Errorf("JSONPath '%s' does not match: %s", selector.JSONPath, err)
+	}
+
+	// Expressions which can match multiple values, like filters, match a list
+	if values, ok := value.([]interface{}); ok {
+		if len(values) != 1 {
+			return 0, fmt.Errorf("JSONPath '%s' must match one value, matched %d: %v", selector.JSONPath, len(values), values)
+		}
+		value = values[0]
+	}
+
+	switch port := value.(type) {
+	case nil:
+		return 0, fmt.Errorf("JSONPath '%s' matched null: %w", selector.JSONPath, ErrPortNotAvailable)
+	case float64:
+		if port != float64(uint16(port)) {
+			return 0, fmt.Errorf("JSONPath '%s' matched %v, which is not a valid port number", selector.JSONPath, port)
+		}
+
+		return uint16(port), nil
+	case string:
+		return parsePortNumber(strings.TrimSpace(port))
+	default:
+		return 0, fmt.Errorf("JSONPath '%s' must match a port number, matched %v", selector.JSONPath, value)
+	}
+}
+
+// Select picks a port from mappings, returns an error listing the mappings if none match
+func (selector PortSelector) Select(mappings []PortMapping) (uint16, error) {
+	if len(selector.Protocol) > 0 {
+		for _, mapping := range mappings {
+			if mapping.Protocol == selector.Protocol {
+				return mapping.Port, nil
+			}
+		}
+
+		return 0, fmt.Errorf("no port has protocol '%s', ports are %v", selector.Protocol, mappings)
+	}
+
+	if selector.Index >= len(mappings) {
+		return 0, fmt.Errorf("no port at index %d, ports are %v", selector.Index, mappings)
+	}
+
+	return mappings[selector.Index].Port, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// errAny is used by tests which expect an error but do not care which
+var errAny = errors.New("any error")
+
+// natpmpcOutput is the output of natpmpc mapping a port with a VPN provider's gateway
+const natpmpcOutput = `initnatpmp() returned 0 (SUCCESS)
+using gateway : 10.2.0.1
+sendpublicaddressrequest returned 2 (SUCCESS)
+readnatpmpresponseorretry returned 0 (OK)
+Public IP address : 203.0.113.7
+epoch = 1834290
+sendnewportmappingrequest returned 12 (SUCCESS)
+readnatpmpresponseorretry returned 0 (OK)
+Mapped public port 49152 protocol UDP to local port 0 liftime 60
+epoch = 1834290
+closenatpmp() returned 0 (SUCCESS)
+`
+
+// natpmpcFailedOutput is the output of natpmpc when the gateway does not support NAT-PMP
+const natpmpcFailedOutput = `initnatpmp() returned 0 (SUCCESS)
+using gateway : 10.2.0.1
+sendpublicaddressrequest returned 2 (SUCCESS)
+readnatpmpresponseorretry returned -7 (FAILED)
+readnatpmpresponseorretry() failed : the gateway does not support nat-pmp
+  errno=111 'Connection refused'
+`
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   PortFileFormat
+		selector PortSelector
+		content  string
+		want     uint16
+
+		// wantErr is ErrPortNotAvailable if the error must wrap it, or errAny if any error is expected
+		wantErr error
+	}{
+		{name: "plain", format: PortFileFormatPlain, content: "6881", want: 6881},
+		{name: "plain surrounding whitespace", format: PortFileFormatPlain, content: "  6881\n", want: 6881},
+		{name: "plain windows line ending", format: PortFileFormatPlain, content: "49152\r\n", want: 49152},
+		{name: "plain only windows line ending", format: PortFileFormatPlain, content: "\r\n", wantErr: ErrPortNotAvailable},
+		{name: "plain not a number", format: PortFileFormatPlain, content: "abc", wantErr: errAny},
+		{name: "plain too large", format: PortFileFormatPlain, content: "65536", wantErr: errAny},
+		{name: "plain empty", format: PortFileFormatPlain, content: " \n", wantErr: ErrPortNotAvailable},
+		{name: "plain zero", format: PortFileFormatPlain, content: "0", want: 0},
+
+		{name: "natpmpc", format: PortFileFormatNATPMPC, content: natpmpcOutput, want: 49152},
+		{name: "natpmpc no mapping", format: PortFileFormatNATPMPC, content: natpmpcFailedOutput, wantErr: ErrPortNotAvailable},
+		{name: "natpmpc empty", format: PortFileFormatNATPMPC, content: "", wantErr: ErrPortNotAvailable},
+		{name: "natpmpc zero", format: PortFileFormatNATPMPC, content: "Mapped public port 0 protocol TCP", want: 0},
+		{name: "natpmpc port too large", format: PortFileFormatNATPMPC, content: "Mapped public port 70000 protocol TCP", wantErr: errAny},
+
+		{name: "json number", format: PortFileFormatJSON, content: "6881", want: 6881},
+		{name: "json object", format: PortFileFormatJSON, content: `{"port": 6881, "protocol": "tcp"}`, want: 6881},
+		{name: "json list first", format: PortFileFormatJSON, content: `[6881, {"port": 6882}]`, want: 6881},
+		{name: "json list index", format: PortFileFormatJSON, selector: PortSelector{Index: 1}, content: `[6881, {"port": 6882}]`, want: 6882},
+		{name: "json list index out of range", format: PortFileFormatJSON, selector: PortSelector{Index: 2}, content: `[6881, 6882]`, wantErr: errAny},
+		{name: "json ports protocol", format: PortFileFormatJSON, selector: PortSelector{Protocol: "udp"}, content: `{"ports": [{"port": 6881, "protocol": "TCP"}, {"port": 6882, "protocol": "UDP"}]}`, want: 6882},
+		{name: "json no port with protocol", format: PortFileFormatJSON, selector: PortSelector{Protocol: "udp"}, content: `[{"port": 6881, "protocol": "tcp"}]`, wantErr: errAny},
+		{name: "json empty list", format: PortFileFormatJSON, content: `{"ports": []}`, wantErr: ErrPortNotAvailable},
+		{name: "json no port", format: PortFileFormatJSON, content: `{"mapping": 6881}`, wantErr: errAny},
+		{name: "json invalid", format: PortFileFormatJSON, content: `{"port": `, wantErr: errAny},
+		{name: "jsonpath top level", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.forwarded_port"}, content: `{"forwarded_port": 6881, "status": "connected"}`, want: 6881},
+		{name: "jsonpath nested", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.vpn.port"}, content: `{"vpn": {"server": "nl-1", "port": 6881}}`, want: 6881},
+		{name: "jsonpath string", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.vpn.port"}, content: `{"vpn": {"port": "6881"}}`, want: 6881},
+		{name: "jsonpath index", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.mappings[1].public"}, content: `{"mappings": [{"public": 6881}, {"public": 6882}]}`, want: 6882},
+		{name: "jsonpath filter", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.mappings[?(@.protocol == 'udp')].public"}, content: `{"mappings": [{"public": 6881, "protocol": "tcp"}, {"public": 6882, "protocol": "udp"}]}`, want: 6882},
+		{name: "jsonpath filter multiple", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.mappings[?(@.public > 0)].public"}, content: `{"mappings": [{"public": 6881}, {"public": 6882}]}`, wantErr: errAny},
+		{name: "jsonpath no match", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.vpn.port"}, content: `{"forwarded_port": 6881}`, wantErr: errAny},
+		{name: "jsonpath null", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.vpn.port"}, content: `{"vpn": {"port": null}}`, wantErr: ErrPortNotAvailable},
+		{name: "jsonpath not a port", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.vpn.port"}, content: `{"vpn": {"port": 70000}}`, wantErr: errAny},
+		{name: "jsonpath object", format: PortFileFormatJSON, selector: PortSelector{JSONPath: "$.vpn"}, content: `{"vpn": {"port": 6881}}`, wantErr: errAny},
+
+		{name: "range single port", format: PortFileFormatRange, content: "49152-49152\n", want: 49152},
+		{name: "range windows line ending", format: PortFileFormatRange, content: "49152-49152\r\n", want: 49152},
+		{name: "range single port colon", format: PortFileFormatRange, content: "49152:49152", want: 49152},
+		{name: "range multiple ports", format: PortFileFormatRange, content: "49152:49153", wantErr: errAny},
+		{name: "range plain", format: PortFileFormatRange, content: "49152", want: 49152},
+		{name: "range empty", format: PortFileFormatRange, content: "\n", wantErr: ErrPortNotAvailable},
+		{name: "range not a number", format: PortFileFormatRange, content: "49152-abc", wantErr: errAny},
+		{name: "plain two lines", format: PortFileFormatPlain, content: "49152\n2026-10-16T12:00:00Z\n", wantErr: errAny},
+		{name: "first token two lines", format: PortFileFormatFirstToken, content: "49152\n2026-10-16T12:00:00Z\n", want: 49152},
+		{name: "first token windows line endings", format: PortFileFormatFirstToken, content: "49152\r\n2026-10-16T12:00:00Z\r\n", want: 49152},
+		{name: "first token same line", format: PortFileFormatFirstToken, content: "  49152 forwarded at 12:00\n", want: 49152},
+		{name: "first token leading blank lines", format: PortFileFormatFirstToken, content: "\n\n49152\n", want: 49152},
+		{name: "first token empty", format: PortFileFormatFirstToken, content: " \n", wantErr: ErrPortNotAvailable},
+		{name: "first token not a number", format: PortFileFormatFirstToken, content: "port: 49152\n", wantErr: errAny},
+
+		{name: "unknown format", format: "xml", content: "6881", wantErr: errAny},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port, err := ParsePort(test.format, test.selector, []byte(test.content))
+			if test.wantErr != nil {
+				if err == nil {
+					t.Fatalf("expected an error, got port %d", port)
+				}
+				if test.wantErr != errAny && !errors.Is(err, test.wantErr) {
+					t.Fatalf("expected an error wrapping %q, got: %s", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if port != test.want {
+				t.Errorf("port is %d, expected %d", port, test.want)
+			}
+		})
+	}
+}
+
+func TestParsePortLostPolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    PortLostPolicy
+		wantErr bool
+	}{
+		{value: "ignore", want: PortLostPolicy{Action: PortLostActionIgnore}},
+		{value: "keep", want: PortLostPolicy{Action: PortLostActionKeep}},
+		{value: "default:6881", want: PortLostPolicy{Action: PortLostActionDefault, DefaultPort: 6881}},
+		{value: "ignore:6881", wantErr: true},
+		{value: "keep:", wantErr: true},
+		{value: "default", wantErr: true},
+		{value: "default:", wantErr: true},
+		{value: "default:0", wantErr: true},
+		{value: "default:65536", wantErr: true},
+		{value: "default:abc", wantErr: true},
+		{value: "", wantErr: true},
+		{value: "Keep", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			policy, err := ParsePortLostPolicy(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if policy != test.want {
+				t.Errorf("policy is %+v, expected %+v", policy, test.want)
+			}
+		})
+	}
+}
+
+func TestParsePortSelector(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    PortSelector
+		wantErr bool
+	}{
+		{value: "", want: PortSelector{}},
+		{value: "index:2", want: PortSelector{Index: 2}},
+		{value: "protocol:UDP", want: PortSelector{Protocol: "udp"}},
+		{value: "index:-1", wantErr: true},
+		{value: "index:first", wantErr: true},
+		{value: "protocol:", wantErr: true},
+		{value: "jsonpath:$.vpn.port", want: PortSelector{JSONPath: "$.vpn.port"}},
+		{value: "jsonpath:$.ports[0:1]", want: PortSelector{JSONPath: "$.ports[0:1]"}},
+		{value: "jsonpath:", wantErr: true},
+		{value: "jsonpath:vpn.port", wantErr: true},
+		{value: "port:6881", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			selector, err := ParsePortSelector(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if selector != test.want {
+				t.Errorf("selector is %+v, expected %+v", selector, test.want)
+			}
+		})
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    PortRange
+		wantErr bool
+	}{
+		{value: "40000-60000", want: PortRange{Min: 40000, Max: 60000}},
+		{value: " 40000 - 60000 ", want: PortRange{Min: 40000, Max: 60000}},
+		{value: "6881-6881", want: PortRange{Min: 6881, Max: 6881}},
+		{value: "60000-40000", wantErr: true},
+		{value: "40000", wantErr: true},
+		{value: "40000-70000", wantErr: true},
+		{value: "a-60000", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			portRange, err := ParsePortRange(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", portRange)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if portRange != test.want {
+				t.Errorf("range is %s, expected %s", portRange, test.want)
+			}
+		})
+	}
+}
+
+func TestReadWithTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+
+		// readDuration is how long the read takes
+		readDuration time.Duration
+
+		wantErr error
+	}{
+		{name: "finishes in time", timeout: time.Second, readDuration: 0},
+		{name: "no limit", timeout: 0, readDuration: 50 * time.Millisecond},
+		{name: "times out", timeout: 50 * time.Millisecond, readDuration: 5 * time.Second, wantErr: ErrPortFileReadTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			content, err := readWithTimeout(test.timeout, func() ([]byte, error) {
+				time.Sleep(test.readDuration)
+				return []byte("50000"), nil
+			})
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("error is %v, expected it to wrap %v", err, test.wantErr)
+			}
+			if test.wantErr != nil {
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("took %s to time out, expected about %s", elapsed, test.timeout)
+				}
+				return
+			}
+
+			if string(content) != "50000" {
+				t.Errorf("content is '%s', expected '50000'", content)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+// makeFIFO creates a named pipe in a temporary directory
+func makeFIFO(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "port")
+	if err := syscall.Mkfifo(path, 0o644); err != nil {
+		t.Fatalf("failed to create named pipe: %s", err)
+	}
+
+	return path
+}
+
+func TestReadPortFileFIFO(t *testing.T) {
+	fifo := makeFIFO(t)
+
+	start := time.Now()
+	if _, err := ReadPortFile(fifo, 5*time.Second); !errors.Is(err, ErrPortNotAvailable) {
+		t.Errorf("reading a named pipe without a writer failed with %v, expected ErrPortNotAvailable", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("reading a named pipe without a writer took %s, expected it to not wait", elapsed)
+	}
+
+	// Opening the named pipe for reading and writing does not block and makes it have a writer which has not written yet
+	writer, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open named pipe for writing: %s", err)
+	}
+	defer writer.Close()
+
+	if _, err := ReadPortFile(fifo, 200*time.Millisecond); !errors.Is(err, ErrPortNotAvailable) {
+		t.Errorf("reading a named pipe which was not written to failed with %v, expected ErrPortNotAvailable", err)
+	}
+}
+
+func TestPortSyncerPortFilePermissionDenied(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+	if err := os.Chmod(portFile, 0o000); err != nil {
+		t.Fatalf("failed to make port file unreadable: %s", err)
+	}
+
+	// root can read any file, so the error a regular user gets is returned instead
+	if os.Geteuid() == 0 {
+		syncer.readPortFile = func(path string) ([]byte, error) {
+			return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EACCES}
+		}
+	}
+
+	_, err := syncer.Sync(context.Background())
+
+	var permissionErr PortFilePermissionError
+	if !errors.As(err, &permissionErr) || permissionErr.Path != portFile {
+		t.Fatalf("error is %v, expected a PortFilePermissionError for the port file", err)
+	}
+	if !strings.Contains(err.Error(), "cannot read port file '"+portFile+"': permission denied") || !strings.Contains(err.Error(), "user the tool runs as") {
+		t.Errorf("error '%s' does not explain the port file can't be read because of its permissions", err)
+	}
+	if class := ClassifyFailure(err); class != FailureClassPortFilePermission {
+		t.Errorf("failure class is %s, expected %s", class, FailureClassPortFilePermission)
+	}
+	if requests := fake.Requests("/api/v2/app/setPreferences"); requests != 0 {
+		t.Errorf("set preferences %d times, expected qBittorrent not to be changed", requests)
+	}
+}
+
+func TestPortSyncerFIFOPortFile(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	fifo := makeFIFO(t)
+	syncer, _ := newTestSyncer(t, fake, NewPortSyncerOptions{PortFiles: []string{fifo}, AllowPortFileNotExist: true})
+
+	// Without a writer the sync must not hang
+	changed, err := syncer.Sync(context.Background())
+	if err != nil || changed {
+		t.Fatalf("sync without a writer returned (%t, %v), expected no change and no error", changed, err)
+	}
+
+	writer, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open named pipe for writing: %s", err)
+	}
+	time.AfterFunc(200*time.Millisecond, func() {
+		writer.WriteString("50000\n")
+		writer.Close()
+	})
+
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("qBittorrent port is %d, expected 50000 written to the named pipe after a delay", port)
+	}
+}
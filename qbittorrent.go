@@ -0,0 +1,1849 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QBittorrentClient is an API client for qBittorrent
+type QBittorrentClient struct {
+	// logger is used to output information
+	logger golog.Logger
+
+	// baseURL is the location of the qBittorrent API location
+	baseURL url.URL
+
+	// httpClient used to make API requests, stores auth cookies
+	httpClient *http.Client
+
+	// username to login with
+	username string
+
+	// password to login with
+	password string
+
+	// skipLogin indicates qBittorrent does not require authentication, so logging in is never attempted
+	skipLogin bool
+
+	// sessionID is the session cookie value which was obtained outside of the tool and seeded into the cookie jar, empty if the tool logs in itself
+	sessionID string
+
+	// headers are added to every request
+	headers http.Header
+
+	// hostHeader replaces the Host header of every request, empty to use the host of baseURL
+	hostHeader string
+
+	// maxResponseBodyBytes is the largest response body which is read, larger responses fail
+	maxResponseBodyBytes int64
+
+	// sessionRefreshMargin is subtracted from the session cookie's expiry to tolerate clock skew, the session is refreshed this long before it expires
+	sessionRefreshMargin time.Duration
+
+	// sessionRefreshAt is when the session should be proactively refreshed by logging in again, zero if the session cookie has no expiry
+	sessionRefreshAt time.Time
+
+	// slowRequestThreshold is the request duration above which a warning is logged, zero disables the warning
+	slowRequestThreshold time.Duration
+
+	// metrics records retries and request durations
+	metrics *Metrics
+
+	// readinessBackoff computes the delays between attempts to reach qBittorrent while waiting for it to be ready
+	readinessBackoff Backoff
+
+	// unavailableRetries is the number of times a request which qBittorrent responded to with 503 is retried
+	unavailableRetries int
+
+	// unavailableBackoff computes the delays between retries of requests qBittorrent responded to with 503
+	unavailableBackoff Backoff
+
+	// setPreferencesRequest is how requests to set preferences are made
+	setPreferencesRequest SetPreferencesRequest
+
+	// preserveScheduler indicates the alternative speed limit scheduler preferences are read and sent unchanged with every set preferences request
+	preserveScheduler bool
+
+	// networkPreferencesPath is the API path of a typed endpoint which sets network preferences, used instead of setPreferencesRequest while supported. Empty if none
+	networkPreferencesPath string
+
+	// networkPreferencesUnsupported indicates qBittorrent responded that the network preferences endpoint does not exist, so setPreferencesRequest is used
+	networkPreferencesUnsupported atomic.Bool
+
+	// formEncoding is how form request bodies are encoded
+	formEncoding FormEncoding
+
+	// postLoginDelay is how long to wait after logging in before making requests with the new session
+	postLoginDelay time.Duration
+
+	// maskHostInLogs indicates qBittorrent's host is replaced in URLs which are logged or included in errors
+	maskHostInLogs bool
+
+	// tracer creates spans around logging in and getting and setting preferences
+	tracer trace.Tracer
+
+	// apiPathPrefix is the path of the API relative to baseURL, which endpoint paths are appended to
+	apiPathPrefix string
+
+	// retries is the number of requests which have been retried
+	retries atomic.Int64
+
+	// requests is the number of requests which have been sent
+	requests atomic.Int64
+
+	// loggedIn indicates the client logged in at least once, so later logins replace a session qBittorrent rejected
+	loggedIn atomic.Bool
+
+	// versionDetected indicates qBittorrent's version was retrieved, so the compatibility headers it requires are known
+	versionDetected atomic.Bool
+
+	// originHeaders indicates Origin and Referer headers are sent with POST requests, which qBittorrent 5 requires
+	originHeaders atomic.Bool
+}
+
+// NewQBittorrentClientOptions are options for creating a new QBittorrentClient
+type NewQBittorrentClientOptions struct {
+	// Logger is used to output information
+	Logger golog.Logger
+
+	// NetworkLocation is the location of the qBittorrent server
+	NetworkLocation string
+
+	// Username to login with
+	Username string
+
+	// Password to login with
+	Password string
+
+	// SessionID is the value of a session cookie obtained outside of the tool, which is used instead of logging in.
+	// If qBittorrent rejects it the tool logs in with Username and Password, if there is no Password requests fail with ErrSessionIDRejected.
+	SessionID string
+
+	// ClientCertFile is the path of a PEM encoded TLS client certificate presented to qBittorrent, for when it is behind a proxy which requires mutual TLS. Empty if no certificate is presented
+	ClientCertFile string
+
+	// ClientKeyFile is the path of the PEM encoded private key of ClientCertFile
+	ClientKeyFile string
+
+	// RequireHTTPS indicates NetworkLocation must use https and redirects to http are refused, so credentials are never sent in plaintext
+	RequireHTTPS bool
+
+	// MaskHostInLogs indicates qBittorrent's host is replaced in URLs which are logged or included in errors, so logs shared in bug reports don't reveal internal addresses. Credentials in URLs are always removed
+	MaskHostInLogs bool
+
+	// SkipLogin indicates qBittorrent does not require authentication, for example because it bypasses authentication for localhost, so logging in is never attempted
+	SkipLogin bool
+
+	// Headers are added to every request, for example to supply a service token to an authentication proxy in front of qBittorrent
+	Headers http.Header
+
+	// HostHeader replaces the Host header of every request, for a qBittorrent which validates the Host header and is reached by a different name. Empty to use the host of NetworkLocation
+	HostHeader string
+
+	// MaxResponseBodyBytes is the largest response body which is read, larger responses fail. Zero means no limit
+	MaxResponseBodyBytes int64
+
+	// SessionRefreshMargin is how long before the session cookie expires the session is proactively refreshed
+	SessionRefreshMargin time.Duration
+
+	// SlowRequestThreshold is the request duration above which a warning is logged, zero disables the warning
+	SlowRequestThreshold time.Duration
+
+	// Metrics records retries and request durations
+	Metrics *Metrics
+
+	// ReadinessBackoff computes the delays between attempts to reach qBittorrent while waiting for it to be ready
+	ReadinessBackoff Backoff
+
+	// UnavailableRetries is the number of times a request is retried if qBittorrent responds with 503, which it does while its WebUI is starting. Zero means requests are not retried
+	UnavailableRetries int
+
+	// UnavailableBackoff computes the delays between retries of requests qBittorrent responded to with 503
+	UnavailableBackoff Backoff
+
+	// DNSFallbackGracePeriod is how long after qBittorrent's host was last resolved the address it resolved to is used if resolving it fails, zero disables the fallback
+	DNSFallbackGracePeriod time.Duration
+
+	// DialTimeout is the maximum duration of establishing a connection to qBittorrent, zero means only the operating system's limit applies
+	DialTimeout time.Duration
+
+	// DialKeepAlive is the interval between TCP keep-alive probes of connections to qBittorrent, zero uses Go's default and negative disables keep-alive probes
+	DialKeepAlive time.Duration
+
+	// SetPreferencesRequest overrides how requests to set preferences are made, for qBittorrent forks whose API differs. Fields which are empty use DefaultSetPreferencesRequest
+	SetPreferencesRequest SetPreferencesRequest
+
+	// PreserveScheduler indicates the alternative speed limit scheduler preferences are read and sent unchanged with every set preferences request, so setting preferences does not reset the scheduler
+	PreserveScheduler bool
+
+	// NetworkPreferencesPath is the path, relative to the API path prefix, of a typed endpoint which sets network preferences from a JSON body, for qBittorrent versions or forks which have one.
+	// It is used instead of SetPreferencesRequest until qBittorrent responds that it does not exist. Empty always uses SetPreferencesRequest
+	NetworkPreferencesPath string
+
+	// FormEncoding is how the bodies of requests which send forms, like logging in and setting preferences, are encoded. Empty uses FormEncodingURLEncoded
+	FormEncoding FormEncoding
+
+	// PostLoginDelay is how long to wait after logging in before making requests with the new session, like repeating the request which was rejected, for proxies where a new session takes a moment to become valid. Zero does not wait
+	PostLoginDelay time.Duration
+
+	// TracerProvider provides the tracer which creates spans around logging in and getting and setting preferences, nil does not trace
+	TracerProvider trace.TracerProvider
+
+	// APIPathPrefix is the path of the API relative to NetworkLocation, for reverse proxies which rewrite paths. Empty uses DefaultAPIPathPrefix
+	APIPathPrefix string
+}
+
+// ParseNetworkLocation parses a qBittorrent network location into a base URL for API requests.
+// The scheme defaults to http if omitted, bare IPv6 addresses are bracketed, and trailing slashes are removed.
+func ParseNetworkLocation(netloc string) (*url.URL, error) {
+	netloc = strings.TrimSpace(netloc)
+	if len(netloc) == 0 {
+		return nil, fmt.Errorf("network location is empty")
+	}
+
+	if !strings.Contains(netloc, "://") {
+		netloc = "http://" + netloc
+	}
+
+	// Bracket bare IPv6 addresses so the port isn't confused with the address
+	scheme, rest, _ := strings.Cut(netloc, "://")
+	host, path, hasPath := strings.Cut(rest, "/")
+	if ip := net.ParseIP(host); ip != nil && strings.Contains(host, ":") {
+		netloc = fmt.Sprintf("%s://[%s]", scheme, host)
+		if hasPath {
+			netloc += "/" + path
+		}
+	}
+
+	parsed, err := url.Parse(netloc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse '%s' as a URL: %s", netloc, err)
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("scheme '%s' is not supported, must be http or https", parsed.Scheme)
+	}
+	if len(parsed.Hostname()) == 0 {
+		return nil, fmt.Errorf("'%s' does not contain a host", netloc)
+	}
+
+	parsed.Path = strings.TrimRight(parsed.Path, "/")
+	parsed.RawPath = ""
+
+	return parsed, nil
+}
+
+// DefaultAPIPathPrefix is the path of qBittorrent's API, which endpoint paths are appended to
+const DefaultAPIPathPrefix = "/api/v2"
+
+// ParseAPIPathPrefix validates an API path prefix and removes trailing slashes, so "/" is no prefix.
+// The prefix must start with a slash, and must be a plain path without a query, fragment, or whitespace.
+func ParseAPIPathPrefix(prefix string) (string, error) {
+	if !strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf("'%s' must start with /", prefix)
+	}
+
+	parsed, err := url.Parse(prefix)
+	if err != nil || parsed.Path != prefix || strings.ContainsAny(prefix, " \t\r\n") {
+		return "", fmt.Errorf("'%s' must be a plain path, without a query, fragment, escapes, or whitespace", prefix)
+	}
+
+	return strings.TrimRight(prefix, "/"), nil
+}
+
+// maskedHost replaces qBittorrent's host in logged URLs when masking is enabled
+const maskedHost = "<masked>"
+
+// LogURL formats u to be logged or included in errors. Credentials are always removed, if maskHost is true the host is also replaced, keeping the port
+func LogURL(u url.URL, maskHost bool) string {
+	u.User = nil
+	if maskHost {
+		port := u.Port()
+		u.Host = maskedHost
+		if len(port) > 0 {
+			u.Host += ":" + port
+		}
+	}
+
+	return u.String()
+}
+
+// NewQBittorrentClient creates a new QBittorrentClient
+func NewQBittorrentClient(opts NewQBittorrentClientOptions) (*QBittorrentClient, error) {
+	// Parse base URL
+	baseURL, err := ParseNetworkLocation(opts.NetworkLocation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network location into valid URL: %s", err)
+	}
+	if opts.RequireHTTPS && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("%w: network location '%s' uses the %s scheme", ErrHTTPSRequired, LogURL(*baseURL, opts.MaskHostInLogs), baseURL.Scheme)
+	}
+
+	// Create HTTP client, each client gets its own cookie jar so sessions of different qBittorrents never mix.
+	// Cookies ignore ports, so with a shared jar logging in to one qBittorrent would replace the session of another on the same host.
+	cookieJar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar for http client: %s", err)
+	}
+
+	// Cloning the default transport keeps its proxy, timeout, and compression behavior
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{}
+
+	if len(opts.ClientCertFile) > 0 {
+		clientCert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate '%s' and key '%s': %s", opts.ClientCertFile, opts.ClientKeyFile, err)
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	netDialer := newDialer(opts.DialTimeout, opts.DialKeepAlive)
+	transport.DialContext = netDialer.DialContext
+	if opts.DNSFallbackGracePeriod > 0 {
+		transport.DialContext = NewDNSFallbackDialer(opts.Logger, netDialer.DialContext, opts.DNSFallbackGracePeriod).DialContext
+	}
+
+	httpClient := &http.Client{
+		Jar:       cookieJar,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if opts.RequireHTTPS && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: %s was redirected to %s which uses the %s scheme", ErrHTTPSRequired, LogURL(*via[0].URL, opts.MaskHostInLogs), LogURL(*req.URL, opts.MaskHostInLogs), req.URL.Scheme)
+			}
+
+			// The API never redirects to another host, an authentication proxy in front of qBittorrent redirecting to its login page does
+			if req.URL.Host != baseURL.Host {
+				return fmt.Errorf("%w: %s was redirected to %s", ErrAuthProxyRedirect, LogURL(*via[0].URL, opts.MaskHostInLogs), LogURL(*req.URL, opts.MaskHostInLogs))
+			}
+
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			return nil
+		},
+	}
+
+	// A provided session is used as if the tool had logged in itself
+	if len(opts.SessionID) > 0 {
+		cookieJar.SetCookies(baseURL, []*http.Cookie{{
+			Name:  QBittorrentSessionCookieName,
+			Value: opts.SessionID,
+			Path:  "/",
+		}})
+	}
+
+	apiPathPrefix := opts.APIPathPrefix
+	if len(apiPathPrefix) == 0 {
+		apiPathPrefix = DefaultAPIPathPrefix
+	}
+	apiPathPrefix, err = ParseAPIPathPrefix(apiPathPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API path prefix: %s", err)
+	}
+
+	// The default set preferences path is under the API, so it moves with the prefix, a custom path is used as is
+	setPreferencesRequest := opts.SetPreferencesRequest.WithDefaults()
+	if setPreferencesRequest.Path == DefaultSetPreferencesRequest.Path {
+		setPreferencesRequest.Path = apiPathPrefix + "/app/setPreferences"
+	}
+	if err := setPreferencesRequest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid set preferences request: %s", err)
+	}
+	if len(opts.NetworkPreferencesPath) > 0 && !strings.HasPrefix(opts.NetworkPreferencesPath, "/") {
+		return nil, fmt.Errorf("network preferences path must start with '/', is '%s'", opts.NetworkPreferencesPath)
+	}
+
+	formEncoding := opts.FormEncoding
+	if len(formEncoding) == 0 {
+		formEncoding = FormEncodingURLEncoded
+	}
+	if !slices.Contains(FormEncodings, formEncoding) {
+		return nil, fmt.Errorf("form encoding must be one of %v, is '%s'", FormEncodings, formEncoding)
+	}
+
+	return &QBittorrentClient{
+		logger:                 opts.Logger,
+		baseURL:                *baseURL,
+		httpClient:             httpClient,
+		username:               opts.Username,
+		password:               opts.Password,
+		skipLogin:              opts.SkipLogin,
+		sessionID:              opts.SessionID,
+		headers:                opts.Headers,
+		hostHeader:             opts.HostHeader,
+		maxResponseBodyBytes:   opts.MaxResponseBodyBytes,
+		sessionRefreshMargin:   opts.SessionRefreshMargin,
+		slowRequestThreshold:   opts.SlowRequestThreshold,
+		metrics:                opts.Metrics,
+		readinessBackoff:       opts.ReadinessBackoff,
+		unavailableRetries:     opts.UnavailableRetries,
+		unavailableBackoff:     opts.UnavailableBackoff,
+		setPreferencesRequest:  setPreferencesRequest,
+		preserveScheduler:      opts.PreserveScheduler,
+		networkPreferencesPath: opts.NetworkPreferencesPath,
+		formEncoding:           formEncoding,
+		postLoginDelay:         opts.PostLoginDelay,
+		maskHostInLogs:         opts.MaskHostInLogs,
+		tracer:                 newTracer(opts.TracerProvider),
+		apiPathPrefix:          apiPathPrefix,
+	}, nil
+}
+
+// endpoint returns the URL of the API endpoint at path, which is relative to the API path prefix (ex., "/auth/login")
+func (client *QBittorrentClient) endpoint(path string) url.URL {
+	endpointURL := client.baseURL
+	endpointURL.Path += client.apiPathPrefix + path
+
+	return endpointURL
+}
+
+// QBittorrentSessionCookieName is the name of the cookie qBittorrent uses to identify a logged in session
+const QBittorrentSessionCookieName = "SID"
+
+// QBittorrentLoginNotAuthorizedError occurs when a qBittorrent API login request fails because credentials were not accepted by the server
+type QBittorrentLoginNotAuthorizedError struct {
+	err string
+}
+
+// Error returns an error message
+func (e QBittorrentLoginNotAuthorizedError) Error() string {
+	return e.err
+}
+
+// QBittorrentStatusError indicates qBittorrent responded with an unexpected status code
+type QBittorrentStatusError struct {
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+
+	// Status is the HTTP status of the response
+	Status string
+
+	// Body is the body of the response
+	Body []byte
+}
+
+// Error returns an error message
+func (e QBittorrentStatusError) Error() string {
+	return fmt.Sprintf("non-OK status code %d - %s: '%s'", e.StatusCode, e.Status, e.Body)
+}
+
+// ErrForbiddenAfterLogin indicates qBittorrent accepted the credentials but still refused a request, usually because of the user's permissions, an IP ban, or a reverse proxy
+var ErrForbiddenAfterLogin = errors.New("authorized but forbidden")
+
+// ErrSessionIDRejected indicates qBittorrent rejected the provided session cookie and there is no password to log in with instead
+var ErrSessionIDRejected = errors.New("qBittorrent rejected the provided session ID and no password is configured to log in with, provide a new session ID")
+
+// ErrQBittorrentUnavailable indicates qBittorrent kept responding with 503 after every retry, so it is not just its WebUI starting
+var ErrQBittorrentUnavailable = errors.New("qBittorrent is unavailable")
+
+// ErrWebUINotConfigured indicates qBittorrent served a web page, such as a first run setup page, instead of the API
+var ErrWebUINotConfigured = errors.New("qBittorrent WebUI not configured yet")
+
+// ErrResponseBodyTooLarge indicates a response body was larger than the limit, so it was not read
+var ErrResponseBodyTooLarge = errors.New("response body too large")
+
+// ErrHTTPSRequired indicates HTTPS is required but a network location or redirect uses plaintext HTTP
+var ErrHTTPSRequired = errors.New("HTTPS is required")
+
+// ErrAuthProxyRedirect indicates a request was redirected to another host, likely the login page of an authentication proxy in front of qBittorrent
+var ErrAuthProxyRedirect = errors.New("redirected to another host, qBittorrent may be behind an authentication proxy")
+
+// ErrAuthProxyChallenge indicates a request was refused with an authentication challenge, which qBittorrent never sends but authentication proxies do
+var ErrAuthProxyChallenge = errors.New("authentication challenge received, qBittorrent may be behind an authentication proxy")
+
+// authProxyHelp explains how to let API requests through an authentication proxy
+const authProxyHelp = "configure the proxy to bypass authentication for /api/v2/ (ex., an Authelia bypass rule) or supply a service token with REQUEST_HEADERS"
+
+// newDialer creates the dialer connections to qBittorrent are made with, timeout and keepAlive are used as net.Dialer's Timeout and KeepAlive
+func newDialer(timeout time.Duration, keepAlive time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: keepAlive,
+	}
+}
+
+// ParseRequestHeaders parses headers in the format "Name: value", separated by commas
+func ParseRequestHeaders(value string) (http.Header, error) {
+	headers := http.Header{}
+	if len(strings.TrimSpace(value)) == 0 {
+		return headers, nil
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		name, headerValue, found := strings.Cut(item, ":")
+		name = strings.TrimSpace(name)
+		if !found || len(name) == 0 {
+			return nil, fmt.Errorf("'%s' must be in the format 'Name: value'", strings.TrimSpace(item))
+		}
+		if strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("header name '%s' must not contain whitespace", name)
+		}
+
+		headers.Add(name, strings.TrimSpace(headerValue))
+	}
+
+	return headers, nil
+}
+
+// QBittorrentUnauthorizedError indicates the API client is not logged in
+type QBittorrentUnauthorizedError struct{}
+
+// Error returns a string representation
+func (e QBittorrentUnauthorizedError) Error() string {
+	return "not authorized"
+}
+
+// doReq sends the provided request, if autoLogin is true also tries to automatically login if the server indicates we are not logged in (403 or 401).
+// Returns (response, response body, error)
+func (client *QBittorrentClient) doReq(ctx context.Context, req *http.Request, autoLogin bool) (*http.Response, []byte, error) {
+	autoLogin = autoLogin && !client.skipLogin
+
+	// Proactively refresh the session before it expires
+	if autoLogin && !client.sessionRefreshAt.IsZero() && !time.Now().Before(client.sessionRefreshAt) {
+		client.logger.Info("session is about to expire, refreshing it by logging in")
+		if err := client.Login(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to refresh session: %w", err)
+		}
+	}
+
+	for key, values := range client.headers {
+		req.Header[key] = values
+	}
+
+	// The Host header is sent from req.Host, values in req.Header are ignored
+	if len(client.hostHeader) > 0 {
+		req.Host = client.hostHeader
+	}
+
+	if req.Method == http.MethodPost && client.originHeaders.Load() {
+		client.setOriginHeaders(req)
+	}
+
+	// Debug log request
+	client.logger.Debugf("HTTP request:")
+	client.logger.Debugf("  %s %s", req.Method, LogURL(*req.URL, client.maskHostInLogs))
+	if len(req.Host) > 0 {
+		client.logger.Debugf("  Host: '%s'", req.Host)
+	}
+	client.logger.Debugf("  Headers:")
+	for key, value := range req.Header {
+		// Custom headers usually contain tokens
+		if _, custom := client.headers[key]; custom {
+			client.logger.Debugf("    '%s': '<redacted>'", key)
+			continue
+		}
+		client.logger.Debugf("    '%s': '%s'", key, value)
+	}
+
+	reqCookies := req.Cookies()
+	client.logger.Debugf("Cookies:")
+	for key, value := range reqCookies {
+		client.logger.Debugf("    '%s': '%s'", key, value)
+	}
+
+	client.logger.Debugf("  Body: '%s'", req.Body)
+
+	// Make request, qBittorrent responds with 503 while its WebUI is starting so those requests are retried
+	resp, respBody, err := client.sendReq(ctx, req)
+	for retry := 1; err == nil && resp.StatusCode == http.StatusServiceUnavailable && client.unavailableRetries > 0; retry++ {
+		if retry > client.unavailableRetries {
+			return resp, respBody, fmt.Errorf("%w, it still responded to %s %s after %d retries with %w", ErrQBittorrentUnavailable, req.Method, req.URL.Path, client.unavailableRetries, QBittorrentStatusError{
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+				Body:       respBody,
+			})
+		}
+
+		backoff := client.unavailableBackoff.Delay(retry)
+		client.logger.Infof("qBittorrent responded with status %d - %s to %s %s, its WebUI may be starting, retrying in %s (retry %d/%d)", resp.StatusCode, resp.Status, req.Method, req.URL.Path, backoff, retry, client.unavailableRetries)
+		client.RecordRetry(RetryReasonServerError)
+
+		select {
+		case <-ctx.Done():
+			return resp, respBody, fmt.Errorf("stopped retrying %s %s which qBittorrent responded to with status %d - %s: %w", req.Method, req.URL.Path, resp.StatusCode, resp.Status, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		if err := rewindRequestBody(req); err != nil {
+			return resp, nil, err
+		}
+		resp, respBody, err = client.sendReq(ctx, req)
+	}
+	if err != nil {
+		return resp, respBody, err
+	}
+
+	// qBittorrent never sends authentication challenges, logging in to qBittorrent will not get through whatever did
+	if resp.StatusCode == http.StatusUnauthorized && len(resp.Header.Get("WWW-Authenticate")) > 0 {
+		return resp, respBody, fmt.Errorf("%w: %s responded with status %d - %s and challenge '%s', %s", ErrAuthProxyChallenge, LogURL(*req.URL, client.maskHostInLogs), resp.StatusCode, resp.Status, resp.Header.Get("WWW-Authenticate"), authProxyHelp)
+	}
+
+	// qBittorrent responds with 403 when not logged in, reverse proxies may respond with 401 instead
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+		// Try to automatically login and then repeat request
+		if autoLogin && len(client.password) == 0 && len(client.sessionID) > 0 {
+			return resp, respBody, fmt.Errorf("%w: %w", QBittorrentUnauthorizedError{}, ErrSessionIDRejected)
+		}
+		if autoLogin && len(client.password) == 0 {
+			return resp, respBody, fmt.Errorf("%w: qBittorrent requires authentication but no password is configured", QBittorrentUnauthorizedError{})
+		}
+
+		if autoLogin {
+			client.recordLogin("qBittorrent responded that the client is not logged in")
+			if err := client.Login(ctx); err != nil {
+				return resp, nil, fmt.Errorf("failed to login: %w", err)
+			}
+
+			// Sending the first attempt added the rejected session cookie to the request, it is removed so the new session from the cookie jar is sent
+			req.Header.Del("Cookie")
+
+			// The first attempt consumed the request body, so it must be recreated to repeat the request
+			if err := rewindRequestBody(req); err != nil {
+				return resp, nil, err
+			}
+
+			resp, respBody, err := client.doReq(ctx, req, false)
+			if errors.As(err, &QBittorrentUnauthorizedError{}) {
+				return resp, respBody, fmt.Errorf("%w: logged in successfully but qBittorrent still responded with status %d - %s to %s %s", ErrForbiddenAfterLogin, resp.StatusCode, resp.Status, req.Method, req.URL.Path)
+			}
+
+			return resp, respBody, err
+		}
+
+		return resp, respBody, QBittorrentUnauthorizedError{}
+	} else if resp.StatusCode != http.StatusOK {
+		return resp, respBody, QBittorrentStatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       respBody,
+		}
+	}
+
+	// API endpoints never respond with HTML, a freshly installed qBittorrent, or a proxy in front of it, may serve a setup page instead
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return resp, respBody, fmt.Errorf("%w: %s responded with an HTML page instead of an API response, finish setting up qBittorrent's WebUI and ensure QBITTORRENT_API_NETLOC points at it", ErrWebUINotConfigured, LogURL(*resp.Request.URL, client.maskHostInLogs))
+	}
+
+	return resp, respBody, nil
+}
+
+// sendReq sends req and reads the response body
+func (client *QBittorrentClient) sendReq(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
+	client.requests.Add(1)
+	start := time.Now()
+	resp, err := client.httpClient.Do(req.WithContext(ctx))
+	client.recordDuration(req, time.Since(start))
+	if urlErr := (*url.Error)(nil); errors.As(err, &urlErr) && errors.Is(err, ErrAuthProxyRedirect) {
+		return nil, nil, fmt.Errorf("%w, %s", urlErr.Err, authProxyHelp)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to make request: %w", err)
+	}
+
+	// Handle response
+	respBody, err := readResponseBody(resp, client.maxResponseBodyBytes)
+	if errors.Is(err, ErrResponseBodyTooLarge) {
+		return resp, nil, fmt.Errorf("%w: %s %s responded with status %d - %s and a body over %d bytes, if this is expected increase MAX_RESPONSE_BODY_BYTES", err, req.Method, req.URL.Path, resp.StatusCode, resp.Status, client.maxResponseBodyBytes)
+	} else if err != nil {
+		return resp, nil, fmt.Errorf("failed to read response body: %s", err)
+	}
+
+	// ... Debug log response
+	client.logger.Debugf("HTTP response: %d - %s", resp.StatusCode, resp.Status)
+	client.logger.Debugf("  Headers:")
+	for key, value := range resp.Header {
+		client.logger.Debugf("    '%s': '%s'", key, value)
+	}
+	client.logger.Debugf("  Body: '%s'", respBody)
+
+	return resp, respBody, nil
+}
+
+// rewindRequestBody recreates the body of req which was consumed by sending it, so it can be sent again
+func rewindRequestBody(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return fmt.Errorf("failed to recreate request body to repeat request: %s", err)
+	}
+	req.Body = body
+
+	return nil
+}
+
+const (
+	// RetryReasonNetwork indicates a request was retried because it could not be sent or no response was received
+	RetryReasonNetwork = "network"
+
+	// RetryReasonServerError indicates a request was retried because qBittorrent responded with a 5xx status
+	RetryReasonServerError = "5xx"
+
+	// RetryReasonTooManyRequests indicates a request was retried because qBittorrent responded with a 429 status
+	RetryReasonTooManyRequests = "429"
+
+	// RetryReasonRelogin indicates a request was retried after logging in again because qBittorrent rejected the client's session, the first login is not counted
+	RetryReasonRelogin = "403-relogin"
+
+	// RetryReasonIncompleteBody indicates a request was retried because qBittorrent responded with a success status but an empty or truncated body
+	RetryReasonIncompleteBody = "incomplete-body"
+
+	// RetryReasonOther indicates a request was retried for any other reason
+	RetryReasonOther = "other"
+)
+
+// RetryReasons are all the reasons requests are retried
+var RetryReasons = []string{
+	RetryReasonNetwork,
+	RetryReasonServerError,
+	RetryReasonTooManyRequests,
+	RetryReasonRelogin,
+	RetryReasonIncompleteBody,
+	RetryReasonOther,
+}
+
+// RetryReasonFor classifies the error of a failed request into the reason it is retried
+func RetryReasonFor(err error) string {
+	var statusErr QBittorrentStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return RetryReasonTooManyRequests
+		case statusErr.StatusCode >= 500:
+			return RetryReasonServerError
+		}
+
+		return RetryReasonOther
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return RetryReasonNetwork
+	}
+
+	return RetryReasonOther
+}
+
+// recordDuration records how long req took in the metrics, and warns if it was slow
+func (client *QBittorrentClient) recordDuration(req *http.Request, duration time.Duration) {
+	endpoint := strings.TrimPrefix(req.URL.Path, client.baseURL.Path)
+
+	if client.metrics != nil {
+		client.metrics.APIRequestDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
+	}
+
+	if client.slowRequestThreshold > 0 && duration > client.slowRequestThreshold {
+		client.logger.Warnf("qBittorrent took %s to respond to %s %s, over the slow request threshold of %s, its WebUI may be overloaded", duration.Round(time.Millisecond), req.Method, endpoint, client.slowRequestThreshold)
+	}
+}
+
+// RecordRetry counts a retried request in the client's retry count and metrics
+func (client *QBittorrentClient) RecordRetry(reason string) {
+	client.retries.Add(1)
+
+	if client.metrics != nil {
+		client.metrics.Retries.WithLabelValues(reason).Inc()
+	}
+}
+
+// Retries returns the number of requests which have been retried
+func (client *QBittorrentClient) Retries() int64 {
+	return client.retries.Load()
+}
+
+// URL returns the network location of qBittorrent, with any credentials in it redacted
+func (client *QBittorrentClient) URL() string {
+	return client.baseURL.Redacted()
+}
+
+// Requests returns the number of requests which have been sent, including retries and logins
+func (client *QBittorrentClient) Requests() int64 {
+	return client.requests.Load()
+}
+
+// readResponseBody reads and closes a response's body, returning ErrResponseBodyTooLarge if the body is over maxBytes. Zero maxBytes means no limit.
+// The limit applies after decompressing, so a small compressed body cannot expand without bound.
+// The HTTP transport transparently decompresses gzip responses it requested and removes the Content-Encoding header, if the header is still present the body was not decompressed, which can happen behind some reverse proxies, so it is decompressed here.
+func readResponseBody(resp *http.Response, maxBytes int64) ([]byte, error) {
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip encoded body: %s", err)
+		}
+		defer gzipReader.Close()
+
+		body = gzipReader
+	}
+
+	if maxBytes <= 0 {
+		return io.ReadAll(body)
+	}
+
+	// Read one extra byte to tell a body exactly at the limit apart from one over it
+	respBody, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(respBody)) > maxBytes {
+		return nil, ErrResponseBodyTooLarge
+	}
+
+	return respBody, nil
+}
+
+// Login authenticates with the API, must be called for each client in order for later API calls to work
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#login
+// Returns QBittorrentLoginNotAuthorizedError if the credentials were not accepted
+// Does nothing if the client was configured to skip logging in, or was provided a session ID and no password
+func (client *QBittorrentClient) Login(ctx context.Context) error {
+	ctx, span := client.tracer.Start(ctx, "qbittorrent.Login")
+	err := client.login(ctx)
+	endSpan(span, err)
+
+	return err
+}
+
+// login performs the work of Login
+func (client *QBittorrentClient) login(ctx context.Context) error {
+	if client.skipLogin {
+		client.logger.Debug("skipping login because qBittorrent is configured to not require authentication")
+		return nil
+	}
+	if len(client.sessionID) > 0 && len(client.password) == 0 {
+		client.logger.Debug("skipping login because a session ID was provided and no password is configured")
+		return nil
+	}
+
+	// Setup request
+	reqURL := client.endpoint("/auth/login")
+
+	reqBodyValues := url.Values{}
+	reqBodyValues.Set("username", client.username)
+	reqBodyValues.Set("password", client.password)
+
+	reqBody, contentType, err := client.formEncoding.encode(reqBodyValues)
+	if err != nil {
+		return fmt.Errorf("failed to encode login form: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", reqURL.String(), strings.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", contentType)
+
+	// Do request
+	resp, respBody, err := client.doReq(ctx, req, false)
+	if errors.As(err, &QBittorrentUnauthorizedError{}) {
+		return QBittorrentLoginNotAuthorizedError{fmt.Sprintf("not authorized (%d): '%s'", resp.StatusCode, respBody)}
+	}
+	if err != nil {
+		return err
+	}
+
+	cookies := resp.Cookies()
+
+	if len(cookies) == 0 && strings.TrimSpace(string(respBody)) == qBittorrentLoginOkBody {
+		cookies, err = client.recoverSessionCookies(ctx, resp)
+		if err != nil {
+			return err
+		}
+	} else if len(cookies) == 0 {
+		return fmt.Errorf("received no authentication cookie in response from the server, body: %s", respBody)
+	}
+
+	client.httpClient.Jar.SetCookies(&client.baseURL, cookies)
+	client.scheduleSessionRefresh(cookies)
+	client.loggedIn.Store(true)
+
+	// Requests made immediately may be rejected again if the new session is not valid yet
+	if client.postLoginDelay > 0 {
+		client.logger.Debugf("waiting %s after logging in before making requests", client.postLoginDelay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting after logging in: %w", ctx.Err())
+		case <-time.After(client.postLoginDelay):
+		}
+	}
+
+	// Authentication cookie should now be in jar, so the version can be detected
+	if !client.versionDetected.Load() {
+		client.detectVersion(ctx)
+	}
+
+	return nil
+}
+
+// qBittorrentLoginOkBody is the body of a login response when the credentials were accepted
+const qBittorrentLoginOkBody = "Ok."
+
+// alternativeSetCookieHeaders are headers some proxies move the Set-Cookie header of responses to
+var alternativeSetCookieHeaders = []string{"X-Set-Cookie", "Set-Cookie2"}
+
+// ErrNoSessionCookie indicates qBittorrent accepted the credentials but no session cookie was received
+var ErrNoSessionCookie = errors.New("qBittorrent accepted the credentials but no session cookie was received, a proxy in front of qBittorrent may strip the Set-Cookie header")
+
+// recoverSessionCookies finds the session when qBittorrent accepted the credentials but the login response, resp, has no Set-Cookie header because a proxy stripped or moved it.
+// The cookie is looked for in headers proxies move it to, then a request is made in case a proxy attaches the cookie to a later response, which the HTTP client stores in the cookie jar.
+// Returns ErrNoSessionCookie, listing the headers which were received, if no session is found.
+func (client *QBittorrentClient) recoverSessionCookies(ctx context.Context, resp *http.Response) ([]*http.Cookie, error) {
+	for _, header := range alternativeSetCookieHeaders {
+		moved := (&http.Response{Header: http.Header{"Set-Cookie": resp.Header.Values(header)}}).Cookies()
+		if slices.ContainsFunc(moved, isSessionCookie) {
+			client.logger.Warnf("login response has no Set-Cookie header, using the session cookie from the %s header", header)
+			return moved, nil
+		}
+	}
+
+	reqURL := client.endpoint("/app/version")
+
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	// Logging in again would end up here again, so a refused request is not retried
+	_, respBody, err := client.doReq(ctx, req, false)
+	if cookies := client.httpClient.Jar.Cookies(&client.baseURL); err == nil && slices.ContainsFunc(cookies, isSessionCookie) {
+		client.logger.Warn("login response has no Set-Cookie header, using the session cookie received with a later response")
+		client.recordVersion(strings.TrimSpace(string(respBody)))
+		return cookies, nil
+	}
+
+	headers := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		headers = append(headers, name)
+	}
+	slices.Sort(headers)
+
+	return nil, fmt.Errorf("%w, login responded with status %d and headers: %s", ErrNoSessionCookie, resp.StatusCode, strings.Join(headers, ", "))
+}
+
+// isSessionCookie determines if cookie is qBittorrent's session cookie
+func isSessionCookie(cookie *http.Cookie) bool {
+	return cookie.Name == QBittorrentSessionCookieName
+}
+
+// detectVersion retrieves qBittorrent's version after logging in, or before the first change if logging in is skipped, so the compatibility headers it requires are sent with following requests.
+// Failing to detect the version is not an error, requests are made like to qBittorrent 4 and detecting it is tried again next time.
+func (client *QBittorrentClient) detectVersion(ctx context.Context) {
+	reqURL := client.endpoint("/app/version")
+
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		client.logger.Debugf("failed to craft HTTP request to detect qBittorrent's version: %s", err)
+		return
+	}
+
+	// Logging in again would detect the version again, so a refused request is not retried
+	_, respBody, err := client.doReq(ctx, req, false)
+	if err != nil {
+		client.logger.Debugf("failed to detect qBittorrent's version: %s", err)
+		return
+	}
+
+	client.recordVersion(strings.TrimSpace(string(respBody)))
+}
+
+// Logout ends the session, so the session cookie can no longer be used
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#logout
+// Does nothing if the client was configured to skip logging in
+func (client *QBittorrentClient) Logout(ctx context.Context) error {
+	if client.skipLogin {
+		return nil
+	}
+
+	// Setup request
+	reqURL := client.endpoint("/auth/logout")
+
+	req, err := http.NewRequest("POST", reqURL.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	// Do request
+	if _, _, err := client.doReq(ctx, req, false); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// recordLogin logs that the client is automatically logging in because of reason, and records it as a retry if a session was rejected.
+// The first login of a client which never had a session is expected, so it is only logged at the debug level and is not counted as a retry.
+func (client *QBittorrentClient) recordLogin(reason string) {
+	if !client.loggedIn.Load() && len(client.sessionID) == 0 {
+		client.logger.Debugf("logging in for the first time, %s", reason)
+		return
+	}
+
+	client.logger.Infof("automatically logging in, %s", reason)
+	client.RecordRetry(RetryReasonRelogin)
+}
+
+// scheduleSessionRefresh determines when the session should be proactively refreshed based on the expiry of the session cookie received from login.
+// The session refresh margin is subtracted from the expiry to tolerate a skewed clock, if this leaves no time the session is refreshed on the next request.
+func (client *QBittorrentClient) scheduleSessionRefresh(cookies []*http.Cookie) {
+	client.sessionRefreshAt = time.Time{}
+
+	now := time.Now()
+	var expiresIn time.Duration
+	for _, cookie := range cookies {
+		if cookie.Name != QBittorrentSessionCookieName {
+			continue
+		}
+
+		// Max-Age is relative so is not affected by clock skew, prefer it over Expires
+		if cookie.MaxAge > 0 {
+			expiresIn = time.Duration(cookie.MaxAge) * time.Second
+		} else if !cookie.Expires.IsZero() {
+			expiresIn = cookie.Expires.Sub(now)
+		}
+	}
+
+	if expiresIn == 0 {
+		client.logger.Debug("session cookie has no expiry, not scheduling a session refresh")
+		return
+	}
+
+	refreshIn := expiresIn - client.sessionRefreshMargin
+	if refreshIn < 0 {
+		refreshIn = 0
+	}
+	client.sessionRefreshAt = now.Add(refreshIn)
+
+	if refreshIn == 0 {
+		client.logger.Warnf("session cookie expires in %s which is within the %s session refresh margin, it will be refreshed on the next request", expiresIn, client.sessionRefreshMargin)
+		return
+	}
+
+	client.logger.Infof("session cookie expires in %s, scheduled session refresh in %s", expiresIn, refreshIn)
+}
+
+// QBittorrentServerPreferences are settings which control the behavior of qBittorrent
+type QBittorrentServerPreferences struct {
+	// ListenPort is the port on which qBittorrent will listen for incoming torrent connections
+	ListenPort uint16 `json:"listen_port,omitempty"`
+
+	// UPnP indicates if UPnP / NAT-PMP port forwarding is enabled
+	UPnP *bool `json:"upnp,omitempty"`
+
+	// RandomPort indicates if qBittorrent picks a different listen port each time it starts
+	RandomPort *bool `json:"random_port,omitempty"`
+
+	// RandomPortRangeMin is the lowest port qBittorrent picks from when RandomPort is on
+	RandomPortRangeMin *uint16 `json:"random_port_range_min,omitempty"`
+
+	// RandomPortRangeMax is the highest port qBittorrent picks from when RandomPort is on
+	RandomPortRangeMax *uint16 `json:"random_port_range_max,omitempty"`
+
+	// AnnouncePort is the port announced to trackers instead of ListenPort, 0 announces ListenPort. Only qBittorrent 5 and later have it
+	AnnouncePort *uint16 `json:"announce_port,omitempty"`
+
+	// MaxConnections is the global maximum number of connections, -1 for unlimited
+	MaxConnections *int `json:"max_connec,omitempty"`
+
+	// MaxConnectionsPerTorrent is the maximum number of connections per torrent, -1 for unlimited
+	MaxConnectionsPerTorrent *int `json:"max_connec_per_torrent,omitempty"`
+
+	// CurrentNetworkInterface is the network interface qBittorrent binds to, empty for any interface
+	CurrentNetworkInterface *string `json:"current_network_interface,omitempty"`
+
+	// CurrentInterfaceAddress is the address of the network interface qBittorrent binds to, empty for all addresses
+	CurrentInterfaceAddress *string `json:"current_interface_address,omitempty"`
+}
+
+// UnmarshalJSON decodes preferences, accepting listen_port as a number or as a numeric string, which some qBittorrent forks send
+func (prefs *QBittorrentServerPreferences) UnmarshalJSON(data []byte) error {
+	// plainPreferences has no UnmarshalJSON method, so decoding it does not recurse
+	type plainPreferences QBittorrentServerPreferences
+
+	var decoded struct {
+		plainPreferences
+
+		// ListenPort shadows the embedded field, so it can be decoded from either type
+		ListenPort json.RawMessage `json:"listen_port,omitempty"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*prefs = QBittorrentServerPreferences(decoded.plainPreferences)
+
+	listenPort := strings.TrimSpace(string(decoded.ListenPort))
+	if len(listenPort) == 0 || listenPort == "null" {
+		return nil
+	}
+
+	var quoted string
+	if err := json.Unmarshal(decoded.ListenPort, &quoted); err == nil {
+		listenPort = strings.TrimSpace(quoted)
+	}
+
+	port, err := strconv.ParseUint(listenPort, 10, 16)
+	if err != nil {
+		return fmt.Errorf("listen_port must be a port number or a string containing one, is %s", decoded.ListenPort)
+	}
+	prefs.ListenPort = uint16(port)
+
+	return nil
+}
+
+// FormEncoding is how the body of a request which sends a form is encoded
+type FormEncoding string
+
+const (
+	// FormEncodingURLEncoded is application/x-www-form-urlencoded, which is what browsers send to qBittorrent
+	FormEncodingURLEncoded FormEncoding = "urlencoded"
+
+	// FormEncodingMultipart is multipart/form-data, which qBittorrent also accepts, for proxies which mangle URL encoded bodies
+	FormEncodingMultipart FormEncoding = "multipart"
+)
+
+// FormEncodings are all the supported form encodings
+var FormEncodings = []FormEncoding{
+	FormEncodingURLEncoded,
+	FormEncodingMultipart,
+}
+
+// encode encodes values as a form body.
+// Returns (body, content type, error)
+func (encoding FormEncoding) encode(values url.Values) (string, string, error) {
+	if encoding != FormEncodingMultipart {
+		return values.Encode(), "application/x-www-form-urlencoded", nil
+	}
+
+	var body strings.Builder
+	writer := multipart.NewWriter(&body)
+
+	// Fields are written in order so bodies only differ by their boundary
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		for _, value := range values[name] {
+			if err := writer.WriteField(name, value); err != nil {
+				return "", "", fmt.Errorf("failed to write field %s: %s", name, err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", "", fmt.Errorf("failed to finish multipart body: %s", err)
+	}
+
+	return body.String(), writer.FormDataContentType(), nil
+}
+
+// SetPreferencesEncoding is how preferences are encoded in the body of a set preferences request
+type SetPreferencesEncoding string
+
+const (
+	// SetPreferencesEncodingJSONInForm is a form with a "json" field containing the preferences as JSON, which is what qBittorrent expects
+	SetPreferencesEncodingJSONInForm SetPreferencesEncoding = "json-in-form"
+
+	// SetPreferencesEncodingForm is a form with a field for each preference
+	SetPreferencesEncodingForm SetPreferencesEncoding = "form"
+
+	// SetPreferencesEncodingJSON is the preferences as a JSON body
+	SetPreferencesEncodingJSON SetPreferencesEncoding = "json"
+)
+
+// SetPreferencesEncodings are all the supported set preferences encodings
+var SetPreferencesEncodings = []SetPreferencesEncoding{
+	SetPreferencesEncodingJSONInForm,
+	SetPreferencesEncodingForm,
+	SetPreferencesEncodingJSON,
+}
+
+// SetPreferencesRequest describes how requests to set preferences are made
+type SetPreferencesRequest struct {
+	// Method is the HTTP method
+	Method string
+
+	// Path is appended to the base URL, it must start with a "/"
+	Path string
+
+	// Encoding is how preferences are encoded in the request body
+	Encoding SetPreferencesEncoding
+}
+
+// DefaultSetPreferencesRequest is how qBittorrent expects requests to set preferences to be made
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#set-application-preferences
+var DefaultSetPreferencesRequest = SetPreferencesRequest{
+	Method:   http.MethodPost,
+	Path:     "/api/v2/app/setPreferences",
+	Encoding: SetPreferencesEncodingJSONInForm,
+}
+
+// WithDefaults returns the request with empty fields set to those of DefaultSetPreferencesRequest
+func (request SetPreferencesRequest) WithDefaults() SetPreferencesRequest {
+	if len(request.Method) == 0 {
+		request.Method = DefaultSetPreferencesRequest.Method
+	}
+	if len(request.Path) == 0 {
+		request.Path = DefaultSetPreferencesRequest.Path
+	}
+	if len(request.Encoding) == 0 {
+		request.Encoding = DefaultSetPreferencesRequest.Encoding
+	}
+
+	return request
+}
+
+// Validate ensures the request can be made, all problems are joined into one error
+func (request SetPreferencesRequest) Validate() error {
+	var problems []error
+
+	if !slices.Contains([]string{http.MethodPost, http.MethodPut, http.MethodPatch}, request.Method) {
+		problems = append(problems, fmt.Errorf("method must be POST, PUT, or PATCH, is '%s'", request.Method))
+	}
+
+	if !strings.HasPrefix(request.Path, "/") {
+		problems = append(problems, fmt.Errorf("path must start with '/', is '%s'", request.Path))
+	} else if parsed, err := url.Parse(request.Path); err != nil || parsed.Path != request.Path {
+		problems = append(problems, fmt.Errorf("path must only be a path, without a query or fragment, is '%s'", request.Path))
+	}
+
+	if !slices.Contains(SetPreferencesEncodings, request.Encoding) {
+		problems = append(problems, fmt.Errorf("encoding must be one of %v, is '%s'", SetPreferencesEncodings, request.Encoding))
+	}
+
+	return errors.Join(problems...)
+}
+
+// encodeBody encodes the preferences, prefsJSON, in the request's encoding, forms are encoded with formEncoding.
+// Returns (body, content type, error)
+func (request SetPreferencesRequest) encodeBody(prefsJSON []byte, formEncoding FormEncoding) (string, string, error) {
+	switch request.Encoding {
+	case SetPreferencesEncodingForm:
+		var prefs map[string]json.RawMessage
+		if err := json.Unmarshal(prefsJSON, &prefs); err != nil {
+			return "", "", fmt.Errorf("failed to decode preferences: %s", err)
+		}
+
+		values := url.Values{}
+		for name, value := range prefs {
+			// Strings are sent without their quotes, other values as their JSON text
+			var str string
+			if err := json.Unmarshal(value, &str); err == nil {
+				values.Set(name, str)
+			} else {
+				values.Set(name, string(value))
+			}
+		}
+
+		return formEncoding.encode(values)
+	case SetPreferencesEncodingJSON:
+		return string(prefsJSON), "application/json", nil
+	default:
+		values := url.Values{}
+		values.Set("json", string(prefsJSON))
+
+		return formEncoding.encode(values)
+	}
+}
+
+// ErrPreferencesRejected indicates qBittorrent did not accept preferences which were set
+var ErrPreferencesRejected = errors.New("qBittorrent rejected preferences")
+
+// SetServerPreferences updates qBittorrent server preferences, the request is made as described by setPreferencesRequest.
+// Some qBittorrent versions respond with a success status even if the preferences are not accepted, so an empty payload is refused before it is sent and any response body is treated as a rejection, since qBittorrent responds with an empty body on success.
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#set-application-preferences
+func (client *QBittorrentClient) SetServerPreferences(ctx context.Context, prefs QBittorrentServerPreferences) error {
+	ctx, span := client.tracer.Start(ctx, "qbittorrent.SetServerPreferences")
+	if prefs.ListenPort != 0 {
+		span.SetAttributes(attribute.Int("listen_port", int(prefs.ListenPort)))
+	}
+	err := client.setServerPreferences(ctx, prefs)
+	endSpan(span, err)
+
+	return err
+}
+
+// setServerPreferences performs the work of SetServerPreferences
+func (client *QBittorrentClient) setServerPreferences(ctx context.Context, prefs QBittorrentServerPreferences) error {
+	prefsJSON, err := json.Marshal(prefs)
+	if err != nil {
+		return fmt.Errorf("failed to encode server preferences as JSON: %s", err)
+	}
+	if string(prefsJSON) == "{}" {
+		return fmt.Errorf("server preferences are empty, there is nothing to set")
+	}
+
+	// qBittorrent 5 refuses changes without the headers its version requires, when logging in the version was detected already
+	if (client.skipLogin || len(client.sessionID) > 0) && !client.versionDetected.Load() {
+		client.detectVersion(ctx)
+	}
+
+	// The scheduler preferences must be sent with whichever request sets the preferences
+	if client.preserveScheduler {
+		prefsJSON, err = client.withSchedulerPreferences(ctx, prefsJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The preferences this tool manages are all network preferences, so the typed endpoint can set them whenever qBittorrent has it
+	if len(client.networkPreferencesPath) > 0 && !client.networkPreferencesUnsupported.Load() {
+		err := client.setNetworkPreferences(ctx, prefsJSON)
+
+		var statusErr QBittorrentStatusError
+		if !errors.As(err, &statusErr) || (statusErr.StatusCode != http.StatusNotFound && statusErr.StatusCode != http.StatusMethodNotAllowed) {
+			return err
+		}
+
+		client.networkPreferencesUnsupported.Store(true)
+		client.logger.Infof("qBittorrent does not have the network preferences endpoint %s, responded with status %d, setting preferences with %s instead", client.networkPreferencesPath, statusErr.StatusCode, client.setPreferencesRequest.Path)
+	}
+
+	// Setup request
+	reqURL := client.baseURL
+	reqURL.Path += client.setPreferencesRequest.Path
+
+	reqBody, contentType, err := client.setPreferencesRequest.encodeBody(prefsJSON, client.formEncoding)
+	if err != nil {
+		return fmt.Errorf("failed to encode server preferences as %s: %s", client.setPreferencesRequest.Encoding, err)
+	}
+
+	req, err := http.NewRequest(client.setPreferencesRequest.Method, reqURL.String(), strings.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", contentType)
+
+	// Do request
+	_, respBody, err := client.doReq(ctx, req, true)
+	if err != nil {
+		return err
+	}
+
+	if msg := strings.TrimSpace(string(respBody)); len(msg) > 0 {
+		return fmt.Errorf("%w, responded with '%s' to %s", ErrPreferencesRejected, msg, prefsJSON)
+	}
+
+	return nil
+}
+
+// setNetworkPreferences sets the network preferences, prefsJSON, with the typed network preferences endpoint
+func (client *QBittorrentClient) setNetworkPreferences(ctx context.Context, prefsJSON []byte) error {
+	// Setup request
+	reqURL := client.endpoint(client.networkPreferencesPath)
+
+	req, err := http.NewRequest(http.MethodPost, reqURL.String(), bytes.NewReader(prefsJSON))
+	if err != nil {
+		return fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	// Do request
+	_, respBody, err := client.doReq(ctx, req, true)
+	if err != nil {
+		return err
+	}
+
+	if msg := strings.TrimSpace(string(respBody)); len(msg) > 0 {
+		return fmt.Errorf("%w, responded with '%s' to %s", ErrPreferencesRejected, msg, prefsJSON)
+	}
+
+	return nil
+}
+
+// SchedulerPreferences are the names of the preferences of qBittorrent's alternative speed limit scheduler
+var SchedulerPreferences = []string{
+	"scheduler_enabled",
+	"schedule_from_hour",
+	"schedule_from_min",
+	"schedule_to_hour",
+	"schedule_to_min",
+	"scheduler_days",
+	"alt_dl_limit",
+	"alt_up_limit",
+}
+
+// withSchedulerPreferences adds qBittorrent's current scheduler preferences to prefsJSON, unless prefsJSON already sets them.
+// Some qBittorrent versions reset the scheduler's state when preferences are set, sending its preferences unchanged avoids this.
+func (client *QBittorrentClient) withSchedulerPreferences(ctx context.Context, prefsJSON []byte) ([]byte, error) {
+	currentJSON, err := client.GetRawServerPreferences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scheduler preferences to preserve them: %w", err)
+	}
+
+	var current map[string]json.RawMessage
+	if err := json.Unmarshal(currentJSON, &current); err != nil {
+		return nil, fmt.Errorf("failed to decode scheduler preferences: %s", err)
+	}
+
+	var prefs map[string]json.RawMessage
+	if err := json.Unmarshal(prefsJSON, &prefs); err != nil {
+		return nil, fmt.Errorf("failed to decode server preferences: %s", err)
+	}
+
+	for _, name := range SchedulerPreferences {
+		value, ok := current[name]
+		if _, set := prefs[name]; ok && !set {
+			prefs[name] = value
+		}
+	}
+
+	return json.Marshal(prefs)
+}
+
+// GetServerPreferences retrieves the current qBittorrent server preferences
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#get-application-preferences
+func (client *QBittorrentClient) GetServerPreferences(ctx context.Context) (*QBittorrentServerPreferences, error) {
+	ctx, span := client.tracer.Start(ctx, "qbittorrent.GetServerPreferences")
+	prefs, err := client.getServerPreferences(ctx)
+	if err == nil {
+		span.SetAttributes(attribute.Int("listen_port", int(prefs.ListenPort)))
+	}
+	endSpan(span, err)
+
+	return prefs, err
+}
+
+// getServerPreferences performs the work of GetServerPreferences
+func (client *QBittorrentClient) getServerPreferences(ctx context.Context) (*QBittorrentServerPreferences, error) {
+	respBody, err := client.GetRawServerPreferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefs QBittorrentServerPreferences
+	if err := json.Unmarshal(respBody, &prefs); err != nil {
+		return nil, fmt.Errorf("failed to decode response into JSON: %s", err)
+	}
+
+	return &prefs, nil
+}
+
+// GetRawServerPreferences retrieves all of qBittorrent's server preferences as the JSON qBittorrent responded with, including those QBittorrentServerPreferences does not model
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#get-application-preferences
+func (client *QBittorrentClient) GetRawServerPreferences(ctx context.Context) ([]byte, error) {
+	// Setup request
+	reqURL := client.endpoint("/app/preferences")
+
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	// Do request
+	_, respBody, err := client.doReq(ctx, req, true)
+
+	// While its WebUI is warming up qBittorrent sometimes responds with a success status and an empty or truncated body, which is retried like a 503
+	for retry := 1; err == nil && isIncompleteJSON(respBody) && client.unavailableRetries > 0; retry++ {
+		if retry > client.unavailableRetries {
+			return nil, fmt.Errorf("%w, preferences were still empty or incomplete after %d retries: '%s'", ErrNotJSONResponse, client.unavailableRetries, truncateResponseBody(respBody))
+		}
+
+		backoff := client.unavailableBackoff.Delay(retry)
+		client.logger.Infof("qBittorrent responded with empty or incomplete preferences, its WebUI may be warming up, retrying in %s (retry %d/%d)", backoff, retry, client.unavailableRetries)
+		client.RecordRetry(RetryReasonIncompleteBody)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("stopped retrying getting preferences which qBittorrent responded to with an empty or incomplete body: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		_, respBody, err = client.doReq(ctx, req, true)
+	}
+
+	// Some proxies respond to requests with an invalid session with a success status and a plain text or HTML "Forbidden" page, which is handled like qBittorrent's 403.
+	// If it is really a setup page logging in fails the same way, so the setup page error is still returned.
+	notJSON := err == nil && !json.Valid(respBody)
+	if (notJSON || errors.Is(err, ErrWebUINotConfigured)) && !client.skipLogin && len(client.password) > 0 {
+		client.recordLogin(fmt.Sprintf("preferences response is not JSON, the session is likely invalid: '%s'", truncateResponseBody(respBody)))
+		if err := client.Login(ctx); err != nil {
+			return nil, fmt.Errorf("failed to login: %w", err)
+		}
+
+		_, respBody, err = client.doReq(ctx, req, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(respBody) {
+		return nil, fmt.Errorf("%w: '%s'", ErrNotJSONResponse, truncateResponseBody(respBody))
+	}
+
+	return respBody, nil
+}
+
+// isIncompleteJSON determines if body is empty, or JSON which ends before it is complete
+func isIncompleteJSON(body []byte) bool {
+	var value interface{}
+	err := json.NewDecoder(bytes.NewReader(body)).Decode(&value)
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// ErrNotJSONResponse indicates qBittorrent responded with a success status but content which is not JSON, even after logging in again
+var ErrNotJSONResponse = errors.New("qBittorrent responded with content which is not JSON")
+
+// maxResponseBodyErrorContent is the most bytes of a response body included in errors and logs
+const maxResponseBodyErrorContent = 64
+
+// truncateResponseBody shortens body for errors and logs, an HTML page would otherwise fill the log
+func truncateResponseBody(body []byte) string {
+	content := strings.TrimSpace(string(body))
+	if len(content) > maxResponseBodyErrorContent {
+		return content[:maxResponseBodyErrorContent] + "..."
+	}
+
+	return content
+}
+
+// QBittorrentConnectionStatusConnected is the connection status qBittorrent reports when it is reachable from the internet
+const QBittorrentConnectionStatusConnected = "connected"
+
+// QBittorrentServerState is the global transfer state of qBittorrent
+type QBittorrentServerState struct {
+	// ConnectionStatus is one of "connected", "firewalled", or "disconnected"
+	ConnectionStatus string `json:"connection_status"`
+}
+
+// QBittorrentMainData is the qBittorrent sync main data, only fields used by this tool are included
+type QBittorrentMainData struct {
+	// ServerState is the global transfer state
+	ServerState QBittorrentServerState `json:"server_state"`
+}
+
+// GetMainData retrieves qBittorrent's sync main data
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#get-main-data
+func (client *QBittorrentClient) GetMainData(ctx context.Context) (*QBittorrentMainData, error) {
+	// Setup request
+	reqURL := client.endpoint("/sync/maindata")
+
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	// Do request
+	_, respBody, err := client.doReq(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var mainData QBittorrentMainData
+	if err := json.Unmarshal(respBody, &mainData); err != nil {
+		return nil, fmt.Errorf("failed to decode response into JSON: %s", err)
+	}
+
+	return &mainData, nil
+}
+
+// CountActiveTorrents returns the number of torrents qBittorrent lists as active, which are those transferring data
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#get-torrent-list
+func (client *QBittorrentClient) CountActiveTorrents(ctx context.Context) (int, error) {
+	// Setup request
+	reqURL := client.endpoint("/torrents/info")
+	reqURL.RawQuery = url.Values{"filter": {"active"}}.Encode()
+
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	// Do request
+	_, respBody, err := client.doReq(ctx, req, true)
+	if err != nil {
+		return 0, err
+	}
+
+	var torrents []json.RawMessage
+	if err := json.Unmarshal(respBody, &torrents); err != nil {
+		return 0, fmt.Errorf("failed to decode response into JSON: %s", err)
+	}
+
+	return len(torrents), nil
+}
+
+// ReannounceTorrents makes qBittorrent reannounce every torrent to its trackers, so peers learn about a new listen port sooner
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#reannounce-torrents
+func (client *QBittorrentClient) ReannounceTorrents(ctx context.Context) error {
+	// Setup request
+	reqURL := client.endpoint("/torrents/reannounce")
+
+	reqBodyValues := url.Values{}
+	reqBodyValues.Set("hashes", "all")
+
+	reqBody, contentType, err := client.formEncoding.encode(reqBodyValues)
+	if err != nil {
+		return fmt.Errorf("failed to encode reannounce form: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", reqURL.String(), strings.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", contentType)
+
+	// Do request
+	if _, _, err := client.doReq(ctx, req, true); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListStalledTorrentHashes returns the hashes of the torrents qBittorrent lists as stalled, which are not transferring data although they are not paused
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#get-torrent-list
+func (client *QBittorrentClient) ListStalledTorrentHashes(ctx context.Context) ([]string, error) {
+	// Setup request
+	reqURL := client.endpoint("/torrents/info")
+	reqURL.RawQuery = url.Values{"filter": {"stalled"}}.Encode()
+
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	// Do request
+	_, respBody, err := client.doReq(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var torrents []struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.Unmarshal(respBody, &torrents); err != nil {
+		return nil, fmt.Errorf("failed to decode response into JSON: %s", err)
+	}
+
+	hashes := make([]string, 0, len(torrents))
+	for _, torrent := range torrents {
+		hashes = append(hashes, torrent.Hash)
+	}
+
+	return hashes, nil
+}
+
+// ResumeTorrents makes qBittorrent resume the torrents with hashes, or every torrent if hashes is empty.
+// qBittorrent 5 renamed the endpoint to start, which is used if the resume endpoint does not exist.
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#resume-torrents
+func (client *QBittorrentClient) ResumeTorrents(ctx context.Context, hashes []string) error {
+	err := client.postTorrentsAction(ctx, "/torrents/resume", hashes)
+
+	var statusErr QBittorrentStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return client.postTorrentsAction(ctx, "/torrents/start", hashes)
+	}
+
+	return err
+}
+
+// postTorrentsAction sends a request to an API endpoint which acts on the torrents with hashes, or every torrent if hashes is empty
+func (client *QBittorrentClient) postTorrentsAction(ctx context.Context, path string, hashes []string) error {
+	// Setup request
+	reqURL := client.endpoint(path)
+
+	reqBodyValues := url.Values{}
+	reqBodyValues.Set("hashes", "all")
+	if len(hashes) > 0 {
+		reqBodyValues.Set("hashes", strings.Join(hashes, "|"))
+	}
+
+	reqBody, contentType, err := client.formEncoding.encode(reqBodyValues)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s form: %s", path, err)
+	}
+
+	req, err := http.NewRequest("POST", reqURL.String(), strings.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", contentType)
+
+	// Do request
+	if _, _, err := client.doReq(ctx, req, true); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ParseQBittorrentMajorVersion parses the major version from a qBittorrent version, like "v5.0.1"
+func ParseQBittorrentMajorVersion(version string) (int, error) {
+	major, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".")
+
+	majorVersion, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a version like 'v4.6.0'", version)
+	}
+
+	return majorVersion, nil
+}
+
+// qBittorrentOriginHeadersMajorVersion is the first qBittorrent major version whose stricter cross-site request checks require Origin and Referer headers
+const qBittorrentOriginHeadersMajorVersion = 5
+
+// recordVersion enables the compatibility headers qBittorrent's version requires, versions before 5 are left unchanged
+func (client *QBittorrentClient) recordVersion(version string) {
+	client.versionDetected.Store(true)
+	if client.metrics != nil {
+		client.metrics.RecordQBittorrentVersion(version)
+	}
+
+	majorVersion, err := ParseQBittorrentMajorVersion(version)
+	if err != nil {
+		client.logger.Debugf("failed to detect qBittorrent's major version: %s", err)
+		return
+	}
+
+	if majorVersion >= qBittorrentOriginHeadersMajorVersion && !client.originHeaders.Swap(true) {
+		client.logger.Infof("qBittorrent %s detected, sending Origin and Referer headers it requires", version)
+	}
+}
+
+// setOriginHeaders sets the Origin and Referer headers the WebUI itself sends on req, so it passes qBittorrent 5's cross-site request checks.
+// They name the host qBittorrent sees in the Host header, which is hostHeader if it is set.
+func (client *QBittorrentClient) setOriginHeaders(req *http.Request) {
+	origin := url.URL{Scheme: client.baseURL.Scheme, Host: client.baseURL.Host}
+	if len(client.hostHeader) > 0 {
+		origin.Host = client.hostHeader
+	}
+
+	req.Header.Set("Origin", origin.String())
+	req.Header.Set("Referer", origin.String()+"/")
+}
+
+// GetVersion retrieves the qBittorrent application version, and enables the compatibility headers it requires
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#get-application-version
+func (client *QBittorrentClient) GetVersion(ctx context.Context) (string, error) {
+	// Setup request
+	reqURL := client.endpoint("/app/version")
+
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	// Do request
+	_, respBody, err := client.doReq(ctx, req, true)
+	if err != nil {
+		return "", err
+	}
+
+	version := strings.TrimSpace(string(respBody))
+	client.recordVersion(version)
+
+	return version, nil
+}
+
+// GetWebAPIVersion retrieves the version of qBittorrent's WebAPI, which changes independently of the application version
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)#get-api-version
+func (client *QBittorrentClient) GetWebAPIVersion(ctx context.Context) (string, error) {
+	// Setup request
+	reqURL := client.endpoint("/app/webapiVersion")
+
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to craft HTTP request: %s", err)
+	}
+
+	// Do request
+	_, respBody, err := client.doReq(ctx, req, true)
+	if err != nil {
+		return "", err
+	}
+
+	webAPIVersion := strings.TrimSpace(string(respBody))
+	if client.metrics != nil {
+		client.metrics.RecordQBittorrentWebAPIVersion(webAPIVersion)
+	}
+
+	return webAPIVersion, nil
+}
+
+// DetectVersions retrieves qBittorrent's version and WebAPI version, which are recorded in the info metric.
+// Returns (version, WebAPI version, error)
+func (client *QBittorrentClient) DetectVersions(ctx context.Context) (string, string, error) {
+	version, err := client.GetVersion(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get version: %w", err)
+	}
+
+	webAPIVersion, err := client.GetWebAPIVersion(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get WebAPI version: %w", err)
+	}
+
+	return version, webAPIVersion, nil
+}
+
+// WaitUntilReady repeatedly tries to retrieve the qBittorrent version, backing off between attempts according to the readiness backoff, until it succeeds or timeout elapses.
+// This logs in if required, so success indicates qBittorrent is ready to be used.
+// Returns the qBittorrent version.
+func (client *QBittorrentClient) WaitUntilReady(ctx context.Context, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		version, err := client.GetVersion(ctx)
+		if err == nil {
+			return version, nil
+		}
+
+		// Waiting will not get requests through an authentication proxy
+		if errors.Is(err, ErrAuthProxyRedirect) || errors.Is(err, ErrAuthProxyChallenge) {
+			return "", err
+		}
+
+		backoff := client.readinessBackoff.Delay(attempt)
+		client.logger.Infof("qBittorrent is not ready yet (attempt %d), retrying in %s: %s", attempt, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("qBittorrent was not ready within %s, last error: %w", timeout, err)
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// ErrPreferencesNotReadable indicates qBittorrent accepted the credentials but refused to return its preferences, so the user lacks the permissions the tool requires
+var ErrPreferencesNotReadable = errors.New("logged in to qBittorrent but it refused to return preferences, ensure the user is allowed to read and change preferences")
+
+// CheckPreferencesReadable retrieves the preferences, logging in if required, so a user which can log in but can't read preferences is told apart from credentials which are not accepted.
+// Returns ErrPreferencesNotReadable if logging in succeeded but retrieving the preferences was forbidden.
+func (client *QBittorrentClient) CheckPreferencesReadable(ctx context.Context) error {
+	_, err := client.GetRawServerPreferences(ctx)
+	if errors.Is(err, ErrForbiddenAfterLogin) {
+		return fmt.Errorf("%w: %w", ErrPreferencesNotReadable, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to get preferences: %w", err)
+	}
+
+	return nil
+}
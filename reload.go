@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// Reloader applies a reloaded configuration to the running tool.
+// Reloadable fields, listed in ReloadableConfigFields, are applied without a restart, changes to any others are logged as requiring a restart.
+type Reloader struct {
+	// logger is used to output information
+	logger golog.Logger
+
+	// loadConfig loads the configuration
+	loadConfig func() (*Config, error)
+
+	// newQBittorrentClient creates a qBittorrent API client for a configuration
+	newQBittorrentClient func(cfg *Config) (*QBittorrentClient, error)
+
+	// loggers have their level changed when VERBOSE changes
+	loggers []golog.Logger
+
+	// syncer has its port files, interval, and qBittorrent client changed
+	syncer *PortSyncer
+
+	// notifier has its notifiers replaced when notification settings change
+	notifier *SwappableNotifier
+
+	// lock ensures only one reload runs at a time, and guards cfg
+	lock sync.Mutex
+
+	// cfg is the configuration currently applied
+	cfg *Config
+}
+
+// NewReloaderOptions are options to create a new Reloader
+type NewReloaderOptions struct {
+	// Logger is used to output information
+	Logger golog.Logger
+
+	// LoadConfig loads the configuration
+	LoadConfig func() (*Config, error)
+
+	// NewQBittorrentClient creates a qBittorrent API client for a configuration
+	NewQBittorrentClient func(cfg *Config) (*QBittorrentClient, error)
+
+	// Loggers have their level changed when VERBOSE changes
+	Loggers []golog.Logger
+
+	// Syncer has its port files, interval, and qBittorrent client changed
+	Syncer *PortSyncer
+
+	// Notifier has its notifiers replaced when notification settings change
+	Notifier *SwappableNotifier
+
+	// Config is the configuration currently applied
+	Config *Config
+}
+
+// NewReloader creates a new Reloader
+func NewReloader(opts NewReloaderOptions) *Reloader {
+	return &Reloader{
+		logger:               opts.Logger,
+		loadConfig:           opts.LoadConfig,
+		newQBittorrentClient: opts.NewQBittorrentClient,
+		loggers:              opts.Loggers,
+		syncer:               opts.Syncer,
+		notifier:             opts.Notifier,
+		cfg:                  opts.Config,
+	}
+}
+
+// Run reloads the configuration each time a signal is received from signals, until ctx is canceled.
+// Failing to reload is logged and the current configuration is kept.
+func (reloader *Reloader) Run(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			reloader.logger.Infof("received %s, reloading configuration", sig)
+
+			cfg, err := reloader.loadConfig()
+			if err != nil {
+				reloader.logger.Errorf("failed to reload configuration, keeping the current configuration: %s", err)
+				continue
+			}
+
+			if err := reloader.Reload(cfg); err != nil {
+				reloader.logger.Errorf("failed to reload configuration, keeping the current configuration: %s", err)
+			}
+		}
+	}
+}
+
+// Reload applies the reloadable fields of cfg which differ from the current configuration.
+// If cfg is invalid, or a new qBittorrent client can't be created, nothing is applied and an error is returned.
+func (reloader *Reloader) Reload(cfg *Config) error {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%s", err)
+	}
+
+	changed := ChangedConfigFields(reloader.cfg, cfg)
+	if len(changed) == 0 {
+		reloader.logger.Info("configuration did not change")
+		return nil
+	}
+
+	var restartRequired []string
+	for _, name := range changed {
+		if !slices.Contains(ReloadableConfigFields, name) {
+			restartRequired = append(restartRequired, name)
+		}
+	}
+
+	// Everything which can fail is done before anything is applied, so a failed reload changes nothing
+	var client *QBittorrentClient
+	if hasAny(changed, "QBITTORRENT_API_NETLOC", "QBITTORRENT_USERNAME", "QBITTORRENT_PASSWORD") {
+		var err error
+		client, err = reloader.newQBittorrentClient(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create qBittorrent API client: %s", err)
+		}
+	}
+
+	var notifiers *MultiNotifier
+	if hasAny(changed, "NOTIFY_WEBHOOK_URLS", "NOTIFY_DISCORD_WEBHOOK_URLS") {
+		var err error
+		notifiers, err = cfg.Notifiers()
+		if err != nil {
+			return fmt.Errorf("failed to create notifiers: %s", err)
+		}
+	}
+
+	if hasAny(changed, "VERBOSE") {
+		for _, logger := range reloader.loggers {
+			if cfg.Verbose {
+				logger.SetLevel(golog.DebugLevel)
+			} else {
+				logger.SetLevel(golog.InfoLevel)
+			}
+		}
+	}
+
+	if hasAny(changed, "PORT_FILE") {
+		reloader.syncer.SetPortFiles(cfg.PortFiles)
+	}
+
+	if hasAny(changed, "REFRESH_INTERVAL_SECONDS") {
+		reloader.syncer.SetInterval(time.Duration(cfg.RefreshIntervalSeconds) * time.Second)
+	}
+
+	if client != nil {
+		reloader.syncer.SetQBittorrentClient(client)
+	}
+
+	if notifiers != nil {
+		reloader.notifier.Set(notifiers)
+	}
+
+	// Fields which were not applied keep their current values, so the configuration reflects what is running
+	applied := *reloader.cfg
+	applied.EnvFile = cfg.EnvFile
+	applied.PortFiles = cfg.PortFiles
+	applied.RefreshIntervalSeconds = cfg.RefreshIntervalSeconds
+	applied.Verbose = cfg.Verbose
+	applied.NotifyWebhookURLs = cfg.NotifyWebhookURLs
+	applied.NotifyDiscordWebhookURLs = cfg.NotifyDiscordWebhookURLs
+	applied.QBittorrentAPINetloc = cfg.QBittorrentAPINetloc
+	applied.QBittorrentUsername = cfg.QBittorrentUsername
+	applied.QBittorrentPassword = cfg.QBittorrentPassword
+	applied.AuthFile = cfg.AuthFile
+	reloader.cfg = &applied
+
+	if len(restartRequired) < len(changed) {
+		reloader.logger.Infof("reloaded configuration, applied changes to: %s", strings.Join(without(changed, restartRequired), ", "))
+	}
+	if len(restartRequired) > 0 {
+		reloader.logger.Warnf("changes to %s can't be applied while running, restart to apply them", strings.Join(restartRequired, ", "))
+	}
+
+	return nil
+}
+
+// hasAny determines if names contains any of wanted
+func hasAny(names []string, wanted ...string) bool {
+	for _, name := range wanted {
+		if slices.Contains(names, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// without returns the names which are not in excluded
+func without(names []string, excluded []string) []string {
+	var remaining []string
+	for _, name := range names {
+		if !slices.Contains(excluded, name) {
+			remaining = append(remaining, name)
+		}
+	}
+
+	return remaining
+}
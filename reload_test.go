@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+// newTestReloader creates a Reloader for syncer whose current configuration is cfg, warnings are written to warnLog
+func newTestReloader(t *testing.T, fake *testutil.FakeQBittorrent, syncer *PortSyncer, cfg Config, warnLog io.Writer) *Reloader {
+	t.Helper()
+
+	return NewReloader(NewReloaderOptions{
+		Logger: golog.NewWriterLogger("test", io.Discard, io.Discard, warnLog, io.Discard, io.Discard),
+		NewQBittorrentClient: func(cfg *Config) (*QBittorrentClient, error) {
+			return newTestClient(t, fake), nil
+		},
+		Syncer:   syncer,
+		Notifier: NewSwappableNotifier(NewMultiNotifier()),
+		Config:   &cfg,
+	})
+}
+
+func TestReloaderInterval(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	cfg := newTestConfig(t)
+	syncer, _ := newTestSyncer(t, fake, NewPortSyncerOptions{PortFiles: cfg.PortFiles, SkipInitialSync: true})
+	reloader := newTestReloader(t, fake, syncer, cfg, io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go syncer.Loop(ctx, ctx, time.Hour)
+
+	reloaded := cfg
+	reloaded.RefreshIntervalSeconds = 1
+	if err := reloader.Reload(&reloaded); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+
+	// With the original interval no sync would run for an hour
+	deadline := time.Now().Add(5 * time.Second)
+	for syncer.Status().TotalSyncs < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ran %d syncs after the interval was reloaded, expected the ticker to use the new interval", syncer.Status().TotalSyncs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestReloaderRestartRequired(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	cfg := newTestConfig(t)
+	syncer, _ := newTestSyncer(t, fake, NewPortSyncerOptions{PortFiles: cfg.PortFiles})
+	var warnLog bytes.Buffer
+	reloader := newTestReloader(t, fake, syncer, cfg, &warnLog)
+	client := syncer.QBittorrentClient()
+
+	reloaded := cfg
+	reloaded.QBittorrentPassword = "new password"
+	reloaded.SyncTimeoutSeconds = 30
+	if err := reloader.Reload(&reloaded); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+
+	if syncer.QBittorrentClient() == client {
+		t.Errorf("qBittorrent client was not recreated after the password changed")
+	}
+	if !strings.Contains(warnLog.String(), "changes to SYNC_TIMEOUT_SECONDS can't be applied while running") {
+		t.Errorf("a restart was not requested for SYNC_TIMEOUT_SECONDS, warnings: %s", warnLog.String())
+	}
+	if strings.Contains(warnLog.String(), "QBITTORRENT_PASSWORD") {
+		t.Errorf("a restart was requested for the reloadable QBITTORRENT_PASSWORD, warnings: %s", warnLog.String())
+	}
+
+	invalid := cfg
+	invalid.RefreshIntervalSeconds = 0
+	if err := reloader.Reload(&invalid); err == nil {
+		t.Errorf("an invalid configuration was reloaded")
+	}
+}
+
+func TestReloaderShutdownCleanupLogout(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	reloadedFake := testutil.NewFakeQBittorrent("admin", "password")
+	defer reloadedFake.Close()
+
+	cfg := newTestConfig(t)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{PortFiles: cfg.PortFiles})
+	reloader := newTestReloader(t, reloadedFake, syncer, cfg, io.Discard)
+	cleanup := NewShutdownCleanup(NewShutdownCleanupOptions{
+		Logger:    golog.NewLogger("test"),
+		Syncer:    syncer,
+		StartTime: time.Now(),
+		Logout:    true,
+		Timeout:   5 * time.Second,
+	})
+
+	// The network location changes, so the reloaded client has the live session
+	reloaded := cfg
+	reloaded.QBittorrentAPINetloc = reloadedFake.URL()
+	if err := reloader.Reload(&reloaded); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	writePortFile(t, portFile, 50000)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	cleanup.Run(context.Background())
+
+	if logouts := reloadedFake.Requests("/api/v2/auth/logout"); logouts != 1 {
+		t.Errorf("logged out of the reloaded qBittorrent %d times, expected 1", logouts)
+	}
+	if logouts := fake.Requests("/api/v2/auth/logout"); logouts != 0 {
+		t.Errorf("logged out of the original qBittorrent %d times, expected its stale session to be left", logouts)
+	}
+}
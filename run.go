@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// RunSyncLoopOptions are options for RunSyncLoop
+type RunSyncLoopOptions struct {
+	// Logger is used to output information
+	Logger golog.Logger
+
+	// Syncer runs the syncs
+	Syncer *PortSyncer
+
+	// Instances runs the sync loops of additional qBittorrent instances alongside Syncer's, nil if there are none
+	Instances *InstanceGroup
+
+	// Cleanup is run once the sync loop stopped, or the watchdog failed
+	Cleanup *ShutdownCleanup
+
+	// Watchdog checks the sync loop is making progress, nil to not check
+	Watchdog *Watchdog
+
+	// Interval is the duration between syncs
+	Interval time.Duration
+
+	// MaxRuntime is how long the sync loop runs before it is stopped like by a graceful stop signal, zero means no limit
+	MaxRuntime time.Duration
+}
+
+// RunSyncLoop runs the sync loop until gracefulCtx is canceled or the max runtime elapses, then runs the shutdown cleanup.
+// Only harshCtx being canceled aborts a running sync and skips the cleanup.
+// The additional instances are stopped along with the loop.
+// Returns nil if the loop stopped without failing, which the tool exits successfully for. Otherwise the error of the loop, the watchdog, or the
+// additional instances, whose failure class determines the exit code. The cleanup is run before any is returned.
+func RunSyncLoop(gracefulCtx context.Context, harshCtx context.Context, opts RunSyncLoopOptions) error {
+	// The max runtime elapsing is handled like a graceful stop signal, so an in-flight sync may finish
+	loopCtx, cancelLoop := context.WithCancel(gracefulCtx)
+	if opts.MaxRuntime > 0 {
+		loopCtx, cancelLoop = context.WithTimeout(gracefulCtx, opts.MaxRuntime)
+	}
+	defer cancelLoop()
+
+	go func() {
+		select {
+		case <-gracefulCtx.Done():
+			opts.Logger.Info("received graceful stop signal, exitting...")
+		case <-harshCtx.Done():
+			opts.Logger.Info("received harsh stop signal, exitting...")
+		case <-loopCtx.Done():
+			if errors.Is(loopCtx.Err(), context.DeadlineExceeded) {
+				opts.Logger.Infof("max runtime of %s reached, exitting...", opts.MaxRuntime)
+			}
+		}
+	}()
+
+	stopped := make(chan error, 3)
+	instancesStopped := make(chan struct{})
+	if opts.Instances != nil {
+		go func() {
+			defer close(instancesStopped)
+			if err := opts.Instances.Run(loopCtx, harshCtx); err != nil {
+				stopped <- err
+			}
+		}()
+	} else {
+		close(instancesStopped)
+	}
+	if opts.Watchdog != nil {
+		go func() {
+			if err := opts.Watchdog.Run(loopCtx); err != nil {
+				stopped <- err
+			}
+		}()
+	}
+	go func() {
+		if err := opts.Syncer.Loop(loopCtx, harshCtx, opts.Interval); err != nil {
+			stopped <- fmt.Errorf("failed to run sync loop: %w", err)
+			return
+		}
+
+		stopped <- nil
+	}()
+
+	// A stalled loop may never stop, so a watchdog failure does not wait for it
+	err := <-stopped
+	cancelLoop()
+	<-instancesStopped
+
+	// Cleanup also runs when the loop failed, logging out is then skipped if SkipLogoutIfLastSyncFailed is set. Queued on change commands run before exiting
+	opts.Cleanup.Run(harshCtx)
+
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+func TestRunSyncLoop(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// maxRuntimeSeconds is the MAX_RUNTIME_SECONDS configuration
+		maxRuntimeSeconds int
+
+		// gracefulStop indicates a graceful stop signal is received once the first sync finished
+		gracefulStop bool
+
+		// invalidPort indicates the port file contains an invalid port, so the loop fails
+		invalidPort bool
+
+		wantExitCode int
+	}{
+		{name: "max runtime", maxRuntimeSeconds: 1},
+		{name: "graceful stop", gracefulStop: true},
+		{name: "sync failed", invalidPort: true, wantExitCode: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+			if test.invalidPort {
+				if err := os.WriteFile(portFile, []byte("not a port"), 0o644); err != nil {
+					t.Fatalf("failed to write port file: %s", err)
+				}
+			} else {
+				writePortFile(t, portFile, 50000)
+			}
+
+			readyFile := filepath.Join(t.TempDir(), "ready")
+			if err := os.WriteFile(readyFile, []byte("ready\n"), 0o644); err != nil {
+				t.Fatalf("failed to write ready file: %s", err)
+			}
+
+			cfg := newTestConfig(t)
+			cfg.MaxRuntimeSeconds = test.maxRuntimeSeconds
+
+			gracefulCtx, cancelGraceful := context.WithCancel(context.Background())
+			defer cancelGraceful()
+			if test.gracefulStop {
+				go func() {
+					for syncer.Status().TotalSyncs == 0 {
+						time.Sleep(time.Millisecond)
+					}
+					cancelGraceful()
+				}()
+			}
+
+			logger := golog.NewLogger("test")
+			err := RunSyncLoop(gracefulCtx, context.Background(), RunSyncLoopOptions{
+				Logger: logger,
+				Syncer: syncer,
+				Cleanup: NewShutdownCleanup(NewShutdownCleanupOptions{
+					Logger:    logger,
+					Syncer:    syncer,
+					StartTime: time.Now(),
+					Logout:    true,
+					ReadyFile: readyFile,
+					Timeout:   5 * time.Second,
+				}),
+				Interval:   time.Hour,
+				MaxRuntime: cfg.MaxRuntime(),
+			})
+
+			// The tool exits with status 0 if the loop stopped without failing
+			exitCode := 0
+			if err != nil {
+				exitCode = ExitCodes{FailureClassPortParse: 3}.For(err)
+			}
+			if exitCode != test.wantExitCode {
+				t.Errorf("exit code is %d for error %v, expected %d", exitCode, err, test.wantExitCode)
+			}
+
+			if logouts := fake.Requests("/api/v2/auth/logout"); logouts != 1 {
+				t.Errorf("logged out %d times, expected the cleanup to log out once", logouts)
+			}
+			if _, err := os.Stat(readyFile); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("ready file still exists, expected the cleanup to remove it: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// HTTPServer serves the tool's auxiliary HTTP endpoints
+type HTTPServer struct {
+	// logger is used to output information
+	logger golog.Logger
+
+	// server is the underlying HTTP server
+	server *http.Server
+
+	// listener accepts connections for server, nil until Listen is called
+	listener net.Listener
+
+	// syncer is controlled by the /reload endpoint and reported on by the /status endpoint
+	syncer *PortSyncer
+
+	// metrics are served on the /metrics endpoint, the qBittorrent versions they recorded are reported by the /status endpoint
+	metrics *Metrics
+
+	// startTime is when the process started, reported by the /status endpoint
+	startTime time.Time
+
+	// token must be provided as a bearer token to use endpoints which change state
+	token string
+}
+
+// NewHTTPServerOptions are options for creating a new HTTPServer
+type NewHTTPServerOptions struct {
+	// Logger is used to output information
+	Logger golog.Logger
+
+	// Address is the host:port on which the server will listen
+	Address string
+
+	// Metrics are served on the /metrics endpoint
+	Metrics *Metrics
+
+	// Syncer is controlled by the /reload endpoint and reported on by the /status endpoint
+	Syncer *PortSyncer
+
+	// StartTime is when the process started, reported by the /status endpoint
+	StartTime time.Time
+
+	// Token must be provided as a bearer token to use endpoints which change state, if empty those endpoints are disabled
+	Token string
+}
+
+// NewHTTPServer creates a new HTTPServer
+func NewHTTPServer(opts NewHTTPServerOptions) *HTTPServer {
+	srv := &HTTPServer{
+		logger:    opts.Logger,
+		syncer:    opts.Syncer,
+		metrics:   opts.Metrics,
+		startTime: opts.StartTime,
+		token:     opts.Token,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(opts.Metrics.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/status", srv.handleStatus)
+	mux.HandleFunc("/reload", srv.requireToken(srv.handleReload))
+
+	srv.server = &http.Server{
+		Addr:              opts.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return srv
+}
+
+// HTTPServerURL returns the URL of path on an HTTP server listening on address, which is a host:port like HTTP_SERVER_ADDRESS.
+// An address which listens on every interface is reached via localhost.
+func HTTPServerURL(address string, path string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse HTTP server address '%s': %s", address, err)
+	}
+
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return "http://" + net.JoinHostPort(host, port) + path, nil
+}
+
+// writeJSON responds with the JSON encoded body
+func (srv *HTTPServer) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		srv.logger.Errorf("failed to write JSON response: %s", err)
+	}
+}
+
+// ErrorResponse is the body of HTTP responses which indicate an error
+type ErrorResponse struct {
+	// Error describes what went wrong
+	Error string `json:"error"`
+}
+
+// requireToken only calls handler if the request includes the server's token as a bearer token
+func (srv *HTTPServer) requireToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(srv.token) == 0 {
+			srv.writeJSON(w, http.StatusForbidden, ErrorResponse{"endpoint is disabled because no HTTP server token is configured"})
+			return
+		}
+
+		reqToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(reqToken), []byte(srv.token)) != 1 {
+			srv.writeJSON(w, http.StatusUnauthorized, ErrorResponse{"missing or incorrect bearer token"})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// StatusResponse is the body of a /status response
+type StatusResponse struct {
+	// StartTime is when the process started
+	StartTime time.Time `json:"start_time"`
+
+	// UptimeSeconds is the number of seconds since the process started
+	UptimeSeconds int64 `json:"uptime_seconds"`
+
+	// QBittorrentVersion is qBittorrent's version, empty until it is detected
+	QBittorrentVersion string `json:"qbittorrent_version"`
+
+	// QBittorrentWebAPIVersion is qBittorrent's WebAPI version, empty until it is detected
+	QBittorrentWebAPIVersion string `json:"qbittorrent_webapi_version"`
+
+	// PortHistory are the most recent changes of qBittorrent's listen port, oldest first
+	PortHistory []PortChange `json:"port_history"`
+
+	SyncStatus
+}
+
+// handleStatus responds with how long the process has been running and a summary of the syncs which have run
+func (srv *HTTPServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		srv.writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{"method must be GET"})
+		return
+	}
+
+	version, webAPIVersion := srv.metrics.QBittorrentVersions()
+
+	srv.writeJSON(w, http.StatusOK, StatusResponse{
+		StartTime:                srv.startTime,
+		UptimeSeconds:            int64(time.Since(srv.startTime).Seconds()),
+		QBittorrentVersion:       version,
+		QBittorrentWebAPIVersion: webAPIVersion,
+		PortHistory:              srv.syncer.PortHistory(),
+		SyncStatus:               srv.syncer.Status(),
+	})
+}
+
+// ReloadRequest is the body of a /reload request
+type ReloadRequest struct {
+	// PortFiles are the new port files to read the port from, in order of priority
+	PortFiles []string `json:"port_files"`
+}
+
+// ReloadResponse is the body of a successful /reload response
+type ReloadResponse struct {
+	// PortFiles are the port files now in use
+	PortFiles []string `json:"port_files"`
+
+	// SyncTriggered indicates a sync was requested with the new port files
+	SyncTriggered bool `json:"sync_triggered"`
+}
+
+// handleReload changes the port files the syncer reads and triggers a sync
+func (srv *HTTPServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		srv.writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{"method must be POST"})
+		return
+	}
+
+	var reloadReq ReloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&reloadReq); err != nil {
+		srv.writeJSON(w, http.StatusBadRequest, ErrorResponse{fmt.Sprintf("failed to decode request body as JSON: %s", err)})
+		return
+	}
+
+	if len(reloadReq.PortFiles) == 0 {
+		srv.writeJSON(w, http.StatusBadRequest, ErrorResponse{"port_files must contain at least one path"})
+		return
+	}
+	for _, portFile := range reloadReq.PortFiles {
+		if len(strings.TrimSpace(portFile)) == 0 || portFile == StdinPortFile {
+			srv.writeJSON(w, http.StatusBadRequest, ErrorResponse{fmt.Sprintf("'%s' is not a valid port file path", portFile)})
+			return
+		}
+	}
+
+	srv.syncer.SetPortFiles(reloadReq.PortFiles)
+	srv.syncer.TriggerSync()
+	srv.logger.Infof("port files changed to %v via reload endpoint", reloadReq.PortFiles)
+
+	srv.writeJSON(w, http.StatusOK, ReloadResponse{
+		PortFiles:     srv.syncer.PortFiles(),
+		SyncTriggered: true,
+	})
+}
+
+// Listen binds the server's address, this is separate from Run so failing to bind can be handled before serving
+func (srv *HTTPServer) Listen() error {
+	listener, err := net.Listen("tcp", srv.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %s", srv.server.Addr, err)
+	}
+	srv.listener = listener
+
+	return nil
+}
+
+// Run serves HTTP requests until ctx is canceled, it calls Listen if it has not been called
+func (srv *HTTPServer) Run(ctx context.Context) error {
+	if srv.listener == nil {
+		if err := srv.Listen(); err != nil {
+			return err
+		}
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		srv.logger.Infof("serving HTTP on %s", srv.listener.Addr())
+		serveErr <- srv.server.Serve(srv.listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("failed to serve HTTP: %s", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+
+	if err := srv.server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shutdown HTTP server: %s", err)
+	}
+
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve HTTP: %s", err)
+	}
+
+	return nil
+}
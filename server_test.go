@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+// newTestHTTPServer creates an HTTPServer which controls syncer and requires token
+func newTestHTTPServer(syncer *PortSyncer, token string) *HTTPServer {
+	return NewHTTPServer(NewHTTPServerOptions{
+		Logger:  golog.NewLogger("test"),
+		Metrics: syncer.metrics,
+		Syncer:  syncer,
+		Token:   token,
+	})
+}
+
+// serveTestRequest sends a request to srv and returns the response
+func serveTestRequest(srv *HTTPServer, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestHTTPServerReload(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+	srv := newTestHTTPServer(syncer, "secret")
+
+	newPortFile := filepath.Join(t.TempDir(), "new-port")
+	writePortFile(t, newPortFile, 50001)
+
+	resp := serveTestRequest(srv, http.MethodPost, "/reload", "secret", `{"port_files": ["`+newPortFile+`"]}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("reload responded with %d, expected 200: %s", resp.Code, resp.Body)
+	}
+
+	select {
+	case <-syncer.syncTrigger:
+	default:
+		t.Errorf("reload did not trigger a sync")
+	}
+
+	// Subsequent syncs read the new port file
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if port := fake.ListenPort(); port != 50001 {
+		t.Errorf("qBittorrent port is %d, expected 50001 from the new port file", port)
+	}
+}
+
+func TestHTTPServerReloadRefused(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverToken string
+		method      string
+		reqToken    string
+		body        string
+		wantStatus  int
+	}{
+		{name: "no server token", method: http.MethodPost, reqToken: "secret", body: `{"port_files": ["/tmp/port"]}`, wantStatus: http.StatusForbidden},
+		{name: "missing token", serverToken: "secret", method: http.MethodPost, body: `{"port_files": ["/tmp/port"]}`, wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", serverToken: "secret", method: http.MethodPost, reqToken: "guess", body: `{"port_files": ["/tmp/port"]}`, wantStatus: http.StatusUnauthorized},
+		{name: "not POST", serverToken: "secret", method: http.MethodGet, reqToken: "secret", wantStatus: http.StatusMethodNotAllowed},
+		{name: "invalid JSON", serverToken: "secret", method: http.MethodPost, reqToken: "secret", body: `{`, wantStatus: http.StatusBadRequest},
+		{name: "no port files", serverToken: "secret", method: http.MethodPost, reqToken: "secret", body: `{"port_files": []}`, wantStatus: http.StatusBadRequest},
+		{name: "stdin port file", serverToken: "secret", method: http.MethodPost, reqToken: "secret", body: `{"port_files": ["-"]}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+			srv := newTestHTTPServer(syncer, test.serverToken)
+
+			resp := serveTestRequest(srv, test.method, "/reload", test.reqToken, test.body)
+			if resp.Code != test.wantStatus {
+				t.Errorf("reload responded with %d, expected %d: %s", resp.Code, test.wantStatus, resp.Body)
+			}
+
+			if portFiles := syncer.PortFiles(); len(portFiles) != 1 || portFiles[0] != portFile {
+				t.Errorf("port files changed to %v", portFiles)
+			}
+		})
+	}
+}
+
+func TestHTTPServerStatus(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{PortHistorySize: 5})
+	writePortFile(t, portFile, 50000)
+
+	startTime := time.Now().Add(-time.Minute)
+	srv := NewHTTPServer(NewHTTPServerOptions{
+		Logger:    golog.NewLogger("test"),
+		Metrics:   syncer.metrics,
+		Syncer:    syncer,
+		StartTime: startTime,
+	})
+
+	// getStatus requests the status, which does not require the token
+	getStatus := func() StatusResponse {
+		t.Helper()
+
+		resp := serveTestRequest(srv, http.MethodGet, "/status", "", "")
+		if resp.Code != http.StatusOK {
+			t.Fatalf("status responded with %d, expected 200: %s", resp.Code, resp.Body)
+		}
+
+		var status StatusResponse
+		if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil {
+			t.Fatalf("failed to decode status: %s", err)
+		}
+
+		return status
+	}
+
+	if status := getStatus(); status.TotalSyncs != 0 || status.LastSync != nil {
+		t.Errorf("status before any sync is %+v, expected no syncs", status)
+	}
+	if status := getStatus(); status.QBittorrentVersion != "" {
+		t.Errorf("qBittorrent version before it was detected is %s, expected none", status.QBittorrentVersion)
+	}
+
+	if _, _, err := syncer.qBittorrentClient.DetectVersions(context.Background()); err != nil {
+		t.Fatalf("failed to detect versions: %s", err)
+	}
+	if status := getStatus(); status.QBittorrentVersion != "v4.6.0" || status.QBittorrentWebAPIVersion != "2.9.3" {
+		t.Errorf("status has qBittorrent version %s and WebAPI version %s, expected v4.6.0 and 2.9.3", status.QBittorrentVersion, status.QBittorrentWebAPIVersion)
+	}
+
+	// Syncs advance the count, whether or not they changed the port
+	for i := 1; i <= 3; i++ {
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync: %s", err)
+		}
+
+		status := getStatus()
+		if status.TotalSyncs != i || status.TotalChanges != 1 {
+			t.Errorf("after %d syncs status is %+v, expected %d syncs and 1 change", i, status, i)
+		}
+		if !status.StartTime.Equal(startTime) {
+			t.Errorf("start time is %s, expected %s", status.StartTime, startTime)
+		}
+		if status.UptimeSeconds < 60 {
+			t.Errorf("uptime is %ds, expected at least 60s", status.UptimeSeconds)
+		}
+		if len(status.PortHistory) != 1 || status.PortHistory[0].OldPort != 6881 || status.PortHistory[0].NewPort != 50000 {
+			t.Errorf("after %d syncs port history is %+v, expected only the change from 6881 to 50000", i, status.PortHistory)
+		}
+	}
+
+	if resp := serveTestRequest(srv, http.MethodPost, "/status", "", ""); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status responded with %d, expected 405", resp.Code)
+	}
+}
+
+func TestHTTPServerListenAddressInUse(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+
+	// Something else is already using the address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	srv := NewHTTPServer(NewHTTPServerOptions{
+		Logger:  golog.NewLogger("test"),
+		Address: listener.Addr().String(),
+		Metrics: syncer.metrics,
+		Syncer:  syncer,
+	})
+	if err := srv.Listen(); err == nil {
+		t.Fatalf("expected listening on an address in use to fail")
+	}
+
+	// Syncing continues without the HTTP server, like main does when it is not required
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := syncer.Loop(ctx, context.Background(), time.Hour); err != nil {
+		t.Fatalf("loop failed: %s", err)
+	}
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("qBittorrent port is %d, expected the loop to set 50000", port)
+	}
+}
+
+func TestHTTPServerRun(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, _ := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	srv := NewHTTPServer(NewHTTPServerOptions{
+		Logger:  golog.NewLogger("test"),
+		Address: "127.0.0.1:0",
+		Metrics: syncer.metrics,
+		Syncer:  syncer,
+	})
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- srv.Run(ctx)
+	}()
+
+	// Run serves on the address bound by Listen
+	resp, err := http.Get("http://" + srv.listener.Addr().String() + "/status")
+	if err != nil {
+		t.Fatalf("failed to get status: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status responded with %d, expected 200", resp.StatusCode)
+	}
+
+	cancel()
+	if err := <-runErr; err != nil {
+		t.Errorf("run failed: %s", err)
+	}
+}
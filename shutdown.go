@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// ShutdownCleanup is done after the sync loop stops gracefully, because of a graceful stop signal or the max runtime elapsing, or because a sync failed.
+// After a harsh stop signal the tool exits immediately and cleanup is skipped.
+type ShutdownCleanup struct {
+	// logger is used to output information
+	logger golog.Logger
+
+	// syncer's status is logged if reportStatus is true, and its current qBittorrent client is logged out of qBittorrent if logout is true
+	syncer *PortSyncer
+
+	// startTime is when the tool started, used to report its uptime
+	startTime time.Time
+
+	// reportStatus indicates a summary of the syncs which ran is logged
+	reportStatus bool
+
+	// logout indicates the qBittorrent session is ended, so it does not linger until it expires
+	logout bool
+
+	// logoutTimeout is the maximum duration of logging out, so an unreachable qBittorrent does not delay exiting, zero means only timeout limits it
+	logoutTimeout time.Duration
+
+	// skipLogoutIfLastSyncFailed indicates logging out is skipped if the last sync failed, since qBittorrent is likely unreachable
+	skipLogoutIfLastSyncFailed bool
+
+	// readyFile is removed so the tool is no longer considered ready, empty if there is none
+	readyFile string
+
+	// notificationsDone is closed once the notifications of every sync result were sent, after the syncer's results are closed. Nil if results are not notified
+	notificationsDone <-chan struct{}
+
+	// timeout is the maximum duration of the cleanup, zero means no limit
+	timeout time.Duration
+
+	// once ensures the cleanup is only done once, since both the sync loop stopping and the watchdog exiting run it
+	once sync.Once
+}
+
+// NewShutdownCleanupOptions are options to create a new shutdown cleanup
+type NewShutdownCleanupOptions struct {
+	// Logger is used to output information
+	Logger golog.Logger
+
+	// Syncer's status is logged if ReportStatus is true, and its current qBittorrent client is logged out of qBittorrent if Logout is true
+	Syncer *PortSyncer
+
+	// StartTime is when the tool started, used to report its uptime
+	StartTime time.Time
+
+	// ReportStatus indicates a summary of the syncs which ran is logged
+	ReportStatus bool
+
+	// Logout indicates the qBittorrent session is ended, so it does not linger until it expires
+	Logout bool
+
+	// LogoutTimeout is the maximum duration of logging out, so an unreachable qBittorrent does not delay exiting, zero means only Timeout limits it
+	LogoutTimeout time.Duration
+
+	// SkipLogoutIfLastSyncFailed indicates logging out is skipped if the last sync failed, since qBittorrent is likely unreachable
+	SkipLogoutIfLastSyncFailed bool
+
+	// ReadyFile is removed so the tool is no longer considered ready, empty if there is none
+	ReadyFile string
+
+	// NotificationsDone is closed once the notifications of every sync result were sent, after the syncer's results are closed. Nil if results are not notified
+	NotificationsDone <-chan struct{}
+
+	// Timeout is the maximum duration of the cleanup, zero means no limit
+	Timeout time.Duration
+}
+
+// NewShutdownCleanup creates a new ShutdownCleanup
+func NewShutdownCleanup(opts NewShutdownCleanupOptions) *ShutdownCleanup {
+	return &ShutdownCleanup{
+		logger:                     opts.Logger,
+		syncer:                     opts.Syncer,
+		startTime:                  opts.StartTime,
+		reportStatus:               opts.ReportStatus,
+		logout:                     opts.Logout,
+		logoutTimeout:              opts.LogoutTimeout,
+		skipLogoutIfLastSyncFailed: opts.SkipLogoutIfLastSyncFailed,
+		readyFile:                  opts.ReadyFile,
+		notificationsDone:          opts.NotificationsDone,
+		timeout:                    opts.Timeout,
+	}
+}
+
+// Run cleans up, unless harshCtx is canceled. If harshCtx is canceled while cleaning up the remaining cleanup is aborted.
+// It is safe to call concurrently, only the first call cleans up and the others wait for it to finish.
+func (cleanup *ShutdownCleanup) Run(harshCtx context.Context) {
+	cleanup.once.Do(func() {
+		cleanup.run(harshCtx)
+	})
+}
+
+// run does the work of Run
+func (cleanup *ShutdownCleanup) run(harshCtx context.Context) {
+	if harshCtx.Err() != nil {
+		cleanup.logger.Info("stopped by a harsh stop signal, skipping cleanup")
+		return
+	}
+
+	ctx := harshCtx
+	if cleanup.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(harshCtx, cleanup.timeout)
+		defer cancel()
+	}
+
+	// On change commands queued in the background were not run yet, the process exiting would skip them
+	if cleanup.syncer != nil {
+		cleanup.syncer.WaitForOnChangeCommands(ctx)
+	}
+
+	if cleanup.notificationsDone != nil {
+		cleanup.waitForNotifications(ctx)
+	}
+
+	if len(cleanup.readyFile) > 0 {
+		if err := RemoveReadyFile(cleanup.readyFile); err != nil {
+			cleanup.logger.Warnf("%s", err)
+		} else {
+			cleanup.logger.Infof("removed ready file '%s'", cleanup.readyFile)
+		}
+	}
+
+	if cleanup.reportStatus {
+		cleanup.syncer.Status().Log(cleanup.logger, time.Since(cleanup.startTime))
+	}
+
+	if cleanup.logout {
+		cleanup.runLogout(ctx)
+	}
+}
+
+// waitForNotifications closes the syncer's results and waits for the notifications of the results which were still queued to be sent, at most notificationTimeout
+func (cleanup *ShutdownCleanup) waitForNotifications(ctx context.Context) {
+	cleanup.syncer.CloseSyncResults()
+
+	timer := time.NewTimer(notificationTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-cleanup.notificationsDone:
+	case <-timer.C:
+		cleanup.logger.Warnf("notifications were not sent within %s, exiting without them", notificationTimeout)
+	case <-ctx.Done():
+		cleanup.logger.Warn("cleanup was aborted before notifications were sent, exiting without them")
+	}
+}
+
+// runLogout logs out of qBittorrent, unless the last sync failed and skipLogoutIfLastSyncFailed is true. Failing to log out is logged.
+func (cleanup *ShutdownCleanup) runLogout(ctx context.Context) {
+	if lastSyncErr := cleanup.syncer.Status().LastSyncError; cleanup.skipLogoutIfLastSyncFailed && len(lastSyncErr) > 0 {
+		cleanup.logger.Infof("skipping logging out of qBittorrent because the last sync failed, qBittorrent is likely unreachable: %s", lastSyncErr)
+		return
+	}
+
+	if cleanup.logoutTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cleanup.logoutTimeout)
+		defer cancel()
+	}
+
+	// A reload may have replaced the client the syncer started with, only the current one has a live session
+	if err := cleanup.syncer.QBittorrentClient().Logout(ctx); err != nil {
+		cleanup.logger.Warnf("failed to log out of qBittorrent: %s", err)
+	} else {
+		cleanup.logger.Info("logged out of qBittorrent")
+	}
+}
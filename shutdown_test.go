@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+func TestShutdownCleanup(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// harsh indicates a harsh stop signal was received
+		harsh bool
+
+		wantCleanup bool
+	}{
+		{name: "graceful", wantCleanup: true},
+		{name: "harsh", harsh: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+			writePortFile(t, portFile, 50000)
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			harshCtx, cancelHarsh := context.WithCancel(context.Background())
+			defer cancelHarsh()
+			if test.harsh {
+				cancelHarsh()
+			}
+
+			var infoLog bytes.Buffer
+			NewShutdownCleanup(NewShutdownCleanupOptions{
+				Logger:       golog.NewWriterLogger("test", io.Discard, io.Discard, io.Discard, &infoLog, io.Discard),
+				Syncer:       syncer,
+				StartTime:    time.Now(),
+				ReportStatus: true,
+				Logout:       true,
+				Timeout:      5 * time.Second,
+			}).Run(harshCtx)
+
+			if logouts := fake.Requests("/api/v2/auth/logout"); (logouts == 1) != test.wantCleanup {
+				t.Errorf("logged out %d times, expected cleanup: %t", logouts, test.wantCleanup)
+			}
+			if reported := strings.Contains(infoLog.String(), "summary:"); reported != test.wantCleanup {
+				t.Errorf("summary reported: %t, expected cleanup: %t, logs: %s", reported, test.wantCleanup, infoLog.String())
+			}
+		})
+	}
+}
+
+func TestShutdownCleanupQBittorrentUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// lastSyncFails indicates the last sync before shutting down failed
+		lastSyncFails              bool
+		skipLogoutIfLastSyncFailed bool
+
+		wantLogouts int
+	}{
+		{name: "logout times out", wantLogouts: 1},
+		{name: "last sync failed", lastSyncFails: true, wantLogouts: 1},
+		{name: "skipped after failed sync", lastSyncFails: true, skipLogoutIfLastSyncFailed: true, wantLogouts: 0},
+		{name: "not skipped after successful sync", skipLogoutIfLastSyncFailed: true, wantLogouts: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+			writePortFile(t, portFile, 50000)
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+			if test.lastSyncFails {
+				if err := os.WriteFile(portFile, []byte("not a port"), 0o644); err != nil {
+					t.Fatalf("failed to write port file: %s", err)
+				}
+				if _, err := syncer.Sync(context.Background()); err == nil {
+					t.Fatalf("sync succeeded, expected it to fail")
+				}
+			}
+
+			// qBittorrent stops responding
+			fake.SetDelay(time.Hour)
+
+			started := time.Now()
+			NewShutdownCleanup(NewShutdownCleanupOptions{
+				Logger:                     golog.NewLogger("test"),
+				Syncer:                     syncer,
+				StartTime:                  time.Now(),
+				Logout:                     true,
+				LogoutTimeout:              100 * time.Millisecond,
+				SkipLogoutIfLastSyncFailed: test.skipLogoutIfLastSyncFailed,
+				Timeout:                    time.Minute,
+			}).Run(context.Background())
+
+			if elapsed := time.Since(started); elapsed > time.Second {
+				t.Errorf("cleanup took %s, expected it to stop logging out after the logout timeout", elapsed)
+			}
+			if logouts := fake.Requests("/api/v2/auth/logout"); logouts != test.wantLogouts {
+				t.Errorf("tried to log out %d times, expected %d", logouts, test.wantLogouts)
+			}
+		})
+	}
+}
+
+func TestShutdownCleanupAfterLoopError(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	if err := os.WriteFile(portFile, []byte("not a port"), 0o644); err != nil {
+		t.Fatalf("failed to write port file: %s", err)
+	}
+
+	if err := syncer.Loop(context.Background(), context.Background(), time.Minute); err == nil {
+		t.Fatalf("loop succeeded, expected it to stop because of the failed sync")
+	}
+
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	if err := os.WriteFile(readyFile, []byte("ready\n"), 0o644); err != nil {
+		t.Fatalf("failed to write ready file: %s", err)
+	}
+
+	NewShutdownCleanup(NewShutdownCleanupOptions{
+		Logger:                     golog.NewLogger("test"),
+		Syncer:                     syncer,
+		StartTime:                  time.Now(),
+		Logout:                     true,
+		SkipLogoutIfLastSyncFailed: true,
+		ReadyFile:                  readyFile,
+		Timeout:                    5 * time.Second,
+	}).Run(context.Background())
+
+	if _, err := os.Stat(readyFile); !os.IsNotExist(err) {
+		t.Errorf("ready file exists after cleanup following the failed loop")
+	}
+	if logouts := fake.Requests("/api/v2/auth/logout"); logouts != 0 {
+		t.Errorf("logged out %d times, expected logging out to be skipped after the failed sync", logouts)
+	}
+}
+
+func TestShutdownCleanupOnChangeCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+
+		wantRuns []string
+	}{
+		{name: "queued runs finish", command: "sleep 0.2; echo $QB_NEW_PORT >> ", wantRuns: []string{"50000"}},
+		{name: "bounded by timeout", command: "sleep 5; echo $QB_NEW_PORT >> "},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			runsFile := filepath.Join(t.TempDir(), "runs")
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				OnChangeCommand:          test.command + runsFile,
+				OnChangeCommandAsync:     true,
+				OnChangeCommandQueueSize: 10,
+			})
+			writePortFile(t, portFile, 50000)
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			started := time.Now()
+			NewShutdownCleanup(NewShutdownCleanupOptions{
+				Logger:    golog.NewLogger("test"),
+				Syncer:    syncer,
+				StartTime: time.Now(),
+				Timeout:   time.Second,
+			}).Run(context.Background())
+
+			if elapsed := time.Since(started); elapsed > 2*time.Second {
+				t.Errorf("cleanup took %s, expected waiting for on change commands to be bounded by the timeout", elapsed)
+			}
+			if runs := readHookRuns(t, runsFile); strings.Join(runs, ",") != strings.Join(test.wantRuns, ",") {
+				t.Errorf("command ran for %v before exiting, expected %v", runs, test.wantRuns)
+			}
+		})
+	}
+}
+
+// slowNotifier is a fakeNotifier which takes delay to send each notification
+type slowNotifier struct {
+	*fakeNotifier
+	delay time.Duration
+}
+
+func (slow *slowNotifier) Notify(ctx context.Context, event NotificationEvent) error {
+	time.Sleep(slow.delay)
+	return slow.fakeNotifier.Notify(ctx, event)
+}
+
+func TestShutdownCleanupNotifications(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncResults := make(chan SyncResult, 4)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{SyncResults: syncResults})
+	if err := os.WriteFile(portFile, []byte("not a port"), 0o644); err != nil {
+		t.Fatalf("failed to write port file: %s", err)
+	}
+
+	notifier := &slowNotifier{fakeNotifier: &fakeNotifier{name: "slow"}, delay: 200 * time.Millisecond}
+	notificationsDone := make(chan struct{})
+	go func() {
+		defer close(notificationsDone)
+		NotifyResults(context.Background(), golog.NewLogger("test"), notifier, "", syncResults)
+	}()
+
+	if err := syncer.Loop(context.Background(), context.Background(), time.Minute); err == nil {
+		t.Fatalf("loop succeeded, expected it to stop because of the failed sync")
+	}
+
+	NewShutdownCleanup(NewShutdownCleanupOptions{
+		Logger:            golog.NewLogger("test"),
+		Syncer:            syncer,
+		StartTime:         time.Now(),
+		NotificationsDone: notificationsDone,
+		Timeout:           5 * time.Second,
+	}).Run(context.Background())
+
+	events := notifier.Events()
+	if len(events) != 1 || len(events[0].Error) == 0 {
+		t.Fatalf("notified of %+v before exiting, expected the failed sync", events)
+	}
+
+	// Syncs after the cleanup don't send to the closed results
+	if _, err := syncer.Sync(context.Background()); err == nil {
+		t.Errorf("sync succeeded, expected it to fail")
+	}
+}
+
+func TestShutdownCleanupConcurrentRuns(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncResults := make(chan SyncResult, 4)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{SyncResults: syncResults})
+	if err := os.WriteFile(portFile, []byte("not a port"), 0o644); err != nil {
+		t.Fatalf("failed to write port file: %s", err)
+	}
+
+	notifier := &fakeNotifier{name: "test"}
+	notificationsDone := make(chan struct{})
+	go func() {
+		defer close(notificationsDone)
+		NotifyResults(context.Background(), golog.NewLogger("test"), notifier, "", syncResults)
+	}()
+
+	if err := syncer.qBittorrentClient.Login(context.Background()); err != nil {
+		t.Fatalf("failed to login: %s", err)
+	}
+	if _, err := syncer.Sync(context.Background()); err == nil {
+		t.Fatalf("sync succeeded, expected it to fail")
+	}
+
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	if err := os.WriteFile(readyFile, []byte("ready\n"), 0o644); err != nil {
+		t.Fatalf("failed to write ready file: %s", err)
+	}
+
+	var warnLog bytes.Buffer
+	cleanup := NewShutdownCleanup(NewShutdownCleanupOptions{
+		Logger:            golog.NewWriterLogger("test", io.Discard, io.Discard, &warnLog, io.Discard, io.Discard),
+		Syncer:            syncer,
+		StartTime:         time.Now(),
+		Logout:            true,
+		ReadyFile:         readyFile,
+		NotificationsDone: notificationsDone,
+		Timeout:           5 * time.Second,
+	})
+
+	// The watchdog exiting and the sync loop stopping both run the cleanup at the same time
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cleanup.Run(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	if logouts := fake.Requests("/api/v2/auth/logout"); logouts != 1 {
+		t.Errorf("logged out %d times, expected 1", logouts)
+	}
+	if events := notifier.Events(); len(events) != 1 {
+		t.Errorf("notified of %d events, expected the failed sync once", len(events))
+	}
+	if len(warnLog.String()) > 0 {
+		t.Errorf("cleanup warned: %s", warnLog.String())
+	}
+}
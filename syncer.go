@@ -0,0 +1,2302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PortSyncer reads the port file and sets qBittorrent's torrent port if it differs
+type PortSyncer struct {
+	// logger is used to output information
+	logger golog.Logger
+
+	// qBittorrentClient is the API client used to make qBittorrent API requests
+	qBittorrentClient *QBittorrentClient
+
+	// allowPortFileNotExist indicates if all the portFiles can not exist without an error being thrown
+	allowPortFileNotExist bool
+
+	// missingPortGracePeriod is how long the port files may not contain a port before it is an error, when allowPortFileNotExist is false
+	missingPortGracePeriod time.Duration
+
+	// portMissingSince is when syncs started finding no port, zero if the last sync found one
+	portMissingSince time.Time
+
+	// portFilesLock guards portFiles, which can be changed while the sync loop is running
+	portFilesLock sync.RWMutex
+
+	// portFiles are the files which contain the VPNs forwarded port, in order of priority
+	portFiles []string
+
+	// portFileReadTimeout is the maximum duration reading a port file may take, zero means no limit
+	portFileReadTimeout time.Duration
+
+	// readPortFile reads the contents of a port file, replaced by tests
+	readPortFile func(path string) ([]byte, error)
+
+	// portCommand is a shell command whose output contains the port, it is used instead of portFiles if not empty
+	portCommand string
+
+	// portCommandTimeout is the maximum duration portCommand may run for each sync, zero means no limit
+	portCommandTimeout time.Duration
+
+	// portFileFormat is how the contents of port files, and the output of the port command, are parsed
+	portFileFormat PortFileFormat
+
+	// portSelector picks the port if a port file contains multiple
+	portSelector PortSelector
+
+	// expectedPortRange is the range ports read from port files must be in, nil if any port is accepted
+	expectedPortRange *PortRange
+
+	// treatZeroAsUnavailable indicates a port file containing port 0 is treated as not containing a port yet, instead of as an error
+	treatZeroAsUnavailable bool
+
+	// onPortLost is what is done when the port files no longer contain a port, after previously containing one
+	onPortLost PortLostPolicy
+
+	// lastPort is the last port read from the port files, zero if none has been read
+	lastPort uint16
+
+	// outputPortFile is a file the port qBittorrent is using is written to after each successful sync, empty if the port is not written
+	outputPortFile string
+
+	// readyFile is a file which is written after the first successful sync, to signal the tool is ready, empty if it is not written
+	readyFile string
+
+	// readyFileWritten indicates the ready file was written, so it is not written again
+	readyFileWritten bool
+
+	// portFileStaleThreshold is the port file age after which a warning is logged, zero disables the warning
+	portFileStaleThreshold time.Duration
+
+	// shutdownGracePeriod is how long an in-flight sync may keep running after a graceful shutdown is requested
+	shutdownGracePeriod time.Duration
+
+	// disableRandomPort indicates qBittorrent's random_port preference is turned off if it is on
+	disableRandomPort bool
+
+	// skipIfRandomPort indicates the port is not set while qBittorrent's random_port preference is on, unless disableRandomPort or pinRandomPortRange is true
+	skipIfRandomPort bool
+
+	// reannounceOnChange indicates torrents are reannounced to their trackers after a sync changes qBittorrent's preferences
+	reannounceOnChange bool
+
+	// resumeOnChange is which torrents are resumed after a sync changes qBittorrent's listen port, one of ResumeOnChangeModes, empty if none are
+	resumeOnChange string
+
+	// onChangeCommand is a shell command run after a sync changes qBittorrent's listen port, empty if none
+	onChangeCommand string
+
+	// onChangeCommandExtendedEnv indicates the on change command is also run with HookExtendedEnvVars
+	onChangeCommandExtendedEnv bool
+
+	// instanceName identifies which qBittorrent the syncer manages, the on change command is given it
+	instanceName string
+
+	// hookWorker runs the on change command in the background, nil if it is run before the sync finishes
+	hookWorker *HookWorker
+
+	// listenPortChange describes how the current sync changed qBittorrent's listen port, nil if it was not changed
+	listenPortChange *HookEvent
+
+	// portHistory holds the most recent changes of qBittorrent's listen port
+	portHistory *PortHistory
+
+	// apiCallBudget is the number of qBittorrent API requests a sync makes before optional requests are skipped, zero means no limit
+	apiCallBudget int
+
+	// budgetStart is the client's request count when the current sync started calling qBittorrent
+	budgetStart int64
+
+	// skipIfListenPortUnset indicates the port is not set while qBittorrent reports listen_port 0, which it does before it finished starting
+	skipIfListenPortUnset bool
+
+	// minimalMode is how the port is set without reading qBittorrent's preferences, one of MinimalModes, empty if the preferences are read and compared
+	minimalMode string
+
+	// minimalModePort is the port minimal mode last set, zero if it has not set one
+	minimalModePort uint16
+
+	// compareAndSwap indicates qBittorrent's port is read again right before changing it, and it is not changed if something else changed it since the sync read it
+	compareAndSwap bool
+
+	// pinRandomPortRange indicates qBittorrent's random port range is narrowed to the port while its random_port preference is on, instead of random_port being turned off
+	pinRandomPortRange bool
+
+	// setAnnouncePort indicates qBittorrent's announce_port preference is set to the port, so trackers are announced the forwarded port
+	setAnnouncePort bool
+
+	// upnp is the UPnP / NAT-PMP state to enforce, nil if it is not managed
+	upnp *bool
+
+	// maxConnections is the global connection limit to enforce, nil if it is not managed
+	maxConnections *int
+
+	// maxConnectionsPerTorrent is the per torrent connection limit to enforce, nil if it is not managed
+	maxConnectionsPerTorrent *int
+
+	// networkInterface is the network interface qBittorrent binds to to enforce, nil if it is not managed
+	networkInterface *string
+
+	// interfaceAddress is the address of the network interface qBittorrent binds to to enforce, nil if it is not managed
+	interfaceAddress *string
+
+	// applyWindow is the daily window outside of which changes are deferred, nil if changes are always applied
+	applyWindow *TimeWindow
+
+	// applyOnlyWhenActive indicates changes are deferred while qBittorrent has no active torrents
+	applyOnlyWhenActive bool
+
+	// pendingPort is the port of changes deferred until the apply window opens or torrents are active, zero if no changes are deferred
+	pendingPort uint16
+
+	// startupReconciled indicates qBittorrent's port has been reconciled with the port file since the tool started, after which changes are no longer logged as startup reconciliation
+	startupReconciled bool
+
+	// syncTimeout is the maximum duration of a single sync, zero means no limit
+	syncTimeout time.Duration
+
+	// forceSet indicates the port is set even if qBittorrent already reports it
+	forceSet bool
+
+	// setPreferencesAttempts is the number of times setting preferences is tried before failing
+	setPreferencesAttempts int
+
+	// setPreferencesBackoff computes the delays between retries of setting preferences
+	setPreferencesBackoff Backoff
+
+	// verifyChanges indicates preferences are read back after being set to ensure they took effect
+	verifyChanges bool
+
+	// verifyAttempts is the number of times preferences are read back before verification fails, for a qBittorrent which applies changes asynchronously
+	verifyAttempts int
+
+	// verifyDelay is how long to wait between reading preferences back
+	verifyDelay time.Duration
+
+	// verifyReachableWithin is how long qBittorrent is given to report it is reachable after a change for verification to pass, zero does not check reachability
+	verifyReachableWithin time.Duration
+
+	// rollbackOnVerifyFailure indicates preferences are changed back to their previous values if verification fails
+	rollbackOnVerifyFailure bool
+
+	// lock is held while reconciling so only one tool managing qBittorrent changes it at a time, nil if no lock is used
+	lock *FileLock
+
+	// circuitBreaker short-circuits syncs while qBittorrent keeps failing, nil if syncs are never short-circuited
+	circuitBreaker *CircuitBreaker
+
+	// skipInitialSync indicates Loop should wait for the first interval to elapse before syncing
+	skipInitialSync bool
+
+	// waitForPortFile is how long Loop waits for a port file to be created before the first sync, zero does not wait
+	waitForPortFile time.Duration
+
+	// watchPortFiles indicates Loop watches the port files and syncs as soon as one changes, in addition to syncing on the interval
+	watchPortFiles bool
+
+	// checkReachability indicates if qBittorrent's connection status should be checked after each sync
+	checkReachability bool
+
+	// noChangeLogEvery is how many identical no change syncs occur between no change log messages, zero logs only the first
+	noChangeLogEvery int
+
+	// noChangePort is the port of the current run of identical no change syncs
+	noChangePort uint16
+
+	// noChangeCount is the number of syncs in the current run of identical no change syncs, zero if the last sync changed the port
+	noChangeCount int
+
+	// skipReason is why the current run of skipped syncs was skipped, empty if the last sync was not skipped for lack of a port
+	skipReason string
+
+	// skipCount is the number of syncs in the current run of skipped syncs
+	skipCount int
+
+	// mismatchSince is when the sync which first failed to apply the port read from the port files started, zero if qBittorrent is using the port
+	mismatchSince time.Time
+
+	// metrics records information about syncs
+	metrics *Metrics
+
+	// tracer creates a span around each sync
+	tracer trace.Tracer
+
+	// metricsPusher pushes metrics after each sync, nil if metrics are not pushed
+	metricsPusher *MetricsPusher
+
+	// statusLock guards status, which is read by the HTTP server while syncs run
+	statusLock sync.RWMutex
+
+	// status summarizes the syncs which have run
+	status SyncStatus
+
+	// syncTrigger requests the sync loop runs a sync immediately
+	syncTrigger chan struct{}
+
+	// intervalUpdates receives a new interval for the sync loop to use
+	intervalUpdates chan time.Duration
+
+	// syncLock ensures only one sync runs at a time, so concurrent syncs don't make competing qBittorrent API calls
+	syncLock sync.Mutex
+
+	// pendingSyncLock guards pendingSync
+	pendingSyncLock sync.Mutex
+
+	// pendingSync is the sync which runs once the running sync finishes, nil if none is waiting.
+	// Syncs requested while one is waiting share its result instead of each queueing their own.
+	pendingSync *pendingSync
+
+	// syncResultsLock guards syncResults, so it is never sent to after being closed
+	syncResultsLock sync.Mutex
+
+	// syncResults receives the result of every sync if not nil, results are dropped if the channel is full
+	syncResults chan<- SyncResult
+
+	// subscribersLock guards subscribers
+	subscribersLock sync.Mutex
+
+	// subscribers receive an event whenever the applied port changes, events are dropped for subscribers whose channel is full
+	subscribers []chan PortChangeEvent
+}
+
+// NewPortSyncerOptions are options to create a new port syncer
+type NewPortSyncerOptions struct {
+	// Logger is used to output information
+	Logger golog.Logger
+
+	// QBittorrentClient is the API client used to make qBittorrent API requests
+	QBittorrentClient *QBittorrentClient
+
+	// AllowPortFileNotExist indicates if all the PortFiles can not exist without an error being thrown
+	AllowPortFileNotExist bool
+
+	// MissingPortGracePeriod is how long the port files may not contain a port before it is an error, when AllowPortFileNotExist is false.
+	// Syncs within the period are skipped, so a port file which briefly disappears while it is replaced is not an error. Zero means no grace period
+	MissingPortGracePeriod time.Duration
+
+	// PortFiles are the files which contain the VPNs forwarded port, in order of priority
+	PortFiles []string
+
+	// PortCommand is a shell command whose output contains the port, it is used instead of PortFiles if not empty
+	PortCommand string
+
+	// PortFileReadTimeout is the maximum duration reading a port file may take, zero means no limit
+	PortFileReadTimeout time.Duration
+
+	// PortCommandTimeout is the maximum duration PortCommand may run for each sync, zero means no limit
+	PortCommandTimeout time.Duration
+
+	// PortFileFormat is how the contents of port files, and the output of the port command, are parsed
+	PortFileFormat PortFileFormat
+
+	// PortSelector picks the port if a port file contains multiple
+	PortSelector PortSelector
+
+	// ExpectedPortRange is the range ports read from port files must be in, nil if any port is accepted
+	ExpectedPortRange *PortRange
+
+	// TreatZeroAsUnavailable indicates a port file containing port 0 is treated as not containing a port yet, instead of as an error
+	TreatZeroAsUnavailable bool
+
+	// OnPortLost is what is done when the port files no longer contain a port, after previously containing one
+	OnPortLost PortLostPolicy
+
+	// OutputPortFile is a file the port qBittorrent is using is written to after each successful sync, empty if the port should not be written
+	OutputPortFile string
+
+	// ReadyFile is a file which is written after the first successful sync, so other programs can wait for the tool to be ready. Empty if it should not be written
+	ReadyFile string
+
+	// PortFileStaleThreshold is the port file age after which a warning is logged, zero disables the warning
+	PortFileStaleThreshold time.Duration
+
+	// ShutdownGracePeriod is how long an in-flight sync may keep running after a graceful shutdown is requested
+	ShutdownGracePeriod time.Duration
+
+	// DisableRandomPort indicates qBittorrent's random_port preference is turned off if it is on
+	DisableRandomPort bool
+
+	// SkipIfRandomPort indicates the port is not set while qBittorrent's random_port preference is on, unless DisableRandomPort or PinRandomPortRange is true
+	SkipIfRandomPort bool
+
+	// ReannounceOnChange indicates torrents are reannounced to their trackers after a sync changes qBittorrent's preferences, so peers learn about the new port sooner
+	ReannounceOnChange bool
+
+	// ResumeOnChange is which torrents are resumed after a sync changes qBittorrent's listen port, so they pick up the new port, one of ResumeOnChangeModes. Empty if none are
+	ResumeOnChange string
+
+	// OnChangeCommand is a shell command run after a sync changes qBittorrent's listen port, with the old and new ports in HookEnvVars. Empty if none
+	OnChangeCommand string
+
+	// OnChangeCommandExtendedEnv indicates the on change command is also run with HookExtendedEnvVars
+	OnChangeCommandExtendedEnv bool
+
+	// OnChangeCommandAsync indicates the on change command is run in the background, one run at a time, so a slow command does not delay syncs
+	OnChangeCommandAsync bool
+
+	// OnChangeCommandQueueSize is the most runs of the on change command which wait while OnChangeCommandAsync is true, the oldest is dropped once it is full
+	OnChangeCommandQueueSize int
+
+	// InstanceName identifies which qBittorrent the syncer manages, the on change command is given it
+	InstanceName string
+
+	// PortHistorySize is the number of the most recent changes of qBittorrent's listen port which are retained and returned by PortHistory, zero retains none
+	PortHistorySize int
+
+	// APICallBudget is the number of qBittorrent API requests a sync makes before optional requests, like reading preferences back and checking reachability, are skipped. Zero means no limit
+	APICallBudget int
+
+	// SkipIfListenPortUnset indicates the port is not set while qBittorrent reports listen_port 0, if false the port is always applied
+	SkipIfListenPortUnset bool
+
+	// MinimalMode is how the port is set without reading qBittorrent's preferences, one of MinimalModes. Only the listen port is managed, so the other preference options must not be set.
+	// Empty reads qBittorrent's preferences and only changes those which differ
+	MinimalMode string
+
+	// CompareAndSwap indicates qBittorrent's port is read again right before changing it, and it is not changed if something else changed it since the sync read it, so a concurrent change is not overwritten
+	CompareAndSwap bool
+
+	// PinRandomPortRange indicates qBittorrent's random port range is narrowed to the port while its random_port preference is on, instead of random_port being turned off
+	PinRandomPortRange bool
+
+	// SetAnnouncePort indicates qBittorrent's announce_port preference is set to the port, so trackers are announced the forwarded port
+	SetAnnouncePort bool
+
+	// UPnP is the UPnP / NAT-PMP state to enforce, nil if it should not be managed
+	UPnP *bool
+
+	// MaxConnections is the global connection limit to enforce, nil if it should not be managed
+	MaxConnections *int
+
+	// MaxConnectionsPerTorrent is the per torrent connection limit to enforce, nil if it should not be managed
+	MaxConnectionsPerTorrent *int
+
+	// NetworkInterface is the network interface qBittorrent binds to to enforce, nil if it should not be managed
+	NetworkInterface *string
+
+	// InterfaceAddress is the address of the network interface qBittorrent binds to to enforce, nil if it should not be managed
+	InterfaceAddress *string
+
+	// ApplyWindow is the daily window outside of which changes are deferred, nil if changes should always be applied
+	ApplyWindow *TimeWindow
+
+	// ApplyOnlyWhenActive indicates changes are deferred while qBittorrent has no active torrents, so dormant instances are not changed
+	ApplyOnlyWhenActive bool
+
+	// SyncTimeout is the maximum duration of a single sync, zero means no limit
+	SyncTimeout time.Duration
+
+	// ForceSet indicates the port is set even if qBittorrent already reports it, this re-applies the port in case qBittorrent did not bind it
+	ForceSet bool
+
+	// SetPreferencesAttempts is the number of times setting preferences is tried before failing
+	SetPreferencesAttempts int
+
+	// SetPreferencesBackoff computes the delays between retries of setting preferences
+	SetPreferencesBackoff Backoff
+
+	// VerifyChanges indicates preferences are read back after being set to ensure they took effect
+	VerifyChanges bool
+
+	// VerifyAttempts is the number of times preferences are read back before verification fails, for a qBittorrent which applies changes asynchronously, more than one implies VerifyChanges
+	VerifyAttempts int
+
+	// VerifyDelay is how long to wait between reading preferences back
+	VerifyDelay time.Duration
+
+	// VerifyReachableWithin is how long qBittorrent is given to report it is reachable after a change for verification to pass, zero does not check reachability
+	VerifyReachableWithin time.Duration
+
+	// RollbackOnVerifyFailure indicates preferences are changed back to their previous values if verification fails, implies VerifyChanges
+	RollbackOnVerifyFailure bool
+
+	// Lock is held while reconciling so only one tool managing qBittorrent changes it at a time, nil if no lock should be used
+	Lock *FileLock
+
+	// CircuitBreaker short-circuits syncs while qBittorrent keeps failing, nil if syncs should never be short-circuited
+	CircuitBreaker *CircuitBreaker
+
+	// SkipInitialSync indicates Loop should wait for the first interval to elapse before syncing
+	SkipInitialSync bool
+
+	// WaitForPortFile is how long Loop waits for a port file to be created before the first sync, zero does not wait. Not used if SkipInitialSync is true
+	WaitForPortFile time.Duration
+
+	// WatchPortFiles indicates Loop watches the port files and syncs as soon as one changes, in addition to syncing on the interval
+	WatchPortFiles bool
+
+	// CheckReachability indicates if qBittorrent's connection status should be checked after each sync
+	CheckReachability bool
+
+	// NoChangeLogEvery is how many identical no change syncs occur between no change log messages, zero logs only the first
+	NoChangeLogEvery int
+
+	// Metrics records information about syncs
+	Metrics *Metrics
+
+	// TracerProvider provides the tracer which creates a span around each sync, nil does not trace
+	TracerProvider trace.TracerProvider
+
+	// MetricsPusher pushes metrics to a Pushgateway after each sync, nil if metrics should not be pushed
+	MetricsPusher *MetricsPusher
+
+	// SyncResults is an optional channel which receives the result of every sync.
+	// Results are never waited on: if the channel is full the result is dropped, so a buffered channel should be used.
+	SyncResults chan<- SyncResult
+}
+
+// NewPortSyncer creates a new PortSyncer
+func NewPortSyncer(opts NewPortSyncerOptions) *PortSyncer {
+	syncer := &PortSyncer{
+		logger:                     opts.Logger,
+		qBittorrentClient:          opts.QBittorrentClient,
+		allowPortFileNotExist:      opts.AllowPortFileNotExist,
+		missingPortGracePeriod:     opts.MissingPortGracePeriod,
+		portFiles:                  opts.PortFiles,
+		portFileReadTimeout:        opts.PortFileReadTimeout,
+		readPortFile:               readPortFileWithFIFOTimeout,
+		portCommand:                opts.PortCommand,
+		portCommandTimeout:         opts.PortCommandTimeout,
+		portFileFormat:             opts.PortFileFormat,
+		portSelector:               opts.PortSelector,
+		expectedPortRange:          opts.ExpectedPortRange,
+		treatZeroAsUnavailable:     opts.TreatZeroAsUnavailable,
+		onPortLost:                 opts.OnPortLost,
+		outputPortFile:             opts.OutputPortFile,
+		readyFile:                  opts.ReadyFile,
+		portFileStaleThreshold:     opts.PortFileStaleThreshold,
+		shutdownGracePeriod:        opts.ShutdownGracePeriod,
+		disableRandomPort:          opts.DisableRandomPort,
+		skipIfRandomPort:           opts.SkipIfRandomPort,
+		skipIfListenPortUnset:      opts.SkipIfListenPortUnset,
+		compareAndSwap:             opts.CompareAndSwap,
+		minimalMode:                opts.MinimalMode,
+		apiCallBudget:              opts.APICallBudget,
+		reannounceOnChange:         opts.ReannounceOnChange,
+		resumeOnChange:             opts.ResumeOnChange,
+		onChangeCommand:            opts.OnChangeCommand,
+		onChangeCommandExtendedEnv: opts.OnChangeCommandExtendedEnv,
+		instanceName:               opts.InstanceName,
+		portHistory:                NewPortHistory(opts.PortHistorySize),
+		pinRandomPortRange:         opts.PinRandomPortRange,
+		setAnnouncePort:            opts.SetAnnouncePort,
+		upnp:                       opts.UPnP,
+		maxConnections:             opts.MaxConnections,
+		maxConnectionsPerTorrent:   opts.MaxConnectionsPerTorrent,
+		networkInterface:           opts.NetworkInterface,
+		interfaceAddress:           opts.InterfaceAddress,
+		applyWindow:                opts.ApplyWindow,
+		applyOnlyWhenActive:        opts.ApplyOnlyWhenActive,
+		syncTimeout:                opts.SyncTimeout,
+		forceSet:                   opts.ForceSet,
+		setPreferencesAttempts:     opts.SetPreferencesAttempts,
+		setPreferencesBackoff:      opts.SetPreferencesBackoff,
+		verifyChanges:              opts.VerifyChanges || opts.RollbackOnVerifyFailure || opts.VerifyAttempts > 1,
+		verifyAttempts:             opts.VerifyAttempts,
+		verifyDelay:                opts.VerifyDelay,
+		verifyReachableWithin:      opts.VerifyReachableWithin,
+		rollbackOnVerifyFailure:    opts.RollbackOnVerifyFailure,
+		lock:                       opts.Lock,
+		circuitBreaker:             opts.CircuitBreaker,
+		skipInitialSync:            opts.SkipInitialSync,
+		waitForPortFile:            opts.WaitForPortFile,
+		watchPortFiles:             opts.WatchPortFiles,
+		checkReachability:          opts.CheckReachability,
+		noChangeLogEvery:           opts.NoChangeLogEvery,
+		metrics:                    opts.Metrics,
+		tracer:                     newTracer(opts.TracerProvider),
+		metricsPusher:              opts.MetricsPusher,
+		syncResults:                opts.SyncResults,
+		syncTrigger:                make(chan struct{}, 1),
+		intervalUpdates:            make(chan time.Duration, 1),
+	}
+
+	if opts.OnChangeCommandAsync && len(opts.OnChangeCommand) > 0 {
+		syncer.hookWorker = NewHookWorker(NewHookWorkerOptions{
+			Logger:      opts.Logger,
+			Command:     opts.OnChangeCommand,
+			ExtendedEnv: opts.OnChangeCommandExtendedEnv,
+			QueueSize:   opts.OnChangeCommandQueueSize,
+		})
+	}
+
+	return syncer
+}
+
+// QBittorrentClient returns the API client used to make qBittorrent API requests. If a sync is running this waits for it to finish first.
+func (syncer *PortSyncer) QBittorrentClient() *QBittorrentClient {
+	syncer.syncLock.Lock()
+	defer syncer.syncLock.Unlock()
+
+	return syncer.qBittorrentClient
+}
+
+// SetQBittorrentClient changes the API client used to make qBittorrent API requests, it is safe to call while the sync loop is running.
+// If a sync is running this waits for it to finish first, so a sync never uses two different clients.
+func (syncer *PortSyncer) SetQBittorrentClient(client *QBittorrentClient) {
+	syncer.syncLock.Lock()
+	defer syncer.syncLock.Unlock()
+
+	syncer.qBittorrentClient = client
+}
+
+// SetInterval changes the interval between syncs of the running sync loop, the next sync runs one interval after it is changed
+func (syncer *PortSyncer) SetInterval(interval time.Duration) {
+	// Only the latest interval matters, replace one the loop has not received yet
+	select {
+	case <-syncer.intervalUpdates:
+	default:
+	}
+
+	syncer.intervalUpdates <- interval
+}
+
+// PortFiles returns the files which contain the VPNs forwarded port, in order of priority
+func (syncer *PortSyncer) PortFiles() []string {
+	syncer.portFilesLock.RLock()
+	defer syncer.portFilesLock.RUnlock()
+
+	return slices.Clone(syncer.portFiles)
+}
+
+// SetPortFiles changes the files which contain the VPNs forwarded port, it is safe to call while the sync loop is running
+func (syncer *PortSyncer) SetPortFiles(portFiles []string) {
+	syncer.portFilesLock.Lock()
+	defer syncer.portFilesLock.Unlock()
+
+	syncer.portFiles = slices.Clone(portFiles)
+}
+
+// TriggerSync requests the sync loop runs a sync as soon as possible, without waiting for the next interval.
+// If a sync has already been requested and not yet started this does nothing.
+func (syncer *PortSyncer) TriggerSync() {
+	select {
+	case syncer.syncTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// GetPortFileValue reads a port file and parses the port from it according to the port file format
+// Returns ErrPortNotAvailable if the port file does not contain a port yet, which includes containing port 0 if treatZeroAsUnavailable is true, and a named pipe port file not being written to in time
+func (syncer *PortSyncer) GetPortFileValue(portFile string) (uint16, error) {
+	readPortFile := syncer.readPortFile
+	fileBytes, err := readWithTimeout(syncer.portFileReadTimeout, func() ([]byte, error) {
+		return readPortFile(portFile)
+	})
+	if errors.Is(err, ErrPortNotAvailable) {
+		return 0, fmt.Errorf("port file '%s' %w", portFile, err)
+	} else if errors.Is(err, ErrPortFileReadTimeout) {
+		return 0, fmt.Errorf("failed to read port file '%s', its filesystem may not be responding: %w", portFile, err)
+	} else if errors.Is(err, os.ErrPermission) {
+		return 0, PortFilePermissionError{Path: portFile, Err: err}
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read port file '%s': %w", portFile, err)
+	}
+
+	port, err := ParsePort(syncer.portFileFormat, syncer.portSelector, fileBytes)
+	if err != nil {
+		return 0, NewPortFileParseError(portFile, fileBytes, err)
+	}
+
+	if err := syncer.checkZeroPort(port); err != nil {
+		return 0, fmt.Errorf("port file '%s' %w", portFile, err)
+	}
+
+	if err := syncer.checkExpectedPortRange(port); err != nil {
+		return 0, fmt.Errorf("port file '%s' contains an unexpected port: %s", portFile, err)
+	}
+
+	return port, nil
+}
+
+// GetPortCommandValue runs the port command and parses the port from its output according to the port file format.
+// Returns ErrPortNotAvailable if the command exits with a non-zero status, prints nothing, or prints port 0 and treatZeroAsUnavailable is true
+func (syncer *PortSyncer) GetPortCommandValue(ctx context.Context) (uint16, error) {
+	output, err := RunPortCommand(ctx, syncer.portCommand, syncer.portCommandTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("port command %w", err)
+	}
+
+	port, err := ParsePort(syncer.portFileFormat, syncer.portSelector, output)
+	if err != nil {
+		return 0, NewPortFileParseError("port command", output, err)
+	}
+
+	if err := syncer.checkZeroPort(port); err != nil {
+		return 0, fmt.Errorf("port command output %w", err)
+	}
+
+	if err := syncer.checkExpectedPortRange(port); err != nil {
+		return 0, fmt.Errorf("port command printed an unexpected port: %s", err)
+	}
+
+	return port, nil
+}
+
+// checkZeroPort returns an error if port is 0, which qBittorrent can't use. Some VPN integrations write 0 to signal no port is forwarded yet, so unless treatZeroAsUnavailable is false the error wraps ErrPortNotAvailable
+func (syncer *PortSyncer) checkZeroPort(port uint16) error {
+	if port != 0 {
+		return nil
+	}
+
+	if syncer.treatZeroAsUnavailable {
+		return fmt.Errorf("contains port 0: %w", ErrPortNotAvailable)
+	}
+
+	return fmt.Errorf("contains port 0, which is not a valid port, set TREAT_ZERO_AS_UNAVAILABLE=true if 0 means no port is forwarded yet")
+}
+
+// checkExpectedPortRange returns an error if port is not in the expected port range, this protects qBittorrent from nonsense ports in a corrupted port file
+func (syncer *PortSyncer) checkExpectedPortRange(port uint16) error {
+	if syncer.expectedPortRange != nil && !syncer.expectedPortRange.Contains(port) {
+		return fmt.Errorf("port %d is outside of the expected port range %s", port, syncer.expectedPortRange)
+	}
+
+	return nil
+}
+
+// danglingSymlinkTarget determines if path is a symlink whose target does not exist, VPN clients may briefly leave a port file symlink dangling while rotating it.
+// Returns (symlink target, if path is a dangling symlink)
+func danglingSymlinkTarget(path string) (string, bool) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", false
+	}
+
+	return target, true
+}
+
+// GetDesiredPort tries each port file in order of priority and returns the port from the first one which exists and contains a valid port.
+// Returns (port, port file the port was read from, error). The port file is empty if none of the port files exist or contain a port yet. An error is only returned if port files exist but none of them contain a valid port.
+func (syncer *PortSyncer) GetDesiredPort() (uint16, string, error) {
+	var portFileErrs []error
+
+	for _, portFile := range syncer.PortFiles() {
+		if _, err := os.Stat(portFile); errors.Is(err, os.ErrNotExist) {
+			if target, isDangling := danglingSymlinkTarget(portFile); isDangling {
+				syncer.logger.Infof("port file '%s' is a symlink to '%s' which does not exist, treating it as not available yet", portFile, target)
+				continue
+			}
+
+			syncer.logger.Debugf("port file '%s' does not exist, trying next", portFile)
+			continue
+		}
+
+		port, err := syncer.GetPortFileValue(portFile)
+
+		// The port file can be removed between checking it exists and reading it, ex., while the VPN replaces it. It is checked again so it is handled like any port file which does not exist, or read again if it was replaced
+		if errors.Is(err, os.ErrNotExist) {
+			if _, statErr := os.Stat(portFile); errors.Is(statErr, os.ErrNotExist) {
+				syncer.logger.Debugf("port file '%s' was removed before it could be read, trying next", portFile)
+				continue
+			}
+
+			port, err = syncer.GetPortFileValue(portFile)
+		}
+
+		if errors.Is(err, ErrPortNotAvailable) {
+			syncer.logger.Debugf("port file '%s' does not contain a port yet, trying next", portFile)
+			continue
+		}
+		if err != nil {
+			syncer.logger.Warnf("skipping port file: %s", err)
+			portFileErrs = append(portFileErrs, err)
+			continue
+		}
+
+		return port, portFile, nil
+	}
+
+	if len(portFileErrs) > 0 {
+		return 0, "", fmt.Errorf("no port file contained a valid port: %w", errors.Join(portFileErrs...))
+	}
+
+	return 0, "", nil
+}
+
+// diffPreferences compares qBittorrent's current preferences with the desired port and any other preferences the syncer manages.
+// Returns (preferences which must be set, descriptions of each change). Only preferences which differ are set in the returned preferences.
+func (syncer *PortSyncer) diffPreferences(current QBittorrentServerPreferences, port uint16) (QBittorrentServerPreferences, []string) {
+	var changes QBittorrentServerPreferences
+	var descriptions []string
+
+	if current.ListenPort != port {
+		changes.ListenPort = port
+		descriptions = append(descriptions, fmt.Sprintf("listen_port %s -> %d", formatListenPort(current.ListenPort), port))
+	}
+
+	if syncer.disableRandomPort && current.RandomPort != nil && *current.RandomPort {
+		disabled := false
+		changes.RandomPort = &disabled
+		descriptions = append(descriptions, "random_port true -> false")
+	}
+
+	// The range is only used while random_port is on, pinning it makes the port qBittorrent picks when it starts the forwarded port
+	if syncer.pinRandomPortRange && current.RandomPort != nil && *current.RandomPort {
+		if current.RandomPortRangeMin == nil || *current.RandomPortRangeMin != port {
+			changes.RandomPortRangeMin = &port
+			descriptions = append(descriptions, fmt.Sprintf("random_port_range_min %s -> %d", formatOptional(current.RandomPortRangeMin), port))
+		}
+		if current.RandomPortRangeMax == nil || *current.RandomPortRangeMax != port {
+			changes.RandomPortRangeMax = &port
+			descriptions = append(descriptions, fmt.Sprintf("random_port_range_max %s -> %d", formatOptional(current.RandomPortRangeMax), port))
+		}
+	}
+
+	if syncer.setAnnouncePort && (current.AnnouncePort == nil || *current.AnnouncePort != port) {
+		changes.AnnouncePort = &port
+		descriptions = append(descriptions, fmt.Sprintf("announce_port %s -> %d", formatOptional(current.AnnouncePort), port))
+	}
+
+	if syncer.upnp != nil && (current.UPnP == nil || *current.UPnP != *syncer.upnp) {
+		changes.UPnP = syncer.upnp
+		descriptions = append(descriptions, fmt.Sprintf("upnp %s -> %t", formatOptional(current.UPnP), *syncer.upnp))
+	}
+
+	if syncer.maxConnections != nil && (current.MaxConnections == nil || *current.MaxConnections != *syncer.maxConnections) {
+		changes.MaxConnections = syncer.maxConnections
+		descriptions = append(descriptions, fmt.Sprintf("max_connec %s -> %d", formatOptional(current.MaxConnections), *syncer.maxConnections))
+	}
+
+	if syncer.maxConnectionsPerTorrent != nil && (current.MaxConnectionsPerTorrent == nil || *current.MaxConnectionsPerTorrent != *syncer.maxConnectionsPerTorrent) {
+		changes.MaxConnectionsPerTorrent = syncer.maxConnectionsPerTorrent
+		descriptions = append(descriptions, fmt.Sprintf("max_connec_per_torrent %s -> %d", formatOptional(current.MaxConnectionsPerTorrent), *syncer.maxConnectionsPerTorrent))
+	}
+
+	if syncer.networkInterface != nil && (current.CurrentNetworkInterface == nil || *current.CurrentNetworkInterface != *syncer.networkInterface) {
+		changes.CurrentNetworkInterface = syncer.networkInterface
+		descriptions = append(descriptions, fmt.Sprintf("current_network_interface '%s' -> '%s'", formatOptional(current.CurrentNetworkInterface), *syncer.networkInterface))
+	}
+
+	if syncer.interfaceAddress != nil && (current.CurrentInterfaceAddress == nil || *current.CurrentInterfaceAddress != *syncer.interfaceAddress) {
+		changes.CurrentInterfaceAddress = syncer.interfaceAddress
+		descriptions = append(descriptions, fmt.Sprintf("current_interface_address '%s' -> '%s'", formatOptional(current.CurrentInterfaceAddress), *syncer.interfaceAddress))
+	}
+
+	return changes, descriptions
+}
+
+// preferenceDiffLines describes every preference the syncer manages: qBittorrent's current value, the desired value, and if it will be sent.
+// changes are the preferences which will be set, as returned by diffPreferences. Preferences which are not managed are not included.
+func (syncer *PortSyncer) preferenceDiffLines(current QBittorrentServerPreferences, changes QBittorrentServerPreferences, port uint16) []string {
+	var lines []string
+	add := func(name string, currentValue string, desiredValue string, send bool) {
+		action := "unchanged"
+		if send {
+			action = "will be sent"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: current %s, desired %s, %s", name, currentValue, desiredValue, action))
+	}
+
+	add("listen_port", formatListenPort(current.ListenPort), fmt.Sprint(port), changes.ListenPort != 0)
+
+	if syncer.disableRandomPort {
+		add("random_port", formatOptional(current.RandomPort), "false", changes.RandomPort != nil)
+	}
+	if syncer.pinRandomPortRange {
+		add("random_port_range_min", formatOptional(current.RandomPortRangeMin), fmt.Sprint(port), changes.RandomPortRangeMin != nil)
+		add("random_port_range_max", formatOptional(current.RandomPortRangeMax), fmt.Sprint(port), changes.RandomPortRangeMax != nil)
+	}
+	if syncer.setAnnouncePort {
+		add("announce_port", formatOptional(current.AnnouncePort), fmt.Sprint(port), changes.AnnouncePort != nil)
+	}
+	if syncer.upnp != nil {
+		add("upnp", formatOptional(current.UPnP), fmt.Sprint(*syncer.upnp), changes.UPnP != nil)
+	}
+	if syncer.maxConnections != nil {
+		add("max_connec", formatOptional(current.MaxConnections), fmt.Sprint(*syncer.maxConnections), changes.MaxConnections != nil)
+	}
+	if syncer.maxConnectionsPerTorrent != nil {
+		add("max_connec_per_torrent", formatOptional(current.MaxConnectionsPerTorrent), fmt.Sprint(*syncer.maxConnectionsPerTorrent), changes.MaxConnectionsPerTorrent != nil)
+	}
+	if syncer.networkInterface != nil {
+		add("current_network_interface", "'"+formatOptional(current.CurrentNetworkInterface)+"'", "'"+*syncer.networkInterface+"'", changes.CurrentNetworkInterface != nil)
+	}
+	if syncer.interfaceAddress != nil {
+		add("current_interface_address", "'"+formatOptional(current.CurrentInterfaceAddress)+"'", "'"+*syncer.interfaceAddress+"'", changes.CurrentInterfaceAddress != nil)
+	}
+
+	return lines
+}
+
+// formatOptional formats a value which may not be set
+func formatOptional[T any](value *T) string {
+	if value == nil {
+		return "<unset>"
+	}
+
+	return fmt.Sprint(*value)
+}
+
+// formatListenPort formats qBittorrent's listen_port, which is 0 before qBittorrent finished starting
+func formatListenPort(port uint16) string {
+	if port == 0 {
+		return "<unset>"
+	}
+
+	return fmt.Sprint(port)
+}
+
+var (
+	// ErrGetPreferences indicates reconciling failed because qBittorrent's current preferences could not be retrieved
+	ErrGetPreferences = errors.New("failed to get current qBittorrent server preferences")
+
+	// ErrSetPreferences indicates reconciling failed because qBittorrent's preferences could not be changed
+	ErrSetPreferences = errors.New("failed to set qBittorrent preferences")
+
+	// ErrVerifyMismatch indicates qBittorrent accepted a preferences change but reading the preferences back showed it did not take effect
+	ErrVerifyMismatch = errors.New("qBittorrent preferences did not match after being set")
+
+	// ErrVerifyNotReachable indicates qBittorrent did not report it was reachable in time after a preferences change
+	ErrVerifyNotReachable = errors.New("qBittorrent did not become reachable after preferences were set")
+)
+
+// ApplySkipReason is why reconciling deliberately left qBittorrent's preferences unchanged although they differ
+type ApplySkipReason string
+
+const (
+	// ApplySkipRandomPort indicates qBittorrent uses a random port and SkipIfRandomPort is set
+	ApplySkipRandomPort ApplySkipReason = "random_port is enabled"
+
+	// ApplySkipListenPortUnset indicates qBittorrent reports listen_port 0 and SkipIfListenPortUnset is set
+	ApplySkipListenPortUnset ApplySkipReason = "qBittorrent reports listen_port 0"
+
+	// ApplySkipConflict indicates CompareAndSwap is set and qBittorrent's listen_port was changed by something else while the sync decided the changes
+	ApplySkipConflict ApplySkipReason = "listen_port was changed by something else while deciding the changes"
+)
+
+// ApplySkippedError indicates reconciling deliberately did not change qBittorrent's preferences, so the port was not applied.
+// It is not a failure, the next sync decides again.
+type ApplySkippedError struct {
+	// Reason is why the preferences were not changed
+	Reason ApplySkipReason
+}
+
+// Error describes why the port was not applied
+func (err ApplySkippedError) Error() string {
+	return fmt.Sprintf("did not apply the port because %s", err.Reason)
+}
+
+// PortDiff is how qBittorrent's preferences differ from the ones syncing a port would set
+type PortDiff struct {
+	// CurrentPort is qBittorrent's listen port, 0 if qBittorrent has not finished starting
+	CurrentPort uint16
+
+	// Changes describe each preference syncing would change, empty if qBittorrent already matches
+	Changes []string
+
+	// Lines describe the current and desired value of every preference the syncer manages
+	Lines []string
+}
+
+// Matches indicates qBittorrent already has the desired preferences, so syncing would not change anything
+func (diff PortDiff) Matches() bool {
+	return len(diff.Changes) == 0
+}
+
+// DiffTorrentPort compares qBittorrent's preferences with the ones ReconcileTorrentPort would set for port, without changing anything.
+// Errors wrap ErrGetPreferences.
+func (syncer *PortSyncer) DiffTorrentPort(ctx context.Context, port uint16) (PortDiff, error) {
+	prefs, err := syncer.qBittorrentClient.GetServerPreferences(ctx)
+	if err != nil {
+		return PortDiff{}, fmt.Errorf("%w: %w", ErrGetPreferences, err)
+	}
+
+	changes, descriptions := syncer.diffPreferences(*prefs, port)
+
+	return PortDiff{
+		CurrentPort: prefs.ListenPort,
+		Changes:     descriptions,
+		Lines:       syncer.preferenceDiffLines(*prefs, changes, port),
+	}, nil
+}
+
+// ReconcileTorrentPort ensures that qBittorrent's torrent port is the one provided, and that any other managed preferences have their desired values
+// If forceSet is true the port is always set, even if qBittorrent already reports it.
+// Errors wrap ErrGetPreferences, ErrSetPreferences, ErrVerifyMismatch, ErrVerifyNotReachable, or ErrLockTimeout, use errors.Is to determine which step failed.
+// If the preferences were deliberately not changed an ApplySkippedError is returned, use errors.As to get its reason.
+// If rollbackOnVerifyFailure is true and verification fails the previous preferences are restored before the error is returned.
+// If a lock file is configured it is held while reconciling, so other tools managing the same qBittorrent don't make competing changes.
+// Returns a boolean indicating if any preferences had to be changed
+func (syncer *PortSyncer) ReconcileTorrentPort(ctx context.Context, port uint16) (bool, error) {
+	if syncer.lock == nil {
+		return syncer.reconcileTorrentPort(ctx, port)
+	}
+
+	release, err := syncer.lock.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := release(); err != nil {
+			syncer.logger.Warnf("failed to release lock: %s", err)
+		}
+	}()
+
+	return syncer.reconcileTorrentPort(ctx, port)
+}
+
+// reconcileTorrentPort does the work of ReconcileTorrentPort, without holding the lock
+func (syncer *PortSyncer) reconcileTorrentPort(ctx context.Context, port uint16) (bool, error) {
+	if len(syncer.minimalMode) > 0 {
+		return syncer.setPortWithoutReading(ctx, port)
+	}
+
+	prefs, err := syncer.qBittorrentClient.GetServerPreferences(ctx)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrGetPreferences, err)
+	}
+
+	if prefs.RandomPort != nil && *prefs.RandomPort && !syncer.disableRandomPort && !syncer.pinRandomPortRange {
+		syncer.logger.Warn("qBittorrent is configured to use a random port each time it starts (random_port), the port set by this tool will be lost when qBittorrent restarts. Set DISABLE_RANDOM_PORT=true to have this tool turn it off")
+
+		if syncer.skipIfRandomPort {
+			syncer.logger.Warn("not setting qBittorrent's port because random_port is enabled and SKIP_IF_RANDOM_PORT is true")
+			return false, ApplySkippedError{Reason: ApplySkipRandomPort}
+		}
+	}
+
+	// qBittorrent reports listen_port 0 before it finished starting, which is not a port it uses. The port read from the port files is never 0, so it always differs
+	if prefs.ListenPort == 0 {
+		if syncer.skipIfListenPortUnset {
+			syncer.logger.Info("not setting qBittorrent's port because it reports listen_port 0, it may not have finished starting, and SKIP_IF_LISTEN_PORT_UNSET is true")
+			return false, ApplySkippedError{Reason: ApplySkipListenPortUnset}
+		}
+
+		syncer.logger.Info("qBittorrent reports listen_port 0, it may not have finished starting, applying the port anyway")
+	}
+
+	changes, descriptions := syncer.diffPreferences(*prefs, port)
+	if syncer.forceSet && changes.ListenPort == 0 {
+		changes.ListenPort = port
+		descriptions = append(descriptions, fmt.Sprintf("listen_port %d (forced)", port))
+	}
+
+	syncer.logger.Debug("managed qBittorrent preferences:")
+	for _, line := range syncer.preferenceDiffLines(*prefs, changes, port) {
+		syncer.logger.Debugf("  %s", line)
+	}
+	if len(descriptions) == 0 {
+		syncer.pendingPort = 0
+		syncer.reconcileStartup(prefs.ListenPort, port)
+		return false, nil
+	}
+
+	if syncer.applyWindow != nil && !syncer.applyWindow.Contains(time.Now()) {
+		if syncer.pendingPort != port {
+			syncer.logger.Infof("deferring qBittorrent preference changes until the apply window %s opens: %s", syncer.applyWindow, strings.Join(descriptions, ", "))
+		}
+		syncer.pendingPort = port
+
+		return false, nil
+	}
+
+	// Failing to list the torrents applies the changes, so the port is not left outdated because of it
+	if syncer.applyOnlyWhenActive {
+		activeTorrents, err := syncer.qBittorrentClient.CountActiveTorrents(ctx)
+		if err != nil {
+			syncer.logger.Warnf("failed to check if qBittorrent has active torrents, applying changes anyway: %s", err)
+		} else if activeTorrents == 0 {
+			if syncer.pendingPort != port {
+				syncer.logger.Infof("deferring qBittorrent preference changes until torrents are active: %s", strings.Join(descriptions, ", "))
+			}
+			syncer.pendingPort = port
+
+			return false, nil
+		}
+	}
+
+	if syncer.pendingPort != 0 {
+		syncer.logger.Info("applying deferred changes")
+		syncer.pendingPort = 0
+	}
+
+	// The changes were decided from the port read above, if another client changed it since then it would be overwritten
+	if syncer.compareAndSwap {
+		current, err := syncer.qBittorrentClient.GetServerPreferences(ctx)
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrGetPreferences, err)
+		}
+
+		if current.ListenPort != prefs.ListenPort {
+			syncer.logger.Warnf("not changing qBittorrent preferences because listen_port changed from %s to %s since it was read, it was changed by something else, the next sync decides again from the new port", formatListenPort(prefs.ListenPort), formatListenPort(current.ListenPort))
+			return false, ApplySkippedError{Reason: ApplySkipConflict}
+		}
+	}
+
+	syncer.reconcileStartup(prefs.ListenPort, port)
+	syncer.logger.Infof("changing qBittorrent preferences: %s", strings.Join(descriptions, ", "))
+
+	// A previous sync ensured qBittorrent was using the port, so if it is not anymore it was changed outside of the tool, not by the port files
+	drifted := prefs.ListenPort != port && syncer.Status().LastPort == port
+
+	if err := syncer.setPreferencesWithRetry(ctx, changes); err != nil {
+		return false, fmt.Errorf("%w: %w", ErrSetPreferences, err)
+	}
+
+	if drifted {
+		syncer.metrics.DriftCorrections.Inc()
+		syncer.logger.Warnf("corrected drift: listen_port %s -> %d, qBittorrent's port was changed outside of this tool", formatListenPort(prefs.ListenPort), port)
+	}
+
+	if prefs.ListenPort != port {
+		trigger := HookTriggerPortChange
+		if drifted {
+			trigger = HookTriggerDrift
+		}
+		syncer.listenPortChange = &HookEvent{OldPort: prefs.ListenPort, NewPort: port, Trigger: trigger}
+	}
+
+	if syncer.verifyChanges {
+		err := syncer.verifyPreferences(ctx, port)
+		if err == nil && syncer.verifyReachableWithin > 0 {
+			err = syncer.waitUntilReachable(ctx, syncer.verifyReachableWithin)
+		}
+
+		if err != nil && syncer.rollbackOnVerifyFailure {
+			return true, syncer.rollback(ctx, *prefs, changes, err)
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// reconcileStartup logs, once, how qBittorrent's port at startup compares with the port file, so it is clear what the tool corrected at boot.
+// current is qBittorrent's port and port is the port from the port file.
+func (syncer *PortSyncer) reconcileStartup(current uint16, port uint16) {
+	if syncer.startupReconciled {
+		return
+	}
+	syncer.startupReconciled = true
+
+	if current == port {
+		syncer.metrics.StartupPortDiffered.Set(0)
+		syncer.logger.Infof("startup reconciliation: qBittorrent already has port %d from the port file", port)
+		return
+	}
+
+	syncer.metrics.StartupPortDiffered.Set(1)
+	if current == 0 {
+		syncer.logger.Infof("startup reconciliation: qBittorrent had no port yet, port file says %d, applying %d", port, port)
+		return
+	}
+	syncer.logger.Infof("startup reconciliation: qBittorrent had port %d, port file says %d, applying %d", current, port, port)
+}
+
+// rollback restores the values previous had before changes were set, because verifyErr occurred.
+// Returns an error which wraps verifyErr and describes the outcome of the rollback.
+func (syncer *PortSyncer) rollback(ctx context.Context, previous QBittorrentServerPreferences, changes QBittorrentServerPreferences, verifyErr error) error {
+	// A listen_port of 0 means qBittorrent had no port yet, it can't be restored
+	var restore QBittorrentServerPreferences
+	if changes.ListenPort != 0 && previous.ListenPort != 0 {
+		restore.ListenPort = previous.ListenPort
+	}
+	if changes.RandomPort != nil {
+		restore.RandomPort = previous.RandomPort
+	}
+	if changes.RandomPortRangeMin != nil {
+		restore.RandomPortRangeMin = previous.RandomPortRangeMin
+	}
+	if changes.RandomPortRangeMax != nil {
+		restore.RandomPortRangeMax = previous.RandomPortRangeMax
+	}
+	if changes.AnnouncePort != nil {
+		restore.AnnouncePort = previous.AnnouncePort
+	}
+	if changes.UPnP != nil {
+		restore.UPnP = previous.UPnP
+	}
+	if changes.MaxConnections != nil {
+		restore.MaxConnections = previous.MaxConnections
+	}
+	if changes.MaxConnectionsPerTorrent != nil {
+		restore.MaxConnectionsPerTorrent = previous.MaxConnectionsPerTorrent
+	}
+	if changes.CurrentNetworkInterface != nil {
+		restore.CurrentNetworkInterface = previous.CurrentNetworkInterface
+	}
+	if changes.CurrentInterfaceAddress != nil {
+		restore.CurrentInterfaceAddress = previous.CurrentInterfaceAddress
+	}
+
+	if restore == (QBittorrentServerPreferences{}) {
+		return fmt.Errorf("%w, there were no previous preferences to roll back to", verifyErr)
+	}
+
+	syncer.logger.Warnf("verifying qBittorrent preference changes failed, rolling back to listen_port %s: %s", formatListenPort(previous.ListenPort), verifyErr)
+
+	if err := syncer.setPreferencesWithRetry(ctx, restore); err != nil {
+		return fmt.Errorf("%w, rolling back also failed, qBittorrent may be left with the unverified preferences: %s", verifyErr, err)
+	}
+
+	return fmt.Errorf("%w, rolled back to the previous preferences (listen_port %s)", verifyErr, formatListenPort(previous.ListenPort))
+}
+
+const (
+	// MinimalModeAlways sets the port every sync without reading qBittorrent's preferences
+	MinimalModeAlways = "always"
+
+	// MinimalModeOnChange sets the port without reading qBittorrent's preferences only when the port files provide a port minimal mode has not set yet
+	MinimalModeOnChange = "on-change"
+)
+
+// MinimalModes are how the port can be set without reading qBittorrent's preferences
+var MinimalModes = []string{MinimalModeAlways, MinimalModeOnChange}
+
+// setPortWithoutReading sets qBittorrent's listen port in minimal mode, without reading its preferences.
+// qBittorrent's current port is unknown, so the port only counts as changed if it differs from the one minimal mode last set, and a port changed outside of this tool is only corrected by MinimalModeAlways.
+func (syncer *PortSyncer) setPortWithoutReading(ctx context.Context, port uint16) (bool, error) {
+	if syncer.minimalMode == MinimalModeOnChange && syncer.minimalModePort == port {
+		return false, nil
+	}
+
+	if err := syncer.setPreferencesWithRetry(ctx, QBittorrentServerPreferences{ListenPort: port}); err != nil {
+		return false, fmt.Errorf("%w: %w", ErrSetPreferences, err)
+	}
+
+	previousPort := syncer.minimalModePort
+	syncer.minimalModePort = port
+	if previousPort == port {
+		syncer.logger.Debugf("set listen_port %d without reading qBittorrent's preferences", port)
+		return false, nil
+	}
+
+	syncer.logger.Infof("set listen_port %d without reading qBittorrent's preferences, previously set %s", port, formatListenPort(previousPort))
+	syncer.listenPortChange = &HookEvent{OldPort: previousPort, NewPort: port, Trigger: HookTriggerPortChange}
+
+	return true, nil
+}
+
+// setPreferencesWithRetry sets qBittorrent's preferences, retrying with an exponential backoff up to setPreferencesAttempts times
+func (syncer *PortSyncer) setPreferencesWithRetry(ctx context.Context, changes QBittorrentServerPreferences) error {
+	var err error
+	for attempt := 1; attempt <= max(syncer.setPreferencesAttempts, 1); attempt++ {
+		if err = syncer.qBittorrentClient.SetServerPreferences(ctx, changes); err == nil {
+			return nil
+		}
+
+		if errors.Is(err, ErrAuthProxyRedirect) || errors.Is(err, ErrAuthProxyChallenge) {
+			return fmt.Errorf("not retrying: %w", err)
+		}
+
+		if attempt >= syncer.setPreferencesAttempts {
+			break
+		}
+
+		backoff := syncer.setPreferencesBackoff.Delay(attempt)
+		if errors.Is(err, ErrForbiddenAfterLogin) {
+			syncer.logger.Warnf("logged in but qBittorrent refused to set preferences (attempt %d/%d), retrying in %s, check the qBittorrent user is allowed to change preferences and that an IP ban or reverse proxy is not blocking requests: %s", attempt, syncer.setPreferencesAttempts, backoff, err)
+		} else {
+			syncer.logger.Warnf("failed to set qBittorrent preferences (attempt %d/%d), retrying in %s: %s", attempt, syncer.setPreferencesAttempts, backoff, err)
+		}
+		syncer.qBittorrentClient.RecordRetry(RetryReasonFor(err))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped retrying: %s, last error: %s", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+	}
+
+	if errors.Is(err, ErrForbiddenAfterLogin) {
+		return fmt.Errorf("still forbidden after %d attempts, check the qBittorrent user is allowed to change preferences and that an IP ban or reverse proxy is not blocking requests: %w", max(syncer.setPreferencesAttempts, 1), err)
+	}
+
+	return err
+}
+
+// verifyPreferences reads qBittorrent's preferences back and ensures they match what was set.
+// Preferences which do not match yet are read again, up to verifyAttempts times, since some qBittorrent builds apply changes asynchronously.
+func (syncer *PortSyncer) verifyPreferences(ctx context.Context, port uint16) error {
+	attempts := max(syncer.verifyAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		if !syncer.allowOptionalCall("reading qBittorrent's preferences back") {
+			if attempt == 1 {
+				return nil
+			}
+			return fmt.Errorf("%w after %d reads, the API call budget does not allow reading again", ErrVerifyMismatch, attempt-1)
+		}
+
+		prefs, err := syncer.qBittorrentClient.GetServerPreferences(ctx)
+		if err != nil {
+			return fmt.Errorf("%w: failed to read preferences back: %w", ErrGetPreferences, err)
+		}
+
+		_, descriptions := syncer.diffPreferences(*prefs, port)
+		if len(descriptions) == 0 {
+			return nil
+		}
+
+		if attempt >= attempts {
+			return fmt.Errorf("%w after %d reads: %s", ErrVerifyMismatch, attempts, strings.Join(descriptions, ", "))
+		}
+
+		syncer.logger.Debugf("qBittorrent preferences do not match yet (read %d/%d), reading again in %s: %s", attempt, attempts, syncer.verifyDelay, strings.Join(descriptions, ", "))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: stopped reading preferences back: %s", ErrVerifyMismatch, ctx.Err())
+		case <-time.After(syncer.verifyDelay):
+		}
+	}
+}
+
+// waitUntilReachable polls qBittorrent's connection status until it reports it is reachable, or returns ErrVerifyNotReachable after timeout
+func (syncer *PortSyncer) waitUntilReachable(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var status string
+	for {
+		if !syncer.allowOptionalCall("waiting for qBittorrent to be reachable") {
+			return nil
+		}
+
+		mainData, err := syncer.qBittorrentClient.GetMainData(ctx)
+		if err == nil {
+			status = mainData.ServerState.ConnectionStatus
+			if status == QBittorrentConnectionStatusConnected {
+				syncer.metrics.Reachable.Set(1)
+				return nil
+			}
+		} else if ctx.Err() == nil {
+			syncer.logger.Debugf("failed to get qBittorrent main data while waiting for it to be reachable: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			syncer.metrics.Reachable.Set(0)
+			return fmt.Errorf("%w: connection status was '%s' after %s", ErrVerifyNotReachable, status, timeout)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// SyncResult describes the outcome of one Sync
+type SyncResult struct {
+	// Time at which the sync finished
+	Time time.Time
+
+	// Port is the port read from the port file, zero if no port was read
+	Port uint16
+
+	// PortFile is the port file the port was read from, empty if no port was read
+	PortFile string
+
+	// Skipped indicates the sync was skipped because no port file existed yet, because the circuit breaker is open, because another tool held the lock file for too long, or because reconciling deliberately did not apply the port
+	Skipped bool
+
+	// Deferred indicates changes to qBittorrent's preferences were deferred, so qBittorrent is not using the port yet
+	Deferred bool
+
+	// Changed indicates qBittorrent's preferences had to be changed
+	Changed bool
+
+	// Retries is the number of qBittorrent API requests which were retried during the sync
+	Retries int64
+
+	// Err is the error which caused the sync to fail, nil if it succeeded
+	Err error
+}
+
+// applied determines if the sync ensured qBittorrent is using the port, either by changing it or by finding it already in use
+func (result SyncResult) applied() bool {
+	return result.Err == nil && !result.Skipped && !result.Deferred && result.Port != 0
+}
+
+// SyncStatus summarizes the syncs which have run
+type SyncStatus struct {
+	// LastSync is when the most recent sync finished, nil if no sync has run
+	LastSync *time.Time `json:"last_sync"`
+
+	// LastSyncError is the error of the most recent sync, empty if it succeeded
+	LastSyncError string `json:"last_sync_error,omitempty"`
+
+	// TotalSyncs is the number of syncs which have run, including those which failed
+	TotalSyncs int `json:"total_syncs"`
+
+	// TotalFailures is the number of syncs which failed
+	TotalFailures int `json:"total_failures"`
+
+	// LastPort is the port the most recent successful sync ensured qBittorrent is using, zero if no sync has succeeded
+	LastPort uint16 `json:"last_port"`
+
+	// LastChange is when a sync most recently changed qBittorrent's preferences, nil if no sync has changed them
+	LastChange *time.Time `json:"last_change"`
+
+	// TotalChanges is the number of syncs which changed qBittorrent's preferences
+	TotalChanges int `json:"total_changes"`
+}
+
+// Log logs a summary of the syncs, uptime is how long syncs have been running for
+func (status SyncStatus) Log(logger golog.Logger, uptime time.Duration) {
+	logger.Info("summary:")
+	logger.Infof("  Uptime        : %s", uptime.Round(time.Second))
+	logger.Infof("  Syncs         : %d", status.TotalSyncs)
+	logger.Infof("  Changes       : %d", status.TotalChanges)
+	logger.Infof("  Failures      : %d", status.TotalFailures)
+	logger.Infof("  Last Port     : %d", status.LastPort)
+}
+
+// Status returns a summary of the syncs which have run
+func (syncer *PortSyncer) Status() SyncStatus {
+	syncer.statusLock.RLock()
+	defer syncer.statusLock.RUnlock()
+
+	return syncer.status
+}
+
+// PortHistory returns the most recent changes of qBittorrent's listen port, oldest first
+func (syncer *PortSyncer) PortHistory() []PortChange {
+	return syncer.portHistory.Changes()
+}
+
+// recordStatus updates the sync status and metrics with result
+func (syncer *PortSyncer) recordStatus(result SyncResult) {
+	syncer.statusLock.Lock()
+	defer syncer.statusLock.Unlock()
+
+	syncer.status.TotalSyncs++
+	syncer.status.LastSync = &result.Time
+	syncer.status.LastSyncError = ""
+	if result.Err != nil {
+		syncer.status.LastSyncError = result.Err.Error()
+		syncer.status.TotalFailures++
+	} else if result.applied() {
+		syncer.status.LastPort = result.Port
+	}
+
+	if result.Changed {
+		syncer.status.LastChange = &result.Time
+		syncer.status.TotalChanges++
+
+		syncer.metrics.Changes.Inc()
+		syncer.metrics.LastChangeTime.Set(float64(result.Time.Unix()))
+	}
+}
+
+// pendingSync is a sync waiting for the running sync to finish, which the callers of Sync share
+type pendingSync struct {
+	// done is closed once the sync finished
+	done chan struct{}
+
+	// changed indicates if the sync changed the qBittorrent port, set before done is closed
+	changed bool
+
+	// err is the error of the sync, set before done is closed
+	err error
+}
+
+// Sync reads the port file and ensures qBittorrent is using that port for torrents
+// The qBittorrent client automatically logs in if not authorized and retries the request once.
+// The result is sent to the sync results channel, if one was provided.
+// If another sync is running this waits for it to finish, then runs one more sync. Calls made while that sync is waiting share
+// its result instead of each running a sync, so bursts of triggers are coalesced. The shared sync uses the first caller's context.
+// Returns a boolean indicating if the qBittorrent port had to be changed
+func (syncer *PortSyncer) Sync(ctx context.Context) (bool, error) {
+	syncer.pendingSyncLock.Lock()
+	if pending := syncer.pendingSync; pending != nil {
+		syncer.pendingSyncLock.Unlock()
+
+		select {
+		case <-pending.done:
+			return pending.changed, pending.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	pending := &pendingSync{done: make(chan struct{})}
+	syncer.pendingSync = pending
+	syncer.pendingSyncLock.Unlock()
+
+	syncer.syncLock.Lock()
+	defer syncer.syncLock.Unlock()
+
+	// Now running, calls from here on must wait for a new sync so they see any port file changes made during this one
+	syncer.pendingSyncLock.Lock()
+	syncer.pendingSync = nil
+	syncer.pendingSyncLock.Unlock()
+
+	defer close(pending.done)
+	pending.changed, pending.err = syncer.runCoalescedSync(ctx)
+
+	return pending.changed, pending.err
+}
+
+// runCoalescedSync performs the work of Sync, the caller must hold syncLock
+func (syncer *PortSyncer) runCoalescedSync(ctx context.Context) (bool, error) {
+	ctx, span := syncer.tracer.Start(ctx, "Sync")
+	startedAt := time.Now()
+	retriesBefore := syncer.qBittorrentClient.Retries()
+	result := syncer.finishSync(syncer.sync(ctx), startedAt, retriesBefore)
+	endSyncSpan(span, result)
+
+	return result.Changed, result.Err
+}
+
+// endSyncSpan tags span with the outcome of the sync, result, and ends it
+func endSyncSpan(span trace.Span, result SyncResult) {
+	span.SetAttributes(
+		attribute.Int("port", int(result.Port)),
+		attribute.String("port_file", result.PortFile),
+		attribute.Bool("changed", result.Changed),
+		attribute.Bool("skipped", result.Skipped),
+		attribute.Bool("deferred", result.Deferred),
+		attribute.Int64("retries", result.Retries),
+	)
+	endSpan(span, result.Err)
+}
+
+// finishSync completes result, logs a summary of retries if there were any, then records and publishes result.
+// startedAt is when the sync started and retriesBefore is the client's retry count before the sync started.
+func (syncer *PortSyncer) finishSync(result SyncResult, startedAt time.Time, retriesBefore int64) SyncResult {
+	result.Time = time.Now()
+	result.Retries = syncer.qBittorrentClient.Retries() - retriesBefore
+
+	if result.Retries > 0 {
+		syncer.logger.Warnf("sync retried %d qBittorrent API requests, see the retries_total metric for the reasons", result.Retries)
+	}
+
+	if result.applied() && len(syncer.readyFile) > 0 && !syncer.readyFileWritten {
+		if err := writeFileAtomic(syncer.readyFile, []byte(result.Time.Format(time.RFC3339)+"\n")); err != nil {
+			syncer.logger.Warnf("failed to write ready file, will try again after the next successful sync: %s", err)
+		} else {
+			syncer.readyFileWritten = true
+			syncer.logger.Infof("wrote ready file '%s'", syncer.readyFile)
+		}
+	}
+
+	previousPort := syncer.Status().LastPort
+	syncer.recordStatus(result)
+	syncer.recordPortMismatch(result, startedAt)
+	syncer.publishResult(result)
+	syncer.pushMetrics()
+
+	if result.applied() && result.Port != previousPort {
+		syncer.publishPortChange(PortChangeEvent{
+			Time:         result.Time,
+			Port:         result.Port,
+			PreviousPort: previousPort,
+			PortFile:     result.PortFile,
+		})
+	}
+
+	return result
+}
+
+// recordPortMismatch updates the port mismatch metric with result, startedAt is when the sync started.
+// The mismatch starts when a sync which read a port starts without applying it, and ends when a sync ensures qBittorrent is using the port.
+// Syncs which did not read a port don't change the mismatch, since there is no port to compare qBittorrent's with.
+func (syncer *PortSyncer) recordPortMismatch(result SyncResult, startedAt time.Time) {
+	if result.applied() {
+		syncer.mismatchSince = time.Time{}
+		syncer.metrics.PortMismatchDuration.Set(0)
+		return
+	}
+	if result.Port == 0 {
+		return
+	}
+
+	if syncer.mismatchSince.IsZero() {
+		syncer.mismatchSince = startedAt
+	}
+	syncer.metrics.PortMismatchDuration.Set(result.Time.Sub(syncer.mismatchSince).Seconds())
+}
+
+// pushMetrics pushes metrics to the Pushgateway if one is configured.
+// Failing is only logged, the Pushgateway being unavailable must not fail syncs.
+// A background context is used so the metrics of the sync which was running when stopping are still pushed.
+func (syncer *PortSyncer) pushMetrics() {
+	if syncer.metricsPusher == nil {
+		return
+	}
+
+	if err := syncer.metricsPusher.Push(context.Background()); err != nil {
+		syncer.logger.Warnf("failed to push metrics to the Pushgateway: %s", err)
+	}
+}
+
+// PortChangeEvent describes a change of the port qBittorrent is using, as ensured by a sync
+type PortChangeEvent struct {
+	// Time at which the sync which applied the port finished
+	Time time.Time
+
+	// Port qBittorrent is now using
+	Port uint16
+
+	// PreviousPort is the port the previous successful sync ensured qBittorrent was using, zero if no sync succeeded before
+	PreviousPort uint16
+
+	// PortFile is the port file the port was read from
+	PortFile string
+}
+
+// portChangeEventBuffer is how many events a subscriber's channel holds before events are dropped
+const portChangeEventBuffer = 16
+
+// Subscribe returns a channel which receives an event whenever a sync ensures qBittorrent is using a different port than the last successful sync did, including the first.
+// Syncs never wait for subscribers: if a subscriber's channel is full the event is dropped for that subscriber. Call Unsubscribe when events are no longer needed.
+func (syncer *PortSyncer) Subscribe() <-chan PortChangeEvent {
+	syncer.subscribersLock.Lock()
+	defer syncer.subscribersLock.Unlock()
+
+	events := make(chan PortChangeEvent, portChangeEventBuffer)
+	syncer.subscribers = append(syncer.subscribers, events)
+
+	return events
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe and closes it
+func (syncer *PortSyncer) Unsubscribe(events <-chan PortChangeEvent) {
+	syncer.subscribersLock.Lock()
+	defer syncer.subscribersLock.Unlock()
+
+	for i, subscriber := range syncer.subscribers {
+		if subscriber == events {
+			syncer.subscribers = slices.Delete(syncer.subscribers, i, i+1)
+			close(subscriber)
+			return
+		}
+	}
+}
+
+// publishPortChange sends event to every subscriber
+func (syncer *PortSyncer) publishPortChange(event PortChangeEvent) {
+	syncer.subscribersLock.Lock()
+	defer syncer.subscribersLock.Unlock()
+
+	for _, subscriber := range syncer.subscribers {
+		// Never block the sync loop on a slow subscriber
+		select {
+		case subscriber <- event:
+		default:
+			syncer.logger.Warnf("port change subscriber is not keeping up, dropping event for port %d", event.Port)
+		}
+	}
+}
+
+// publishResult sends result to the sync results channel if there is one
+func (syncer *PortSyncer) publishResult(result SyncResult) {
+	syncer.syncResultsLock.Lock()
+	defer syncer.syncResultsLock.Unlock()
+
+	if syncer.syncResults == nil {
+		return
+	}
+
+	// Never block the sync loop on a slow receiver
+	select {
+	case syncer.syncResults <- result:
+	default:
+		syncer.logger.Warn("sync results channel is full, dropping result")
+	}
+}
+
+// CloseSyncResults closes the channel sync results are sent to, so its receiver knows no more results follow. Results of later syncs are dropped.
+func (syncer *PortSyncer) CloseSyncResults() {
+	syncer.syncResultsLock.Lock()
+	defer syncer.syncResultsLock.Unlock()
+
+	if syncer.syncResults == nil {
+		return
+	}
+
+	close(syncer.syncResults)
+	syncer.syncResults = nil
+}
+
+// sync performs the work of Sync
+func (syncer *PortSyncer) sync(ctx context.Context) SyncResult {
+	if len(syncer.portCommand) > 0 {
+		return syncer.syncFromPortCommand(ctx)
+	}
+
+	port, portFile, err := syncer.GetDesiredPort()
+	if err != nil {
+		return SyncResult{Err: fmt.Errorf("failed to get desired port from port files: %w", err)}
+	}
+	if portFile == "" {
+		return syncer.syncWithoutPort(ctx, fmt.Sprintf("port files %v do not exist yet", syncer.PortFiles()), fmt.Sprintf("port files %v do not exist or do not contain a port", syncer.PortFiles()))
+	}
+
+	syncer.endSkipped(portFile)
+	syncer.portMissingSince = time.Time{}
+	syncer.lastPort = port
+	syncer.checkPortFileAge(portFile)
+
+	return syncer.syncPort(ctx, port, portFile)
+}
+
+// syncFromPortCommand performs the work of Sync, reading the port from the port command instead of the port files
+func (syncer *PortSyncer) syncFromPortCommand(ctx context.Context) SyncResult {
+	port, err := syncer.GetPortCommandValue(ctx)
+	if errors.Is(err, ErrPortNotAvailable) {
+		syncer.logger.Debugf("no port available: %s", err)
+		return syncer.syncWithoutPort(ctx, "port command did not print a port", fmt.Sprintf("port command did not print a port: %s", err))
+	}
+	if err != nil {
+		return SyncResult{Err: fmt.Errorf("failed to get desired port from port command: %w", err)}
+	}
+
+	syncer.endSkipped("port command")
+	syncer.portMissingSince = time.Time{}
+	syncer.lastPort = port
+
+	return syncer.syncPort(ctx, port, "port command")
+}
+
+// syncWithoutPort handles a sync for which no port is available, according to the port lost policy and allowPortFileNotExist.
+// skipReason is logged if the sync is skipped, errReason is the error if it is not allowed.
+func (syncer *PortSyncer) syncWithoutPort(ctx context.Context, skipReason string, errReason string) SyncResult {
+	if lostPort, source, ok := syncer.portLostFallback(); ok {
+		return syncer.syncPort(ctx, lostPort, source)
+	}
+
+	if syncer.allowPortFileNotExist {
+		syncer.logSkipped(skipReason)
+		return SyncResult{Skipped: true}
+	}
+
+	if syncer.missingPortGracePeriod > 0 {
+		now := time.Now()
+		if syncer.portMissingSince.IsZero() {
+			syncer.portMissingSince = now
+		}
+
+		if missingFor := now.Sub(syncer.portMissingSince); missingFor < syncer.missingPortGracePeriod {
+			syncer.logger.Infof("%s, skipping sync, this becomes an error if there is still no port in %s", skipReason, (syncer.missingPortGracePeriod - missingFor).Round(time.Millisecond))
+			return SyncResult{Skipped: true}
+		}
+	}
+
+	return SyncResult{Err: errors.New(errReason)}
+}
+
+// logSkipped logs that a sync was skipped because of skipReason. Only the first of identical following messages is logged at the info level, the rest at the debug level, so waiting for a VPN to start does not flood the logs.
+func (syncer *PortSyncer) logSkipped(skipReason string) {
+	if syncer.skipReason != skipReason {
+		syncer.skipReason = skipReason
+		syncer.skipCount = 1
+		syncer.logger.Infof("%s, skipping sync...", skipReason)
+		return
+	}
+
+	syncer.skipCount++
+	syncer.logger.Debugf("%s, skipping sync... (skipped %d syncs)", skipReason, syncer.skipCount)
+}
+
+// endSkipped logs, once, that a port is available from source after syncs were skipped for lack of one
+func (syncer *PortSyncer) endSkipped(source string) {
+	if syncer.skipReason == "" {
+		return
+	}
+
+	syncer.logger.Infof("a port is available from %s after skipping %d syncs, resuming syncs", source, syncer.skipCount)
+	syncer.skipReason = ""
+	syncer.skipCount = 0
+}
+
+// portLostFallback determines the port to set, according to the port lost policy, when the port files no longer contain a port after previously containing one.
+// Returns (port, description of where the port came from, if the port should be set)
+func (syncer *PortSyncer) portLostFallback() (uint16, string, bool) {
+	if syncer.lastPort == 0 {
+		return 0, "", false
+	}
+
+	source := fmt.Sprintf("port files %v", syncer.PortFiles())
+	if len(syncer.portCommand) > 0 {
+		source = "port command"
+	}
+
+	switch syncer.onPortLost.Action {
+	case PortLostActionKeep:
+		syncer.logger.Warnf("no port is available from %s anymore, keeping the last port %d", source, syncer.lastPort)
+		return syncer.lastPort, "last known port", true
+	case PortLostActionDefault:
+		syncer.logger.Warnf("no port is available from %s anymore, using the default port %d", source, syncer.onPortLost.DefaultPort)
+		return syncer.onPortLost.DefaultPort, "port lost default", true
+	default:
+		syncer.logger.Warnf("no port is available from %s anymore, the last port was %d, leaving qBittorrent untouched", source, syncer.lastPort)
+		return 0, "", false
+	}
+}
+
+// checkPortFileAge records how long ago the port file was last written and warns if it is older than the stale threshold, which may indicate the VPN stopped refreshing the port mapping
+func (syncer *PortSyncer) checkPortFileAge(portFile string) {
+	info, err := os.Stat(portFile)
+	if err != nil {
+		syncer.logger.Warnf("failed to determine age of port file '%s': %s", portFile, err)
+		return
+	}
+
+	age := time.Since(info.ModTime())
+	syncer.metrics.PortFileAge.Set(age.Seconds())
+
+	if syncer.portFileStaleThreshold > 0 && age > syncer.portFileStaleThreshold {
+		syncer.logger.Warnf("port file '%s' was last written %s ago, which is longer than %s, the VPN may have stopped refreshing the port mapping", portFile, age.Round(time.Second), syncer.portFileStaleThreshold)
+	}
+}
+
+// SyncFromReader reads the port from reader, instead of from the port files, and ensures qBittorrent is using that port for torrents.
+// The reader's contents are parsed using the port file format.
+// If another sync is running this waits for it to finish first.
+// Returns a boolean indicating if the qBittorrent port had to be changed
+func (syncer *PortSyncer) SyncFromReader(ctx context.Context, reader io.Reader, source string) (bool, error) {
+	syncer.syncLock.Lock()
+	defer syncer.syncLock.Unlock()
+
+	ctx, span := syncer.tracer.Start(ctx, "SyncFromReader")
+	startedAt := time.Now()
+	retriesBefore := syncer.qBittorrentClient.Retries()
+	result := syncer.finishSync(syncer.syncFromReader(ctx, reader, source), startedAt, retriesBefore)
+	endSyncSpan(span, result)
+
+	return result.Changed, result.Err
+}
+
+// syncFromReader performs the work of SyncFromReader
+func (syncer *PortSyncer) syncFromReader(ctx context.Context, reader io.Reader, source string) SyncResult {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return SyncResult{Err: fmt.Errorf("failed to read port from %s: %s", source, err)}
+	}
+
+	port, err := ParsePort(syncer.portFileFormat, syncer.portSelector, content)
+	if err != nil {
+		return SyncResult{Err: NewPortFileParseError(source, content, err)}
+	}
+
+	if err := syncer.checkZeroPort(port); err != nil {
+		return SyncResult{Err: fmt.Errorf("%s %w", source, err)}
+	}
+
+	if err := syncer.checkExpectedPortRange(port); err != nil {
+		return SyncResult{Err: fmt.Errorf("%s contains an unexpected port: %s", source, err)}
+	}
+
+	return syncer.syncPort(ctx, port, source)
+}
+
+// syncPort ensures qBittorrent is using port, which was read from portFile
+func (syncer *PortSyncer) syncPort(ctx context.Context, port uint16, portFile string) SyncResult {
+	result := SyncResult{
+		Port:     port,
+		PortFile: portFile,
+	}
+
+	if !syncer.allowCircuit() {
+		result.Skipped = true
+		return result
+	}
+	syncer.budgetStart = syncer.qBittorrentClient.Requests()
+	syncer.listenPortChange = nil
+
+	changed, err := syncer.ReconcileTorrentPort(ctx, port)
+	syncer.recordCircuit(err)
+	if skipped := (ApplySkippedError{}); errors.As(err, &skipped) {
+		// Nothing was written, so the port must not be recorded as applied. A conflict is decided again by the next sync, like deferred changes
+		syncer.logger.Debugf("qBittorrent preference changes for torrent port %d (from: %s) were skipped: %s", port, portFile, err)
+		result.Deferred = skipped.Reason == ApplySkipConflict
+		result.Skipped = !result.Deferred
+		return result
+	}
+	if errors.Is(err, ErrLockTimeout) {
+		// Another tool is changing qBittorrent, the next sync tries again
+		syncer.logger.Warnf("skipping sync, another tool held the lock file for too long: %s", err)
+		result.Skipped = true
+		return result
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("failed to reconcile qBittorrent port differences: %w", err)
+		return result
+	}
+	result.Changed = changed
+
+	if changed {
+		syncer.noChangeCount = 0
+		syncer.logger.Infof("Changed qBittorrent preferences for torrent port %d (from: %s)", port, portFile)
+
+		if syncer.listenPortChange != nil {
+			syncer.portHistory.Add(PortChange{
+				Time:    time.Now(),
+				OldPort: syncer.listenPortChange.OldPort,
+				NewPort: syncer.listenPortChange.NewPort,
+			})
+		}
+
+		if syncer.reannounceOnChange && syncer.allowOptionalCall("reannouncing torrents") {
+			if err := syncer.qBittorrentClient.ReannounceTorrents(ctx); err != nil {
+				syncer.logger.Warnf("failed to reannounce torrents to their trackers: %s", err)
+			} else {
+				syncer.logger.Info("reannounced torrents to their trackers")
+			}
+		}
+
+		if len(syncer.resumeOnChange) > 0 && syncer.listenPortChange != nil && syncer.allowOptionalCall("resuming torrents") {
+			if err := syncer.resumeTorrents(ctx); err != nil {
+				syncer.logger.Warnf("failed to resume torrents: %s", err)
+			}
+		}
+
+		if len(syncer.onChangeCommand) > 0 && syncer.listenPortChange != nil {
+			syncer.runOnChangeCommand(ctx, *syncer.listenPortChange, portFile)
+		}
+	} else if syncer.pendingPort != 0 {
+		result.Deferred = true
+		syncer.logger.Debugf("qBittorrent preference changes for torrent port %d (from: %s) are deferred", port, portFile)
+	} else {
+		syncer.logNoChange(port, portFile)
+	}
+
+	if len(syncer.outputPortFile) > 0 {
+		if err := syncer.writeOutputPortFile(port); err != nil {
+			syncer.logger.Warnf("failed to write port to output port file: %s", err)
+		}
+	}
+
+	if syncer.checkReachability && syncer.allowOptionalCall("checking if qBittorrent is reachable") {
+		if err := syncer.CheckReachability(ctx); err != nil {
+			syncer.logger.Warnf("failed to check if qBittorrent is reachable: %s", err)
+		}
+	}
+
+	return result
+}
+
+const (
+	// ResumeOnChangeAll resumes every torrent after a sync changes qBittorrent's listen port
+	ResumeOnChangeAll = "all"
+
+	// ResumeOnChangeStalled resumes only the torrents qBittorrent lists as stalled after a sync changes qBittorrent's listen port
+	ResumeOnChangeStalled = "stalled"
+)
+
+// ResumeOnChangeModes are which torrents can be resumed after a sync changes qBittorrent's listen port
+var ResumeOnChangeModes = []string{ResumeOnChangeAll, ResumeOnChangeStalled}
+
+// resumeTorrents resumes the torrents resumeOnChange selects
+func (syncer *PortSyncer) resumeTorrents(ctx context.Context) error {
+	var hashes []string
+	if syncer.resumeOnChange == ResumeOnChangeStalled {
+		var err error
+		hashes, err = syncer.qBittorrentClient.ListStalledTorrentHashes(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list stalled torrents: %w", err)
+		}
+
+		if len(hashes) == 0 {
+			syncer.logger.Debug("no torrents are stalled, not resuming any")
+			return nil
+		}
+	}
+
+	if err := syncer.qBittorrentClient.ResumeTorrents(ctx, hashes); err != nil {
+		return err
+	}
+
+	if len(hashes) > 0 {
+		syncer.logger.Infof("resumed %d stalled torrents", len(hashes))
+	} else {
+		syncer.logger.Info("resumed all torrents")
+	}
+
+	return nil
+}
+
+// runOnChangeCommand runs the on change command for event, which is completed with the details known by the syncer. Failures are logged and do not fail the sync.
+// portSource is the port file, or "port command", the new port was read from
+func (syncer *PortSyncer) runOnChangeCommand(ctx context.Context, event HookEvent, portSource string) {
+	event.InstanceName = syncer.instanceName
+	event.QBittorrentURL = syncer.qBittorrentClient.URL()
+	event.Time = time.Now()
+	event.PortSource = portSource
+
+	if syncer.hookWorker != nil {
+		syncer.hookWorker.Enqueue(event)
+		return
+	}
+
+	if err := RunHookCommand(ctx, syncer.onChangeCommand, event, syncer.onChangeCommandExtendedEnv); err != nil {
+		syncer.logger.Warnf("on change command failed: %s", err)
+		return
+	}
+
+	syncer.logger.Debugf("ran on change command for listen_port %s -> %d", formatListenPort(event.OldPort), event.NewPort)
+}
+
+// WaitForOnChangeCommands blocks until the on change commands queued in the background have run, or ctx is canceled. Returns immediately if they are not run in the background
+func (syncer *PortSyncer) WaitForOnChangeCommands(ctx context.Context) {
+	if syncer.hookWorker != nil {
+		syncer.hookWorker.Wait(ctx)
+	}
+}
+
+// allowOptionalCall determines if the API call budget allows the current sync to make an optional request, logging what is skipped if it does not.
+// action describes what the request is for.
+func (syncer *PortSyncer) allowOptionalCall(action string) bool {
+	if syncer.apiCallBudget == 0 {
+		return true
+	}
+
+	used := syncer.qBittorrentClient.Requests() - syncer.budgetStart
+	if used < int64(syncer.apiCallBudget) {
+		return true
+	}
+
+	syncer.logger.Infof("skipping %s, the sync made %d API requests which exhausts the API call budget of %d", action, used, syncer.apiCallBudget)
+	return false
+}
+
+// allowCircuit determines if the circuit breaker lets the sync call qBittorrent, logging if it does not
+func (syncer *PortSyncer) allowCircuit() bool {
+	if syncer.circuitBreaker == nil {
+		return true
+	}
+
+	allowed, remaining := syncer.circuitBreaker.Allow()
+	state := syncer.circuitBreaker.State()
+	syncer.metrics.CircuitBreakerState.Set(float64(state))
+
+	if !allowed {
+		syncer.logger.Warnf("circuit breaker is open after repeated qBittorrent failures, skipping sync, will try again in %s", remaining.Round(time.Second))
+		return false
+	}
+	if state == CircuitHalfOpen {
+		syncer.logger.Info("circuit breaker is half-open, trying qBittorrent again")
+	}
+
+	return true
+}
+
+// recordCircuit records the outcome of reconciling with qBittorrent in the circuit breaker, err is the reconcile error.
+// Failing to acquire the lock file is not a qBittorrent failure, so it is not recorded.
+func (syncer *PortSyncer) recordCircuit(err error) {
+	if syncer.circuitBreaker == nil || errors.Is(err, ErrLockTimeout) {
+		return
+	}
+
+	// qBittorrent responded, the port was only not applied on purpose
+	if errors.As(err, &ApplySkippedError{}) {
+		err = nil
+	}
+
+	before := syncer.circuitBreaker.State()
+	if err != nil {
+		syncer.circuitBreaker.RecordFailure()
+	} else {
+		syncer.circuitBreaker.RecordSuccess()
+	}
+
+	after := syncer.circuitBreaker.State()
+	syncer.metrics.CircuitBreakerState.Set(float64(after))
+
+	if before != CircuitOpen && after == CircuitOpen {
+		syncer.logger.Warnf("circuit breaker opened, syncs are skipped for %s to avoid hammering qBittorrent", syncer.circuitBreaker.cooldown)
+	} else if before != CircuitClosed && after == CircuitClosed {
+		syncer.logger.Info("circuit breaker closed, qBittorrent recovered")
+	}
+}
+
+// writeOutputPortFile writes port to the output port file, if the file does not already contain it.
+// The file is written atomically, so readers never see a partially written port.
+func (syncer *PortSyncer) writeOutputPortFile(port uint16) error {
+	content := []byte(fmt.Sprintf("%d\n", port))
+
+	existing, err := os.ReadFile(syncer.outputPortFile)
+	if err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+
+	if err := writeFileAtomic(syncer.outputPortFile, content); err != nil {
+		return err
+	}
+
+	syncer.logger.Infof("wrote port %d to output port file '%s'", port, syncer.outputPortFile)
+
+	return nil
+}
+
+// writeFileAtomic writes content to path by writing a temporary file next to it and renaming it, so readers never see a partially written file
+func writeFileAtomic(path string, content []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write temporary file '%s': %s", tmpFile.Name(), err)
+	}
+	if err := tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to set permissions of temporary file '%s': %s", tmpFile.Name(), err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file '%s': %s", tmpFile.Name(), err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to move temporary file '%s' to '%s': %s", tmpFile.Name(), path, err)
+	}
+
+	return nil
+}
+
+// RemoveReadyFile removes the ready file at path, so other programs no longer consider the tool ready. A ready file which does not exist is not an error
+func RemoveReadyFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove ready file '%s': %s", path, err)
+	}
+
+	return nil
+}
+
+// logNoChange logs that qBittorrent is already using port. Once a no change message is logged identical following ones are only logged every noChangeLogEvery syncs, until the port changes.
+func (syncer *PortSyncer) logNoChange(port uint16, portFile string) {
+	if syncer.noChangeCount == 0 || syncer.noChangePort != port {
+		syncer.noChangePort = port
+		syncer.noChangeCount = 1
+		syncer.logger.Infof("No change to qBittorrent torrent port (is: %d, from: %s)", port, portFile)
+		return
+	}
+
+	syncer.noChangeCount++
+
+	if syncer.noChangeLogEvery > 0 && (syncer.noChangeCount-1)%syncer.noChangeLogEvery == 0 {
+		syncer.logger.Infof("No change to qBittorrent torrent port (is: %d, from: %s, unchanged for %d syncs)", port, portFile, syncer.noChangeCount)
+		return
+	}
+
+	syncer.logger.Debugf("No change to qBittorrent torrent port (is: %d, from: %s)", port, portFile)
+}
+
+// CheckReachability retrieves qBittorrent's connection status, logs if the torrent port is reachable, and records it in metrics
+func (syncer *PortSyncer) CheckReachability(ctx context.Context) error {
+	mainData, err := syncer.qBittorrentClient.GetMainData(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get qBittorrent main data: %s", err)
+	}
+
+	status := mainData.ServerState.ConnectionStatus
+	if status == QBittorrentConnectionStatusConnected {
+		syncer.logger.Infof("qBittorrent reports it is reachable (connection status: %s)", status)
+		syncer.metrics.Reachable.Set(1)
+	} else {
+		syncer.logger.Warnf("qBittorrent reports it is not reachable, the forwarded port may not be working (connection status: %s)", status)
+		syncer.metrics.Reachable.Set(0)
+	}
+
+	return nil
+}
+
+// runSync calls Sync with a context derived from harshCtx so that a graceful shutdown does not abort it.
+// If ctx is canceled while the sync is running the sync is given shutdownGracePeriod to finish before it is aborted.
+// A sync which exceeds syncTimeout is aborted and counted as a failure, but no error is returned so the loop continues.
+func (syncer *PortSyncer) runSync(ctx context.Context, harshCtx context.Context) error {
+	syncCtx, cancelSync := context.WithCancel(harshCtx)
+	if syncer.syncTimeout > 0 {
+		syncCtx, cancelSync = context.WithTimeout(harshCtx, syncer.syncTimeout)
+	}
+	defer cancelSync()
+
+	syncErr := make(chan error, 1)
+	go func() {
+		_, err := syncer.Sync(syncCtx)
+		if err != nil {
+			syncer.metrics.SyncFailures.Inc()
+
+			if errors.Is(syncCtx.Err(), context.DeadlineExceeded) {
+				syncer.logger.Errorf("sync did not finish within the %s sync timeout, will try again next interval: %s", syncer.syncTimeout, err)
+				err = nil
+			} else if errors.Is(err, ErrPortFileReadTimeout) {
+				syncer.logger.Errorf("reading the port file timed out, will try again next interval: %s", err)
+				err = nil
+			} else if syncer.circuitBreaker != nil {
+				// The circuit breaker decides when qBittorrent is tried again, so the loop must keep running for it to ever open
+				syncer.logger.Errorf("sync failed, will try again next interval: %s", err)
+				err = nil
+			}
+		}
+		syncErr <- err
+	}()
+
+	select {
+	case err := <-syncErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Graceful shutdown requested mid-sync
+	syncer.logger.Infof("waiting up to %s for in-flight sync to finish", syncer.shutdownGracePeriod)
+
+	graceTimer := time.NewTimer(syncer.shutdownGracePeriod)
+	defer graceTimer.Stop()
+
+	select {
+	case err := <-syncErr:
+		return err
+	case <-graceTimer.C:
+		syncer.logger.Warn("in-flight sync did not finish within the shutdown grace period, aborting it")
+		cancelSync()
+		<-syncErr
+		return nil
+	}
+}
+
+// waitForFirstPortFile waits up to waitForPortFile for one of the port files to be created, so the first sync happens as soon as the VPN writes the port.
+// If no port file is created in time syncing proceeds anyway.
+func (syncer *PortSyncer) waitForFirstPortFile(ctx context.Context) {
+	portFiles := syncer.PortFiles()
+	if len(portFiles) == 0 {
+		return
+	}
+	for _, portFile := range portFiles {
+		if _, err := os.Stat(portFile); err == nil {
+			return
+		}
+	}
+
+	syncer.logger.Infof("waiting up to %s for one of the port files %v to be created", syncer.waitForPortFile, portFiles)
+
+	portFile, err := WaitForFiles(ctx, portFiles, syncer.waitForPortFile)
+	if errors.Is(err, ErrWaitForFileTimeout) {
+		syncer.logger.Warnf("no port file was created, syncing anyway: %s", err)
+	} else if err != nil && ctx.Err() == nil {
+		syncer.logger.Warnf("failed to wait for a port file to be created, syncing anyway: %s", err)
+	} else if err == nil {
+		syncer.logger.Infof("port file '%s' was created", portFile)
+	}
+}
+
+// watchForPortFileChanges triggers a sync whenever one of the port files changes, until ctx is canceled.
+// The port files are only read when the watch starts, port files set later by SetPortFiles are synced on the interval.
+func (syncer *PortSyncer) watchForPortFileChanges(ctx context.Context) {
+	portFiles := syncer.PortFiles()
+	syncer.logger.Infof("watching port files %v for changes", portFiles)
+
+	err := WatchFiles(ctx, portFiles, func(portFile string) {
+		syncer.logger.Debugf("port file '%s' changed, triggering a sync", portFile)
+		syncer.TriggerSync()
+	})
+	if err != nil {
+		syncer.logger.Warnf("stopped watching port files for changes, syncing only on the interval: %s", err)
+	}
+}
+
+// LoopStats are aggregate statistics of the syncs run by one call to LoopWithStats
+type LoopStats struct {
+	// Syncs is the number of syncs which ran, including those which failed
+	Syncs int `json:"syncs"`
+
+	// Changes is the number of syncs which changed qBittorrent's preferences
+	Changes int `json:"changes"`
+
+	// Failures is the number of syncs which failed
+	Failures int `json:"failures"`
+
+	// LastPort is the port the most recent successful sync ensured qBittorrent is using, zero if no sync has succeeded
+	LastPort uint16 `json:"last_port"`
+}
+
+// LoopWithStats runs Loop and returns statistics of the syncs it ran once it stops, for programs which embed the syncer and react to its outcome.
+// Syncs run before LoopWithStats was called, like with Sync, are not included, except in LastPort.
+// Returns (statistics, error which stopped the loop)
+func (syncer *PortSyncer) LoopWithStats(ctx context.Context, harshCtx context.Context, interval time.Duration) (LoopStats, error) {
+	before := syncer.Status()
+	err := syncer.Loop(ctx, harshCtx, interval)
+	after := syncer.Status()
+
+	return LoopStats{
+		Syncs:    after.TotalSyncs - before.TotalSyncs,
+		Changes:  after.TotalChanges - before.TotalChanges,
+		Failures: after.TotalFailures - before.TotalFailures,
+		LastPort: after.LastPort,
+	}, err
+}
+
+// ErrInvalidInterval indicates the interval between syncs is not positive, so syncs could not be scheduled
+var ErrInvalidInterval = errors.New("sync interval must be greater than 0")
+
+// Loop calls the sync process on an interval until ctx is canceled. Unless skipInitialSync is set the first sync runs immediately, after waiting for a port file to be created if waitForPortFile is set.
+// A sync also runs whenever TriggerSync is called, or a port file changes if watchPortFiles is set, and the interval is changed whenever SetInterval is called.
+// A sync which is running when ctx is canceled is allowed to finish within the shutdown grace period, only harshCtx being canceled aborts it immediately.
+// Returns an error wrapping ErrInvalidInterval if interval is not positive, an interval from SetInterval which is not positive is ignored.
+// A failed sync stops the loop with its error, unless a circuit breaker is configured in which case it is logged and the loop keeps running.
+func (syncer *PortSyncer) Loop(ctx context.Context, harshCtx context.Context, interval time.Duration) error {
+	// NewTicker panics on intervals which are not positive
+	if interval <= 0 {
+		return fmt.Errorf("%w, is %s", ErrInvalidInterval, interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if syncer.watchPortFiles && len(syncer.PortFiles()) > 0 {
+		go syncer.watchForPortFileChanges(ctx)
+	}
+
+	if syncer.waitForPortFile > 0 && !syncer.skipInitialSync {
+		syncer.waitForFirstPortFile(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	if syncer.skipInitialSync {
+		syncer.logger.Infof("skipping initial sync, first sync will run in %s", interval)
+	} else if err := syncer.runSync(ctx, harshCtx); err != nil && harshCtx.Err() == nil {
+		return fmt.Errorf("failed to sync port: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-harshCtx.Done():
+			return nil
+		case <-ticker.C:
+			if err := syncer.runSync(ctx, harshCtx); err != nil && harshCtx.Err() == nil {
+				return fmt.Errorf("failed to sync port: %w", err)
+			}
+		case newInterval := <-syncer.intervalUpdates:
+			if newInterval <= 0 {
+				syncer.logger.Warnf("ignoring sync interval change to %s, keeping %s: %s", newInterval, interval, ErrInvalidInterval)
+				continue
+			}
+
+			syncer.logger.Infof("sync interval changed from %s to %s", interval, newInterval)
+			interval = newInterval
+			ticker.Reset(interval)
+		case <-syncer.syncTrigger:
+			syncer.logger.Info("sync triggered")
+			if err := syncer.runSync(ctx, harshCtx); err != nil && harshCtx.Err() == nil {
+				return fmt.Errorf("failed to sync port: %w", err)
+			}
+		}
+	}
+}
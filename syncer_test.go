@@ -0,0 +1,2585 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestSyncer creates a PortSyncer for the fake qBittorrent which reads a plain port file in a temporary directory.
+// Options which are not set in opts get defaults.
+// Returns the syncer and the port file's path, the port file is not created.
+func newTestSyncer(t *testing.T, fake *testutil.FakeQBittorrent, opts NewPortSyncerOptions) (*PortSyncer, string) {
+	t.Helper()
+
+	if opts.Logger == nil {
+		opts.Logger = golog.NewLogger("test")
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = NewMetrics("test")
+	}
+	opts.QBittorrentClient = newTestClient(t, fake)
+	opts.QBittorrentClient.metrics = opts.Metrics
+	if len(opts.PortFiles) == 0 {
+		opts.PortFiles = []string{filepath.Join(t.TempDir(), "port")}
+	}
+	if len(opts.PortFileFormat) == 0 {
+		opts.PortFileFormat = PortFileFormatPlain
+	}
+
+	return NewPortSyncer(opts), opts.PortFiles[0]
+}
+
+// writePortFile writes port to the port file at path
+func writePortFile(t *testing.T, path string, port uint16) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(fmt.Sprint(port)), 0o644); err != nil {
+		t.Fatalf("failed to write port file: %s", err)
+	}
+}
+
+func TestPortSyncerRunSyncGracePeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod time.Duration
+
+		// wantPort is qBittorrent's port after runSync returns
+		wantPort uint16
+	}{
+		{name: "finishes within grace period", gracePeriod: 5 * time.Second, wantPort: 50000},
+		{name: "aborted after grace period", gracePeriod: 50 * time.Millisecond, wantPort: 6881},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			// Each request is slow, so the sync is still running when the graceful shutdown is requested
+			fake.SetDelay(100 * time.Millisecond)
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{ShutdownGracePeriod: test.gracePeriod})
+			writePortFile(t, portFile, 50000)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			defer cancel()
+
+			start := time.Now()
+			if err := syncer.runSync(ctx, context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if elapsed := time.Since(start); elapsed > test.gracePeriod+time.Second {
+				t.Errorf("runSync took %s, expected it to return within the %s grace period", elapsed, test.gracePeriod)
+			}
+
+			if fake.ListenPort() != test.wantPort {
+				t.Errorf("qBittorrent's port is %d, expected %d", fake.ListenPort(), test.wantPort)
+			}
+		})
+	}
+}
+
+func TestPortSyncerRunSyncHarshShutdown(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	fake.SetDelay(time.Second)
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{ShutdownGracePeriod: time.Minute})
+	writePortFile(t, portFile, 50000)
+
+	// A harsh shutdown aborts the sync without waiting for the grace period
+	harshCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	defer cancel()
+
+	start := time.Now()
+	syncer.runSync(harshCtx, harshCtx)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("runSync took %s after a harsh shutdown", elapsed)
+	}
+	if fake.ListenPort() != 6881 {
+		t.Errorf("qBittorrent's port changed to %d", fake.ListenPort())
+	}
+}
+
+func TestPortSyncerGetDesiredPort(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// contents of the port files in priority order, nil if the file does not exist
+		contents []*string
+
+		wantPort uint16
+
+		// wantFile is the index of the port file the port must be read from, -1 if none
+		wantFile int
+		wantErr  bool
+	}{
+		{name: "first present", contents: []*string{strPtr("50000"), strPtr("50001")}, wantPort: 50000, wantFile: 0},
+		{name: "fallback to second", contents: []*string{nil, strPtr("50001")}, wantPort: 50001, wantFile: 1},
+		{name: "windows line ending", contents: []*string{strPtr("49152\r\n")}, wantPort: 49152, wantFile: 0},
+		{name: "fallback past invalid", contents: []*string{strPtr("not a port"), strPtr("50001")}, wantPort: 50001, wantFile: 1},
+		{name: "all absent", contents: []*string{nil, nil}, wantFile: -1},
+		{name: "none valid", contents: []*string{nil, strPtr("not a port")}, wantFile: -1, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var portFiles []string
+			for i, content := range test.contents {
+				portFile := filepath.Join(dir, fmt.Sprintf("port%d", i))
+				portFiles = append(portFiles, portFile)
+
+				if content != nil {
+					if err := os.WriteFile(portFile, []byte(*content), 0o644); err != nil {
+						t.Fatalf("failed to write port file: %s", err)
+					}
+				}
+			}
+
+			syncer := NewPortSyncer(NewPortSyncerOptions{
+				Logger:         golog.NewLogger("test"),
+				PortFiles:      portFiles,
+				PortFileFormat: PortFileFormatPlain,
+			})
+
+			port, portFile, err := syncer.GetDesiredPort()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got port %d from '%s'", port, portFile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			wantPortFile := ""
+			if test.wantFile >= 0 {
+				wantPortFile = portFiles[test.wantFile]
+			}
+			if port != test.wantPort || portFile != wantPortFile {
+				t.Errorf("got port %d from '%s', expected %d from '%s'", port, portFile, test.wantPort, wantPortFile)
+			}
+		})
+	}
+}
+
+func TestPortSyncerGetDesiredPortGarbage(t *testing.T) {
+	portFile := filepath.Join(t.TempDir(), "port")
+	garbage := append([]byte("\x00\xff\n"), bytes.Repeat([]byte("not a port "), 10000)...)
+	if err := os.WriteFile(portFile, garbage, 0o644); err != nil {
+		t.Fatalf("failed to write port file: %s", err)
+	}
+
+	syncer := NewPortSyncer(NewPortSyncerOptions{
+		Logger:         golog.NewLogger("test"),
+		PortFiles:      []string{portFile},
+		PortFileFormat: PortFileFormatPlain,
+	})
+
+	_, _, err := syncer.GetDesiredPort()
+
+	var parseErr PortFileParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("error is %v, expected a PortFileParseError", err)
+	}
+	if parseErr.Source != portFile || !parseErr.Truncated || len(parseErr.Content) != maxPortFileErrorContent {
+		t.Errorf("parse error is from '%s' with %d bytes of content, truncated %t, expected the first %d bytes of '%s'", parseErr.Source, len(parseErr.Content), parseErr.Truncated, maxPortFileErrorContent, portFile)
+	}
+	if len(err.Error()) > 1000 {
+		t.Errorf("error message is %d bytes long, expected it to be bounded", len(err.Error()))
+	}
+	if !strings.Contains(err.Error(), `"\x00\xff\nnot a port`) {
+		t.Errorf("error is '%s', expected the contents to be quoted", err)
+	}
+}
+
+func TestPortSyncerGetDesiredPortDanglingSymlink(t *testing.T) {
+	dir := t.TempDir()
+	portFile := filepath.Join(dir, "port")
+	if err := os.Symlink(filepath.Join(dir, "rotated-away"), portFile); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+	fallbackPortFile := filepath.Join(dir, "fallback")
+
+	syncer := NewPortSyncer(NewPortSyncerOptions{
+		Logger:         golog.NewLogger("test"),
+		PortFiles:      []string{portFile, fallbackPortFile},
+		PortFileFormat: PortFileFormatPlain,
+	})
+
+	// The dangling symlink is treated as not available yet, so the sync is skipped
+	port, readFrom, err := syncer.GetDesiredPort()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if port != 0 || len(readFrom) > 0 {
+		t.Errorf("got port %d from '%s', expected none", port, readFrom)
+	}
+
+	// The fallback is used instead
+	writePortFile(t, fallbackPortFile, 50001)
+	port, readFrom, err = syncer.GetDesiredPort()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if port != 50001 || readFrom != fallbackPortFile {
+		t.Errorf("got port %d from '%s', expected 50001 from '%s'", port, readFrom, fallbackPortFile)
+	}
+}
+
+// strPtr returns a pointer to s
+func strPtr(s string) *string {
+	return &s
+}
+
+// gaugeValue returns the current value of gauge
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	t.Helper()
+
+	var metric dto.Metric
+	if err := gauge.Write(&metric); err != nil {
+		t.Fatalf("failed to read gauge: %s", err)
+	}
+
+	return metric.GetGauge().GetValue()
+}
+
+// counterValue returns the current value of counter
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+
+	var metric dto.Metric
+	if err := counter.Write(&metric); err != nil {
+		t.Fatalf("failed to read counter: %s", err)
+	}
+
+	return metric.GetCounter().GetValue()
+}
+
+func TestPortSyncerCheckReachability(t *testing.T) {
+	tests := []struct {
+		status        string
+		wantReachable float64
+	}{
+		{status: "connected", wantReachable: 1},
+		{status: "firewalled", wantReachable: 0},
+		{status: "disconnected", wantReachable: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			fake.SetConnectionStatus(test.status)
+
+			metrics := NewMetrics("test")
+			// Start from the opposite value, so the test fails if the gauge is not set
+			metrics.Reachable.Set(1 - test.wantReachable)
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{CheckReachability: true, Metrics: metrics})
+			writePortFile(t, portFile, 6881)
+
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if requests := fake.Requests("/api/v2/sync/maindata"); requests == 0 {
+				t.Fatal("main data was not requested")
+			}
+			if reachable := gaugeValue(t, metrics.Reachable); reachable != test.wantReachable {
+				t.Errorf("reachable is %v, expected %v", reachable, test.wantReachable)
+			}
+		})
+	}
+}
+
+func TestPortSyncerLoopSyncTimeout(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	// Every sync takes longer than the sync timeout
+	fake.SetDelay(time.Second)
+
+	metrics := NewMetrics("test")
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{SyncTimeout: 50 * time.Millisecond, Metrics: metrics})
+	writePortFile(t, portFile, 50000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := syncer.Loop(ctx, context.Background(), 100*time.Millisecond); err != nil {
+		t.Fatalf("loop stopped because of a timed out sync: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("loop took %s, expected each sync to be bounded by the sync timeout", elapsed)
+	}
+
+	// The initial sync and at least one sync on a later tick timed out
+	if failures := counterValue(t, metrics.SyncFailures); failures < 2 {
+		t.Errorf("%v syncs failed, expected at least 2", failures)
+	}
+}
+
+func TestPortSyncerDiffPreferences(t *testing.T) {
+	enabled := true
+	disabled := false
+	unlimited := -1
+	limit := 100
+
+	tests := []struct {
+		name    string
+		opts    NewPortSyncerOptions
+		current QBittorrentServerPreferences
+
+		// wantJSON is the preferences which must be set, encoded as they are sent to qBittorrent
+		wantJSON string
+	}{
+		{name: "nothing managed", current: QBittorrentServerPreferences{ListenPort: 6881, UPnP: &enabled, MaxConnections: &limit}, wantJSON: `{}`},
+		{name: "port changed", current: QBittorrentServerPreferences{ListenPort: 6882, UPnP: &enabled}, wantJSON: `{"listen_port":6881}`},
+		{name: "upnp already enabled", opts: NewPortSyncerOptions{UPnP: &enabled}, current: QBittorrentServerPreferences{ListenPort: 6881, UPnP: &enabled}, wantJSON: `{}`},
+		{name: "upnp enabled", opts: NewPortSyncerOptions{UPnP: &enabled}, current: QBittorrentServerPreferences{ListenPort: 6881, UPnP: &disabled}, wantJSON: `{"upnp":true}`},
+		{name: "upnp disabled", opts: NewPortSyncerOptions{UPnP: &disabled}, current: QBittorrentServerPreferences{ListenPort: 6881, UPnP: &enabled}, wantJSON: `{"upnp":false}`},
+		{name: "upnp not reported", opts: NewPortSyncerOptions{UPnP: &disabled}, current: QBittorrentServerPreferences{ListenPort: 6881}, wantJSON: `{"upnp":false}`},
+		{name: "connection limits unchanged", opts: NewPortSyncerOptions{MaxConnections: &limit, MaxConnectionsPerTorrent: &unlimited}, current: QBittorrentServerPreferences{
+			ListenPort:               6881,
+			MaxConnections:           &limit,
+			MaxConnectionsPerTorrent: &unlimited,
+		}, wantJSON: `{}`},
+		{name: "only changed connection limit", opts: NewPortSyncerOptions{MaxConnections: &limit, MaxConnectionsPerTorrent: &unlimited}, current: QBittorrentServerPreferences{
+			ListenPort:               6881,
+			MaxConnections:           &unlimited,
+			MaxConnectionsPerTorrent: &unlimited,
+		}, wantJSON: `{"max_connec":100}`},
+		{name: "only configured connection limit", opts: NewPortSyncerOptions{MaxConnectionsPerTorrent: &limit}, current: QBittorrentServerPreferences{
+			ListenPort:               6881,
+			MaxConnections:           &unlimited,
+			MaxConnectionsPerTorrent: &unlimited,
+		}, wantJSON: `{"max_connec_per_torrent":100}`},
+		{name: "port and limits changed", opts: NewPortSyncerOptions{MaxConnections: &unlimited, MaxConnectionsPerTorrent: &limit}, current: QBittorrentServerPreferences{
+			ListenPort: 6882,
+		}, wantJSON: `{"listen_port":6881,"max_connec":-1,"max_connec_per_torrent":100}`},
+		{name: "interface not managed", current: QBittorrentServerPreferences{ListenPort: 6881, CurrentNetworkInterface: strPtr("eth0")}, wantJSON: `{}`},
+		{name: "interface unchanged", opts: NewPortSyncerOptions{NetworkInterface: strPtr("wg0"), InterfaceAddress: strPtr("10.2.0.2")}, current: QBittorrentServerPreferences{
+			ListenPort:              6881,
+			CurrentNetworkInterface: strPtr("wg0"),
+			CurrentInterfaceAddress: strPtr("10.2.0.2"),
+		}, wantJSON: `{}`},
+		{name: "interface changed", opts: NewPortSyncerOptions{NetworkInterface: strPtr("wg0"), InterfaceAddress: strPtr("")}, current: QBittorrentServerPreferences{
+			ListenPort:              6881,
+			CurrentNetworkInterface: strPtr(""),
+			CurrentInterfaceAddress: strPtr("10.2.0.2"),
+		}, wantJSON: `{"current_network_interface":"wg0","current_interface_address":""}`},
+		{name: "interface not reported", opts: NewPortSyncerOptions{NetworkInterface: strPtr("wg0")}, current: QBittorrentServerPreferences{ListenPort: 6881}, wantJSON: `{"current_network_interface":"wg0"}`},
+		{name: "already listening on IPv6", opts: NewPortSyncerOptions{InterfaceAddress: strPtr("::")}, current: QBittorrentServerPreferences{ListenPort: 6881, CurrentInterfaceAddress: strPtr("::")}, wantJSON: `{}`},
+		{name: "listen on IPv6", opts: NewPortSyncerOptions{InterfaceAddress: strPtr("::")}, current: QBittorrentServerPreferences{ListenPort: 6881, CurrentInterfaceAddress: strPtr("0.0.0.0")}, wantJSON: `{"current_interface_address":"::"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Logger = golog.NewLogger("test")
+			syncer := NewPortSyncer(test.opts)
+
+			changes, descriptions := syncer.diffPreferences(test.current, 6881)
+
+			changesJSON, err := json.Marshal(changes)
+			if err != nil {
+				t.Fatalf("failed to encode changes: %s", err)
+			}
+			if string(changesJSON) != test.wantJSON {
+				t.Errorf("changes are %s, expected %s", changesJSON, test.wantJSON)
+			}
+			if (len(descriptions) == 0) != (test.wantJSON == `{}`) {
+				t.Errorf("changes are described as %v", descriptions)
+			}
+		})
+	}
+}
+
+func TestPortSyncerSyncResults(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	results := make(chan SyncResult, 1)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{AllowPortFileNotExist: true, SyncResults: results})
+
+	steps := []struct {
+		name string
+
+		// port is written to the port file before syncing, zero if the port file must not exist
+		port uint16
+
+		want SyncResult
+	}{
+		{name: "skipped", want: SyncResult{Skipped: true}},
+		{name: "changed", port: 50000, want: SyncResult{Port: 50000, PortFile: portFile, Changed: true}},
+		{name: "unchanged", port: 50000, want: SyncResult{Port: 50000, PortFile: portFile}},
+	}
+
+	for _, step := range steps {
+		if step.port != 0 {
+			writePortFile(t, portFile, step.port)
+		}
+
+		before := time.Now()
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("%s: unexpected error: %s", step.name, err)
+		}
+
+		result := <-results
+		if result.Time.Before(before) {
+			t.Errorf("%s: result time %s is before the sync started", step.name, result.Time)
+		}
+		if result.Port != step.want.Port || result.PortFile != step.want.PortFile || result.Skipped != step.want.Skipped || result.Changed != step.want.Changed || result.Err != nil {
+			t.Errorf("%s: result is %+v, expected %+v", step.name, result, step.want)
+		}
+	}
+
+	// A full channel does not block syncs
+	results <- SyncResult{}
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("unexpected error with a full results channel: %s", err)
+	}
+}
+
+func TestPortSyncerLoopSkipInitialSync(t *testing.T) {
+	tests := []struct {
+		name            string
+		skipInitialSync bool
+		wantSyncs       int
+	}{
+		{name: "initial sync", wantSyncs: 1},
+		{name: "initial sync skipped", skipInitialSync: true, wantSyncs: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			results := make(chan SyncResult, 16)
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{SkipInitialSync: test.skipInitialSync, SyncResults: results})
+			writePortFile(t, portFile, 50000)
+
+			// Stop before the first tick
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			if err := syncer.Loop(ctx, context.Background(), time.Hour); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if len(results) != test.wantSyncs {
+				t.Errorf("%d syncs before the first tick, expected %d", len(results), test.wantSyncs)
+			}
+			if requests := fake.Requests("/api/v2/app/preferences"); (requests > 0) != (test.wantSyncs > 0) {
+				t.Errorf("read preferences %d times before the first tick", requests)
+			}
+		})
+	}
+}
+
+func TestPortSyncerLoopInvalidInterval(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := syncer.Loop(context.Background(), context.Background(), interval); !errors.Is(err, ErrInvalidInterval) {
+			t.Errorf("%s interval: error is %v, expected ErrInvalidInterval", interval, err)
+		}
+	}
+
+	if requests := fake.Requests("/api/v2/app/preferences"); requests != 0 {
+		t.Errorf("read preferences %d times, expected the loop not to sync", requests)
+	}
+
+	// Changing to an interval which is not positive while running is ignored rather than panicking
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	syncer.SetInterval(0)
+	if err := syncer.Loop(ctx, context.Background(), time.Hour); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestPortSyncerLoopWithStats(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	results := make(chan SyncResult, 16)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{SyncResults: results})
+	writePortFile(t, portFile, 50000)
+
+	type loopResult struct {
+		stats LoopStats
+		err   error
+	}
+	done := make(chan loopResult, 1)
+	go func() {
+		stats, err := syncer.LoopWithStats(context.Background(), context.Background(), time.Hour)
+		done <- loopResult{stats, err}
+	}()
+
+	// waitForSync waits for the next sync to finish
+	waitForSync := func() {
+		t.Helper()
+
+		select {
+		case <-results:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sync did not finish")
+		}
+	}
+
+	// The initial sync changes the port, the next finds it unchanged, then the port file changes
+	waitForSync()
+	syncer.TriggerSync()
+	waitForSync()
+	writePortFile(t, portFile, 50001)
+	syncer.TriggerSync()
+	waitForSync()
+
+	// A sync which fails stops the loop
+	fake.FailNext(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	syncer.TriggerSync()
+
+	var result loopResult
+	select {
+	case result = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("loop did not stop after a sync failed")
+	}
+
+	if result.err == nil {
+		t.Errorf("loop stopped without an error, expected the failed sync's error")
+	}
+	want := LoopStats{Syncs: 4, Changes: 2, Failures: 1, LastPort: 50001}
+	if result.stats != want {
+		t.Errorf("stats are %+v, expected %+v", result.stats, want)
+	}
+}
+
+func TestPortSyncerLoopWaitForPortFile(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	results := make(chan SyncResult, 16)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		AllowPortFileNotExist: true,
+		WaitForPortFile:       5 * time.Second,
+		SyncResults:           results,
+	})
+	time.AfterFunc(100*time.Millisecond, func() { writePortFile(t, portFile, 50000) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	go syncer.Loop(ctx, context.Background(), time.Hour)
+
+	select {
+	case result := <-results:
+		if result.Port != 50000 || !result.Changed {
+			t.Errorf("first sync was %+v, expected it to change the port to 50000", result)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("first sync happened %s after starting, expected it right after the port file was created", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no sync happened after the port file was created")
+	}
+}
+
+// writeConfigMapPort writes port to dir like Kubernetes updates a ConfigMap volume with the key "port": into a new timestamped directory, which the "..data" symlink is then swapped to
+func writeConfigMapPort(t *testing.T, dir string, version int, port uint16) {
+	t.Helper()
+
+	dataDir := fmt.Sprintf("..2024_01_01_00_00_0%d.000000000", version)
+	if err := os.Mkdir(filepath.Join(dir, dataDir), 0o755); err != nil {
+		t.Fatalf("failed to create data directory: %s", err)
+	}
+	writePortFile(t, filepath.Join(dir, dataDir, "port"), port)
+
+	if err := os.Symlink(dataDir, filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatalf("failed to create data symlink: %s", err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("failed to swap data symlink: %s", err)
+	}
+}
+
+func TestPortSyncerLoopWatchKubernetesConfigMap(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	dir := t.TempDir()
+	writeConfigMapPort(t, dir, 1, 50000)
+	portFile := filepath.Join(dir, "port")
+	if err := os.Symlink(filepath.Join("..data", "port"), portFile); err != nil {
+		t.Fatalf("failed to create port file symlink: %s", err)
+	}
+
+	results := make(chan SyncResult, 16)
+	syncer, _ := newTestSyncer(t, fake, NewPortSyncerOptions{
+		PortFiles:      []string{portFile},
+		WatchPortFiles: true,
+		SyncResults:    results,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go syncer.Loop(ctx, context.Background(), time.Hour)
+
+	select {
+	case result := <-results:
+		if result.Port != 50000 {
+			t.Fatalf("first sync was %+v, expected port 50000", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("initial sync did not happen")
+	}
+
+	// Give the watch time to start, then update the ConfigMap, the interval is too long for the change to be noticed without the watch
+	time.Sleep(200 * time.Millisecond)
+	writeConfigMapPort(t, dir, 2, 50001)
+
+	select {
+	case result := <-results:
+		if result.Port != 50001 || !result.Changed {
+			t.Errorf("sync after the ConfigMap update was %+v, expected it to change the port to 50001", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no sync happened after the ConfigMap was updated")
+	}
+}
+
+func TestPortSyncerPortFileReadTimeout(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{PortFileReadTimeout: 50 * time.Millisecond})
+	writePortFile(t, portFile, 50000)
+
+	// The port file is on a filesystem which stopped responding
+	stuck := make(chan struct{})
+	defer close(stuck)
+	syncer.readPortFile = func(path string) ([]byte, error) {
+		<-stuck
+		return nil, errors.New("filesystem stopped responding")
+	}
+
+	if _, err := syncer.Sync(context.Background()); !errors.Is(err, ErrPortFileReadTimeout) {
+		t.Fatalf("error is %v, expected it to wrap ErrPortFileReadTimeout", err)
+	}
+
+	// The sync loop keeps running
+	if err := syncer.runSync(context.Background(), context.Background()); err != nil {
+		t.Errorf("sync loop would stop because of the read timeout: %s", err)
+	}
+
+	// Once the filesystem responds again syncs succeed
+	syncer.readPortFile = readPortFileWithFIFOTimeout
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("qBittorrent's port is %d, expected 50000", port)
+	}
+}
+
+func TestPortSyncerPortFileRemovedBeforeRead(t *testing.T) {
+	tests := []struct {
+		name                  string
+		allowPortFileNotExist bool
+
+		// replacement is written to the port file after it was removed, zero if it stays removed
+		replacement uint16
+
+		wantErr  string
+		wantPort uint16
+	}{
+		{name: "allowed to not exist", allowPortFileNotExist: true, wantPort: 6881},
+		{name: "not allowed to not exist", wantErr: "do not exist or do not contain a port", wantPort: 6881},
+		{name: "replaced", replacement: 50001, wantPort: 50001},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{AllowPortFileNotExist: test.allowPortFileNotExist})
+			writePortFile(t, portFile, 50000)
+
+			// The port file exists when it is checked, but is removed before the first read
+			reads := 0
+			syncer.readPortFile = func(path string) ([]byte, error) {
+				reads++
+				if reads > 1 {
+					return readPortFileWithFIFOTimeout(path)
+				}
+
+				if err := os.Remove(path); err != nil {
+					t.Fatalf("failed to remove port file: %s", err)
+				}
+				content, err := readPortFileWithFIFOTimeout(path)
+				if test.replacement != 0 {
+					writePortFile(t, path, test.replacement)
+				}
+
+				return content, err
+			}
+
+			_, err := syncer.Sync(context.Background())
+			if len(test.wantErr) == 0 && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(test.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), test.wantErr) || strings.Contains(err.Error(), "failed to read")) {
+				t.Fatalf("error is %v, expected it to contain '%s' instead of a read error", err, test.wantErr)
+			}
+
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent's port is %d, expected %d", port, test.wantPort)
+			}
+		})
+	}
+}
+
+func TestPortSyncerSyncFromReader(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	results := make(chan SyncResult, 16)
+	syncer, _ := newTestSyncer(t, fake, NewPortSyncerOptions{SyncResults: results})
+
+	// A value piped through stdin, like: echo 50000 | qbittorrent-port-updater
+	changed, err := syncer.SyncFromReader(context.Background(), strings.NewReader("50000\n"), "stdin")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !changed {
+		t.Error("expected qBittorrent's port to change")
+	}
+	if fake.ListenPort() != 50000 {
+		t.Errorf("qBittorrent's port is %d, expected 50000", fake.ListenPort())
+	}
+	if requests := fake.Requests("/api/v2/app/setPreferences"); requests != 1 {
+		t.Errorf("set preferences %d times, expected 1", requests)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("%d sync results, expected 1", len(results))
+	}
+	if result := <-results; result.Port != 50000 || result.PortFile != "stdin" {
+		t.Errorf("result is %+v, expected port 50000 from stdin", result)
+	}
+
+	if _, err := syncer.SyncFromReader(context.Background(), strings.NewReader("not a port"), "stdin"); err == nil {
+		t.Error("expected an error for an invalid port")
+	}
+}
+
+func TestPortSyncerReconcileTorrentPortErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		verifyChanges bool
+
+		// failures are status codes for the fake to respond with to the next requests, 0 handles the request normally
+		failures []int
+
+		// ignoreChanges makes the fake accept but not store preference changes
+		ignoreChanges bool
+
+		// verifyAttempts is the number of times preferences are read back
+		verifyAttempts int
+
+		// changeReads makes the fake only report changes on this read of preferences after they are set
+		changeReads int
+
+		wantErr     error
+		wantChanged bool
+	}{
+		{name: "get fails", failures: []int{500}, wantErr: ErrGetPreferences},
+		{name: "set fails", failures: []int{0, 500}, wantErr: ErrSetPreferences},
+		{name: "not verified", ignoreChanges: true, wantChanged: true},
+		{name: "verified", verifyChanges: true, wantChanged: true},
+		{name: "verify read back fails", verifyChanges: true, failures: []int{0, 0, 500}, wantErr: ErrGetPreferences, wantChanged: true},
+		{name: "verify mismatch", verifyChanges: true, ignoreChanges: true, wantErr: ErrVerifyMismatch, wantChanged: true},
+		{name: "verified on third read", verifyAttempts: 3, changeReads: 3, wantChanged: true},
+		{name: "not verified within attempts", verifyAttempts: 2, changeReads: 3, wantErr: ErrVerifyMismatch, wantChanged: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, _ := newTestSyncer(t, fake, NewPortSyncerOptions{
+				VerifyChanges:  test.verifyChanges,
+				VerifyAttempts: test.verifyAttempts,
+				VerifyDelay:    10 * time.Millisecond,
+			})
+			if err := syncer.qBittorrentClient.Login(context.Background()); err != nil {
+				t.Fatalf("failed to login: %s", err)
+			}
+
+			fake.SetIgnorePreferenceChanges(test.ignoreChanges)
+			fake.SetPreferenceChangeReads(test.changeReads)
+			fake.FailNext(test.failures...)
+
+			changed, err := syncer.ReconcileTorrentPort(context.Background(), 50000)
+			if test.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("error is %v, expected it to wrap %v", err, test.wantErr)
+			}
+			if changed != test.wantChanged {
+				t.Errorf("changed is %t, expected %t", changed, test.wantChanged)
+			}
+		})
+	}
+}
+
+func TestPortSyncerPortFileAge(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{PortFileStaleThreshold: time.Hour})
+	writePortFile(t, portFile, 50000)
+
+	// The VPN last wrote the port file two hours ago
+	modTime := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(portFile, modTime, modTime); err != nil {
+		t.Fatalf("failed to change port file times: %s", err)
+	}
+
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	age := gaugeValue(t, syncer.metrics.PortFileAge)
+	if age < 2*60*60 || age > 2*60*60+60 {
+		t.Errorf("port file age is %fs, expected about 7200s", age)
+	}
+}
+
+func TestPortSyncerForceSet(t *testing.T) {
+	for _, forceSet := range []bool{false, true} {
+		t.Run(fmt.Sprintf("force %t", forceSet), func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			// qBittorrent already reports the port
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{ForceSet: forceSet})
+			writePortFile(t, portFile, 6881)
+
+			changed, err := syncer.Sync(context.Background())
+			if err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if changed != forceSet {
+				t.Errorf("changed is %t, expected %t", changed, forceSet)
+			}
+			if sets := fake.Requests("/api/v2/app/setPreferences"); (sets == 1) != forceSet {
+				t.Errorf("set preferences %d times, force is %t", sets, forceSet)
+			}
+			if port := fake.ListenPort(); port != 6881 {
+				t.Errorf("qBittorrent port is %d, expected 6881", port)
+			}
+		})
+	}
+}
+
+func TestPortSyncerSetPreferencesRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		wantErr  bool
+	}{
+		{name: "succeeds on last attempt", attempts: 3},
+		{name: "attempts exhausted", attempts: 2, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				SetPreferencesAttempts: test.attempts,
+				SetPreferencesBackoff:  Backoff{Strategy: BackoffStrategyExponential, Base: time.Millisecond},
+			})
+			writePortFile(t, portFile, 50000)
+			if err := syncer.qBittorrentClient.Login(context.Background()); err != nil {
+				t.Fatalf("failed to login: %s", err)
+			}
+
+			// Getting preferences succeeds, then setting them fails twice
+			fake.FailNext(0, http.StatusInternalServerError, http.StatusInternalServerError)
+
+			_, err := syncer.Sync(context.Background())
+			if test.wantErr {
+				if !errors.Is(err, ErrSetPreferences) {
+					t.Errorf("error is %v, expected it to wrap %v", err, ErrSetPreferences)
+				}
+				if port := fake.ListenPort(); port != 6881 {
+					t.Errorf("qBittorrent port is %d, expected it to be unchanged", port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if port := fake.ListenPort(); port != 50000 {
+				t.Errorf("qBittorrent port is %d, expected 50000", port)
+			}
+			if sets := fake.Requests("/api/v2/app/setPreferences"); sets != 3 {
+				t.Errorf("set preferences %d times, expected 3", sets)
+			}
+		})
+	}
+}
+
+func TestPortSyncerSetPreferencesForbiddenAfterLogin(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	var warnLog bytes.Buffer
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		Logger:                 golog.NewWriterLogger("test", io.Discard, io.Discard, &warnLog, io.Discard, io.Discard),
+		SetPreferencesAttempts: 2,
+		SetPreferencesBackoff:  Backoff{Strategy: BackoffStrategyExponential, Base: 100 * time.Millisecond},
+	})
+	writePortFile(t, portFile, 50000)
+	if err := syncer.qBittorrentClient.Login(context.Background()); err != nil {
+		t.Fatalf("failed to login: %s", err)
+	}
+
+	// Getting preferences succeeds, then every attempt to set them is refused even after logging in again
+	fake.FailNext(0, http.StatusForbidden, 0, http.StatusForbidden, http.StatusForbidden, 0, http.StatusForbidden)
+
+	start := time.Now()
+	_, err := syncer.Sync(context.Background())
+	if !errors.Is(err, ErrForbiddenAfterLogin) || !errors.Is(err, ErrSetPreferences) {
+		t.Fatalf("error is %v, expected it to wrap %v and %v", err, ErrForbiddenAfterLogin, ErrSetPreferences)
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("sync took %s, expected it to back off for 100ms between attempts", elapsed)
+	}
+	if sets := fake.Requests("/api/v2/app/setPreferences"); sets != 4 {
+		t.Errorf("set preferences %d times, expected 2 attempts each retried after logging in", sets)
+	}
+	if !strings.Contains(warnLog.String(), "logged in but qBittorrent refused to set preferences (attempt 1/2)") {
+		t.Errorf("warnings are '%s', expected a forbidden after login warning", warnLog.String())
+	}
+	if port := fake.ListenPort(); port != 6881 {
+		t.Errorf("qBittorrent port is %d, expected it to be unchanged", port)
+	}
+}
+
+func TestPortSyncerRollbackOnVerifyFailure(t *testing.T) {
+	tests := []struct {
+		name             string
+		connectionStatus string
+		rollback         bool
+
+		wantErr  error
+		wantPort uint16
+	}{
+		{name: "verified", connectionStatus: "connected", rollback: true, wantPort: 50000},
+		{name: "not reachable", connectionStatus: "firewalled", rollback: true, wantErr: ErrVerifyNotReachable, wantPort: 6881},
+		{name: "not reachable without rollback", connectionStatus: "firewalled", wantErr: ErrVerifyNotReachable, wantPort: 50000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			fake.SetConnectionStatus(test.connectionStatus)
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				VerifyChanges:           true,
+				VerifyReachableWithin:   100 * time.Millisecond,
+				RollbackOnVerifyFailure: test.rollback,
+			})
+			writePortFile(t, portFile, 50000)
+
+			_, err := syncer.Sync(context.Background())
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("error is %v, expected it to wrap %v", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent port is %d, expected %d", port, test.wantPort)
+			}
+		})
+	}
+}
+
+func TestPortSyncerRandomPort(t *testing.T) {
+	tests := []struct {
+		name       string
+		randomPort bool
+		opts       NewPortSyncerOptions
+
+		wantPort       uint16
+		wantRandomPort bool
+
+		// wantSkipped indicates the port is not applied, so the status and subscribers must not report it
+		wantSkipped bool
+	}{
+		{name: "random port off", opts: NewPortSyncerOptions{SkipIfRandomPort: true}, wantPort: 50000},
+		{name: "only warns", randomPort: true, wantPort: 50000, wantRandomPort: true},
+		{name: "disabled", randomPort: true, opts: NewPortSyncerOptions{DisableRandomPort: true}, wantPort: 50000},
+		{name: "disable takes precedence over skip", randomPort: true, opts: NewPortSyncerOptions{DisableRandomPort: true, SkipIfRandomPort: true}, wantPort: 50000},
+		{name: "skipped", randomPort: true, opts: NewPortSyncerOptions{SkipIfRandomPort: true}, wantPort: 6881, wantRandomPort: true, wantSkipped: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			fake.SetPreference("random_port", test.randomPort)
+
+			syncer, portFile := newTestSyncer(t, fake, test.opts)
+			writePortFile(t, portFile, 50000)
+			events := syncer.Subscribe()
+
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent port is %d, expected %d", port, test.wantPort)
+			}
+			if randomPort := fake.Preference("random_port"); randomPort != test.wantRandomPort {
+				t.Errorf("qBittorrent random_port is %v, expected %t", randomPort, test.wantRandomPort)
+			}
+			assertPortApplied(t, syncer, events, 50000, !test.wantSkipped)
+		})
+	}
+}
+
+// assertPortApplied checks the syncer's status and the port change events received from events report port as applied, or if applied is false that neither reports any port
+func assertPortApplied(t *testing.T, syncer *PortSyncer, events <-chan PortChangeEvent, port uint16, applied bool) {
+	t.Helper()
+
+	wantPort := uint16(0)
+	if applied {
+		wantPort = port
+	}
+
+	if lastPort := syncer.Status().LastPort; lastPort != wantPort {
+		t.Errorf("status last port is %d, expected %d", lastPort, wantPort)
+	}
+
+	select {
+	case event := <-events:
+		if !applied || event.Port != port {
+			t.Errorf("published a port change event for port %d, expected applied: %t for port %d", event.Port, applied, port)
+		}
+	default:
+		if applied {
+			t.Errorf("no port change event was published for port %d", port)
+		}
+	}
+}
+
+func TestPortSyncerListenPortUnset(t *testing.T) {
+	tests := []struct {
+		name string
+		skip bool
+
+		wantPort    uint16
+		wantChanged bool
+		wantLog     string
+	}{
+		{name: "applied", wantPort: 50000, wantChanged: true, wantLog: "qBittorrent reports listen_port 0, it may not have finished starting, applying the port anyway"},
+		{name: "skipped", skip: true, wantPort: 0, wantLog: "not setting qBittorrent's port because it reports listen_port 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			fake.SetPreference("listen_port", 0)
+
+			var infoLog bytes.Buffer
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				Logger:                golog.NewWriterLogger("test", io.Discard, io.Discard, io.Discard, &infoLog, io.Discard),
+				VerifyChanges:         true,
+				SkipIfListenPortUnset: test.skip,
+			})
+			writePortFile(t, portFile, 50000)
+			events := syncer.Subscribe()
+
+			changed, err := syncer.Sync(context.Background())
+			if err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if changed != test.wantChanged {
+				t.Errorf("changed is %t, expected %t", changed, test.wantChanged)
+			}
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent port is %d, expected %d", port, test.wantPort)
+			}
+			assertPortApplied(t, syncer, events, 50000, !test.skip)
+			if !strings.Contains(infoLog.String(), test.wantLog) {
+				t.Errorf("info log is '%s', expected it to contain '%s'", infoLog.String(), test.wantLog)
+			}
+		})
+	}
+}
+
+func TestPortSyncerReadyFile(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{ReadyFile: readyFile})
+
+	// The port file does not exist yet, so the sync fails
+	if _, err := syncer.Sync(context.Background()); err == nil {
+		t.Fatalf("sync without a port file did not fail")
+	}
+	if _, err := os.Stat(readyFile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ready file exists after a failed sync, stat: %v", err)
+	}
+
+	writePortFile(t, portFile, 50000)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if _, err := os.Stat(readyFile); err != nil {
+		t.Fatalf("ready file was not written after the first successful sync: %s", err)
+	}
+
+	NewShutdownCleanup(NewShutdownCleanupOptions{
+		Logger:    golog.NewLogger("test"),
+		Syncer:    syncer,
+		ReadyFile: readyFile,
+	}).Run(context.Background())
+
+	if _, err := os.Stat(readyFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ready file exists after shutdown, stat: %v", err)
+	}
+}
+
+func TestPortSyncerCompareAndSwap(t *testing.T) {
+	tests := []struct {
+		name           string
+		compareAndSwap bool
+
+		// externalPort is what something else changes qBittorrent's port to between the sync reading and setting it, 0 if it is not changed
+		externalPort uint16
+
+		wantPort    uint16
+		wantChanged bool
+	}{
+		{name: "disabled overwrites external change", externalPort: 7000, wantPort: 50000, wantChanged: true},
+		{name: "external change", compareAndSwap: true, externalPort: 7000, wantPort: 7000},
+		{name: "no external change", compareAndSwap: true, wantPort: 50000, wantChanged: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			if test.externalPort != 0 {
+				fake.SetPreferenceAfterRead("listen_port", test.externalPort)
+			}
+
+			var warnLog bytes.Buffer
+			syncResults := make(chan SyncResult, 1)
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				Logger:         golog.NewWriterLogger("test", io.Discard, io.Discard, &warnLog, io.Discard, io.Discard),
+				CompareAndSwap: test.compareAndSwap,
+				SyncResults:    syncResults,
+			})
+			writePortFile(t, portFile, 50000)
+			events := syncer.Subscribe()
+
+			changed, err := syncer.Sync(context.Background())
+			if err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if changed != test.wantChanged {
+				t.Errorf("changed is %t, expected %t", changed, test.wantChanged)
+			}
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent port is %d, expected %d", port, test.wantPort)
+			}
+
+			wantSkipped := test.compareAndSwap && test.externalPort != 0
+			skipped := strings.Contains(warnLog.String(), "listen_port changed from 6881 to 7000 since it was read")
+			if skipped != wantSkipped {
+				t.Errorf("warning log is '%s', expected it to report the external change: %t", warnLog.String(), wantSkipped)
+			}
+
+			// The next sync decides again, the port was not applied
+			if result := <-syncResults; result.Deferred != wantSkipped {
+				t.Errorf("sync deferred is %t, expected %t", result.Deferred, wantSkipped)
+			}
+			assertPortApplied(t, syncer, events, 50000, !wantSkipped)
+		})
+	}
+}
+
+func TestPortSyncerAPICallBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget int
+
+		// wantReads is the number of times preferences are read, once to compare and once more for each read back
+		wantReads int
+
+		// wantReachabilityChecks is the number of times qBittorrent's connection status is retrieved
+		wantReachabilityChecks int
+
+		wantSkipLog bool
+	}{
+		{name: "no limit", wantReads: 2, wantReachabilityChecks: 1},
+		{name: "budget allows all", budget: 4, wantReads: 2, wantReachabilityChecks: 1},
+		{name: "budget skips reachability", budget: 3, wantReads: 2, wantSkipLog: true},
+		{name: "budget skips verification", budget: 2, wantReads: 1, wantSkipLog: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			var infoLog bytes.Buffer
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				Logger:            golog.NewWriterLogger("test", io.Discard, io.Discard, io.Discard, &infoLog, io.Discard),
+				VerifyChanges:     true,
+				CheckReachability: true,
+				APICallBudget:     test.budget,
+			})
+			writePortFile(t, portFile, 50000)
+			if err := syncer.qBittorrentClient.Login(context.Background()); err != nil {
+				t.Fatalf("failed to login: %s", err)
+			}
+
+			changed, err := syncer.Sync(context.Background())
+			if err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			// Optional requests are skipped, changing the port is not
+			if !changed || fake.ListenPort() != 50000 {
+				t.Errorf("changed is %t and qBittorrent's port is %d, expected the port to be changed to 50000", changed, fake.ListenPort())
+			}
+			if reads := fake.Requests("/api/v2/app/preferences"); reads != test.wantReads {
+				t.Errorf("read preferences %d times, expected %d", reads, test.wantReads)
+			}
+			if checks := fake.Requests("/api/v2/sync/maindata"); checks != test.wantReachabilityChecks {
+				t.Errorf("retrieved connection status %d times, expected %d", checks, test.wantReachabilityChecks)
+			}
+			if skipped := strings.Contains(infoLog.String(), "exhausts the API call budget"); skipped != test.wantSkipLog {
+				t.Errorf("logged a skip is %t, expected %t", skipped, test.wantSkipLog)
+			}
+		})
+	}
+}
+
+func TestPortSyncerReannounceOnChange(t *testing.T) {
+	tests := []struct {
+		name       string
+		reannounce bool
+		port       uint16
+
+		wantReannounces int
+	}{
+		{name: "changed", reannounce: true, port: 50000, wantReannounces: 1},
+		{name: "unchanged", reannounce: true, port: 6881},
+		{name: "disabled", port: 50000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{ReannounceOnChange: test.reannounce})
+			writePortFile(t, portFile, test.port)
+
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if reannounces := fake.Requests("/api/v2/torrents/reannounce"); reannounces != test.wantReannounces {
+				t.Errorf("reannounced %d times, expected %d", reannounces, test.wantReannounces)
+			}
+		})
+	}
+}
+
+func TestPortSyncerResumeOnChange(t *testing.T) {
+	tests := []struct {
+		name            string
+		resume          string
+		version         string
+		stalledTorrents int
+		port            uint16
+
+		wantHashes string
+	}{
+		{name: "changed all", resume: ResumeOnChangeAll, port: 50000, wantHashes: "all"},
+		{name: "changed all qBittorrent 5", resume: ResumeOnChangeAll, version: "v5.0.0", port: 50000, wantHashes: "all"},
+		{name: "changed stalled", resume: ResumeOnChangeStalled, stalledTorrents: 2, port: 50000, wantHashes: fmt.Sprintf("%040x|%040x", 1, 2)},
+		{name: "changed none stalled", resume: ResumeOnChangeStalled, port: 50000},
+		{name: "unchanged", resume: ResumeOnChangeAll, port: 6881},
+		{name: "disabled", port: 50000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			if len(test.version) > 0 {
+				fake.SetVersion(test.version)
+			}
+			fake.SetActiveTorrents(1)
+			fake.SetStalledTorrents(test.stalledTorrents)
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{ResumeOnChange: test.resume})
+			writePortFile(t, portFile, test.port)
+
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if hashes := fake.ResumedHashes(); hashes != test.wantHashes {
+				t.Errorf("resumed hashes are '%s', expected '%s'", hashes, test.wantHashes)
+			}
+		})
+	}
+}
+
+func TestPortSyncerMinimalMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		minimalMode string
+		wantSets    int
+	}{
+		{name: "always", minimalMode: MinimalModeAlways, wantSets: 3},
+		{name: "on change", minimalMode: MinimalModeOnChange, wantSets: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{MinimalMode: test.minimalMode})
+			if err := syncer.qBittorrentClient.Login(context.Background()); err != nil {
+				t.Fatalf("failed to login: %s", err)
+			}
+
+			// Only a port minimal mode has not set yet counts as a change, since qBittorrent's port is never read
+			steps := []struct {
+				port        uint16
+				wantChanged bool
+			}{
+				{port: 50000, wantChanged: true},
+				{port: 50000},
+				{port: 50001, wantChanged: true},
+			}
+			for _, step := range steps {
+				writePortFile(t, portFile, step.port)
+
+				changed, err := syncer.Sync(context.Background())
+				if err != nil {
+					t.Fatalf("failed to sync port %d: %s", step.port, err)
+				}
+				if changed != step.wantChanged {
+					t.Errorf("sync of port %d changed: %t, expected %t", step.port, changed, step.wantChanged)
+				}
+				if port := fake.ListenPort(); port != step.port {
+					t.Errorf("qBittorrent's port is %d, expected %d", port, step.port)
+				}
+			}
+
+			if reads := fake.Requests("/api/v2/app/preferences"); reads != 0 {
+				t.Errorf("read preferences %d times, expected never", reads)
+			}
+			if sets := fake.Requests("/api/v2/app/setPreferences"); sets != test.wantSets {
+				t.Errorf("set preferences %d times, expected %d", sets, test.wantSets)
+			}
+			if changes := fake.LastPreferenceChanges(); len(changes) != 1 || changes["listen_port"] != float64(50001) {
+				t.Errorf("last preference changes are %v, expected only listen_port", changes)
+			}
+		})
+	}
+}
+
+func TestPortSyncerMissingPortGracePeriod(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		AllowPortFileNotExist:  false,
+		MissingPortGracePeriod: 200 * time.Millisecond,
+	})
+	writePortFile(t, portFile, 50000)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	// The port file vanishes while it is replaced, then returns within the grace period
+	if err := os.Remove(portFile); err != nil {
+		t.Fatalf("failed to remove port file: %s", err)
+	}
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("sync failed while the port file was missing within the grace period: %s", err)
+	}
+
+	writePortFile(t, portFile, 50001)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync after the port file returned: %s", err)
+	}
+	if port := fake.ListenPort(); port != 50001 {
+		t.Errorf("qBittorrent's port is %d, expected 50001", port)
+	}
+
+	// The port file returning restarts the grace period, so vanishing again is tolerated until it elapses
+	if err := os.Remove(portFile); err != nil {
+		t.Fatalf("failed to remove port file: %s", err)
+	}
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("sync failed while the port file was missing within the grace period: %s", err)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if _, err := syncer.Sync(context.Background()); err == nil {
+		t.Errorf("expected an error once the port file was missing for longer than the grace period")
+	}
+}
+
+func TestPortSyncerDriftCorrection(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	var warnLog bytes.Buffer
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		Logger: golog.NewWriterLogger("test", io.Discard, io.Discard, &warnLog, io.Discard, io.Discard),
+	})
+	writePortFile(t, portFile, 50000)
+
+	// Changes caused by the port file are not drift
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if corrections := counterValue(t, syncer.metrics.DriftCorrections); corrections != 0 {
+		t.Errorf("drift corrections is %v after the first change, expected 0", corrections)
+	}
+
+	// qBittorrent's port is changed outside of the tool while the port file stays the same
+	fake.SetPreference("listen_port", 6882)
+
+	changed, err := syncer.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if !changed || fake.ListenPort() != 50000 {
+		t.Errorf("changed is %t and qBittorrent's port is %d, expected it to be changed back to 50000", changed, fake.ListenPort())
+	}
+	if corrections := counterValue(t, syncer.metrics.DriftCorrections); corrections != 1 {
+		t.Errorf("drift corrections is %v, expected 1", corrections)
+	}
+	if !strings.Contains(warnLog.String(), "corrected drift: listen_port 6882 -> 50000") {
+		t.Errorf("warning log is '%s', expected it to report the corrected drift", warnLog.String())
+	}
+
+	// A new port in the port file is not drift either
+	writePortFile(t, portFile, 50001)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if corrections := counterValue(t, syncer.metrics.DriftCorrections); corrections != 1 {
+		t.Errorf("drift corrections is %v after the port file changed, expected 1", corrections)
+	}
+}
+
+func TestPortSyncerPinRandomPortRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		randomPort bool
+
+		wantMin float64
+		wantMax float64
+	}{
+		{name: "random port on", randomPort: true, wantMin: 50000, wantMax: 50000},
+		{name: "random port off", wantMin: 1024, wantMax: 65535},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			fake.SetPreference("random_port", test.randomPort)
+			fake.SetPreference("random_port_range_min", float64(1024))
+			fake.SetPreference("random_port_range_max", float64(65535))
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{PinRandomPortRange: true, SkipIfRandomPort: true})
+			writePortFile(t, portFile, 50000)
+
+			for i := 0; i < 2; i++ {
+				if _, err := syncer.Sync(context.Background()); err != nil {
+					t.Fatalf("failed to sync: %s", err)
+				}
+			}
+
+			if port := fake.ListenPort(); port != 50000 {
+				t.Errorf("qBittorrent port is %d, expected 50000", port)
+			}
+			if randomPort := fake.Preference("random_port"); randomPort != test.randomPort {
+				t.Errorf("qBittorrent random_port is %v, expected it to be left %t", randomPort, test.randomPort)
+			}
+			if min, max := fake.Preference("random_port_range_min"), fake.Preference("random_port_range_max"); min != test.wantMin || max != test.wantMax {
+				t.Errorf("qBittorrent random port range is %v-%v, expected %v-%v", min, max, test.wantMin, test.wantMax)
+			}
+			if requests := fake.Requests("/api/v2/app/setPreferences"); requests != 1 {
+				t.Errorf("preferences were set %d times, expected only the first sync to change them", requests)
+			}
+		})
+	}
+}
+
+func TestPortSyncerSetAnnouncePort(t *testing.T) {
+	tests := []struct {
+		name            string
+		setAnnouncePort bool
+
+		wantAnnouncePort float64
+		wantChanges      []string
+	}{
+		{name: "enabled", setAnnouncePort: true, wantAnnouncePort: 50000, wantChanges: []string{"announce_port", "listen_port"}},
+		{name: "disabled", wantAnnouncePort: 0, wantChanges: []string{"listen_port"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			fake.SetPreference("announce_port", float64(0))
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{SetAnnouncePort: test.setAnnouncePort})
+			writePortFile(t, portFile, 50000)
+
+			for i := 0; i < 2; i++ {
+				if _, err := syncer.Sync(context.Background()); err != nil {
+					t.Fatalf("failed to sync: %s", err)
+				}
+			}
+
+			if port := fake.ListenPort(); port != 50000 {
+				t.Errorf("qBittorrent port is %d, expected 50000", port)
+			}
+			if announcePort := fake.Preference("announce_port"); announcePort != test.wantAnnouncePort {
+				t.Errorf("qBittorrent announce_port is %v, expected %v", announcePort, test.wantAnnouncePort)
+			}
+
+			// Both ports are set in one request, which only the first sync makes
+			if requests := fake.Requests("/api/v2/app/setPreferences"); requests != 1 {
+				t.Errorf("preferences were set %d times, expected only the first sync to change them", requests)
+			}
+			changes := []string{}
+			for name := range fake.LastPreferenceChanges() {
+				changes = append(changes, name)
+			}
+			sort.Strings(changes)
+			if fmt.Sprint(changes) != fmt.Sprint(test.wantChanges) {
+				t.Errorf("set preferences %v, expected %v", changes, test.wantChanges)
+			}
+		})
+	}
+}
+
+func TestPortSyncerNetworkInterface(t *testing.T) {
+	tests := []struct {
+		name             string
+		currentInterface string
+		currentAddress   string
+		wantChanges      []string
+	}{
+		{name: "both differ", currentInterface: "", currentAddress: "", wantChanges: []string{"current_interface_address", "current_network_interface", "listen_port"}},
+		{name: "interface bound", currentInterface: "tun0", currentAddress: "", wantChanges: []string{"current_interface_address", "listen_port"}},
+		{name: "both bound", currentInterface: "tun0", currentAddress: "10.2.0.2", wantChanges: []string{"listen_port"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+			fake.SetPreference("current_network_interface", test.currentInterface)
+			fake.SetPreference("current_interface_address", test.currentAddress)
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{NetworkInterface: strPtr("tun0"), InterfaceAddress: strPtr("10.2.0.2")})
+			writePortFile(t, portFile, 50000)
+
+			for i := 0; i < 2; i++ {
+				if _, err := syncer.Sync(context.Background()); err != nil {
+					t.Fatalf("failed to sync: %s", err)
+				}
+			}
+
+			if networkInterface := fake.Preference("current_network_interface"); networkInterface != "tun0" {
+				t.Errorf("qBittorrent current_network_interface is %v, expected tun0", networkInterface)
+			}
+			if address := fake.Preference("current_interface_address"); address != "10.2.0.2" {
+				t.Errorf("qBittorrent current_interface_address is %v, expected 10.2.0.2", address)
+			}
+
+			// Only the fields which differ are sent, in the same request as the port, which only the first sync makes
+			if requests := fake.Requests("/api/v2/app/setPreferences"); requests != 1 {
+				t.Errorf("preferences were set %d times, expected only the first sync to change them", requests)
+			}
+			changes := []string{}
+			for name := range fake.LastPreferenceChanges() {
+				changes = append(changes, name)
+			}
+			sort.Strings(changes)
+			if fmt.Sprint(changes) != fmt.Sprint(test.wantChanges) {
+				t.Errorf("set preferences %v, expected %v", changes, test.wantChanges)
+			}
+		})
+	}
+}
+
+func TestPortSyncerNoChangeLogEvery(t *testing.T) {
+	tests := []struct {
+		noChangeLogEvery int
+		wantLogged       int
+	}{
+		{noChangeLogEvery: 1, wantLogged: 5},
+		{noChangeLogEvery: 3, wantLogged: 2},
+		{noChangeLogEvery: 0, wantLogged: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("every %d", test.noChangeLogEvery), func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			var infoLog bytes.Buffer
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				Logger:           golog.NewWriterLogger("test", io.Discard, io.Discard, io.Discard, &infoLog, io.Discard),
+				NoChangeLogEvery: test.noChangeLogEvery,
+			})
+			writePortFile(t, portFile, 6881)
+
+			for i := 0; i < 5; i++ {
+				if _, err := syncer.Sync(context.Background()); err != nil {
+					t.Fatalf("failed to sync: %s", err)
+				}
+			}
+
+			if logged := strings.Count(infoLog.String(), "No change"); logged != test.wantLogged {
+				t.Errorf("logged no change %d times in 5 syncs, expected %d", logged, test.wantLogged)
+			}
+		})
+	}
+}
+
+func TestPortSyncerSkippedLog(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	var infoLog bytes.Buffer
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		Logger:                golog.NewWriterLogger("test", io.Discard, io.Discard, io.Discard, &infoLog, io.Discard),
+		AllowPortFileNotExist: true,
+	})
+
+	// The VPN takes several syncs to create the port file
+	for i := 0; i < 5; i++ {
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync: %s", err)
+		}
+	}
+	if logged := strings.Count(infoLog.String(), "skipping sync"); logged != 1 {
+		t.Errorf("logged skipping sync %d times in 5 syncs, expected 1", logged)
+	}
+
+	writePortFile(t, portFile, 50000)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if logged := strings.Count(infoLog.String(), "resuming syncs"); logged != 1 {
+		t.Errorf("logged resuming syncs %d times after the port file appeared, expected 1", logged)
+	}
+}
+
+func TestPortSyncerStartupReconciliation(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	var infoLog bytes.Buffer
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		Logger: golog.NewWriterLogger("test", io.Discard, io.Discard, io.Discard, &infoLog, io.Discard),
+	})
+
+	for _, port := range []uint16{50000, 50001, 50001} {
+		writePortFile(t, portFile, port)
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync port %d: %s", port, err)
+		}
+	}
+
+	if count := strings.Count(infoLog.String(), "startup reconciliation"); count != 1 {
+		t.Errorf("startup reconciliation was logged %d times, expected only by the first sync:\n%s", count, infoLog.String())
+	}
+	if !strings.Contains(infoLog.String(), "startup reconciliation: qBittorrent had port 6881, port file says 50000, applying 50000") {
+		t.Errorf("startup reconciliation did not describe the change from 6881 to 50000:\n%s", infoLog.String())
+	}
+	if value := gaugeValue(t, syncer.metrics.StartupPortDiffered); value != 1 {
+		t.Errorf("startup_port_differed is %f, expected 1", value)
+	}
+}
+
+func TestPortSyncerLoopMaxRuntime(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+
+	// The max runtime is applied to the loop's context, like main does
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := syncer.Loop(ctx, context.Background(), time.Hour); err != nil {
+		t.Fatalf("loop failed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("loop returned after %s, expected it to return once the max runtime elapsed", elapsed)
+	}
+
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("qBittorrent port is %d, expected the initial sync to set 50000", port)
+	}
+}
+
+func TestPortSyncerStatus(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+
+	if status := syncer.Status(); status.LastSync != nil || status.LastChange != nil {
+		t.Fatalf("status before any sync is %+v, expected no syncs", status)
+	}
+
+	// The first sync changes the port
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	changed := syncer.Status()
+	if changed.LastSync == nil || changed.LastChange == nil || !changed.LastChange.Equal(*changed.LastSync) {
+		t.Fatalf("status after a change is %+v, expected the last sync and change to be the same", changed)
+	}
+
+	// The second sync does not, so only the last sync time advances
+	time.Sleep(10 * time.Millisecond)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	unchanged := syncer.Status()
+	if !unchanged.LastSync.After(*changed.LastSync) {
+		t.Errorf("last sync is %s, expected it to advance past %s", unchanged.LastSync, changed.LastSync)
+	}
+	if !unchanged.LastChange.Equal(*changed.LastChange) {
+		t.Errorf("last change is %s, expected it to stay %s", unchanged.LastChange, changed.LastChange)
+	}
+	if unchanged.TotalChanges != 1 {
+		t.Errorf("total changes is %d, expected 1", unchanged.TotalChanges)
+	}
+	if changes := counterValue(t, syncer.metrics.Changes); changes != 1 {
+		t.Errorf("changes metric is %v, expected 1", changes)
+	}
+	if lastChange := gaugeValue(t, syncer.metrics.LastChangeTime); lastChange != float64(changed.LastChange.Unix()) {
+		t.Errorf("last change time metric is %v, expected %d", lastChange, changed.LastChange.Unix())
+	}
+}
+
+func TestSyncStatusLog(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+
+	// A change, then no change, then a failure because the port file was removed
+	for i := 0; i < 2; i++ {
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync: %s", err)
+		}
+	}
+	if err := os.Remove(portFile); err != nil {
+		t.Fatalf("failed to remove port file: %s", err)
+	}
+	if _, err := syncer.Sync(context.Background()); err == nil {
+		t.Fatalf("expected the sync without a port file to fail")
+	}
+
+	var infoLog bytes.Buffer
+	syncer.Status().Log(golog.NewWriterLogger("test", io.Discard, io.Discard, io.Discard, &infoLog, io.Discard), 90*time.Second)
+
+	for _, want := range []string{"Uptime        : 1m30s", "Syncs         : 3", "Changes       : 1", "Failures      : 1", "Last Port     : 50000"} {
+		if !strings.Contains(infoLog.String(), want) {
+			t.Errorf("summary is '%s', expected it to contain '%s'", infoLog.String(), want)
+		}
+	}
+}
+
+// windowAround creates a window which is open for an hour either side of now if open is true, otherwise one which opens in an hour
+func windowAround(now time.Time, open bool) *TimeWindow {
+	now = now.UTC()
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+
+	start := sinceMidnight - time.Hour
+	if !open {
+		start = sinceMidnight + time.Hour
+	}
+	start = (start + 24*time.Hour) % (24 * time.Hour)
+
+	return &TimeWindow{
+		Start:    start,
+		End:      (start + 2*time.Hour) % (24 * time.Hour),
+		Location: time.UTC,
+	}
+}
+
+func TestPortSyncerApplyWindow(t *testing.T) {
+	tests := []struct {
+		name         string
+		open         bool
+		wantPort     uint16
+		wantLastPort uint16
+	}{
+		{name: "in window", open: true, wantPort: 50000, wantLastPort: 50000},
+		{name: "out of window", wantPort: 6881},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			results := make(chan SyncResult, 1)
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				ApplyWindow: windowAround(time.Now(), test.open),
+				SyncResults: results,
+			})
+			writePortFile(t, portFile, 50000)
+
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent port is %d, expected %d", port, test.wantPort)
+			}
+			if result := <-results; result.Deferred == test.open {
+				t.Errorf("result deferred is %t, expected %t", result.Deferred, !test.open)
+			}
+
+			// A deferred port is not the port qBittorrent is using
+			if lastPort := syncer.Status().LastPort; lastPort != test.wantLastPort {
+				t.Errorf("last port is %d, expected %d", lastPort, test.wantLastPort)
+			}
+
+			// Once the window opens the deferred change is applied
+			syncer.applyWindow = windowAround(time.Now(), true)
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+			if port := fake.ListenPort(); port != 50000 {
+				t.Errorf("qBittorrent port is %d after the window opened, expected 50000", port)
+			}
+			if lastPort := syncer.Status().LastPort; lastPort != 50000 {
+				t.Errorf("last port is %d after the window opened, expected 50000", lastPort)
+			}
+		})
+	}
+}
+
+func TestPortSyncerApplyOnlyWhenActive(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	results := make(chan SyncResult, 2)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		ApplyOnlyWhenActive: true,
+		SyncResults:         results,
+	})
+	writePortFile(t, portFile, 50000)
+
+	// Without active torrents the change is deferred
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if port := fake.ListenPort(); port != 6881 {
+		t.Errorf("qBittorrent port is %d without active torrents, expected it to be left 6881", port)
+	}
+	if result := <-results; !result.Deferred {
+		t.Errorf("result is not deferred without active torrents")
+	}
+	if lastPort := syncer.Status().LastPort; lastPort != 0 {
+		t.Errorf("last port is %d, expected none since the port was deferred", lastPort)
+	}
+
+	// Once a torrent is active the deferred change is applied
+	fake.SetActiveTorrents(1)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("qBittorrent port is %d with an active torrent, expected 50000", port)
+	}
+	if result := <-results; result.Deferred || !result.Changed {
+		t.Errorf("result is %+v with an active torrent, expected it to be changed and not deferred", result)
+	}
+}
+
+func TestPortSyncerSyncSerialized(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	fake.SetDelay(20 * time.Millisecond)
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+
+	// Overlapping triggers, like the sync loop and the HTTP server's reload endpoint
+	var wg sync.WaitGroup
+	startSync := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Errorf("failed to sync: %s", err)
+			}
+		}()
+	}
+
+	// Trigger the rest once the first sync is running
+	startSync()
+	for fake.Requests("/api/v2/app/preferences") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		startSync()
+	}
+	wg.Wait()
+
+	if concurrent := fake.MaxConcurrentRequests(); concurrent != 1 {
+		t.Errorf("qBittorrent handled %d requests at once, expected syncs to be serialized", concurrent)
+	}
+	if sets := fake.Requests("/api/v2/app/setPreferences"); sets != 1 {
+		t.Errorf("set preferences %d times, expected only the first sync to change the port", sets)
+	}
+
+	// The triggers made while the first sync ran share one follow-up sync
+	if syncs := syncer.Status().TotalSyncs; syncs != 2 {
+		t.Errorf("ran %d syncs, expected the waiting syncs to be coalesced into 1 after the first", syncs)
+	}
+}
+
+func TestPortSyncerOnPortLost(t *testing.T) {
+	tests := []struct {
+		policy   PortLostPolicy
+		wantPort uint16
+	}{
+		{policy: PortLostPolicy{Action: PortLostActionIgnore}, wantPort: 6881},
+		{policy: PortLostPolicy{Action: PortLostActionKeep}, wantPort: 50000},
+		{policy: PortLostPolicy{Action: PortLostActionDefault, DefaultPort: 40000}, wantPort: 40000},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy.Action), func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				AllowPortFileNotExist: true,
+				OnPortLost:            test.policy,
+			})
+			writePortFile(t, portFile, 50000)
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			// The VPN loses the port, and qBittorrent restarts with its old port
+			if err := os.WriteFile(portFile, nil, 0o644); err != nil {
+				t.Fatalf("failed to empty port file: %s", err)
+			}
+			fake.SetPreference("listen_port", 6881)
+
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent port is %d, expected %d", port, test.wantPort)
+			}
+		})
+	}
+}
+
+func TestPortSyncerRetryMetrics(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		SetPreferencesAttempts: 3,
+		SetPreferencesBackoff:  Backoff{Strategy: BackoffStrategyExponential, Base: time.Millisecond},
+	})
+	writePortFile(t, portFile, 50000)
+
+	// Not logged in yet, so getting preferences is repeated after logging in and detecting the version, then setting preferences fails twice.
+	// The first login is not counted as a retry.
+	fake.FailNext(0, 0, 0, 0, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+	results := make(chan SyncResult, 1)
+	syncer.syncResults = results
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	if result := <-results; result.Retries != 2 {
+		t.Errorf("sync result has %d retries, expected 2", result.Retries)
+	}
+
+	wantRetries := map[string]float64{
+		RetryReasonRelogin:         0,
+		RetryReasonServerError:     1,
+		RetryReasonTooManyRequests: 1,
+		RetryReasonNetwork:         0,
+		RetryReasonIncompleteBody:  0,
+		RetryReasonOther:           0,
+	}
+	for reason, want := range wantRetries {
+		if retries := counterValue(t, syncer.metrics.Retries.WithLabelValues(reason)); retries != want {
+			t.Errorf("%s retries are %v, expected %v", reason, retries, want)
+		}
+	}
+}
+
+func TestPortSyncerFirstLoginRetries(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+
+	results := make(chan SyncResult, 2)
+	syncer.syncResults = results
+
+	// The client never had a session, so logging in is not a retry
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if result := <-results; result.Retries != 0 {
+		t.Errorf("first sync result has %d retries, expected 0", result.Retries)
+	}
+	if retries := syncer.QBittorrentClient().Retries(); retries != 0 {
+		t.Errorf("client recorded %d retries after the first sync, expected 0", retries)
+	}
+
+	// qBittorrent restarted and forgot the session, so logging in again is a retry
+	fake.SetSessionID("restarted")
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if result := <-results; result.Retries != 1 {
+		t.Errorf("sync result after the session was rejected has %d retries, expected 1", result.Retries)
+	}
+	if retries := counterValue(t, syncer.metrics.Retries.WithLabelValues(RetryReasonRelogin)); retries != 1 {
+		t.Errorf("%s retries are %v, expected 1", RetryReasonRelogin, retries)
+	}
+}
+
+func TestPortSyncerExpectedPortRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     uint16
+		wantErr  bool
+		wantPort uint16
+	}{
+		{name: "in range", port: 50000, wantPort: 50000},
+		{name: "minimum", port: 40000, wantPort: 40000},
+		{name: "maximum", port: 60000, wantPort: 60000},
+		{name: "below range", port: 39999, wantErr: true, wantPort: 6881},
+		{name: "above range", port: 60001, wantErr: true, wantPort: 6881},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{ExpectedPortRange: &PortRange{Min: 40000, Max: 60000}})
+			writePortFile(t, portFile, test.port)
+
+			_, err := syncer.Sync(context.Background())
+			if test.wantErr != (err != nil) {
+				t.Errorf("error is %v, expected an error: %t", err, test.wantErr)
+			}
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent port is %d, expected %d", port, test.wantPort)
+			}
+		})
+	}
+}
+
+func TestPortSyncerTreatZeroAsUnavailable(t *testing.T) {
+	tests := []struct {
+		name                   string
+		format                 PortFileFormat
+		content                string
+		treatZeroAsUnavailable bool
+
+		wantErr     bool
+		wantSkipped bool
+	}{
+		{name: "plain zero unavailable", format: PortFileFormatPlain, content: "0", treatZeroAsUnavailable: true, wantSkipped: true},
+		{name: "json zero unavailable", format: PortFileFormatJSON, content: `{"port": 0}`, treatZeroAsUnavailable: true, wantSkipped: true},
+		{name: "plain zero strict", format: PortFileFormatPlain, content: "0", wantErr: true},
+		{name: "natpmpc zero strict", format: PortFileFormatNATPMPC, content: "Mapped public port 0 protocol TCP", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			results := make(chan SyncResult, 1)
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+				AllowPortFileNotExist:  true,
+				PortFileFormat:         test.format,
+				TreatZeroAsUnavailable: test.treatZeroAsUnavailable,
+				SyncResults:            results,
+			})
+			if err := os.WriteFile(portFile, []byte(test.content), 0o644); err != nil {
+				t.Fatalf("failed to write port file: %s", err)
+			}
+
+			_, err := syncer.Sync(context.Background())
+			if test.wantErr != (err != nil) {
+				t.Errorf("error is %v, expected an error: %t", err, test.wantErr)
+			}
+			if result := <-results; result.Skipped != test.wantSkipped {
+				t.Errorf("sync skipped: %t, expected %t", result.Skipped, test.wantSkipped)
+			}
+			if requests := fake.Requests("/api/v2/app/setPreferences"); requests > 0 {
+				t.Errorf("set qBittorrent's preferences %d times, expected port 0 to never be set", requests)
+			}
+		})
+	}
+}
+
+func TestPortSyncerOutputPortFile(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	outputPortFile := filepath.Join(t.TempDir(), "applied-port")
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{OutputPortFile: outputPortFile})
+
+	for _, port := range []uint16{50000, 50001} {
+		writePortFile(t, portFile, port)
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync: %s", err)
+		}
+
+		content, err := os.ReadFile(outputPortFile)
+		if err != nil {
+			t.Fatalf("failed to read output port file: %s", err)
+		}
+		if want := fmt.Sprintf("%d\n", port); string(content) != want {
+			t.Errorf("output port file contains '%s', expected '%s'", content, want)
+		}
+	}
+
+	// Only the output port file is left in its directory
+	entries, err := os.ReadDir(filepath.Dir(outputPortFile))
+	if err != nil {
+		t.Fatalf("failed to list output port file directory: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("output port file directory contains %d files, expected temporary files to be removed", len(entries))
+	}
+}
+
+func TestPortSyncerOutputPortFileNotWrittenOnFailure(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	outputPortFile := filepath.Join(t.TempDir(), "applied-port")
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{OutputPortFile: outputPortFile})
+	writePortFile(t, portFile, 50000)
+
+	fake.FailNext(http.StatusInternalServerError)
+	if _, err := syncer.Sync(context.Background()); err == nil {
+		t.Fatalf("expected the sync to fail")
+	}
+
+	if _, err := os.Stat(outputPortFile); !os.IsNotExist(err) {
+		t.Errorf("output port file was written even though the port was not applied: %v", err)
+	}
+}
+
+func TestPortSyncerLockContention(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	fake.SetDelay(50 * time.Millisecond)
+
+	lockFile := filepath.Join(t.TempDir(), "lock")
+	syncers := make([]*PortSyncer, 2)
+	for i := range syncers {
+		syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+			Lock: NewFileLock(lockFile, 10*time.Second, time.Minute),
+		})
+		writePortFile(t, portFile, uint16(50000+i))
+		syncers[i] = syncer
+	}
+
+	errs := make(chan error, len(syncers))
+	for _, syncer := range syncers {
+		go func() {
+			_, err := syncer.Sync(context.Background())
+			errs <- err
+		}()
+	}
+	for range syncers {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to sync: %s", err)
+		}
+	}
+
+	if concurrent := fake.MaxConcurrentRequests(); concurrent != 1 {
+		t.Errorf("qBittorrent received %d concurrent requests, expected syncers to take turns", concurrent)
+	}
+	if port := fake.ListenPort(); port != 50000 && port != 50001 {
+		t.Errorf("qBittorrent port is %d, expected one of the syncers' ports", port)
+	}
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Errorf("lock file exists after both syncers finished")
+	}
+}
+
+func TestPortSyncerLockTimeout(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	// Another tool holds the lock for longer than the lock timeout
+	lockFile := filepath.Join(t.TempDir(), "lock")
+	if err := os.WriteFile(lockFile, []byte("other tool\n"), 0o644); err != nil {
+		t.Fatalf("failed to write lock file: %s", err)
+	}
+
+	syncResults := make(chan SyncResult, 1)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		Lock:        NewFileLock(lockFile, 100*time.Millisecond, time.Minute),
+		SyncResults: syncResults,
+	})
+	writePortFile(t, portFile, 50000)
+
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("sync failed while another tool held the lock, expected it to be skipped: %s", err)
+	}
+	if result := <-syncResults; !result.Skipped {
+		t.Errorf("sync was not skipped while another tool held the lock")
+	}
+	if port := fake.ListenPort(); port == 50000 {
+		t.Errorf("qBittorrent port was changed while another tool held the lock")
+	}
+}
+
+func TestPortSyncerCircuitBreaker(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{CircuitBreaker: breaker})
+	writePortFile(t, portFile, 50000)
+
+	// Consecutive failures open the breaker
+	for i := 0; i < 2; i++ {
+		fake.FailNext(http.StatusInternalServerError)
+		if _, err := syncer.Sync(context.Background()); err == nil {
+			t.Fatalf("expected sync %d to fail", i)
+		}
+	}
+	if state := breaker.State(); state != CircuitOpen {
+		t.Fatalf("circuit breaker is %s after failures, expected open", state)
+	}
+	if state := gaugeValue(t, syncer.metrics.CircuitBreakerState); state != float64(CircuitOpen) {
+		t.Errorf("circuit breaker state metric is %v, expected %v", state, float64(CircuitOpen))
+	}
+
+	// Syncs are skipped until the cooldown elapses
+	requestsBefore := fake.Requests("/api/v2/app/preferences")
+	now = now.Add(30 * time.Second)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync while the circuit breaker is open: %s", err)
+	}
+	if requests := fake.Requests("/api/v2/app/preferences"); requests != requestsBefore {
+		t.Errorf("qBittorrent received %d preferences requests while the circuit breaker was open", requests-requestsBefore)
+	}
+	if port := fake.ListenPort(); port == 50000 {
+		t.Errorf("qBittorrent port was changed while the circuit breaker was open")
+	}
+
+	// After the cooldown a successful sync closes the breaker
+	now = now.Add(time.Minute)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync after the cooldown: %s", err)
+	}
+	if state := breaker.State(); state != CircuitClosed {
+		t.Errorf("circuit breaker is %s after a successful sync, expected closed", state)
+	}
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("qBittorrent port is %d, expected 50000", port)
+	}
+}
+
+func TestPortSyncerLoopCircuitBreaker(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	breaker := NewCircuitBreaker(2, time.Minute)
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{CircuitBreaker: breaker})
+	writePortFile(t, portFile, 50000)
+
+	// qBittorrent is unreachable for every sync
+	fake.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if err := syncer.Loop(ctx, context.Background(), 50*time.Millisecond); err != nil {
+		t.Fatalf("loop stopped because of a failed sync while a circuit breaker is configured: %s", err)
+	}
+	if state := breaker.State(); state != CircuitOpen {
+		t.Errorf("circuit breaker is %s after repeated failures in the loop, expected open", state)
+	}
+}
+
+func TestPortSyncerPortCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+
+		wantSkipped bool
+		wantPort    uint16
+	}{
+		{name: "command prints port", command: "printf 'port: %s\\n' 50000 | cut -d ' ' -f 2", wantPort: 50000},
+		{name: "command fails", command: "exit 1", wantSkipped: true, wantPort: 6881},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncResults := make(chan SyncResult, 1)
+			syncer, _ := newTestSyncer(t, fake, NewPortSyncerOptions{
+				PortCommand:           test.command,
+				PortCommandTimeout:    5 * time.Second,
+				AllowPortFileNotExist: true,
+				SyncResults:           syncResults,
+			})
+
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			if result := <-syncResults; result.Skipped != test.wantSkipped {
+				t.Errorf("sync skipped is %t, expected %t", result.Skipped, test.wantSkipped)
+			}
+			if port := fake.ListenPort(); port != test.wantPort {
+				t.Errorf("qBittorrent port is %d, expected %d", port, test.wantPort)
+			}
+		})
+	}
+}
+
+func TestPortSyncerPreferenceDiffLog(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	fake.SetPreference("upnp", false)
+	fake.SetPreference("max_connec", float64(500))
+
+	var debugLog bytes.Buffer
+	logger := golog.NewWriterLogger("test", io.Discard, io.Discard, io.Discard, io.Discard, &debugLog)
+	logger.SetLevel(golog.DebugLevel)
+
+	upnp := false
+	maxConnections := 200
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{
+		Logger:         logger,
+		UPnP:           &upnp,
+		MaxConnections: &maxConnections,
+	})
+	writePortFile(t, portFile, 50000)
+
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	for _, want := range []string{
+		"listen_port: current 6881, desired 50000, will be sent",
+		"upnp: current false, desired false, unchanged",
+		"max_connec: current 500, desired 200, will be sent",
+	} {
+		if !strings.Contains(debugLog.String(), want) {
+			t.Errorf("debug log does not contain '%s':\n%s", want, debugLog.String())
+		}
+	}
+	if strings.Contains(debugLog.String(), "max_connec_per_torrent") {
+		t.Errorf("debug log contains max_connec_per_torrent, which is not managed:\n%s", debugLog.String())
+	}
+}
+
+func TestPortSyncerPortMismatchDuration(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	writePortFile(t, portFile, 50000)
+
+	// The mismatch grows while syncs fail to apply the port
+	for i := 0; i < 2; i++ {
+		fake.FailNext(http.StatusInternalServerError)
+		if _, err := syncer.Sync(context.Background()); err == nil {
+			t.Fatalf("expected sync %d to fail", i)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if mismatch := gaugeValue(t, syncer.metrics.PortMismatchDuration); mismatch < 0.05 {
+		t.Errorf("port mismatch duration is %vs after two failed syncs, expected at least 0.05s", mismatch)
+	}
+
+	// Applying the port resets it
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if mismatch := gaugeValue(t, syncer.metrics.PortMismatchDuration); mismatch != 0 {
+		t.Errorf("port mismatch duration is %vs after the port was applied, expected 0", mismatch)
+	}
+}
+
+func TestPortSyncerSubscribe(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	first := syncer.Subscribe()
+	second := syncer.Subscribe()
+
+	writePortFile(t, portFile, 50000)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	// Both subscribers receive the change
+	for i, events := range []<-chan PortChangeEvent{first, second} {
+		select {
+		case event := <-events:
+			if event.Port != 50000 || event.PreviousPort != 0 {
+				t.Errorf("subscriber %d received port %d, previous port %d, expected 50000, previous port 0", i, event.Port, event.PreviousPort)
+			}
+		default:
+			t.Fatalf("subscriber %d did not receive an event", i)
+		}
+	}
+
+	// Syncing the same port again is not a change
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if len(first) != 0 {
+		t.Errorf("received an event when the port did not change")
+	}
+
+	// An unsubscribed channel is closed and receives nothing more
+	syncer.Unsubscribe(second)
+	if _, ok := <-second; ok {
+		t.Errorf("unsubscribed channel is not closed")
+	}
+
+	writePortFile(t, portFile, 50001)
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	select {
+	case event := <-first:
+		if event.Port != 50001 || event.PreviousPort != 50000 {
+			t.Errorf("received port %d, previous port %d, expected 50001, previous port 50000", event.Port, event.PreviousPort)
+		}
+	default:
+		t.Fatalf("remaining subscriber did not receive an event")
+	}
+}
+
+func TestPortSyncerSubscribeSlowSubscriber(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+	events := syncer.Subscribe()
+
+	// Syncs never block on a subscriber which does not read, extra events are dropped
+	for i := 0; i < portChangeEventBuffer+5; i++ {
+		writePortFile(t, portFile, uint16(50000+i))
+		if _, err := syncer.Sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync %d: %s", i, err)
+		}
+	}
+
+	if len(events) != portChangeEventBuffer {
+		t.Errorf("subscriber has %d buffered events, expected %d", len(events), portChangeEventBuffer)
+	}
+}
@@ -0,0 +1,785 @@
+// Package testutil provides a fake qBittorrent server for exercising the tool without a real qBittorrent.
+package testutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeQBittorrentSID is the session cookie value the fake qBittorrent issues on login
+const FakeQBittorrentSID = "fake-session-id"
+
+// FakeNetworkPreferencesPath is the API path of the fake qBittorrent's typed network preferences endpoint, relative to "/api/v2"
+const FakeNetworkPreferencesPath = "/app/setNetworkPreferences"
+
+// FakeQBittorrent is an in-memory qBittorrent WebUI API served by an httptest.Server.
+// It implements login, version, get / set preferences, and main data, and can inject failures.
+type FakeQBittorrent struct {
+	// Server is the underlying test server, its URL is the qBittorrent network location
+	Server *httptest.Server
+
+	// lock guards all the following fields
+	lock sync.Mutex
+
+	// username which login accepts
+	username string
+
+	// password which login accepts
+	password string
+
+	// requireAuth indicates API requests must include the session cookie
+	requireAuth bool
+
+	// version is returned by the version endpoint
+	version string
+
+	// webAPIVersion is returned by the WebAPI version endpoint
+	webAPIVersion string
+
+	// preferences are the current preferences, keyed by qBittorrent's JSON names
+	preferences map[string]interface{}
+
+	// connectionStatus is the connection status reported in main data
+	connectionStatus string
+
+	// activeTorrents is the number of torrents listed as active
+	activeTorrents int
+
+	// stalledTorrents is the number of torrents listed as stalled
+	stalledTorrents int
+
+	// networkPreferencesEndpoint indicates the typed network preferences endpoint exists, otherwise it responds with 404
+	networkPreferencesEndpoint bool
+
+	// resumedHashes are the hashes sent in the last request to resume torrents
+	resumedHashes string
+
+	// failures are status codes to respond with, in order, instead of handling the next requests
+	failures []int
+
+	// banned indicates login responds like qBittorrent does after too many failed logins
+	banned bool
+
+	// delay is how long each request waits before being handled
+	delay time.Duration
+
+	// authProxyLogin is the URL requests are redirected to, emulating an authentication proxy, empty if requests are not redirected
+	authProxyLogin string
+
+	// authProxyBypassHeader is a header which lets requests through the authentication proxy, like a service token
+	authProxyBypassHeader string
+
+	// authProxyBypassValue is the value authProxyBypassHeader must have
+	authProxyBypassValue string
+
+	// requests counts the requests received for each path
+	requests map[string]int
+
+	// inFlight is the number of requests currently being handled
+	inFlight int
+
+	// maxInFlight is the most requests which were handled at once
+	maxInFlight int
+
+	// ignorePreferenceChanges indicates setting preferences succeeds without storing them
+	ignorePreferenceChanges bool
+
+	// preferenceChangeReads is how many times preferences are read before changes set after it was configured are reported, emulating a qBittorrent which applies changes asynchronously
+	preferenceChangeReads int
+
+	// pendingPreferenceChanges are changes which are not reported yet, nil if there are none
+	pendingPreferenceChanges map[string]interface{}
+
+	// pendingPreferenceReads is how many more reads must happen before pendingPreferenceChanges are reported
+	pendingPreferenceReads int
+
+	// preferenceBodies are the bodies the next reads of preferences respond with instead of the preferences, in order
+	preferenceBodies []string
+
+	// changesAfterRead are preferences which are changed after the next read of preferences, emulating another client changing them, nil if there are none
+	changesAfterRead map[string]interface{}
+
+	// lastPreferenceChanges are the preferences sent by the last request to set preferences, nil if none was received
+	lastPreferenceChanges map[string]interface{}
+
+	// originRequests counts the requests which included an Origin or Referer header
+	originRequests int
+
+	// contentTypes are the media types of the last request received for each path which had a body
+	contentTypes map[string]string
+
+	// sessionID is the session cookie value issued on login and required by API requests
+	sessionID string
+
+	// loginCookieHeader is the header the session cookie is sent in on login, empty to not send it, like a proxy which strips Set-Cookie
+	loginCookieHeader string
+
+	// sessionMaxAge is the Max-Age in seconds of the session cookie issued on login, zero for a session cookie without expiry
+	sessionMaxAge int
+}
+
+// NewFakeQBittorrent starts a fake qBittorrent which accepts username and password and requires login before API requests.
+// The caller must call Close.
+func NewFakeQBittorrent(username string, password string) *FakeQBittorrent {
+	fake := &FakeQBittorrent{
+		username:      username,
+		password:      password,
+		requireAuth:   true,
+		version:       "v4.6.0",
+		webAPIVersion: "2.9.3",
+		preferences: map[string]interface{}{
+			"listen_port": float64(6881),
+			"random_port": false,
+		},
+		connectionStatus:  "connected",
+		requests:          map[string]int{},
+		contentTypes:      map[string]string{},
+		sessionID:         FakeQBittorrentSID,
+		loginCookieHeader: "Set-Cookie",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/auth/login", fake.handleLogin)
+	mux.HandleFunc("/api/v2/auth/logout", fake.requireSession(fake.handleLogout))
+	mux.HandleFunc("/api/v2/app/version", fake.requireSession(fake.handleVersion))
+	mux.HandleFunc("/api/v2/app/webapiVersion", fake.requireSession(fake.handleWebAPIVersion))
+	mux.HandleFunc("/api/v2/app/preferences", fake.requireSession(fake.handleGetPreferences))
+	mux.HandleFunc("/api/v2/app/setPreferences", fake.requireSession(fake.handleSetPreferences))
+	mux.HandleFunc("/api/v2"+FakeNetworkPreferencesPath, fake.requireSession(fake.handleSetNetworkPreferences))
+	mux.HandleFunc("/api/v2/sync/maindata", fake.requireSession(fake.handleMainData))
+	mux.HandleFunc("/api/v2/torrents/reannounce", fake.requireSession(fake.handleReannounce))
+	mux.HandleFunc("/api/v2/torrents/info", fake.requireSession(fake.handleTorrentsInfo))
+	mux.HandleFunc("/api/v2/torrents/resume", fake.requireSession(fake.handleResume))
+	mux.HandleFunc("/api/v2/torrents/start", fake.requireSession(fake.handleResume))
+
+	fake.Server = httptest.NewServer(fake.middleware(mux))
+
+	return fake
+}
+
+// Close stops the fake qBittorrent
+func (fake *FakeQBittorrent) Close() {
+	fake.Server.Close()
+}
+
+// URL returns the network location of the fake qBittorrent
+func (fake *FakeQBittorrent) URL() string {
+	return fake.Server.URL
+}
+
+// NetworkLocation returns the fake qBittorrent's host and port, without a scheme
+func (fake *FakeQBittorrent) NetworkLocation() string {
+	parsed, err := url.Parse(fake.Server.URL)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse test server URL '%s': %s", fake.Server.URL, err))
+	}
+
+	return parsed.Host
+}
+
+// SetRequireAuth controls whether API requests must be logged in, false emulates qBittorrent with WebUI authentication disabled
+func (fake *FakeQBittorrent) SetRequireAuth(requireAuth bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.requireAuth = requireAuth
+}
+
+// ListenPort returns the listen_port preference currently stored
+func (fake *FakeQBittorrent) ListenPort() uint16 {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	port, _ := fake.preferences["listen_port"].(float64)
+
+	return uint16(port)
+}
+
+// Preference returns the value of a preference currently stored, nil if it is not set
+func (fake *FakeQBittorrent) Preference(name string) interface{} {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	return fake.preferences[name]
+}
+
+// SetPreference changes the value of a stored preference, as if it was changed in qBittorrent
+func (fake *FakeQBittorrent) SetPreference(name string, value interface{}) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.setPreference(name, value)
+}
+
+// setPreference stores a preference, the caller must hold lock
+func (fake *FakeQBittorrent) setPreference(name string, value interface{}) {
+	// Store values as decoding JSON would, so comparisons are consistent
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		panic(fmt.Sprintf("failed to encode preference '%s' value: %s", name, err))
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		panic(fmt.Sprintf("failed to decode preference '%s' value: %s", name, err))
+	}
+
+	fake.preferences[name] = decoded
+}
+
+// SetVersion changes the version returned by the version endpoint. From "v5" on POST requests, other than logging in, must include an Origin or Referer header naming the requested host, like qBittorrent 5's stricter cross-site request checks
+func (fake *FakeQBittorrent) SetVersion(version string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.version = version
+}
+
+// SetWebAPIVersion changes the version returned by the WebAPI version endpoint
+func (fake *FakeQBittorrent) SetWebAPIVersion(webAPIVersion string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.webAPIVersion = webAPIVersion
+}
+
+// OriginRequests returns the number of requests which included an Origin or Referer header
+func (fake *FakeQBittorrent) OriginRequests() int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	return fake.originRequests
+}
+
+// SetConnectionStatus changes the connection status reported in main data, one of "connected", "firewalled", or "disconnected"
+func (fake *FakeQBittorrent) SetConnectionStatus(status string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.connectionStatus = status
+}
+
+// SetActiveTorrents changes the number of torrents listed as active
+func (fake *FakeQBittorrent) SetActiveTorrents(count int) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.activeTorrents = count
+}
+
+// SetNetworkPreferencesEndpoint changes if the typed network preferences endpoint exists, like a qBittorrent version or fork which has one
+func (fake *FakeQBittorrent) SetNetworkPreferencesEndpoint(enabled bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.networkPreferencesEndpoint = enabled
+}
+
+// SetStalledTorrents changes the number of torrents listed as stalled
+func (fake *FakeQBittorrent) SetStalledTorrents(count int) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.stalledTorrents = count
+}
+
+// ResumedHashes returns the hashes sent in the last request to resume torrents, empty if none was made
+func (fake *FakeQBittorrent) ResumedHashes() string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	return fake.resumedHashes
+}
+
+// LastPreferenceChanges returns the preferences sent by the last request to set preferences, keyed by qBittorrent's JSON names, nil if none was received
+func (fake *FakeQBittorrent) LastPreferenceChanges() map[string]interface{} {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	return fake.lastPreferenceChanges
+}
+
+// FailNext makes the next requests fail with the status codes, in order, one status code per request
+func (fake *FakeQBittorrent) FailNext(statusCodes ...int) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.failures = append(fake.failures, statusCodes...)
+}
+
+// RespondToPreferencesWith makes the next reads of preferences respond with the bodies, in order, with a success status, like qBittorrent while its WebUI is warming up
+func (fake *FakeQBittorrent) RespondToPreferencesWith(bodies ...string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.preferenceBodies = append(fake.preferenceBodies, bodies...)
+}
+
+// SetBanned controls whether login responds like qBittorrent does after banning an IP for too many failed logins
+func (fake *FakeQBittorrent) SetBanned(banned bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.banned = banned
+}
+
+// SetDelay makes every request wait for delay before being handled, which can be used to cause timeouts
+func (fake *FakeQBittorrent) SetDelay(delay time.Duration) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.delay = delay
+}
+
+// SetIgnorePreferenceChanges controls whether setting preferences responds with success without storing them, like a qBittorrent which silently rejects a change
+func (fake *FakeQBittorrent) SetIgnorePreferenceChanges(ignore bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.ignorePreferenceChanges = ignore
+}
+
+// SetPreferenceChangeReads makes preferences changes only show up on the reads-th read of preferences after they are set, like a qBittorrent which applies changes asynchronously.
+// Zero, the default, makes changes show up immediately.
+func (fake *FakeQBittorrent) SetPreferenceChangeReads(reads int) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.preferenceChangeReads = reads
+}
+
+// SetPreferenceAfterRead changes a preference right after the next read of preferences, like another client changing it between the tool reading and setting preferences
+func (fake *FakeQBittorrent) SetPreferenceAfterRead(name string, value interface{}) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if fake.changesAfterRead == nil {
+		fake.changesAfterRead = map[string]interface{}{}
+	}
+	fake.changesAfterRead[name] = value
+}
+
+// SetSessionMaxAge makes login issue a session cookie which expires after maxAge seconds
+func (fake *FakeQBittorrent) SetSessionMaxAge(maxAge int) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.sessionMaxAge = maxAge
+}
+
+// SetLoginCookieHeader makes login send the session cookie in header instead of Set-Cookie, like a proxy which moves it, an empty header does not send it at all
+func (fake *FakeQBittorrent) SetLoginCookieHeader(header string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.loginCookieHeader = header
+}
+
+// SetSessionID makes login issue, and API requests require, sessionID instead of FakeQBittorrentSID, so sessions of several fakes can be told apart
+func (fake *FakeQBittorrent) SetSessionID(sessionID string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.sessionID = sessionID
+}
+
+// SetAuthProxy emulates an authentication proxy, like Authelia or OAuth2 Proxy, in front of qBittorrent by redirecting requests to loginURL.
+// Requests with the header bypassHeader set to bypassValue are let through, like a service token. An empty loginURL disables the proxy.
+func (fake *FakeQBittorrent) SetAuthProxy(loginURL string, bypassHeader string, bypassValue string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.authProxyLogin = loginURL
+	fake.authProxyBypassHeader = bypassHeader
+	fake.authProxyBypassValue = bypassValue
+}
+
+// Requests returns the number of requests received for the path, ex. "/api/v2/auth/login"
+func (fake *FakeQBittorrent) Requests(path string) int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	return fake.requests[path]
+}
+
+// ContentType returns the media type of the last request with a body received for the path, ex. "multipart/form-data", empty if there was none
+func (fake *FakeQBittorrent) ContentType(path string) string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	return fake.contentTypes[path]
+}
+
+// MaxConcurrentRequests returns the most requests which were handled at once
+func (fake *FakeQBittorrent) MaxConcurrentRequests() int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	return fake.maxInFlight
+}
+
+// middleware counts requests, applies the delay, redirects to the authentication proxy, and injects failures before calling next
+func (fake *FakeQBittorrent) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.lock.Lock()
+		fake.requests[r.URL.Path]++
+		if len(r.Header.Get("Origin")) > 0 || len(r.Header.Get("Referer")) > 0 {
+			fake.originRequests++
+		}
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+			fake.contentTypes[r.URL.Path] = mediaType
+		}
+		fake.inFlight++
+		fake.maxInFlight = max(fake.maxInFlight, fake.inFlight)
+		delay := fake.delay
+		authProxyLogin := fake.authProxyLogin
+		bypassed := len(fake.authProxyBypassHeader) > 0 && r.Header.Get(fake.authProxyBypassHeader) == fake.authProxyBypassValue
+
+		var failure int
+		if len(fake.failures) > 0 {
+			failure = fake.failures[0]
+			fake.failures = fake.failures[1:]
+		}
+		fake.lock.Unlock()
+
+		defer func() {
+			fake.lock.Lock()
+			fake.inFlight--
+			fake.lock.Unlock()
+		}()
+
+		if delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		if len(authProxyLogin) > 0 && !bypassed {
+			http.Redirect(w, r, authProxyLogin+"?rd="+url.QueryEscape(fake.Server.URL+r.URL.String()), http.StatusFound)
+			return
+		}
+
+		if failure != 0 {
+			http.Error(w, http.StatusText(failure), failure)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireSession responds with 403, like qBittorrent, if authentication is required and the request does not include the session cookie
+func (fake *FakeQBittorrent) requireSession(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fake.lock.Lock()
+		requireAuth := fake.requireAuth
+		sessionID := fake.sessionID
+		strictOrigin := strings.HasPrefix(fake.version, "v5")
+		fake.lock.Unlock()
+
+		if strictOrigin && r.Method == http.MethodPost && !sameOrigin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if requireAuth {
+			cookie, err := r.Cookie("SID")
+			if err != nil || cookie.Value != sessionID {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+// sameOrigin determines if r has an Origin or Referer header naming the host it was sent to
+func sameOrigin(r *http.Request) bool {
+	for _, header := range []string{"Origin", "Referer"} {
+		value := r.Header.Get(header)
+		if len(value) == 0 {
+			continue
+		}
+
+		source, err := url.Parse(value)
+		if err != nil || source.Host != r.Host {
+			return false
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// handleLogin responds "Ok." and sets the session cookie if the credentials are correct, otherwise "Fails."
+func (fake *FakeQBittorrent) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if fake.banned {
+		http.Error(w, "Your IP address has been banned after too many failed authentication attempts.", http.StatusForbidden)
+		return
+	}
+
+	if err := parseForm(r); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if r.PostForm.Get("username") != fake.username || r.PostForm.Get("password") != fake.password {
+		fmt.Fprint(w, "Fails.")
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     "SID",
+		Value:    fake.sessionID,
+		Path:     "/",
+		MaxAge:   fake.sessionMaxAge,
+		HttpOnly: true,
+	}
+	if len(fake.loginCookieHeader) > 0 {
+		w.Header().Add(fake.loginCookieHeader, cookie.String())
+	}
+	fmt.Fprint(w, "Ok.")
+}
+
+// handleLogout expires the session cookie
+func (fake *FakeQBittorrent) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   "SID",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// handleVersion responds with the qBittorrent version
+func (fake *FakeQBittorrent) handleVersion(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fmt.Fprint(w, fake.version)
+}
+
+// handleWebAPIVersion responds with the WebAPI version
+func (fake *FakeQBittorrent) handleWebAPIVersion(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fmt.Fprint(w, fake.webAPIVersion)
+}
+
+// handleGetPreferences responds with all stored preferences as JSON
+func (fake *FakeQBittorrent) handleGetPreferences(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if fake.pendingPreferenceChanges != nil {
+		fake.pendingPreferenceReads--
+		if fake.pendingPreferenceReads <= 0 {
+			for name, value := range fake.pendingPreferenceChanges {
+				fake.preferences[name] = value
+			}
+			fake.pendingPreferenceChanges = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(fake.preferenceBodies) > 0 {
+		body := fake.preferenceBodies[0]
+		fake.preferenceBodies = fake.preferenceBodies[1:]
+		fmt.Fprint(w, body)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(fake.preferences); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	for name, value := range fake.changesAfterRead {
+		fake.setPreference(name, value)
+	}
+	fake.changesAfterRead = nil
+}
+
+// handleSetPreferences stores the preferences in the form encoded json field, like qBittorrent it responds with an empty body on success
+func (fake *FakeQBittorrent) handleSetPreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := parseForm(r); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var changes map[string]interface{}
+	if err := json.Unmarshal([]byte(r.PostForm.Get("json")), &changes); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.applyPreferenceChanges(changes)
+}
+
+// handleSetNetworkPreferences updates preferences from a JSON body, if the typed network preferences endpoint is enabled
+func (fake *FakeQBittorrent) handleSetNetworkPreferences(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if !fake.networkPreferencesEndpoint {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var changes map[string]interface{}
+	if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&changes) != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	fake.applyPreferenceChanges(changes)
+}
+
+// applyPreferenceChanges records and applies changes to the preferences, the lock must be held
+func (fake *FakeQBittorrent) applyPreferenceChanges(changes map[string]interface{}) {
+	fake.lastPreferenceChanges = changes
+	if fake.ignorePreferenceChanges {
+		return
+	}
+
+	if fake.preferenceChangeReads > 0 {
+		fake.pendingPreferenceChanges = changes
+		fake.pendingPreferenceReads = fake.preferenceChangeReads
+		return
+	}
+
+	for name, value := range changes {
+		fake.preferences[name] = value
+	}
+}
+
+// parseForm parses the request's form into PostForm, like qBittorrent it accepts URL encoded and multipart forms
+func parseForm(r *http.Request) error {
+	if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return err
+	}
+
+	return nil
+}
+
+// handleReannounce accepts a request to reannounce torrents, which must name the torrents
+func (fake *FakeQBittorrent) handleReannounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := parseForm(r); err != nil || len(r.PostForm.Get("hashes")) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+}
+
+// handleResume accepts a request to resume torrents, which must name the torrents.
+// From "v5" the resume endpoint does not exist, like qBittorrent 5 which renamed it to start.
+func (fake *FakeQBittorrent) handleResume(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if strings.HasPrefix(fake.version, "v5") == strings.HasSuffix(r.URL.Path, "/resume") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := parseForm(r); err != nil || len(r.PostForm.Get("hashes")) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	fake.resumedHashes = r.PostForm.Get("hashes")
+}
+
+// handleTorrentsInfo responds with the torrent list, which contains the active torrents followed by the stalled torrents.
+// The "active" and "stalled" filters only list those torrents.
+func (fake *FakeQBittorrent) handleTorrentsInfo(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	filter := r.URL.Query().Get("filter")
+
+	torrents := []map[string]interface{}{}
+	if filter != "stalled" {
+		for i := 0; i < fake.activeTorrents; i++ {
+			torrents = append(torrents, map[string]interface{}{
+				"hash":  fmt.Sprintf("%040x", i),
+				"state": "uploading",
+			})
+		}
+	}
+	if filter != "active" {
+		for i := 0; i < fake.stalledTorrents; i++ {
+			torrents = append(torrents, map[string]interface{}{
+				"hash":  fmt.Sprintf("%040x", fake.activeTorrents+i),
+				"state": "stalledDL",
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(torrents); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleMainData responds with main data containing the server state
+func (fake *FakeQBittorrent) handleMainData(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"rid":         1,
+		"full_update": true,
+		"server_state": map[string]interface{}{
+			"connection_status": fake.connectionStatus,
+		},
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,255 @@
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHTTPClient creates an HTTP client which keeps cookies, like the qBittorrent client does
+func newTestHTTPClient(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("failed to create cookie jar: %s", err)
+	}
+
+	return &http.Client{Jar: jar}
+}
+
+// doTestRequest sends a request to the fake and returns the status code and body
+func doTestRequest(t *testing.T, client *http.Client, fake *FakeQBittorrent, method string, path string, form url.Values) (int, string) {
+	t.Helper()
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, fake.URL()+path, body)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	return doRequest(t, client, req)
+}
+
+// doRequest sends req and returns the status code and body
+func doRequest(t *testing.T, client *http.Client, req *http.Request) (int, string) {
+	t.Helper()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+
+	return resp.StatusCode, string(respBody)
+}
+
+// login logs client in to the fake with username and password, and returns the login response body
+func login(t *testing.T, client *http.Client, fake *FakeQBittorrent, username string, password string) string {
+	t.Helper()
+
+	_, body := doTestRequest(t, client, fake, http.MethodPost, "/api/v2/auth/login", url.Values{
+		"username": {username},
+		"password": {password},
+	})
+
+	return body
+}
+
+func TestFakeQBittorrentLogin(t *testing.T) {
+	fake := NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	client := newTestHTTPClient(t)
+
+	// Not logged in
+	if status, _ := doTestRequest(t, client, fake, http.MethodGet, "/api/v2/app/version", nil); status != http.StatusForbidden {
+		t.Errorf("version responded with %d before login, expected 403", status)
+	}
+
+	if body := login(t, client, fake, "admin", "wrong"); body != "Fails." {
+		t.Errorf("login with the wrong password responded '%s', expected 'Fails.'", body)
+	}
+	if body := login(t, client, fake, "admin", "password"); body != "Ok." {
+		t.Fatalf("login responded '%s', expected 'Ok.'", body)
+	}
+
+	status, version := doTestRequest(t, client, fake, http.MethodGet, "/api/v2/app/version", nil)
+	if status != http.StatusOK || version != "v4.6.0" {
+		t.Errorf("version responded with %d '%s', expected 200 'v4.6.0'", status, version)
+	}
+	if logins := fake.Requests("/api/v2/auth/login"); logins != 2 {
+		t.Errorf("counted %d logins, expected 2", logins)
+	}
+}
+
+func TestFakeQBittorrentRequireAuth(t *testing.T) {
+	fake := NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	fake.SetRequireAuth(false)
+
+	status, _ := doTestRequest(t, newTestHTTPClient(t), fake, http.MethodGet, "/api/v2/app/preferences", nil)
+	if status != http.StatusOK {
+		t.Errorf("preferences responded with %d without login, expected 200", status)
+	}
+}
+
+func TestFakeQBittorrentBanned(t *testing.T) {
+	fake := NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	client := newTestHTTPClient(t)
+
+	fake.SetBanned(true)
+	if body := login(t, client, fake, "admin", "password"); !strings.Contains(body, "banned") {
+		t.Errorf("login while banned responded '%s', expected a ban message", body)
+	}
+
+	fake.SetBanned(false)
+	if body := login(t, client, fake, "admin", "password"); body != "Ok." {
+		t.Errorf("login after the ban was lifted responded '%s', expected 'Ok.'", body)
+	}
+}
+
+func TestFakeQBittorrentPreferences(t *testing.T) {
+	fake := NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	client := newTestHTTPClient(t)
+	login(t, client, fake, "admin", "password")
+
+	status, _ := doTestRequest(t, client, fake, http.MethodPost, "/api/v2/app/setPreferences", url.Values{
+		"json": {`{"listen_port": 50000, "upnp": false}`},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("set preferences responded with %d, expected 200", status)
+	}
+	if port := fake.ListenPort(); port != 50000 {
+		t.Errorf("listen port is %d, expected 50000", port)
+	}
+
+	// Preferences changed in the fake are reported like they were changed in qBittorrent
+	fake.SetPreference("random_port", true)
+
+	_, body := doTestRequest(t, client, fake, http.MethodGet, "/api/v2/app/preferences", nil)
+	var prefs map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &prefs); err != nil {
+		t.Fatalf("failed to decode preferences '%s': %s", body, err)
+	}
+	if prefs["listen_port"] != float64(50000) || prefs["upnp"] != false || prefs["random_port"] != true {
+		t.Errorf("preferences are %v, expected the set preferences", prefs)
+	}
+	if fake.Preference("upnp") != false {
+		t.Errorf("upnp preference is %v, expected false", fake.Preference("upnp"))
+	}
+
+	if status, _ := doTestRequest(t, client, fake, http.MethodPost, "/api/v2/app/setPreferences", url.Values{"json": {"{"}}); status != http.StatusBadRequest {
+		t.Errorf("set preferences with invalid JSON responded with %d, expected 400", status)
+	}
+}
+
+func TestFakeQBittorrentFailNext(t *testing.T) {
+	fake := NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	client := newTestHTTPClient(t)
+	login(t, client, fake, "admin", "password")
+
+	// Failures apply to the next requests in order, 0 handles the request normally
+	fake.FailNext(http.StatusServiceUnavailable, 0, http.StatusInternalServerError)
+
+	var statuses []int
+	for i := 0; i < 4; i++ {
+		status, _ := doTestRequest(t, client, fake, http.MethodGet, "/api/v2/app/version", nil)
+		statuses = append(statuses, status)
+	}
+
+	want := []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusInternalServerError, http.StatusOK}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Errorf("responded with %v, expected %v", statuses, want)
+			break
+		}
+	}
+}
+
+func TestFakeQBittorrentDelay(t *testing.T) {
+	fake := NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	fake.SetDelay(time.Second)
+
+	// A request which gives up is not waited on
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fake.URL()+"/api/v2/app/version", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+
+	start := time.Now()
+	_, err = http.DefaultClient.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error is %v, expected the request to time out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("request took %s, expected it to time out", elapsed)
+	}
+}
+
+func TestFakeQBittorrentNetworkLocation(t *testing.T) {
+	fake := NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	if netloc := fake.NetworkLocation(); "http://"+netloc != fake.URL() {
+		t.Errorf("network location is %s, expected the host and port of %s", netloc, fake.URL())
+	}
+}
+
+func TestFakeQBittorrentAuthProxy(t *testing.T) {
+	fake := NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+	fake.SetRequireAuth(false)
+	fake.SetAuthProxy("https://auth.example.com/login", "X-Service-Token", "secret")
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(fake.URL() + "/api/v2/app/version")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || !strings.HasPrefix(location, "https://auth.example.com/login?rd=") {
+		t.Errorf("responded with %d to %s, expected a redirect to the login page", resp.StatusCode, location)
+	}
+
+	// The service token lets requests through
+	req, err := http.NewRequest(http.MethodGet, fake.URL()+"/api/v2/app/version", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("X-Service-Token", "secret")
+
+	if status, _ := doRequest(t, client, req); status != http.StatusOK {
+		t.Errorf("responded with %d with the service token, expected 200", status)
+	}
+}
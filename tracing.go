@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the name of the tracer which creates this tool's spans
+const tracerName = "github.com/Noah-Huppert/qbittorrent-port-updater"
+
+// tracingServiceName is the service name spans are exported with, unless overridden by the standard OTEL_SERVICE_NAME env var
+const tracingServiceName = "qbittorrent-port-updater"
+
+// tracingShutdownTimeout is how long exporting the remaining spans may take when the tool stops
+const tracingShutdownTimeout = 5 * time.Second
+
+// TracingEndpointEnvVars are the standard OpenTelemetry env vars which configure where spans are exported, tracing is only enabled if one is set
+var TracingEndpointEnvVars = []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"}
+
+// TracingEndpoint returns the OTLP endpoint spans are exported to, empty if tracing is not configured
+func TracingEndpoint() string {
+	for _, envVar := range TracingEndpointEnvVars {
+		if endpoint := os.Getenv(envVar); len(endpoint) > 0 {
+			return endpoint
+		}
+	}
+
+	return ""
+}
+
+// NewTracerProvider creates a tracer provider which exports spans over OTLP/HTTP, configured by the standard OTEL_ env vars.
+// If no endpoint is configured a no-op provider is returned, so tracing has no overhead.
+// Returns (tracer provider, function which flushes spans and stops exporting, error)
+func NewTracerProvider(ctx context.Context, instanceName string) (trace.TracerProvider, func(context.Context) error, error) {
+	if len(TracingEndpoint()) == 0 {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create OTLP trace exporter: %s", err)
+	}
+
+	// Attributes from the OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES env vars override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", tracingServiceName),
+			attribute.String("service.instance.id", instanceName),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create tracing resource: %s", err)
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	return tracerProvider, tracerProvider.Shutdown, nil
+}
+
+// newTracer returns the tracer of tracerProvider which creates this tool's spans, a no-op tracer if tracerProvider is nil
+func newTracer(tracerProvider trace.TracerProvider) trace.Tracer {
+	if tracerProvider == nil {
+		tracerProvider = noop.NewTracerProvider()
+	}
+
+	return tracerProvider.Tracer(tracerName)
+}
+
+// endSpan records err, if not nil, as the outcome of span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
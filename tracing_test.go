@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPortSyncerTracing(t *testing.T) {
+	fake := testutil.NewFakeQBittorrent("admin", "password")
+	defer fake.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{TracerProvider: tracerProvider})
+	syncer.qBittorrentClient.tracer = newTracer(tracerProvider)
+	writePortFile(t, portFile, 50000)
+
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	spans := exporter.GetSpans()
+	byName := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+
+	syncSpan, ok := byName["Sync"]
+	if !ok {
+		t.Fatalf("no Sync span was created, spans: %v", spans.Snapshots())
+	}
+	if syncSpan.Parent.IsValid() {
+		t.Errorf("Sync span has a parent, expected it to be the root")
+	}
+	if syncSpan.Status.Code == codes.Error {
+		t.Errorf("Sync span has an error status: %s", syncSpan.Status.Description)
+	}
+	wantAttributes := []attribute.KeyValue{attribute.Int("port", 50000), attribute.Bool("changed", true)}
+	for _, want := range wantAttributes {
+		if !hasAttribute(syncSpan.Attributes, want) {
+			t.Errorf("Sync span attributes %v do not include %v", syncSpan.Attributes, want)
+		}
+	}
+
+	// The API calls are children of the sync, the first request is rejected so logging in is a child of it
+	wantParents := []struct {
+		name   string
+		parent string
+	}{
+		{name: "qbittorrent.GetServerPreferences", parent: "Sync"},
+		{name: "qbittorrent.SetServerPreferences", parent: "Sync"},
+		{name: "qbittorrent.Login", parent: "qbittorrent.GetServerPreferences"},
+	}
+	for _, want := range wantParents {
+		span, ok := byName[want.name]
+		if !ok {
+			t.Errorf("no %s span was created", want.name)
+			continue
+		}
+
+		parent := byName[want.parent]
+		if span.Parent.SpanID() != parent.SpanContext.SpanID() || span.SpanContext.TraceID() != syncSpan.SpanContext.TraceID() {
+			t.Errorf("%s span is not a child of the %s span", want.name, want.parent)
+		}
+	}
+
+	if span := byName["qbittorrent.SetServerPreferences"]; !hasAttribute(span.Attributes, attribute.Int("listen_port", 50000)) {
+		t.Errorf("SetServerPreferences span attributes %v do not include the port", span.Attributes)
+	}
+}
+
+// hasAttribute determines if attributes include want
+func hasAttribute(attributes []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attributes {
+		if attr == want {
+			return true
+		}
+	}
+
+	return false
+}
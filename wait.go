@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ErrWaitForFileTimeout indicates none of the files waited for appeared before the timeout elapsed
+var ErrWaitForFileTimeout = errors.New("timed out waiting for file to appear")
+
+// WaitForFiles blocks until one of paths exists, ctx is canceled, or timeout elapses. A timeout of zero means no limit.
+// Instead of polling, the parent directory of each path is watched for the file being created. If a parent directory does not exist yet its nearest existing ancestor is watched, and the watch moves closer as the missing directories are created.
+// Returns the first of paths which exists, or an error wrapping ErrWaitForFileTimeout if none appeared in time.
+func WaitForFiles(ctx context.Context, paths []string, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return "", fmt.Errorf("failed to create file watcher: %s", err)
+	}
+	defer watcher.Close()
+
+	for {
+		// Watches are added before checking if the files exist so a file created in between is not missed
+		for _, path := range paths {
+			dir := nearestExistingDir(filepath.Dir(path))
+			if err := watcher.Add(dir); err != nil {
+				return "", fmt.Errorf("failed to watch directory '%s': %s", dir, err)
+			}
+		}
+
+		for _, path := range paths {
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", fmt.Errorf("%w: none of %v exist after %s", ErrWaitForFileTimeout, paths, timeout)
+			}
+
+			return "", ctx.Err()
+		case <-watcher.Events:
+		case err := <-watcher.Errors:
+			return "", fmt.Errorf("failed to watch for files: %s", err)
+		}
+	}
+}
+
+// kubernetesDataDir is the symlink Kubernetes ConfigMap and Secret volumes swap to atomically update every file in the volume, each file is a symlink through it
+const kubernetesDataDir = "..data"
+
+// WatchFiles calls onChange with the path whenever one of paths may have changed, until ctx is canceled.
+// The parent directory of each path is watched instead of the path itself, so a file which is replaced, like by renaming a new file over it, is still watched.
+// This includes Kubernetes ConfigMap and Secret volumes, whose files are symlinks through a "..data" symlink which is swapped to update the volume, without any event for the files themselves.
+// Like WaitForFiles, if a parent directory does not exist yet its nearest existing ancestor is watched.
+func WatchFiles(ctx context.Context, paths []string, onChange func(path string)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %s", err)
+	}
+	defer watcher.Close()
+
+	for {
+		// Directories which did not exist may have been created, so watches are added again after every event
+		for _, path := range paths {
+			dir := nearestExistingDir(filepath.Dir(path))
+			if err := watcher.Add(dir); err != nil {
+				return fmt.Errorf("failed to watch directory '%s': %s", dir, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-watcher.Events:
+			for _, path := range paths {
+				if affectsFile(event.Name, path) {
+					onChange(path)
+				}
+			}
+		case err := <-watcher.Errors:
+			return fmt.Errorf("failed to watch files: %s", err)
+		}
+	}
+}
+
+// affectsFile determines if a change to name, reported by watching a directory, may have changed the file at path
+func affectsFile(name string, path string) bool {
+	name = filepath.Clean(name)
+	path = filepath.Clean(path)
+
+	if name == path {
+		return true
+	}
+
+	if filepath.Dir(name) == filepath.Dir(path) && filepath.Base(name) == kubernetesDataDir {
+		return true
+	}
+
+	// One of the missing parent directories of path was created
+	return strings.HasPrefix(path, name+string(filepath.Separator))
+}
+
+// nearestExistingDir returns dir if it exists, otherwise its closest ancestor which exists
+func nearestExistingDir(dir string) string {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWaitForFiles(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// dirs are created, relative to a temporary directory, before the file is
+		dirs string
+	}{
+		{name: "directory exists"},
+		{name: "directory created later", dirs: filepath.Join("vpn", "forwarded")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			portFile := filepath.Join(root, test.dirs, "port")
+
+			time.AfterFunc(100*time.Millisecond, func() {
+				if err := os.MkdirAll(filepath.Dir(portFile), 0o755); err != nil {
+					t.Errorf("failed to create directories: %s", err)
+				}
+				if err := os.WriteFile(portFile, []byte("50000"), 0o644); err != nil {
+					t.Errorf("failed to write port file: %s", err)
+				}
+			})
+
+			start := time.Now()
+			path, err := WaitForFiles(context.Background(), []string{filepath.Join(root, "missing"), portFile}, 5*time.Second)
+			if err != nil {
+				t.Fatalf("failed to wait for file: %s", err)
+			}
+			if path != portFile {
+				t.Errorf("returned '%s', expected '%s'", path, portFile)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %s to notice the file was created", elapsed)
+			}
+		})
+	}
+}
+
+func TestWaitForFilesTimeout(t *testing.T) {
+	_, err := WaitForFiles(context.Background(), []string{filepath.Join(t.TempDir(), "port")}, 50*time.Millisecond)
+	if !errors.Is(err, ErrWaitForFileTimeout) {
+		t.Errorf("error is %v, expected it to wrap ErrWaitForFileTimeout", err)
+	}
+}
+
+func TestAffectsFile(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{name: "/vpn/port", path: "/vpn/port", want: true},
+		{name: "/vpn/other", path: "/vpn/port", want: false},
+		{name: "/vpn/..data", path: "/vpn/port", want: true},
+		{name: "/other/..data", path: "/vpn/port", want: false},
+		{name: "/vpn", path: "/vpn/forwarded/port", want: true},
+		{name: "/vpn-other", path: "/vpn/forwarded/port", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := affectsFile(test.name, test.path); got != test.want {
+				t.Errorf("affectsFile('%s', '%s') is %t, expected %t", test.name, test.path, got, test.want)
+			}
+		})
+	}
+}
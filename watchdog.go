@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+)
+
+// ErrSyncLoopStalled indicates no sync finished for longer than the watchdog threshold, the sync loop is likely stuck
+var ErrSyncLoopStalled = errors.New("sync loop stalled")
+
+// Watchdog checks the sync loop is making progress, by comparing the time the last sync finished against a threshold.
+// It guards against hangs which timeouts do not catch, such as a deadlock.
+type Watchdog struct {
+	// logger is used to output information
+	logger golog.Logger
+
+	// syncer is the syncer whose syncs are checked
+	syncer *PortSyncer
+
+	// threshold is how long may pass without a sync finishing before the loop is considered stalled
+	threshold time.Duration
+
+	// checkInterval is how often progress is checked
+	checkInterval time.Duration
+
+	// exitOnStall indicates Run returns an error when the loop stalls, so the tool exits and can be restarted
+	exitOnStall bool
+}
+
+// NewWatchdogOptions are options to create a new Watchdog
+type NewWatchdogOptions struct {
+	// Logger is used to output information
+	Logger golog.Logger
+
+	// Syncer is the syncer whose syncs are checked
+	Syncer *PortSyncer
+
+	// Threshold is how long may pass without a sync finishing before the loop is considered stalled
+	Threshold time.Duration
+
+	// CheckInterval is how often progress is checked, if zero a quarter of Threshold
+	CheckInterval time.Duration
+
+	// ExitOnStall indicates Run returns an error when the loop stalls, so the tool exits and can be restarted
+	ExitOnStall bool
+}
+
+// NewWatchdog creates a new Watchdog
+func NewWatchdog(opts NewWatchdogOptions) *Watchdog {
+	checkInterval := opts.CheckInterval
+	if checkInterval == 0 {
+		checkInterval = opts.Threshold / 4
+	}
+
+	return &Watchdog{
+		logger:        opts.Logger,
+		syncer:        opts.Syncer,
+		threshold:     opts.Threshold,
+		checkInterval: checkInterval,
+		exitOnStall:   opts.ExitOnStall,
+	}
+}
+
+// Run checks the sync loop is making progress every check interval, until ctx is canceled. Before the first sync finishes progress is measured from when Run was called.
+// A stall is logged as an error once, and recovering from it is logged. If exitOnStall is true an error wrapping ErrSyncLoopStalled is returned instead.
+func (watchdog *Watchdog) Run(ctx context.Context) error {
+	startedAt := time.Now()
+	stalled := false
+
+	ticker := time.NewTicker(watchdog.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			lastProgress := startedAt
+			if lastSync := watchdog.syncer.Status().LastSync; lastSync != nil && lastSync.After(lastProgress) {
+				lastProgress = *lastSync
+			}
+
+			sinceProgress := now.Sub(lastProgress)
+			if sinceProgress <= watchdog.threshold {
+				if stalled {
+					watchdog.logger.Infof("sync loop is making progress again, a sync finished %s ago", sinceProgress.Round(time.Millisecond))
+					stalled = false
+				}
+				continue
+			}
+
+			err := fmt.Errorf("%w: no sync finished in %s, which is over the watchdog threshold of %s", ErrSyncLoopStalled, sinceProgress.Round(time.Millisecond), watchdog.threshold)
+			if watchdog.exitOnStall {
+				return err
+			}
+
+			if !stalled {
+				watchdog.logger.Errorf("%s, a request or the port source may be stuck", err)
+				stalled = true
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Noah-Huppert/golog"
+	"github.com/Noah-Huppert/qbittorrent-port-updater/testutil"
+)
+
+func TestWatchdog(t *testing.T) {
+	tests := []struct {
+		name        string
+		exitOnStall bool
+
+		// syncEvery is how often the loop syncs after the first sync, zero if it stalls after the first sync
+		syncEvery time.Duration
+
+		wantStalled bool
+	}{
+		{name: "stalled", exitOnStall: true, wantStalled: true},
+		{name: "stalled without exiting", exitOnStall: false},
+		{name: "making progress", exitOnStall: true, syncEvery: 20 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := testutil.NewFakeQBittorrent("admin", "password")
+			defer fake.Close()
+
+			syncer, portFile := newTestSyncer(t, fake, NewPortSyncerOptions{})
+			writePortFile(t, portFile, 50000)
+			if _, err := syncer.Sync(context.Background()); err != nil {
+				t.Fatalf("failed to sync: %s", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			if test.syncEvery > 0 {
+				go func() {
+					for ctx.Err() == nil {
+						syncer.Sync(ctx)
+						time.Sleep(test.syncEvery)
+					}
+				}()
+			}
+
+			watchdog := NewWatchdog(NewWatchdogOptions{
+				Logger:        golog.NewLogger("test"),
+				Syncer:        syncer,
+				Threshold:     100 * time.Millisecond,
+				CheckInterval: 10 * time.Millisecond,
+				ExitOnStall:   test.exitOnStall,
+			})
+
+			started := time.Now()
+			err := watchdog.Run(ctx)
+			if errors.Is(err, ErrSyncLoopStalled) != test.wantStalled {
+				t.Fatalf("error is %v, expected the loop to be detected as stalled: %t", err, test.wantStalled)
+			}
+
+			// A stall is detected once the threshold passed, not when the watchdog is stopped
+			if elapsed := time.Since(started); test.wantStalled && elapsed >= 400*time.Millisecond {
+				t.Errorf("stall was detected after %s, expected soon after the threshold", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Embed the timezone database so timezones can be loaded in containers without one
+	_ "time/tzdata"
+)
+
+// TimeWindow is a daily period of time, it may wrap past midnight
+type TimeWindow struct {
+	// Start is the time since midnight at which the window opens
+	Start time.Duration
+
+	// End is the time since midnight at which the window closes
+	End time.Duration
+
+	// Location is the timezone the window is in
+	Location *time.Location
+}
+
+// ParseTimeWindow parses a window in the format "HH:MM-HH:MM" in the timezone location
+func ParseTimeWindow(value string, location *time.Location) (TimeWindow, error) {
+	startValue, endValue, found := strings.Cut(value, "-")
+	if !found {
+		return TimeWindow{}, fmt.Errorf("must be in the format 'HH:MM-HH:MM'")
+	}
+
+	start, err := parseTimeOfDay(strings.TrimSpace(startValue))
+	if err != nil {
+		return TimeWindow{}, fmt.Errorf("invalid start: %s", err)
+	}
+
+	end, err := parseTimeOfDay(strings.TrimSpace(endValue))
+	if err != nil {
+		return TimeWindow{}, fmt.Errorf("invalid end: %s", err)
+	}
+
+	if start == end {
+		return TimeWindow{}, fmt.Errorf("start and end must be different")
+	}
+
+	return TimeWindow{
+		Start:    start,
+		End:      end,
+		Location: location,
+	}, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into the time since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not in the format 'HH:MM'", value)
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Contains indicates if t is within the window, the start is inclusive and the end exclusive
+func (window TimeWindow) Contains(t time.Time) bool {
+	t = t.In(window.Location)
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if window.Start < window.End {
+		return sinceMidnight >= window.Start && sinceMidnight < window.End
+	}
+
+	// Window wraps past midnight
+	return sinceMidnight >= window.Start || sinceMidnight < window.End
+}
+
+// String formats the window in the format ParseTimeWindow accepts, followed by the timezone
+func (window TimeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d %s", int(window.Start.Hours()), int(window.Start.Minutes())%60, int(window.End.Hours()), int(window.End.Minutes())%60, window.Location)
+}
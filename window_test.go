@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    TimeWindow
+		wantErr bool
+	}{
+		{value: "02:00-05:30", want: TimeWindow{Start: 2 * time.Hour, End: 5*time.Hour + 30*time.Minute, Location: time.UTC}},
+		{value: " 22:00 - 06:00 ", want: TimeWindow{Start: 22 * time.Hour, End: 6 * time.Hour, Location: time.UTC}},
+		{value: "02:00", wantErr: true},
+		{value: "2am-5am", wantErr: true},
+		{value: "02:00-24:00", wantErr: true},
+		{value: "02:00-02:00", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			window, err := ParseTimeWindow(test.value, time.UTC)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", window)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if window != test.want {
+				t.Errorf("window is %s, expected %s", window, test.want)
+			}
+		})
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load timezone: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		window string
+		time   time.Time
+		want   bool
+	}{
+		{name: "inside", window: "02:00-05:00", time: time.Date(2024, 1, 1, 3, 0, 0, 0, newYork), want: true},
+		{name: "start is inclusive", window: "02:00-05:00", time: time.Date(2024, 1, 1, 2, 0, 0, 0, newYork), want: true},
+		{name: "end is exclusive", window: "02:00-05:00", time: time.Date(2024, 1, 1, 5, 0, 0, 0, newYork)},
+		{name: "outside", window: "02:00-05:00", time: time.Date(2024, 1, 1, 12, 0, 0, 0, newYork)},
+		{name: "other timezone", window: "02:00-05:00", time: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC), want: true},
+		{name: "wrapped before midnight", window: "22:00-06:00", time: time.Date(2024, 1, 1, 23, 0, 0, 0, newYork), want: true},
+		{name: "wrapped after midnight", window: "22:00-06:00", time: time.Date(2024, 1, 1, 1, 0, 0, 0, newYork), want: true},
+		{name: "wrapped outside", window: "22:00-06:00", time: time.Date(2024, 1, 1, 12, 0, 0, 0, newYork)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window, err := ParseTimeWindow(test.window, newYork)
+			if err != nil {
+				t.Fatalf("failed to parse window: %s", err)
+			}
+
+			if contains := window.Contains(test.time); contains != test.want {
+				t.Errorf("window %s contains %s is %t, expected %t", window, test.time, contains, test.want)
+			}
+		})
+	}
+}